@@ -0,0 +1,94 @@
+package authn
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/header"
+)
+
+// Proxy adapts an authenticator, such as Basic or JWT, to proxy authentication
+// for a forward proxy
+func Proxy(m parapet.Middleware) *ProxyAuthenticator {
+	return &ProxyAuthenticator{Authenticator: m}
+}
+
+// ProxyAuthenticator runs Authenticator on the Proxy-Authorization header
+// instead of Authorization, and turns its 401 with WWW-Authenticate into a 407
+// with Proxy-Authenticate. The client's own Authorization, meant for the
+// destination, reaches the next handler untouched; Proxy-Authorization does
+// not.
+type ProxyAuthenticator struct {
+	Authenticator parapet.Middleware
+}
+
+type proxyAuthContextKey struct{}
+
+type proxyAuthState struct {
+	w    http.ResponseWriter
+	auth []string
+}
+
+// ServeHandler implements middleware interface
+func (m ProxyAuthenticator) ServeHandler(h http.Handler) http.Handler {
+	if m.Authenticator == nil {
+		return h
+	}
+
+	next := m.Authenticator.ServeHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		st := r.Context().Value(proxyAuthContextKey{}).(*proxyAuthState)
+		delete(r.Header, header.Authorization)
+		if st.auth != nil {
+			r.Header[header.Authorization] = st.auth
+		}
+		h.ServeHTTP(st.w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := proxyAuthState{w: w, auth: r.Header[header.Authorization]}
+		delete(r.Header, header.Authorization)
+		if v := r.Header[header.ProxyAuthorization]; v != nil {
+			r.Header[header.Authorization] = v
+		}
+		delete(r.Header, header.ProxyAuthorization)
+
+		ctx := context.WithValue(r.Context(), proxyAuthContextKey{}, &st)
+		next.ServeHTTP(&proxyAuthWriter{ResponseWriter: w}, r.WithContext(ctx))
+	})
+}
+
+// proxyAuthWriter turns the authenticator's challenge into a proxy challenge.
+type proxyAuthWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+}
+
+func (w *proxyAuthWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if code == http.StatusUnauthorized {
+		code = http.StatusProxyAuthRequired
+		h := w.Header()
+		if v := h[header.WWWAuthenticate]; v != nil {
+			h[header.ProxyAuthenticate] = v
+			delete(h, header.WWWAuthenticate)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *proxyAuthWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *proxyAuthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,44 @@
+package authn_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/moonrhythm/parapet/pkg/authn"
+)
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	basic := Basic("root", "pass")
+	basic.Realm = "proxy"
+	m := Proxy(basic)
+
+	t.Run("Proxy Authentication Required", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.SetBasicAuth("root", "pass") // for the origin, not the proxy
+		w := httptest.NewRecorder()
+		m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Fail(t, "must not be called")
+		})).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+		assert.Equal(t, `Basic realm="proxy"`, w.Header().Get("Proxy-Authenticate"))
+		assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("Authorized", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Proxy-Authorization", "Basic cm9vdDpwYXNz")
+		r.Header.Set("Authorization", "Bearer origin-token")
+		w := httptest.NewRecorder()
+		m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+			assert.Equal(t, "Bearer origin-token", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized) // the origin's own 401 is left alone
+		})).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
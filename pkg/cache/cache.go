@@ -3,6 +3,7 @@ package cache
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"net"
 	"net/http"
 	"sort"
@@ -43,9 +44,10 @@ type Options struct {
 	// stored entry's Meta and returns an invalidation epoch in unix nanos: a hit
 	// whose Meta.Created is <= the returned epoch is treated as stale (reaped and
 	// served as a miss), exactly like a passed FreshUntil. Return 0 (or any value
-	// below the entry's Created) to keep the entry. It runs only on a hit, so it
-	// costs nothing while the cache is idle; nil disables the check entirely (zero
-	// overhead). The callee owns its own concurrency.
+	// below the entry's Created) to keep the entry. It runs only on a hit (or an
+	// expired entry about to be revalidated, which an invalidated one never is),
+	// so it costs nothing while the cache is idle; nil disables the check entirely
+	// (zero overhead). The callee owns its own concurrency.
 	InvalidatedAfter func(r *http.Request, m Meta) int64
 
 	// Cacheable, when non-nil, is called for each GET/HEAD request; returning false
@@ -83,7 +85,7 @@ type Options struct {
 
 	// OnResult, when non-nil, is called once per request the cache serves, after it
 	// decides how it was served, with the request and a ResultInfo (the outcome —
-	// HIT/MISS/STALE/STALE_ERROR/BYPASS — and, on a fill, its duration). It makes
+	// HIT/MISS/REVALIDATED/STALE/STALE_ERROR/NEGATIVE/BYPASS — and, on a fill, its duration). It makes
 	// the cache observable without changing behavior: see prom.Cache for Prometheus
 	// metrics and cache.LogResult for a structured-log field, or compose your own
 	// ResultFunc. It runs synchronously on the foreground serving path only, never
@@ -165,6 +167,32 @@ type Options struct {
 	// swallows the error and returns normally could otherwise cache a partial body.
 	// When false (default), a chunked GET passes through uncached as before.
 	CacheChunked bool
+
+	// SliceSize, when > 0, turns on slice mode for ranged GETs of objects with no
+	// stored full entry: instead of filling the whole object, the cache asks the
+	// origin for the SliceSize-aligned ranges the request covers and stores each
+	// as an independent entry, so seeking into an object far larger than
+	// MaxFileSize fills (and keeps) only the slices actually read. The origin must
+	// answer a Range request with 206 and a Content-Range; when it doesn't, the
+	// request is served as without slice mode. Slices of one object must agree on
+	// its length and ETag/Last-Modified, or the response is aborted. Each slice
+	// passes the same policy as a full 200 (the Override hook sees status 200),
+	// is buffered in memory while filled, and is tagged X-Cache by whether the
+	// first one it served was stored. Requests without Range still fill whole
+	// objects up to MaxFileSize. Clamped to MaxFileSize; 0 (the default) disables
+	// it.
+	SliceSize int64
+
+	// Key composes the cache key: query parameter filtering and ordering, path
+	// case, fragments, and request headers, cookies or a device class to add. The
+	// zero value keys on host + method + scheme + the request-uri as received.
+	Key KeyOptions
+
+	// Negative caches error responses — a 404 for 30s, a 503 for 5s — that the
+	// origin gives no freshness for, per status or status class, and can serve a
+	// stored response in place of a 5xx. The zero value caches an error only when
+	// the origin opts in. See NegativeOptions.
+	Negative NegativeOptions
 }
 
 // OverrideMode selects how far an Override reaches over the origin's
@@ -228,16 +256,21 @@ type Cache struct {
 	override          func(r *http.Request, status int, header http.Header) *Override
 	onResult          ResultFunc
 	primaryVary       map[string][]string  // primaryHex -> Vary header names learned from a stored response
+	wholeFill         map[string]bool      // primaryHex -> a ranged miss may fetch the whole object (see fillsWhole)
 	locks             map[string]*fillLock // variantHex -> in-flight fill
 	maxFileSize       int64
 	lockTimeout       time.Duration
 	revalidateTimeout time.Duration
 	defaultSWR        time.Duration // Options.DefaultStaleWhileRevalidate, clamped
 	defaultSIE        time.Duration // Options.DefaultStaleIfError, clamped
+	sliceSize         int64         // Options.SliceSize, clamped; 0 disables slice mode
 	decoupleFill      bool
 	cacheChunked      bool
+	key               KeyOptions
+	negative          negativePolicy
 
 	pvMu sync.RWMutex
+	wfMu sync.RWMutex
 
 	lockMu sync.Mutex
 }
@@ -279,7 +312,11 @@ func New(storage Storage, opts Options) *Cache {
 		onResult:          opts.OnResult,
 		decoupleFill:      opts.DecoupleFill,
 		cacheChunked:      opts.CacheChunked,
+		sliceSize:         min(max(opts.SliceSize, 0), mfs),
+		key:               opts.Key,
+		negative:          newNegativePolicy(opts.Negative, mfs),
 		primaryVary:       map[string][]string{},
+		wholeFill:         map[string]bool{},
 		locks:             map[string]*fillLock{},
 	}
 }
@@ -301,6 +338,26 @@ func (c *Cache) overrideFor(r *http.Request, status int, header http.Header) *Ov
 	return ov
 }
 
+// policy decides whether an origin response to r may be stored: the Override
+// hook's forced policy when it returns one, honor-origin otherwise, and the
+// negative-caching rule for an error response either of them refuses.
+func (c *Cache) policy(r *http.Request, method string, status int, header http.Header) decision {
+	reqAuthorized := r.Header.Get("Authorization") != ""
+	now := time.Now()
+	var dec decision
+	if ov := c.overrideFor(r, status, header); ov != nil {
+		dec = decideForced(method, status, header, reqAuthorized, c.maxFileSize, c.cacheChunked, now, ov)
+	} else {
+		dec = decide(method, status, header, reqAuthorized, c.maxFileSize, c.cacheChunked, now)
+	}
+	if !dec.cacheable && status >= 400 {
+		if ttl := c.negative.ttl(status); ttl > 0 {
+			return decideNegative(method, header, reqAuthorized, c.negative.maxSize, ttl, now)
+		}
+	}
+	return dec
+}
+
 // ServeHandler implements parapet.Middleware: it wraps next (the
 // upstream/handler whose responses are cached). A hit short-circuits next; a
 // miss fetches via next and stores.
@@ -311,20 +368,32 @@ func (c *Cache) ServeHandler(next http.Handler) http.Handler {
 }
 
 func (c *Cache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
-	// Range requests are passed straight through: this cache has no Range support,
-	// so it must not answer a Range request with a stored full 200 (let the origin
-	// serve 206). They are also not used to fill the cache.
-	if !cacheableMethod(r.Method) || isUpgrade(r) || r.Header.Get("Range") != "" || (c.cacheable != nil && !c.cacheable(r)) {
+	if !cacheableMethod(r.Method) || isUpgrade(r) || (c.cacheable != nil && !c.cacheable(r)) {
 		c.report(r, ResultInfo{Result: ResultBypass})
 		next.ServeHTTP(w, r) // never cache these; no X-Cache header
 		return
 	}
+	// The origin is asked for the full representation when what it returns can be
+	// stored, and a ranged request is answered from it: by writeStored on a hit,
+	// and by cutting the ranges from the streamed fill on a miss. Otherwise the
+	// ranged miss is passed through (see passRange).
+	fw, fr := w, withoutRange(r)
+	specs, ranged := rangeRequest(r)
+	if ranged {
+		fw = &rangeWriter{rw: w, r: r, specs: specs}
+	}
 	primaryHex := c.primaryHash(r)
 	key := c.variantHash(primaryHex, r)
-	if m, body, ok := c.storage.Get(key); ok {
-		switch c.classify(m, r, time.Now()) {
+	var stale *storedEntry // an expired entry to revalidate rather than refetch
+	stored := false        // the object was stored, so a fill of it can be too
+	if m, body, ok := openEntry(c.storage, key); ok {
+		stored = true
+		defer body.Close() // every use of it below is synchronous
+		e := &storedEntry{key: key, m: m, body: body}
+		now := time.Now()
+		switch c.classify(m, r, now) {
 		case stateFresh:
-			c.report(r, ResultInfo{Result: ResultHit})
+			c.report(r, ResultInfo{Result: hitResult(m)})
 			writeStored(w, r, m, body, "HIT")
 			return
 		case stateStaleRevalidate:
@@ -333,18 +402,57 @@ func (c *Cache) serve(w http.ResponseWriter, r *http.Request, next http.Handler)
 			// origin.
 			c.report(r, ResultInfo{Result: ResultStale})
 			writeStored(w, r, m, body, "STALE")
-			c.revalidate(r, next, primaryHex)
+			c.revalidate(fr, next, primaryHex, &storedEntry{key: key, m: m})
 			return
 		case stateStaleIfError:
 			// RFC 5861 stale-if-error: try the origin, but fall back to this stale
 			// entry if the revalidation returns a server error.
-			c.report(r, c.fillWithStale(w, r, next, primaryHex, m, body))
+			c.report(r, c.fillWithStale(fw, fr, next, primaryHex, e, nil))
 			return
 		case stateExpired:
+			// Options.Negative may still serve it in place of an origin error.
+			if fallback := c.negative.staleFallback(m, now); fallback != nil && !c.invalidated(m, r) {
+				c.report(r, c.fillWithStale(fw, fr, next, primaryHex, e, fallback))
+				return
+			}
+			// Kept only while a conditional fill may still refresh it with a 304.
+			if c.revalidatable(m, r) {
+				e.expired = true
+				stale = e
+			} else {
+				c.storage.Delete(key)
+			}
+		case stateInvalidated:
 			c.storage.Delete(key)
 		}
 	}
-	c.report(r, c.fillAndServe(w, r, next, primaryHex))
+	if ranged && c.sliceSize > 0 {
+		if info, ok := c.serveSlices(w, r, next, primaryHex, specs); ok {
+			c.report(r, info)
+			return
+		}
+	}
+	if ranged && !stored && !c.fillsWhole(primaryHex) {
+		c.report(r, c.passRange(w, r, next, primaryHex))
+		return
+	}
+	c.report(r, c.fillAndServe(fw, fr, next, primaryHex, stale))
+}
+
+// passRange sends a ranged miss to the origin with its Range unchanged, uncached:
+// nothing yet shows the whole object can be stored, and fetching an uncacheable
+// or oversize one in full for a few bytes of it would waste the transfer. The
+// object's length, from the origin's Content-Range, lets a later ranged miss fill
+// it whole when it fits MaxFileSize.
+func (c *Cache) passRange(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex string) ResultInfo {
+	w.Header().Set("X-Cache", "MISS")
+	start := time.Now()
+	next.ServeHTTP(w, r)
+	dur := time.Since(start)
+	if _, _, total, ok := parseContentRange(w.Header().Get("Content-Range")); ok && total <= c.maxFileSize {
+		c.learnWholeFill(primaryHex)
+	}
+	return ResultInfo{Result: ResultMiss, FillDuration: dur}
 }
 
 // report invokes the OnResult hook, if any. It is nil-cheap so an unobserved
@@ -355,24 +463,34 @@ func (c *Cache) report(r *http.Request, info ResultInfo) {
 	}
 }
 
-// tryServeHit serves key from storage if present and fresh, returning true. It is
-// the follower re-read after a fill: an expired entry is reaped and reported as a
-// miss, while a stale-but-still-serveable entry (within an RFC 5861 window) is
-// kept (so stale-if-error can still fall back to it) and reported as a miss here.
-// Fail-static: a storage error reads as a miss.
-func (c *Cache) tryServeHit(w http.ResponseWriter, r *http.Request, key string) bool {
-	m, body, ok := c.storage.Get(key)
+// tryServeHit serves key from storage if present and fresh, returning its result
+// and true. It is the follower re-read after a fill: an expired entry is reaped
+// and reported as a miss, while a stale-but-still-serveable entry (within an RFC
+// 5861 window) is kept (so stale-if-error can still fall back to it) and reported
+// as a miss here. Fail-static: a storage error reads as a miss.
+func (c *Cache) tryServeHit(w http.ResponseWriter, r *http.Request, key string) (Result, bool) {
+	m, body, ok := openEntry(c.storage, key)
 	if !ok {
-		return false
+		return "", false
 	}
+	defer body.Close()
 	switch c.classify(m, r, time.Now()) {
 	case stateFresh:
 		writeStored(w, r, m, body, "HIT")
-		return true
-	case stateExpired:
+		return hitResult(m), true
+	case stateExpired, stateInvalidated:
 		c.storage.Delete(key)
 	}
-	return false
+	return "", false
+}
+
+// hitResult is the result of serving the fresh entry m: ResultNegative for an
+// error stored under Options.Negative, ResultHit otherwise.
+func hitResult(m Meta) Result {
+	if m.Negative {
+		return ResultNegative
+	}
+	return ResultHit
 }
 
 // fillAndServe handles a miss with single-flight. The first arrival for a variant
@@ -388,12 +506,18 @@ func (c *Cache) tryServeHit(w http.ResponseWriter, r *http.Request, key string)
 // origin fetch and is cached, instead of every differing follower fetching
 // uncached. The loop runs at most twice: once on the pre-Vary key, once on the
 // learned-Vary key (which is stable thereafter).
-func (c *Cache) fillAndServe(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex string) ResultInfo {
+//
+// stale, when set, is the stored entry for the request's key: the leader's fill
+// for that key is conditional on it (see teeWriter.notModified).
+func (c *Cache) fillAndServe(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex string, stale *storedEntry) ResultInfo {
 	for attempt := 0; attempt < 2; attempt++ {
 		variantHex := c.variantHash(primaryHex, r)
 		lock, leader := c.acquire(variantHex)
 		if leader {
-			return c.fill(w, r, next, primaryHex, variantHex, lock)
+			if stale != nil && stale.key != variantHex {
+				stale = nil
+			}
+			return c.fill(w, r, next, primaryHex, variantHex, lock, stale)
 		}
 		lock.waiters.Add(1)
 		select {
@@ -404,8 +528,8 @@ func (c *Cache) fillAndServe(w http.ResponseWriter, r *http.Request, next http.H
 		// Leader finished (or we timed out). Re-read: it may have just learned this
 		// primary's Vary, so our key now matches the stored entry IF our varied
 		// values match the leader's. A wrong-Vary variant is never served.
-		if c.tryServeHit(w, r, c.variantHash(primaryHex, r)) {
-			return ResultInfo{Result: ResultHit} // served from the leader's just-filled entry
+		if result, ok := c.tryServeHit(w, r, c.variantHash(primaryHex, r)); ok {
+			return ResultInfo{Result: result} // served from the leader's just-filled entry
 		}
 		// Still a miss. If the leader learned a Vary we differ on, our key changed —
 		// loop to lead/join the fill for our own variant. If the key is unchanged
@@ -423,8 +547,10 @@ func (c *Cache) fillAndServe(w http.ResponseWriter, r *http.Request, next http.H
 
 // fill is the leader path: stream the response to the client through a teeWriter
 // that also writes the cacheable body to storage, commit on completion, then
-// release the fill lock so waiting followers find the committed entry.
-func (c *Cache) fill(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex, variantHex string, lock *fillLock) ResultInfo {
+// release the fill lock so waiting followers find the committed entry. With a
+// stale entry the origin request is conditional, and a 304 refreshes that entry
+// instead (ResultRevalidated).
+func (c *Cache) fill(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex, variantHex string, lock *fillLock, stale *storedEntry) ResultInfo {
 	released := false
 	release := func() {
 		if !released {
@@ -437,7 +563,7 @@ func (c *Cache) fill(w http.ResponseWriter, r *http.Request, next http.Handler,
 	tw := &teeWriter{rw: w, r: r, c: c, method: r.Method, primaryHex: primaryHex, lock: lock}
 	defer tw.cleanup() // panic-safe: abort an uncommitted entry if finish never ran
 	start := time.Now()
-	next.ServeHTTP(tw, r)
+	next.ServeHTTP(tw, tw.revalidating(stale))
 	tw.finish()
 	// The fill is the origin round-trip + store; the leader's own client write (below,
 	// under DecoupleFill) is serve time, not fill time, so stamp the duration here.
@@ -451,6 +577,9 @@ func (c *Cache) fill(w http.ResponseWriter, r *http.Request, next http.Handler,
 		release()
 		tw.serveLeader()
 	}
+	if tw.revalidated {
+		return ResultInfo{Result: ResultRevalidated, FillDuration: dur}
+	}
 	return ResultInfo{Result: ResultMiss, FillDuration: dur}
 }
 
@@ -473,14 +602,15 @@ func (c *Cache) release(variantHex string, l *fillLock) {
 }
 
 // primaryHash keys on host + method + scheme + uri (so distinct hosts/schemes/
-// methods never collide). The host is lowercased and port-stripped so
-// "example.com" and "example.com:443" share a key regardless of upstream host
-// normalization. scheme is canonicalized to http/https by schemeOf.
+// methods never collide), the uri normalized and any request values added as
+// Options.Key says. The host is lowercased and port-stripped so "example.com"
+// and "example.com:443" share a key regardless of upstream host normalization.
+// scheme is canonicalized to http/https by schemeOf.
 func (c *Cache) primaryHash(r *http.Request) string {
 	scheme := schemeOf(r)
 	host := normalizeHost(r.Host)
-	uri := r.URL.RequestURI()
-	sum := sha256.Sum256([]byte(host + "\n" + r.Method + "\n" + scheme + "\n" + uri))
+	uri := c.key.URI(r)
+	sum := sha256.Sum256([]byte(host + "\n" + r.Method + "\n" + scheme + "\n" + uri + c.key.extra(r)))
 	return hex.EncodeToString(sum[:16])
 }
 
@@ -561,26 +691,85 @@ func (c *Cache) setPrimaryVary(primaryHex string, names []string) {
 	c.pvMu.Unlock()
 }
 
+// fillsWhole reports whether a ranged miss for primaryHex should fetch the whole
+// object: its length was seen within MaxFileSize, and its last whole fill, if
+// any, was stored.
+func (c *Cache) fillsWhole(primaryHex string) bool {
+	c.wfMu.RLock()
+	defer c.wfMu.RUnlock()
+	return c.wholeFill[primaryHex]
+}
+
+// setWholeFill records whether a whole fill of primaryHex was stored.
+func (c *Cache) setWholeFill(primaryHex string, stored bool) {
+	c.wfMu.Lock()
+	defer c.wfMu.Unlock()
+	if _, exists := c.wholeFill[primaryHex]; !exists {
+		if !stored {
+			return // absent already means "pass the Range through"
+		}
+		c.evictWholeFill()
+	}
+	c.wholeFill[primaryHex] = stored
+}
+
+// learnWholeFill records that primaryHex fits MaxFileSize, unless a whole fill
+// of it has already shown whether it is stored.
+func (c *Cache) learnWholeFill(primaryHex string) {
+	c.wfMu.Lock()
+	defer c.wfMu.Unlock()
+	if _, exists := c.wholeFill[primaryHex]; !exists {
+		c.evictWholeFill()
+		c.wholeFill[primaryHex] = true
+	}
+}
+
+// evictWholeFill bounds the map like primaryVary: one arbitrary entry goes when
+// it is full. c.wfMu must be held.
+func (c *Cache) evictWholeFill() {
+	if len(c.wholeFill) < maxPrimaryVary {
+		return
+	}
+	for k := range c.wholeFill {
+		delete(c.wholeFill, k)
+		break
+	}
+}
+
 // writeStored writes a cached entry to the client. body is omitted for HEAD and
-// bodiless statuses. X-Cache is set to tag (HIT/MISS).
-func writeStored(w http.ResponseWriter, r *http.Request, m Meta, body []byte, tag string) {
+// bodiless statuses, a request whose preconditions the entry fails gets a 304 or
+// 412 (see checkPreconditions), and a ranged GET gets just its ranges (see
+// writeStoredRange). X-Cache is set to tag (HIT/MISS). body holds m.Size bytes;
+// it is read from the start, however far a previous use read it.
+func writeStored(w http.ResponseWriter, r *http.Request, m Meta, body io.ReadSeeker, tag string) {
 	h := w.Header()
 	for k, vs := range m.Header {
 		h[k] = append([]string(nil), vs...)
 	}
 	h.Set("Age", strconv.FormatInt(servedAgeSeconds(m, time.Now()), 10))
 	h.Set("X-Cache", tag)
+	if code := checkPreconditions(r, m.Status, m.Header); code != 0 {
+		writeCondition(w, code)
+		return
+	}
+	if writeStoredRange(w, r, m, body) {
+		return
+	}
 	// A chunked-buffered entry was stored without a Content-Length; serve the
 	// definitive length now that the whole body is in hand, so the served response
 	// is itself a well-formed cacheable one (and not re-chunked downstream).
 	if h.Get("Content-Length") == "" && r.Method != http.MethodHead && m.Status != http.StatusNoContent {
-		h.Set("Content-Length", strconv.Itoa(len(body)))
+		h.Set("Content-Length", strconv.FormatInt(m.Size, 10))
 	}
 	w.WriteHeader(m.Status)
 	if r.Method == http.MethodHead || m.Status == http.StatusNoContent {
 		return
 	}
-	_, _ = w.Write(body)
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	// io.Copy hands a file body to the connection's ReadFrom: sendfile(2).
+	_, _ = io.Copy(w, io.LimitReader(body, m.Size))
 }
 
 // servedAgeSeconds is the Age header value for a cache hit: the age the response
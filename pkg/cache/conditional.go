@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// checkPreconditions evaluates the client's preconditions (RFC 9110 §13.2.2)
+// against a stored response with status and header h, returning 412, 304, or 0
+// to serve the response as usual. Preconditions only apply to a 2xx response;
+// the cache only serves GET and HEAD, so a passing If-None-Match or
+// If-Modified-Since is always a 304.
+func checkPreconditions(r *http.Request, status int, h http.Header) int {
+	if status < 200 || status > 299 {
+		return 0
+	}
+	etag := h.Get("ETag")
+	lastModified := h.Get("Last-Modified")
+
+	if v := r.Header.Get("If-Match"); v != "" {
+		if !matchETag(v, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if v := r.Header.Get("If-Unmodified-Since"); v != "" {
+		if modified, ok := modifiedAfter(lastModified, v); ok && modified {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		if matchETag(v, etag, true) {
+			return http.StatusNotModified
+		}
+	} else if v := r.Header.Get("If-Modified-Since"); v != "" {
+		if modified, ok := modifiedAfter(lastModified, v); ok && !modified {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// modifiedAfter reports whether the Last-Modified date lastModified is later
+// than the HTTP-date since. ok is false when either is missing or not a valid
+// HTTP-date: the precondition is then ignored (RFC 9110 §13.1.3, §13.1.4).
+func modifiedAfter(lastModified, since string) (after, ok bool) {
+	t, err := http.ParseTime(since)
+	if err != nil {
+		return false, false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false, false
+	}
+	return lm.After(t), true
+}
+
+// writeCondition answers a failed precondition with code (304 or 412), w's
+// header holding the stored response's. The body and the headers describing it
+// are dropped; validators and caching headers stay, so the client can update
+// its own copy.
+func writeCondition(w http.ResponseWriter, code int) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("Content-Range")
+	if h.Get("ETag") != "" {
+		h.Del("Last-Modified")
+	}
+	w.WriteHeader(code)
+}
+
+// matchETag reports whether the If-Match / If-None-Match list v holds a tag
+// matching etag: by weak comparison when weak is set (If-None-Match), by strong
+// comparison otherwise (If-Match). "*" matches any stored response. A malformed
+// list matches nothing from the point it goes wrong.
+func matchETag(v, etag string, weak bool) bool {
+	for {
+		v = strings.TrimLeft(v, " \t,")
+		if v == "" {
+			return false
+		}
+		if v[0] == '*' {
+			return true
+		}
+		tag, rest, ok := scanETag(v)
+		if !ok {
+			return false
+		}
+		if etagEqual(tag, etag, weak) {
+			return true
+		}
+		v = rest
+	}
+}
+
+// scanETag splits the entity-tag at the start of s from the rest.
+func scanETag(s string) (tag, rest string, ok bool) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return "", "", false
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", "", false
+	}
+	end += start + 2
+	return s[:end], s[end:], true
+}
+
+// etagEqual compares two entity-tags (RFC 9110 §8.8.3.2): strongly, both must
+// be strong and identical; weakly, their opaque tags must be identical.
+func etagEqual(a, b string, weak bool) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if weak {
+		return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+	}
+	return a == b && !strings.HasPrefix(a, "W/")
+}
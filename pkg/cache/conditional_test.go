@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchETag(t *testing.T) {
+	cases := []struct {
+		list, etag   string
+		weak, strong bool
+	}{
+		{`"a"`, `"a"`, true, true},
+		{`"b", "a"`, `"a"`, true, true},
+		{`"b","a"`, `"a"`, true, true},
+		{`W/"a"`, `"a"`, true, false},
+		{`"a"`, `W/"a"`, true, false},
+		{`W/"a"`, `W/"a"`, true, false},
+		{`"a,b"`, `"a,b"`, true, true},
+		{`"b"`, `"a"`, false, false},
+		{`*`, `"a"`, true, true},
+		{`*`, ``, true, true},
+		{`"a"`, ``, false, false},
+		{`a`, `a`, false, false},
+		{`"a`, `"a`, false, false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.weak, matchETag(tc.list, tc.etag, true), "weak %s vs %s", tc.list, tc.etag)
+		assert.Equal(t, tc.strong, matchETag(tc.list, tc.etag, false), "strong %s vs %s", tc.list, tc.etag)
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	lm := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	before := lm.Add(-time.Hour).Format(http.TimeFormat)
+	at := lm.Format(http.TimeFormat)
+	after := lm.Add(time.Hour).Format(http.TimeFormat)
+	stored := hdr("ETag", `"v1"`, "Last-Modified", at)
+
+	cases := []struct {
+		name   string
+		header http.Header
+		status int
+		want   int
+	}{
+		{"none", nil, 200, 0},
+		{"if-none-match", hdr("If-None-Match", `"v1"`), 200, 304},
+		{"if-none-match weak", hdr("If-None-Match", `W/"v1"`), 200, 304},
+		{"if-none-match other", hdr("If-None-Match", `"v0"`), 200, 0},
+		{"if-none-match any", hdr("If-None-Match", "*"), 200, 304},
+		{"if-modified-since", hdr("If-Modified-Since", at), 200, 304},
+		{"if-modified-since later", hdr("If-Modified-Since", after), 200, 304},
+		{"if-modified-since earlier", hdr("If-Modified-Since", before), 200, 0},
+		{"if-modified-since invalid", hdr("If-Modified-Since", "yesterday"), 200, 0},
+		{"if-none-match wins", hdr("If-None-Match", `"v0"`, "If-Modified-Since", at), 200, 0},
+		{"if-match", hdr("If-Match", `"v1"`), 200, 0},
+		{"if-match weak", hdr("If-Match", `W/"v1"`), 200, 412},
+		{"if-match other", hdr("If-Match", `"v0"`), 200, 412},
+		{"if-match any", hdr("If-Match", "*"), 200, 0},
+		{"if-unmodified-since", hdr("If-Unmodified-Since", at), 200, 0},
+		{"if-unmodified-since earlier", hdr("If-Unmodified-Since", before), 200, 412},
+		{"if-match wins", hdr("If-Match", `"v1"`, "If-Unmodified-Since", before), 200, 0},
+		{"412 before 304", hdr("If-Match", `"v0"`, "If-None-Match", `"v1"`), 200, 412},
+		{"not 2xx", hdr("If-None-Match", `"v1"`, "If-Match", `"v0"`), 404, 0},
+	}
+	for _, tc := range cases {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		for k, vs := range tc.header {
+			r.Header[k] = vs
+		}
+		assert.Equal(t, tc.want, checkPreconditions(r, tc.status, stored), tc.name)
+	}
+}
+
+func TestCache_ClientConditional(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		lm := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		var calls int32
+		h := origin(originSpec{body: []byte("hello"), header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Content-Type":  {"text/plain"},
+			"Etag":          {`"v1"`},
+			"Last-Modified": {lm},
+		}}, &calls)
+		do(c, h, "GET", "/x", nil)
+
+		rec := do(c, h, "GET", "/x", hdr("If-None-Match", `W/"v0", "v1"`))
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+		assert.Empty(t, rec.Body.String())
+		assert.Equal(t, `"v1"`, rec.Header().Get("ETag"))
+		assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+		assert.NotEmpty(t, rec.Header().Get("Age"))
+		assert.Empty(t, rec.Header().Get("Content-Type"))
+		assert.Empty(t, rec.Header().Get("Content-Length"))
+
+		do(c, h, "HEAD", "/x", nil)
+		rec = do(c, h, "HEAD", "/x", hdr("If-Modified-Since", lm))
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+
+		rec = do(c, h, "GET", "/x", hdr("If-Match", `"v0"`))
+		assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+		assert.Empty(t, rec.Body.String())
+
+		rec = do(c, h, "GET", "/x", hdr("If-Unmodified-Since", time.Now().Add(-2*time.Hour).UTC().Format(http.TimeFormat)))
+		assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+		rec = do(c, h, "GET", "/x", hdr("If-None-Match", `"v0"`, "Range", "bytes=0-1"))
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "he", rec.Body.String())
+
+		rec = do(c, h, "GET", "/x", hdr("If-Match", `"v1"`))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "hello", rec.Body.String())
+		assert.EqualValues(t, 2, calls, "every precondition is answered from the cache")
+	})
+}
+
+func TestCache_ClientConditionalRevalidated(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+	seedValidated(t, c, "/x", 5*time.Second, 0, 0)
+	o := &validatingOrigin{etag: `"v1"`, body: "new"}
+
+	rec := do(c, o, "GET", "/x", hdr("If-None-Match", `"v1"`))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, "REVALIDATED", rec.Header().Get("X-Cache"))
+	assert.Empty(t, rec.Body.String())
+}
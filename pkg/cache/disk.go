@@ -1,8 +1,11 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -22,7 +25,8 @@ const reapMinAge = 60 * time.Second
 const minKeyLen = 2
 
 // DiskStorage is a disk-backed cache backend. Entries survive restarts and the
-// body is streamed to disk, so the cache isn't bounded by RSS. The total on-disk
+// body is streamed to disk on a fill and from it on a hit (see Open), so the
+// cache isn't bounded by RSS. The total on-disk
 // byte cap is held by an in-memory LRU, re-seeded from disk by a background
 // startup scan that also reaps orphans, torn writes, and expired entries. Safe
 // for concurrent use by a single Cache (see Storage).
@@ -66,23 +70,42 @@ func (s *DiskStorage) tempPath(prefix string) string {
 	return filepath.Join(s.dir, "tmp", prefix+"."+strconv.FormatUint(s.seq.Add(1), 10))
 }
 
+// WritableCheck returns a readiness check (see healthz.Check) that creates, syncs
+// and removes a probe file under <dir>/tmp, failing when the cache volume is
+// read-only, full or gone — a disk cache that cannot commit silently turns every
+// request into a miss.
+func (s *DiskStorage) WritableCheck() func(ctx context.Context) error {
+	return func(context.Context) error {
+		path := s.tempPath("healthz")
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("cache: disk not writable: %w", err)
+		}
+		_, err = f.Write([]byte("ok"))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("cache: disk not writable: %w", err)
+		}
+		return nil
+	}
+}
+
 // Get reads the entry under key, touching its LRU recency on a hit. ok=false on
 // any miss / corruption / torn read (fail-static — treated as a cache miss). The
 // body length is checked against meta.Size so a reader can never serve an old
 // meta paired with a concurrently-rewritten body (the two files are read
 // non-atomically; this guards the framing-corruption case).
 func (s *DiskStorage) Get(key string) (Meta, []byte, bool) {
-	if len(key) < minKeyLen {
+	m, ok := s.readMeta(key)
+	if !ok {
 		return Meta{}, nil, false
 	}
-	mb, err := os.ReadFile(s.metaPath(key))
-	if err != nil {
-		return Meta{}, nil, false // clean miss or unreadable
-	}
-	var m Meta
-	if err := json.Unmarshal(mb, &m); err != nil {
-		return Meta{}, nil, false // corrupt sidecar
-	}
 	body, err := os.ReadFile(s.bodyPath(key))
 	if err != nil || int64(len(body)) != m.Size {
 		return Meta{}, nil, false // meta without body (torn), or meta/body size disagree
@@ -91,6 +114,44 @@ func (s *DiskStorage) Get(key string) (Meta, []byte, bool) {
 	return m, body, true
 }
 
+// Open is Get without reading the body: it returns the open body file, which
+// net/http serves with sendfile(2). The file's size is checked against meta.Size
+// as in Get; once open, a concurrent rewrite or Delete of the entry replaces or
+// unlinks the path, never the open file, so the body read stays whole.
+func (s *DiskStorage) Open(key string) (Meta, io.ReadSeekCloser, bool) {
+	m, ok := s.readMeta(key)
+	if !ok {
+		return Meta{}, nil, false
+	}
+	f, err := os.Open(s.bodyPath(key))
+	if err != nil {
+		return Meta{}, nil, false
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != m.Size {
+		f.Close()
+		return Meta{}, nil, false
+	}
+	s.lru.touch(key)
+	return m, f, true
+}
+
+// readMeta reads and decodes the .meta sidecar of key; ok=false on a clean miss,
+// an unreadable file, or a corrupt sidecar.
+func (s *DiskStorage) readMeta(key string) (Meta, bool) {
+	if len(key) < minKeyLen {
+		return Meta{}, false
+	}
+	mb, err := os.ReadFile(s.metaPath(key))
+	if err != nil {
+		return Meta{}, false
+	}
+	var m Meta
+	if err := json.Unmarshal(mb, &m); err != nil {
+		return Meta{}, false
+	}
+	return m, true
+}
+
 // Writer streams a new entry's body to a temp file; Commit fsyncs + renames it
 // into place (body first, meta last) and admits it to the byte cap; Abort
 // discards the temp file. Returns an error if the temp file can't be created.
@@ -116,6 +177,32 @@ func (s *DiskStorage) Delete(key string) {
 	s.lru.remove(key)
 }
 
+// UpdateMeta atomically replaces the .meta sidecar of the entry under key,
+// leaving its body file untouched. The entry must exist with a body of the
+// recorded size.
+func (s *DiskStorage) UpdateMeta(key string, meta Meta) error {
+	if len(key) < minKeyLen {
+		return errNoEntry
+	}
+	fi, err := os.Stat(s.bodyPath(key))
+	if err != nil {
+		return errNoEntry
+	}
+	if _, err := os.Stat(s.metaPath(key)); err != nil {
+		return errNoEntry
+	}
+	meta.Size = fi.Size()
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := atomicWriteRename(s.metaPath(key), mb, s.tempPath(key+".meta")); err != nil {
+		return err
+	}
+	s.lru.touch(key)
+	return fsyncDir(s.shardDir(key))
+}
+
 func (s *DiskStorage) removeFiles(key string) {
 	if len(key) < minKeyLen {
 		return // guard shardDir(key[:2]) against a malformed key
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -111,6 +113,66 @@ func TestDisk_GetSetDelete(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestDisk_Open(t *testing.T) {
+	s, err := NewDisk(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	const key = "aabbccddeeff00112233445566778899"
+	storePut(t, s, key, Meta{Status: 200, Header: http.Header{}, FreshUntil: time.Now().Add(time.Hour).UnixNano(), Size: 3}, []byte("abc"))
+
+	m, body, ok := s.Open(key)
+	require.True(t, ok)
+	assert.IsType(t, (*os.File)(nil), body, "the body file itself, for sendfile")
+	assert.EqualValues(t, 3, m.Size)
+	b, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+
+	s.Delete(key)
+	_, err = body.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	b, err = io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b), "an open body outlives a Delete")
+	require.NoError(t, body.Close())
+
+	storePut(t, s, key, Meta{Status: 200, Header: http.Header{}, Size: 3}, []byte("abc"))
+	require.NoError(t, os.WriteFile(s.bodyPath(key), []byte("ab"), 0o644))
+	_, _, ok = s.Open(key)
+	assert.False(t, ok, "a body disagreeing with meta.Size is a miss")
+}
+
+// getlessDisk is a DiskStorage whose Get fails the test: every hit must be served
+// through Open.
+type getlessDisk struct {
+	*DiskStorage
+	t *testing.T
+}
+
+func (s getlessDisk) Get(string) (Meta, []byte, bool) {
+	s.t.Error("Get called on the serving path")
+	return Meta{}, nil, false
+}
+
+func TestCache_ServesHitsThroughOpener(t *testing.T) {
+	d, err := NewDisk(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	c := New(getlessDisk{d, t}, Options{MaxFileSize: 1024})
+	var calls int32
+	h := origin(originSpec{body: []byte("0123456789"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+	do(c, h, "GET", "/x", nil)
+
+	rec := do(c, h, "GET", "/x", nil)
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "0123456789", rec.Body.String())
+	assert.Equal(t, "10", rec.Header().Get("Content-Length"))
+
+	rec = do(c, h, "GET", "/x", hdr("Range", "bytes=2-4,7-"))
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Contains(t, rec.Body.String(), "234")
+	assert.Contains(t, rec.Body.String(), "789")
+	assert.EqualValues(t, 1, calls)
+}
+
 func TestDisk_RemoveFilesShortKeyNoPanic(t *testing.T) {
 	d, err := NewDisk(t.TempDir(), 1<<20)
 	require.NoError(t, err)
@@ -136,3 +198,18 @@ func TestDisk_ScanSkipsSizeMismatch(t *testing.T) {
 	b.scan(time.Now())
 	assert.EqualValues(t, 0, b.lru.size(), "size-mismatched entry is not admitted to the byte cap")
 }
+
+func TestDisk_WritableCheck(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, 1<<20)
+	require.NoError(t, err)
+
+	check := d.WritableCheck()
+	assert.NoError(t, check(context.Background()))
+	ents, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, ents, "the probe file is removed")
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "tmp")))
+	assert.ErrorContains(t, check(context.Background()), "cache: disk not writable")
+}
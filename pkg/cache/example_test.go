@@ -8,6 +8,7 @@ import (
 
 	"github.com/moonrhythm/parapet"
 	"github.com/moonrhythm/parapet/pkg/cache"
+	"github.com/moonrhythm/parapet/pkg/cache/purge"
 )
 
 // Mount a disk-backed response cache ahead of the upstream whose responses it
@@ -49,3 +50,57 @@ func ExampleOverride() {
 		},
 	})
 }
+
+// Share one entry across tracking-parameter and parameter-order variants, and
+// keep the purge table keyed the same way.
+func ExampleKeyOptions() {
+	key := cache.KeyOptions{
+		ExcludeQuery: []string{"utm_*", "gclid", "fbclid"},
+		SortQuery:    true,
+		Cookies:      []string{"lang"}, // the page is localized by this cookie
+	}
+	pt := purge.New(purge.WithURINormalizer(key.NormalizeURI))
+	cache.New(cache.NewMemory(256<<20), cache.Options{
+		Key:              key,
+		InvalidatedAfter: pt.InvalidatedAfter,
+	})
+}
+
+// Shield a struggling origin: remember a 404 for 30s and a gateway error for 5s,
+// and serve the last good copy instead of a gateway error for up to 10 minutes.
+func ExampleNegativeOptions() {
+	cache.New(cache.NewMemory(256<<20), cache.Options{
+		Negative: cache.NegativeOptions{Rules: []cache.NegativeRule{
+			{Statuses: []int{404}, TTL: 30 * time.Second},
+			{Statuses: []int{502, 503, 504}, TTL: 5 * time.Second, ServeStale: 10 * time.Minute},
+		}},
+	})
+}
+
+// Serve video and large downloads from cache: ranged requests for objects too
+// large to store whole fill and keep only the 1 MiB slices they read.
+func ExampleOptions_sliceSize() {
+	cache.New(cache.NewMemory(1<<30), cache.Options{
+		MaxFileSize: 8 << 20,
+		SliceSize:   1 << 20,
+	})
+}
+
+// Serve hot entries from a 256 MiB memory tier in front of a 64 GiB disk tier.
+func ExampleNewTiered() {
+	disk, err := cache.NewDisk("/var/cache/app", 64<<30)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := cache.NewTiered(cache.NewMemory(256<<20), disk, cache.TieredOptions{
+		MaxPromoteSize: 1 << 20,
+	})
+	cache.New(store, cache.Options{MaxFileSize: 8 << 20})
+}
+
+// Share one cache across every replica through Redis.
+func ExampleNewRemote() {
+	kv := &cache.RedisKV{Addr: "redis:6379"}
+	store := cache.NewRemote(kv, cache.RemoteOptions{Timeout: 200 * time.Millisecond})
+	cache.New(store, cache.Options{MaxFileSize: 8 << 20})
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// KeyOptions composes the cache key (Options.Key). The key always covers the
+// host, method and scheme; KeyOptions normalizes the request-uri that completes
+// it and can add request values to it. The zero value keys on the request-uri
+// as received, so ?utm_source= variants and reordered parameters are each cached
+// apart.
+//
+// The normalized request-uri is what the entry records in Meta.URI, so URL and
+// prefix purges (package purge) match every request sharing the entry; give the
+// purge table the same normalization with purge.WithURINormalizer(k.NormalizeURI).
+// Only the key is normalized: the origin still receives the request unchanged.
+type KeyOptions struct {
+	// IncludeQuery, when non-empty, keeps only the query parameters it names in
+	// the key; ExcludeQuery drops the ones it names (applied after IncludeQuery).
+	// An entry is a parameter name or a path.Match pattern such as "utm_*";
+	// matching is case-sensitive.
+	IncludeQuery []string
+	ExcludeQuery []string
+
+	// SortQuery orders the query parameters by name, so ?a=1&b=2 and ?b=2&a=1
+	// share an entry. Repeated parameters keep their relative order.
+	SortQuery bool
+
+	// IgnoreCase lowercases the path (not the query), for an origin with
+	// case-insensitive paths.
+	IgnoreCase bool
+
+	// StripFragment drops a "#fragment" a client sent in the request target.
+	// Fragments are never meant to reach the server, but a raw '#' ends up in the
+	// path or query when one does. Only a raw '#' is cut: a percent-encoded %23
+	// is part of the path, and keys as sent.
+	StripFragment bool
+
+	// Headers and Cookies add the named request header and cookie values to the
+	// key, like a Vary the origin doesn't send. A missing one keys as empty. Each
+	// distinct value is a separate entry, so prefer low-cardinality values.
+	Headers []string
+	Cookies []string
+
+	// Device, when set, adds its result to the key: a device class such as
+	// "mobile" or "desktop", derived however the caller likes. Keep the set of
+	// results small.
+	Device func(r *http.Request) string
+}
+
+// normalizesURI reports whether any option rewrites the request-uri.
+func (k *KeyOptions) normalizesURI() bool {
+	return len(k.IncludeQuery) > 0 || len(k.ExcludeQuery) > 0 || k.SortQuery || k.IgnoreCase || k.StripFragment
+}
+
+// URI returns r's request-uri as the cache key sees it: r.URL.RequestURI() with
+// the options applied. It is also the entry's Meta.URI.
+func (k *KeyOptions) URI(r *http.Request) string {
+	if !k.normalizesURI() {
+		return r.URL.RequestURI()
+	}
+	p, q := r.URL.EscapedPath(), r.URL.RawQuery
+	if k.StripFragment {
+		// A raw '#' in the path survives only in RawPath: EscapedPath re-encodes it
+		// as %23, indistinguishable from one the client encoded.
+		if i := strings.IndexByte(r.URL.RawPath, '#'); i >= 0 {
+			raw := r.URL.RawPath[:i]
+			if dec, err := url.PathUnescape(raw); err == nil {
+				p = (&url.URL{Path: dec, RawPath: raw}).EscapedPath()
+			}
+			q = "" // a '?' after the '#' is the fragment's
+		}
+		q, _, _ = strings.Cut(q, "#")
+	}
+	if p == "" {
+		p = "/"
+	}
+	return k.normalize(p, q)
+}
+
+// NormalizeURI applies the options to a request-uri (path and query), as URI
+// does to a request. Pass it to purge.WithURINormalizer so a purge names the
+// entry the cache stored.
+func (k *KeyOptions) NormalizeURI(uri string) string {
+	if !k.normalizesURI() {
+		return uri
+	}
+	if k.StripFragment {
+		uri, _, _ = strings.Cut(uri, "#")
+	}
+	p, q, _ := strings.Cut(uri, "?")
+	return k.normalize(p, q)
+}
+
+func (k *KeyOptions) normalize(p, rawQuery string) string {
+	if k.IgnoreCase {
+		p = strings.ToLower(p)
+	}
+	if q := k.query(rawQuery); q != "" {
+		return p + "?" + q
+	}
+	return p
+}
+
+// query filters and orders a raw query string, keeping each parameter's
+// original encoding.
+func (k *KeyOptions) query(raw string) string {
+	if len(k.IncludeQuery) == 0 && len(k.ExcludeQuery) == 0 && !k.SortQuery {
+		return raw
+	}
+	type param struct{ name, raw string }
+	var params []param
+	for _, kv := range strings.Split(raw, "&") {
+		if kv == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(kv, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if len(k.IncludeQuery) > 0 && !matchParam(k.IncludeQuery, name) {
+			continue
+		}
+		if matchParam(k.ExcludeQuery, name) {
+			continue
+		}
+		params = append(params, param{name: name, raw: kv})
+	}
+	if k.SortQuery {
+		slices.SortStableFunc(params, func(a, b param) int { return strings.Compare(a.name, b.name) })
+	}
+	var b strings.Builder
+	for i, p := range params {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(p.raw)
+	}
+	return b.String()
+}
+
+// matchParam reports whether name is one of patterns, literally or by
+// path.Match.
+func matchParam(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == name {
+			return true
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extra returns the request values the options add to the key, or "" when
+// there are none, so the default key is unchanged.
+func (k *KeyOptions) extra(r *http.Request) string {
+	if len(k.Headers) == 0 && len(k.Cookies) == 0 && k.Device == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, name := range k.Headers {
+		b.WriteString("\nh:" + name + "=" + strings.Join(r.Header.Values(name), ","))
+	}
+	for _, name := range k.Cookies {
+		var v string
+		if c, err := r.Cookie(name); err == nil {
+			v = c.Value
+		}
+		b.WriteString("\nc:" + name + "=" + v)
+	}
+	if k.Device != nil {
+		b.WriteString("\nd:" + k.Device(r))
+	}
+	return b.String()
+}
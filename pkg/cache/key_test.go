@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyOptions_URI(t *testing.T) {
+	cases := []struct {
+		name string
+		k    KeyOptions
+		in   string
+		want string
+	}{
+		{"zero value", KeyOptions{}, "/A?b=2&a=1", "/A?b=2&a=1"},
+		{"exclude by pattern", KeyOptions{ExcludeQuery: []string{"utm_*", "fbclid"}}, "/a?utm_source=x&id=1&fbclid=y&utm_medium=z", "/a?id=1"},
+		{"include", KeyOptions{IncludeQuery: []string{"id", "p*"}}, "/a?x=1&id=2&page=3", "/a?id=2&page=3"},
+		{"include then exclude", KeyOptions{IncludeQuery: []string{"p*"}, ExcludeQuery: []string{"preview"}}, "/a?page=1&preview=1", "/a?page=1"},
+		{"sort keeps repeats in order", KeyOptions{SortQuery: true}, "/a?b=2&a=9&b=1", "/a?a=9&b=2&b=1"},
+		{"encoded names", KeyOptions{ExcludeQuery: []string{"a b"}}, "/a?a%20b=1&c=%2F", "/a?c=%2F"},
+		{"no params left", KeyOptions{ExcludeQuery: []string{"*"}}, "/a?x=1", "/a"},
+		{"ignore case", KeyOptions{IgnoreCase: true}, "/Blog/Post?Q=A", "/blog/post?Q=A"},
+		{"fragment in query", KeyOptions{StripFragment: true}, "/a?x=1#top", "/a?x=1"},
+		{"fragment in path", KeyOptions{StripFragment: true}, "/a#top", "/a"},
+		{"fragment in path before a query", KeyOptions{StripFragment: true}, "/a#top?x=1", "/a"},
+		{"encoded # kept", KeyOptions{StripFragment: true}, "/docs/C%23/intro?v=2", "/docs/C%23/intro?v=2"},
+		{"encoded # then fragment", KeyOptions{StripFragment: true}, "/docs/C%23/a%20b#top", "/docs/C%23/a%20b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			u, err := url.ParseRequestURI(tc.in) // as the server parses a raw request target: a '#' is not split off
+			require.NoError(t, err)
+			r.URL = u
+			assert.Equal(t, tc.want, tc.k.URI(r))
+			assert.Equal(t, tc.want, tc.k.NormalizeURI(tc.in), "NormalizeURI agrees")
+		})
+	}
+}
+
+func TestKeyOptions_DefaultKeyUnchanged(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{})
+	r := httptest.NewRequest("GET", "http://Example.com:443/a?b=1", nil)
+	sum := sha256.Sum256([]byte("example.com\nGET\nhttp\n/a?b=1"))
+	assert.Equal(t, hex.EncodeToString(sum[:16]), c.primaryHash(r), "existing stored entries keep their keys")
+}
+
+func TestCache_KeyNormalizesQuery(t *testing.T) {
+	store := NewMemory(1 << 20)
+	c := New(store, Options{MaxFileSize: 1024, Key: KeyOptions{ExcludeQuery: []string{"utm_*"}, SortQuery: true}})
+	var calls int32
+	h := origin(originSpec{body: []byte("a"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+
+	assert.Equal(t, "MISS", do(c, h, "GET", "/a?y=2&x=1&utm_source=mail", nil).Header().Get("X-Cache"))
+	assert.Equal(t, "HIT", do(c, h, "GET", "/a?x=1&y=2", nil).Header().Get("X-Cache"))
+	assert.Equal(t, "HIT", do(c, h, "GET", "/a?utm_campaign=z&y=2&x=1", nil).Header().Get("X-Cache"))
+	assert.Equal(t, "MISS", do(c, h, "GET", "/a?x=2&y=2", nil).Header().Get("X-Cache"))
+	assert.EqualValues(t, 2, calls)
+
+	var uris []string
+	store.Range(func(_ string, m Meta) bool { uris = append(uris, m.URI); return true })
+	assert.ElementsMatch(t, []string{"/a?x=1&y=2", "/a?x=2&y=2"}, uris, "Meta.URI is the normalized uri")
+}
+
+func TestCache_KeyKeepsEncodedHash(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024, Key: KeyOptions{StripFragment: true}})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri := r.URL.RequestURI()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", strconv.Itoa(len(uri)))
+		_, _ = w.Write([]byte(uri))
+	})
+	assert.Equal(t, "/docs/C%23/intro?v=2", do(c, h, "GET", "/docs/C%23/intro?v=2", nil).Body.String())
+	rec := do(c, h, "GET", "/docs/C%23/other?v=3", nil)
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"), "a %23 doesn't cut the path")
+	assert.Equal(t, "/docs/C%23/other?v=3", rec.Body.String())
+}
+
+func TestCache_KeyAddsRequestValues(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024, Key: KeyOptions{
+		Headers: []string{"X-Tenant"},
+		Cookies: []string{"lang"},
+		Device: func(r *http.Request) string {
+			if r.Header.Get("Sec-CH-UA-Mobile") == "?1" {
+				return "mobile"
+			}
+			return "desktop"
+		},
+	}})
+	var calls int32
+	h := origin(originSpec{body: []byte("a"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+	get := func(header ...string) string {
+		return do(c, h, "GET", "/a", hdr(header...)).Header().Get("X-Cache")
+	}
+
+	assert.Equal(t, "MISS", get())
+	assert.Equal(t, "HIT", get("Cookie", "other=1"))
+	assert.Equal(t, "MISS", get("X-Tenant", "t1"))
+	assert.Equal(t, "HIT", get("X-Tenant", "t1", "Cookie", "session=abc"))
+	assert.Equal(t, "MISS", get("Cookie", "lang=th"))
+	assert.Equal(t, "MISS", get("Sec-CH-UA-Mobile", "?1"))
+	assert.Equal(t, "HIT", get("Sec-CH-UA-Mobile", "?1"))
+	assert.EqualValues(t, 4, calls)
+}
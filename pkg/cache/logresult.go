@@ -7,8 +7,8 @@ import (
 )
 
 // LogResult is a ResultFunc that records the cache outcome on the request's
-// structured-logger record as the field "cacheStatus" (HIT, MISS, STALE,
-// STALE_ERROR, or BYPASS), so it appears in access logs alongside the upstream,
+// structured-logger record as the field "cacheStatus" (HIT, MISS, REVALIDATED,
+// STALE, STALE_ERROR, or BYPASS), so it appears in access logs alongside the upstream,
 // status, and timing fields. It is a no-op when no logger middleware is mounted
 // ahead of the cache (logger.Set ignores a request with no record).
 //
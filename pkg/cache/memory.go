@@ -28,6 +28,9 @@ func NewMemory(maxSize int64) *MemoryStorage {
 	return &MemoryStorage{m: map[string]memEntry{}, lru: newLRU(maxSize)}
 }
 
+// capacity returns the byte cap passed to NewMemory.
+func (s *MemoryStorage) capacity() int64 { return s.lru.max }
+
 // Get returns the entry under key, touching its LRU recency on a hit. The Meta is
 // deep-copied so a caller (e.g. the InvalidatedAfter hook) can't mutate the live
 // stored entry; the body is returned by reference and must not be mutated (see
@@ -78,6 +81,20 @@ func (s *MemoryStorage) Delete(key string) {
 	s.lru.remove(key)
 }
 
+// UpdateMeta replaces the Meta of the entry under key, keeping its body.
+func (s *MemoryStorage) UpdateMeta(key string, meta Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok {
+		return errNoEntry
+	}
+	meta.Size = e.meta.Size
+	e.meta = cloneMeta(meta)
+	s.m[key] = e
+	return nil
+}
+
 // Range snapshots the current (key, Meta) pairs under the read lock, then calls fn
 // for each WITHOUT holding the lock — so fn may Delete entries (which takes the
 // write lock) without deadlocking. The snapshot deep-copies each Meta (header map
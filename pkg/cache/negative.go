@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// defaultNegativeMaxSize caps a negatively cached body when
+// NegativeOptions.MaxSize <= 0. Error pages are small; a large one is more
+// likely a misrouted object than an error worth keeping.
+const defaultNegativeMaxSize = 64 << 10 // 64 KiB
+
+// NegativeOptions configures negative caching (Options.Negative): storing an
+// error response the origin gives no freshness for, so an origin failing under
+// load — or a flood of requests for a missing object — costs one origin fetch
+// per TTL instead of one per request. The zero value caches no errors beyond
+// those the origin opts in to with its own freshness.
+//
+// A negative entry is stored only when it is safe to share: Set-Cookie, Vary: *,
+// private, no-store and an Authorization-bearing request without a shared opt-in
+// (public, s-maxage, must-revalidate) all still refuse it. It overrides no-cache
+// and a missing or zero max-age — the usual headers on an error page. The body
+// needs a Content-Length within MaxSize. A negative entry is never served stale
+// and is reported as ResultNegative when served.
+type NegativeOptions struct {
+	// Rules gives the per-status policy. The rule naming a status exactly wins
+	// over one naming its class; a rule for a status below 400 never applies.
+	Rules []NegativeRule
+
+	// MaxSize caps a negatively cached body; <= 0 means 64 KiB. It is clamped to
+	// Options.MaxFileSize.
+	MaxSize int64
+}
+
+// NegativeRule is the negative-caching policy for a set of error statuses.
+type NegativeRule struct {
+	// Statuses lists the status codes the rule covers. A single digit names a
+	// whole class: 5 covers every 5xx.
+	Statuses []int
+
+	// TTL is how long an error response with one of Statuses is cached. <= 0
+	// leaves it uncached (a rule may set only ServeStale).
+	TTL time.Duration
+
+	// ServeStale, for 5xx statuses, serves a stored response up to this long past
+	// its freshness instead of the origin's error, leaving the error uncached —
+	// like an RFC 5861 stale-if-error window the origin didn't send — and reports
+	// ResultStaleError. The cache keeps an expired entry for this long rather than
+	// reaping it on access, but the disk backend's startup scan and RemoteStorage
+	// still drop it at the end of its own windows; give those backends
+	// DefaultStaleIfError as well.
+	ServeStale time.Duration
+}
+
+// negativePolicy is NegativeOptions compiled for lookup by status.
+type negativePolicy struct {
+	exact    map[int]*NegativeRule
+	class    map[int]*NegativeRule
+	maxSize  int64
+	maxStale time.Duration // the longest ServeStale; 0 keeps no expired entry
+}
+
+func newNegativePolicy(opts NegativeOptions, maxFileSize int64) negativePolicy {
+	p := negativePolicy{maxSize: opts.MaxSize}
+	if p.maxSize <= 0 {
+		p.maxSize = defaultNegativeMaxSize
+	}
+	p.maxSize = min(p.maxSize, maxFileSize)
+	for i := range opts.Rules {
+		rule := &opts.Rules[i]
+		serverError := false
+		for _, s := range rule.Statuses {
+			switch {
+			case s >= 4 && s <= 5:
+				if p.class == nil {
+					p.class = map[int]*NegativeRule{}
+				}
+				p.class[s] = rule
+				serverError = serverError || s == 5
+			case s >= 400 && s <= 599:
+				if p.exact == nil {
+					p.exact = map[int]*NegativeRule{}
+				}
+				p.exact[s] = rule
+				serverError = serverError || s >= 500
+			}
+		}
+		if serverError {
+			p.maxStale = max(p.maxStale, clampStaleWindow(rule.ServeStale))
+		}
+	}
+	return p
+}
+
+// rule returns the rule covering status, or nil.
+func (p *negativePolicy) rule(status int) *NegativeRule {
+	if r := p.exact[status]; r != nil {
+		return r
+	}
+	return p.class[status/100]
+}
+
+// ttl returns how long an error response with status may be negatively cached;
+// 0 means not at all.
+func (p *negativePolicy) ttl(status int) time.Duration {
+	if r := p.rule(status); r != nil {
+		return r.TTL
+	}
+	return 0
+}
+
+// staleFallback returns the stale gate's test for serving the expired entry m in
+// place of an origin error, or nil when no rule would serve it. A negative
+// entry never stands in for another error.
+func (p *negativePolicy) staleFallback(m Meta, now time.Time) func(code int) bool {
+	if p.maxStale <= 0 || m.Negative {
+		return nil
+	}
+	age := now.Sub(time.Unix(0, m.FreshUntil))
+	if age >= p.maxStale {
+		return nil
+	}
+	return func(code int) bool {
+		r := p.rule(code)
+		return code >= 500 && r != nil && age < r.ServeStale
+	}
+}
+
+// decideNegative applies a negative-caching rule to an error response the
+// honor-origin (or forced) policy refused: the response is stored for ttl when
+// it is safe to share and its body fits maxSize (see NegativeOptions).
+func decideNegative(method string, h http.Header, reqAuthorized bool, maxSize int64, ttl time.Duration, now time.Time) decision {
+	no := decision{}
+	vary, ok := headerRefusals(h)
+	if !ok {
+		return no
+	}
+	cc := parseCacheControl(h)
+	if cc.private || cc.noStore {
+		return no
+	}
+	if reqAuthorized && !sharedOptIn(cc) {
+		return no
+	}
+	if !fitsCap(method, h, maxSize, false) {
+		return no
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return decision{cacheable: true, negative: true, freshUntil: now.Add(ttl), vary: vary, noStale: true}
+}
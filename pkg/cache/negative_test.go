@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testNegative = NegativeOptions{Rules: []NegativeRule{
+	{Statuses: []int{404}, TTL: 30 * time.Second},
+	{Statuses: []int{5}, TTL: 5 * time.Second},
+	{Statuses: []int{501}}, // exact beats class: never cached
+}}
+
+func TestNegativePolicy_Rules(t *testing.T) {
+	p := newNegativePolicy(testNegative, 1<<20)
+	assert.Equal(t, 30*time.Second, p.ttl(404))
+	assert.Equal(t, 5*time.Second, p.ttl(503))
+	assert.Zero(t, p.ttl(501))
+	assert.Zero(t, p.ttl(410))
+	assert.Zero(t, p.ttl(200))
+	assert.EqualValues(t, defaultNegativeMaxSize, p.maxSize)
+	assert.Zero(t, p.maxStale)
+
+	p = newNegativePolicy(NegativeOptions{MaxSize: 1 << 30, Rules: []NegativeRule{
+		{Statuses: []int{4}, ServeStale: time.Hour}, // a 4xx never serves stale
+		{Statuses: []int{503}, ServeStale: time.Minute},
+		{Statuses: []int{301}, TTL: time.Hour},
+	}}, 1024)
+	assert.EqualValues(t, 1024, p.maxSize, "clamped to MaxFileSize")
+	assert.Equal(t, time.Minute, p.maxStale)
+	assert.Zero(t, p.ttl(301))
+}
+
+func TestDecideNegative_SafetyRefusals(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name       string
+		h          http.Header
+		authorized bool
+		want       bool
+	}{
+		{"bare", hdr("Content-Length", "10"), false, true},
+		{"no-cache overridden", hdr("Content-Length", "10", "Cache-Control", "no-cache, max-age=0"), false, true},
+		{"private", hdr("Content-Length", "10", "Cache-Control", "private"), false, false},
+		{"no-store", hdr("Content-Length", "10", "Cache-Control", "no-store"), false, false},
+		{"set-cookie", hdr("Content-Length", "10", "Set-Cookie", "a=1"), false, false},
+		{"vary star", hdr("Content-Length", "10", "Vary", "*"), false, false},
+		{"authorization", hdr("Content-Length", "10"), true, false},
+		{"authorization, public", hdr("Content-Length", "10", "Cache-Control", "public"), true, true},
+		{"chunked", hdr(), false, false},
+		{"oversize", hdr("Content-Length", "101"), false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dec := decideNegative(http.MethodGet, tc.h, tc.authorized, 100, 5*time.Second, now)
+			assert.Equal(t, tc.want, dec.cacheable)
+			if tc.want {
+				assert.True(t, dec.negative)
+				assert.True(t, dec.noStale)
+				assert.Equal(t, now.Add(5*time.Second), dec.freshUntil)
+			}
+		})
+	}
+}
+
+func TestCache_Negative(t *testing.T) {
+	var results []Result
+	c := New(NewMemory(1<<20), Options{
+		MaxFileSize: 1024,
+		Negative:    testNegative,
+		OnResult:    func(_ *http.Request, info ResultInfo) { results = append(results, info.Result) },
+	})
+	get := func(h http.Handler, target string, header ...string) string {
+		return do(c, h, "GET", target, hdr(header...)).Header().Get("X-Cache")
+	}
+
+	var notFound, unavailable, unimplemented, private int32
+	nf := origin(originSpec{status: 404, body: []byte("gone"), header: hdr("Cache-Control", "no-cache")}, &notFound)
+	assert.Equal(t, "MISS", get(nf, "/missing"))
+	rec := do(c, nf, "GET", "/missing", nil)
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "gone", rec.Body.String())
+	assert.EqualValues(t, 1, notFound)
+
+	su := origin(originSpec{status: 503, body: []byte("down")}, &unavailable)
+	assert.Equal(t, "MISS", get(su, "/busy"))
+	assert.Equal(t, "HIT", get(su, "/busy"))
+	assert.EqualValues(t, 1, unavailable)
+
+	ni := origin(originSpec{status: 501}, &unimplemented)
+	assert.Equal(t, "MISS", get(ni, "/x"))
+	assert.Equal(t, "MISS", get(ni, "/x"))
+	assert.EqualValues(t, 2, unimplemented)
+
+	pv := origin(originSpec{status: 404, header: hdr("Cache-Control", "private")}, &private)
+	assert.Equal(t, "MISS", get(pv, "/private"))
+	assert.Equal(t, "MISS", get(pv, "/private"))
+	assert.Equal(t, "MISS", get(nf, "/authed", "Authorization", "Bearer x"))
+	assert.Equal(t, "MISS", get(nf, "/authed", "Authorization", "Bearer x"))
+	assert.EqualValues(t, 2, private)
+	assert.EqualValues(t, 3, notFound)
+
+	assert.Equal(t, []Result{
+		ResultMiss, ResultNegative,
+		ResultMiss, ResultNegative,
+		ResultMiss, ResultMiss,
+		ResultMiss, ResultMiss, ResultMiss, ResultMiss,
+	}, results)
+}
+
+func TestCache_Negative_OriginFreshnessIsAHit(t *testing.T) {
+	var results []Result
+	c := New(NewMemory(1<<20), Options{
+		MaxFileSize: 1024,
+		Negative:    testNegative,
+		OnResult:    func(_ *http.Request, info ResultInfo) { results = append(results, info.Result) },
+	})
+	var calls int32
+	h := origin(originSpec{status: 404, header: hdr("Cache-Control", "max-age=60")}, &calls)
+	do(c, h, "GET", "/a", nil)
+	do(c, h, "GET", "/a", nil)
+	assert.Equal(t, []Result{ResultMiss, ResultHit}, results)
+}
+
+func TestCache_Negative_Expires(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		c.negative = newNegativePolicy(testNegative, c.maxFileSize)
+		seedStale(t, c, "GET", "/a", Meta{
+			Status:     http.StatusServiceUnavailable,
+			Created:    time.Now().Add(-6 * time.Second).UnixNano(),
+			FreshUntil: time.Now().Add(-time.Second).UnixNano(),
+			Negative:   true,
+		}, []byte("down"))
+
+		var calls int32
+		h := origin(originSpec{body: []byte("up"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+		rec := do(c, h, "GET", "/a", nil)
+		assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+		assert.Equal(t, "up", rec.Body.String())
+		assert.Equal(t, "HIT", do(c, h, "GET", "/a", nil).Header().Get("X-Cache"))
+		assert.EqualValues(t, 1, calls)
+	})
+}
+
+func TestCache_Negative_ServeStale(t *testing.T) {
+	var results []Result
+	c := New(NewMemory(1<<20), Options{
+		MaxFileSize: 1024,
+		Negative: NegativeOptions{Rules: []NegativeRule{
+			{Statuses: []int{502, 503, 504}, TTL: 5 * time.Second, ServeStale: time.Minute},
+			{Statuses: []int{404}, TTL: 30 * time.Second},
+		}},
+		OnResult: func(_ *http.Request, info ResultInfo) { results = append(results, info.Result) },
+	})
+	seedStale(t, c, "GET", "/a", staleMeta(10*time.Second, 0, 0), []byte("old"))
+
+	var calls int32
+	down := origin(originSpec{status: 503, body: []byte("down")}, &calls)
+	rec := do(c, down, "GET", "/a", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "STALE", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "old", rec.Body.String())
+	rec = do(c, down, "GET", "/a", nil)
+	assert.Equal(t, "old", rec.Body.String(), "the error was not stored over the stale entry")
+	assert.EqualValues(t, 2, calls, "every request still tries the origin")
+
+	gone := origin(originSpec{status: 404, body: []byte("gone")}, &calls)
+	rec = do(c, gone, "GET", "/a", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "a 404 is an answer, not a failure")
+	assert.Equal(t, "HIT", do(c, gone, "GET", "/a", nil).Header().Get("X-Cache"))
+
+	seedStale(t, c, "GET", "/b", staleMeta(2*time.Minute, 0, 0), []byte("old"))
+	rec = do(c, down, "GET", "/b", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "past ServeStale")
+	assert.Equal(t, "HIT", do(c, down, "GET", "/b", nil).Header().Get("X-Cache"))
+
+	assert.Equal(t, []Result{
+		ResultStaleError, ResultStaleError,
+		ResultMiss, ResultNegative,
+		ResultMiss, ResultNegative,
+	}, results)
+}
+
+func TestCache_Negative_DiskRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Cache {
+		d, err := NewDisk(dir, 1<<20)
+		require.NoError(t, err)
+		return New(d, Options{MaxFileSize: 1024, Negative: testNegative})
+	}
+	var calls int32
+	h := origin(originSpec{status: 404, body: []byte(strings.Repeat("x", 10))}, &calls)
+	do(open(), h, "GET", "/a", nil)
+
+	var got Result
+	c := open()
+	c.onResult = func(_ *http.Request, info ResultInfo) { got = info.Result }
+	do(c, h, "GET", "/a", nil)
+	assert.Equal(t, ResultNegative, got, "Meta.Negative persists")
+	assert.EqualValues(t, 1, calls)
+}
@@ -31,8 +31,9 @@ func isUpgrade(r *http.Request) bool {
 }
 
 // cacheableStatus is the set of status codes the cache will store (a conservative
-// subset of the RFC "heuristically cacheable" set; 206/partial is excluded — no
-// Range support). Freshness is still required regardless.
+// subset of the RFC "heuristically cacheable" set). 206 is excluded: ranges are
+// cut from a stored full 200, and slice mode stores its 206 slices under their
+// own keys. Freshness is still required regardless.
 func cacheableStatus(code int) bool {
 	switch code {
 	case 200, 203, 204, 300, 301, 308, 404, 410:
@@ -55,6 +56,8 @@ type decision struct {
 	// noStale reports that the response forbids serving stale (must-revalidate /
 	// proxy-revalidate), so operator-configured default windows must not apply.
 	noStale bool
+	// negative reports an error response stored under Options.Negative.
+	negative bool
 }
 
 // decide applies the honor-origin policy to an origin response. method is the
@@ -186,6 +189,12 @@ func storeRefusals(status int, h http.Header) (vary []string, ok bool) {
 	if !cacheableStatus(status) {
 		return nil, false
 	}
+	return headerRefusals(h)
+}
+
+// headerRefusals is storeRefusals without the status check, shared with negative
+// caching, which stores statuses cacheableStatus refuses.
+func headerRefusals(h http.Header) (vary []string, ok bool) {
 	if len(h.Values("Set-Cookie")) > 0 {
 		return nil, false
 	}
@@ -0,0 +1,270 @@
+package purge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClusterTimeout = 5 * time.Second
+	defaultMaxSkew        = 5 * time.Second
+	seenIDs               = 1 << 14 // message IDs remembered for deduplication
+)
+
+// Message is a batch of purges propagated between replicas. ID makes delivery
+// idempotent: a replica applies each ID once, however often it arrives. Origin
+// names the replica that issued it, which ignores its own messages.
+type Message struct {
+	ID     string `json:"id"`
+	Origin string `json:"origin"`
+	Ops    []Op   `json:"ops"`
+}
+
+// Transport carries messages from a Cluster to its peers. Deliveries may repeat
+// (the Cluster deduplicates them) and may include the sender.
+type Transport interface {
+	// Publish delivers msg to every peer, or returns an error when it may not
+	// have reached them all.
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Listener is an optional Transport extension for transports that receive by
+// subscription (see PubSubTransport); Cluster.Run drives it. A transport without
+// it delivers to the peers' Cluster.ServeHTTP instead.
+type Listener interface {
+	// Listen calls deliver with each message received, until ctx is done or the
+	// subscription fails.
+	Listen(ctx context.Context, deliver func(Message)) error
+}
+
+// SnapshotSource supplies the purge state a replica catches up from
+// (Cluster.CatchUp); HTTPPeers fetches it from its peers.
+type SnapshotSource interface {
+	Snapshot(ctx context.Context) (Snapshot, error)
+}
+
+// ClusterOptions configures a Cluster.
+type ClusterOptions struct {
+	// Name identifies this replica in the messages it sends; "" picks a random
+	// one. Replicas must not share a name.
+	Name string
+
+	// Token is the bearer token peers present to ServeHTTP; Authorize, when set,
+	// replaces the check. With neither, ServeHTTP refuses every request.
+	Token     string
+	Authorize func(r *http.Request) bool
+
+	// Timeout bounds one Publish; <= 0 means 5s.
+	Timeout time.Duration
+
+	// MaxSkew is the clock difference between replicas CatchUp tolerates; <= 0
+	// means 5s. See CatchUp.
+	MaxSkew time.Duration
+
+	// OnError observes a message that failed to apply; nil ignores it.
+	OnError func(error)
+}
+
+// Cluster propagates purges across replicas, each with its own Table. Apply
+// purges the local table and publishes the ops through a Transport; a peer
+// receiving them (Receive, through ServeHTTP or a Listener) applies them to its
+// own table.
+//
+// A received purge is stamped with the receiver's clock at receipt, never the
+// sender's: the purge was issued before it arrived, so the receiver's stamp
+// covers everything it cached beforehand however far the two clocks disagree.
+// Deduplicating by message ID keeps a redelivered message from purging again
+// what the receiver has cached since.
+//
+// A replica that was offline missed the messages sent meanwhile; CatchUp merges
+// a peer's Snapshot into its table.
+type Cluster struct {
+	table     *Table
+	transport Transport
+	name      string
+	token     string
+	authorize func(*http.Request) bool
+	timeout   time.Duration
+	maxSkew   time.Duration
+	onError   func(error)
+
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string // ring of the IDs in seen, oldest at next
+	next  int
+}
+
+// NewCluster creates a Cluster purging t and publishing through tr.
+func NewCluster(t *Table, tr Transport, opts ClusterOptions) *Cluster {
+	c := &Cluster{
+		table:     t,
+		transport: tr,
+		name:      opts.Name,
+		token:     opts.Token,
+		authorize: opts.Authorize,
+		timeout:   opts.Timeout,
+		maxSkew:   opts.MaxSkew,
+		onError:   opts.OnError,
+		seen:      map[string]struct{}{},
+	}
+	if c.name == "" {
+		c.name = randomID()
+	}
+	if c.timeout <= 0 {
+		c.timeout = defaultClusterTimeout
+	}
+	if c.maxSkew <= 0 {
+		c.maxSkew = defaultMaxSkew
+	}
+	return c
+}
+
+// Apply purges the local table, then publishes ops to the peers. An invalid op
+// fails the batch before anything is purged or sent; a publish error is returned
+// after the local purge has taken effect.
+func (c *Cluster) Apply(ops ...Op) error {
+	if err := c.table.Apply(ops...); err != nil {
+		return err
+	}
+	msg := Message{ID: randomID(), Origin: c.name, Ops: ops}
+	c.markSeen(msg.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.transport.Publish(ctx, msg); err != nil {
+		return fmt.Errorf("purge: propagate: %w", err)
+	}
+	return nil
+}
+
+// Receive applies a message from a peer, unless it is this replica's own or was
+// already received.
+func (c *Cluster) Receive(msg Message) error {
+	if msg.ID == "" {
+		return fmt.Errorf("%w: message without id", ErrInvalidOp)
+	}
+	if msg.Origin == c.name || !c.markSeen(msg.ID) {
+		return nil
+	}
+	return c.table.Apply(msg.Ops...)
+}
+
+// markSeen records id and reports whether it is new. The oldest ID is forgotten
+// once seenIDs are remembered, long after any redelivery.
+func (c *Cluster) markSeen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[id]; ok {
+		return false
+	}
+	if len(c.order) < seenIDs {
+		c.order = append(c.order, id)
+	} else {
+		delete(c.seen, c.order[c.next])
+		c.order[c.next] = id
+		c.next = (c.next + 1) % seenIDs
+	}
+	c.seen[id] = struct{}{}
+	return true
+}
+
+// Run receives from a Listener transport until ctx is done, returning its error.
+// It returns nil at once for a transport without Listener.
+func (c *Cluster) Run(ctx context.Context) error {
+	l, ok := c.transport.(Listener)
+	if !ok {
+		return nil
+	}
+	return l.Listen(ctx, func(msg Message) {
+		if err := c.Receive(msg); err != nil && c.onError != nil {
+			c.onError(err)
+		}
+	})
+}
+
+// CatchUp merges the purge state from src into the local table, for a replica
+// that was offline. Start receiving first (mount ServeHTTP, or Run), so no
+// message falls between the snapshot and the first delivery.
+//
+// The snapshot's epochs are on the peers' clocks, so each is moved MaxSkew later
+// to cover a peer clock running behind this one, then capped at this replica's
+// now so a peer clock running ahead can't invalidate future fills.
+func (c *Cluster) CatchUp(ctx context.Context, src SnapshotSource) error {
+	s, err := src.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	c.table.Merge(s.shifted(int64(c.maxSkew), c.table.nowNanos()))
+	return nil
+}
+
+// ServeHTTP is the peer endpoint: POST delivers a JSON Message (HTTPPeers
+// publishes to it) and GET returns the table's Snapshot (HTTPPeers catches up
+// from it). Requests are authenticated like Handler's.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, c.token, c.authorize) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(c.table.Snapshot())
+	case http.MethodPost:
+		var msg Message
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.Receive(msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shifted returns a copy of s with every epoch moved d later, capped at now.
+func (s Snapshot) shifted(d, now int64) Snapshot {
+	shift := func(e int64) int64 {
+		if e <= 0 {
+			return e
+		}
+		return min(e+d, now)
+	}
+	shiftMap := func(m map[string]int64) map[string]int64 {
+		out := make(map[string]int64, len(m))
+		for k, v := range m {
+			out[k] = shift(v)
+		}
+		return out
+	}
+	out := Snapshot{
+		Global: shift(s.Global),
+		Host:   shiftMap(s.Host),
+		URL:    shiftMap(s.URL),
+		Tag:    shiftMap(s.Tag),
+		Prefix: make(map[string][]PrefixRec, len(s.Prefix)),
+	}
+	for h, recs := range s.Prefix {
+		for _, p := range recs {
+			out.Prefix[h] = append(out.Prefix[h], PrefixRec{Prefix: p.Prefix, Epoch: shift(p.Epoch)})
+		}
+	}
+	return out
+}
+
+func randomID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
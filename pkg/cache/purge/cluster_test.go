@@ -0,0 +1,183 @@
+package purge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPeers starts one Cluster endpoint per table, all sharing one HTTPPeers list
+// that includes each replica itself.
+func newPeers(t *testing.T, tables ...*Table) ([]*Cluster, *HTTPPeers) {
+	t.Helper()
+	peers := &HTTPPeers{Token: "k"}
+	clusters := make([]*Cluster, len(tables))
+	for i, tbl := range tables {
+		clusters[i] = NewCluster(tbl, peers, ClusterOptions{Token: "k"})
+		srv := httptest.NewServer(clusters[i])
+		t.Cleanup(srv.Close)
+		peers.Peers = append(peers.Peers, srv.URL)
+	}
+	return clusters, peers
+}
+
+func TestCluster_HTTPPeers(t *testing.T) {
+	a, b, c := New(), New(), New()
+	fixedClock(a, 5000)
+	fixedClock(b, 1000) // behind the sender
+	fixedClock(c, 9000) // ahead of it
+	clusters, _ := newPeers(t, a, b, c)
+
+	require.NoError(t, clusters[0].Apply(Op{Scope: ScopeURL, Host: "x.com", Path: "/p"}, Op{Scope: ScopeTag, Tag: "t"}))
+	assert.EqualValues(t, 5000, epochFor(a, "GET", "http://x.com/p"))
+	assert.EqualValues(t, 1000, epochFor(b, "GET", "http://x.com/p"), "stamped with the receiver's clock")
+	assert.EqualValues(t, 9000, epochFor(c, "GET", "http://x.com/p"))
+	assert.EqualValues(t, 9000, c.InvalidatedAfterMeta(cache.Meta{Host: "y.com", Tags: []string{"t"}}))
+
+	assert.ErrorIs(t, clusters[1].Apply(Op{Scope: ScopeHost}), ErrInvalidOp)
+	assert.Zero(t, a.Stats().HostRecs+b.Stats().HostRecs, "an invalid op is neither applied nor sent")
+}
+
+func TestCluster_ReceiveIdempotent(t *testing.T) {
+	tbl := New()
+	c := NewCluster(tbl, &HTTPPeers{}, ClusterOptions{Name: "me"})
+	msg := Message{ID: "m1", Origin: "peer", Ops: []Op{{Scope: ScopeHost, Host: "x.com"}}}
+
+	fixedClock(tbl, 1000)
+	require.NoError(t, c.Receive(msg))
+	fixedClock(tbl, 2000)
+	require.NoError(t, c.Receive(msg))
+	assert.EqualValues(t, 1000, epochFor(tbl, "GET", "http://x.com/"), "a redelivery doesn't purge again")
+
+	require.NoError(t, c.Receive(Message{ID: "m2", Origin: "me", Ops: []Op{{Scope: ScopeAll}}}))
+	assert.Zero(t, tbl.Stats().Global, "its own message")
+	assert.ErrorIs(t, c.Receive(Message{Origin: "peer", Ops: []Op{{Scope: ScopeAll}}}), ErrInvalidOp)
+}
+
+func TestCluster_MarkSeenBounded(t *testing.T) {
+	c := NewCluster(New(), &HTTPPeers{}, ClusterOptions{})
+	for i := range seenIDs + 10 {
+		assert.True(t, c.markSeen(time.Unix(0, int64(i)).String()))
+	}
+	assert.Len(t, c.seen, seenIDs)
+	assert.True(t, c.markSeen(time.Unix(0, 0).String()), "the oldest was forgotten")
+	assert.False(t, c.markSeen(time.Unix(0, int64(seenIDs+9)).String()))
+}
+
+func TestHTTPPeers_Retries(t *testing.T) {
+	var failing, refusing atomic.Int32
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Add(1) < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer fail.Close()
+	refuse := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refusing.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer refuse.Close()
+
+	p := &HTTPPeers{Peers: []string{fail.URL}}
+	require.NoError(t, p.Publish(context.Background(), Message{ID: "m"}))
+	assert.EqualValues(t, 2, failing.Load(), "a 5xx is retried")
+
+	tbl := New()
+	c := NewCluster(tbl, &HTTPPeers{Peers: []string{refuse.URL, fail.URL}}, ClusterOptions{})
+	err := c.Apply(Op{Scope: ScopeAll})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), refuse.URL)
+	assert.EqualValues(t, 1, refusing.Load(), "a 4xx is not retried")
+	assert.Positive(t, tbl.Stats().Global, "purged locally regardless")
+}
+
+// memPubSub is an in-process PubSub delivering to every subscriber, the
+// publisher included.
+type memPubSub struct {
+	mu   sync.Mutex
+	subs map[string][]func([]byte)
+}
+
+func (p *memPubSub) Publish(_ context.Context, channel string, payload []byte) error {
+	p.mu.Lock()
+	subs := p.subs[channel]
+	p.mu.Unlock()
+	for _, fn := range subs {
+		fn(payload)
+	}
+	return nil
+}
+
+func (p *memPubSub) Subscribe(ctx context.Context, channel string, fn func([]byte)) error {
+	p.mu.Lock()
+	if p.subs == nil {
+		p.subs = map[string][]func([]byte){}
+	}
+	p.subs[channel] = append(p.subs[channel], fn)
+	p.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (p *memPubSub) subscribers(channel string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.subs[channel])
+}
+
+func TestCluster_PubSub(t *testing.T) {
+	ps := &memPubSub{}
+	tr := &PubSubTransport{PubSub: ps}
+	a, b := New(), New()
+	ca, cb := NewCluster(a, tr, ClusterOptions{}), NewCluster(b, tr, ClusterOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, c := range []*Cluster{ca, cb} {
+		go c.Run(ctx)
+	}
+	require.Eventually(t, func() bool { return ps.subscribers(defaultPubSubChannel) == 2 }, time.Second, time.Millisecond)
+
+	fixedClock(a, 1000)
+	fixedClock(b, 2000)
+	require.NoError(t, ca.Apply(Op{Scope: ScopePrefix, Host: "x.com", Path: "/blog"}))
+	assert.EqualValues(t, 1000, epochFor(a, "GET", "http://x.com/blog/1"), "its own echo is ignored")
+	assert.EqualValues(t, 2000, epochFor(b, "GET", "http://x.com/blog/1"))
+}
+
+func TestCluster_CatchUp(t *testing.T) {
+	peer := New()
+	fixedClock(peer, 1000)
+	peer.PurgeHost("a.com")
+	fixedClock(peer, 50_000)
+	peer.PurgeTag("t")
+	_, peers := newPeers(t, peer)
+
+	offline := New()
+	fixedClock(offline, 3000)
+	offline.PurgeHost("b.com")
+	fixedClock(offline, 10_000)
+	c := NewCluster(offline, peers, ClusterOptions{MaxSkew: 500 * time.Nanosecond})
+	require.NoError(t, c.CatchUp(context.Background(), peers))
+
+	assert.EqualValues(t, 1500, epochFor(offline, "GET", "http://a.com/"), "moved MaxSkew later")
+	assert.EqualValues(t, 3000, epochFor(offline, "GET", "http://b.com/"), "its own records kept")
+	st := offline.Snapshot()
+	assert.EqualValues(t, 10_000, st.Tag["t"], "capped at its own now")
+
+	down := &HTTPPeers{Peers: []string{"http://127.0.0.1:1"}}
+	assert.Error(t, c.CatchUp(context.Background(), down))
+
+	unauth := httptest.NewRecorder()
+	NewCluster(peer, peers, ClusterOptions{Token: "k"}).ServeHTTP(unauth, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, unauth.Code)
+}
@@ -1,6 +1,8 @@
 package purge_test
 
 import (
+	"context"
+	"net/http"
 	"time"
 
 	"github.com/moonrhythm/parapet/pkg/cache"
@@ -33,3 +35,23 @@ func ExampleTable() {
 		}
 	}()
 }
+
+// Serve an authenticated purge API whose purges reach every replica.
+func ExampleCluster() {
+	pt := purge.New()
+	peers := &purge.HTTPPeers{
+		Peers: []string{"http://10.0.0.1:9000/purge/peer", "http://10.0.0.2:9000/purge/peer"},
+		Token: "peer-secret",
+	}
+	cl := purge.NewCluster(pt, peers, purge.ClusterOptions{Token: "peer-secret"})
+
+	admin := http.NewServeMux()
+	admin.Handle("/purge/peer", cl)                              // peers deliver purges and read snapshots here
+	admin.Handle("/purge", purge.NewHandler(cl, "admin-secret")) // operators purge here, cluster-wide
+	go http.ListenAndServe(":9000", admin)
+
+	// Back from downtime: pick up the purges the peers applied meanwhile.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_ = cl.CatchUp(ctx, peers)
+}
@@ -0,0 +1,174 @@
+package purge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// MethodPurge is the request method the Handler answers with a purge of the
+// request's own URL.
+const MethodPurge = "PURGE"
+
+const (
+	defaultMaxBatch = 1000
+	maxBatchBody    = 1 << 20
+)
+
+// Handler is an authenticated purge endpoint over a Purger (a Table, or a Cluster
+// to propagate). It answers two forms:
+//
+//   - PURGE <url> purges that URL on the request's Host. An X-Purge-Scope header
+//     widens it: "prefix" (the URL's path), "host", "tag" (each surrogate key
+//     listed in the request's Cache-Tag header, any host) or "all".
+//   - POST with a JSON body {"purges": [Op, ...]} applies a batch, e.g.
+//     {"purges": [{"scope": "tag", "tag": "product-42"}]}.
+//
+// Either replies 200 with {"purged": n}, or an error status with {"error": "..."}:
+// 400 for an invalid op (nothing purged), 413 for an oversized batch, and 502 when
+// a Cluster purged locally but failed to reach a peer.
+//
+// A request must carry "Authorization: Bearer <Token>", or pass Authorize when it
+// is set; with neither configured every request is refused. Mount it on an admin
+// listener or path, or use ServeHandler to intercept PURGE in front of the cache.
+type Handler struct {
+	Purger Purger
+
+	// Token is the bearer token a request must present.
+	Token string
+
+	// Authorize, when set, replaces the Token check.
+	Authorize func(r *http.Request) bool
+
+	// MaxBatch bounds the ops in one request; <= 0 means 1000.
+	MaxBatch int
+}
+
+// NewHandler creates a Handler purging p, authenticated by the bearer token.
+func NewHandler(p Purger, token string) *Handler {
+	return &Handler{Purger: p, Token: token}
+}
+
+type handlerResult struct {
+	Purged int    `json:"purged"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchRequest struct {
+	Purges []Op `json:"purges"`
+}
+
+// ServeHandler implements middleware interface: PURGE requests are answered by
+// the Handler, everything else passes through to h.
+func (m *Handler) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != MethodPurge {
+			h.ServeHTTP(w, r)
+			return
+		}
+		m.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, m.Token, m.Authorize) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeResult(w, http.StatusUnauthorized, handlerResult{Error: "unauthorized"})
+		return
+	}
+
+	var (
+		ops []Op
+		err error
+	)
+	switch r.Method {
+	case MethodPurge:
+		ops, err = requestOps(r)
+	case http.MethodPost:
+		var req batchRequest
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req)
+		ops = req.Purges
+	default:
+		w.Header().Set("Allow", "POST, PURGE")
+		writeResult(w, http.StatusMethodNotAllowed, handlerResult{Error: "method not allowed"})
+		return
+	}
+	if err != nil {
+		code := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		writeResult(w, code, handlerResult{Error: err.Error()})
+		return
+	}
+	maxBatch := m.MaxBatch
+	if maxBatch <= 0 {
+		maxBatch = defaultMaxBatch
+	}
+	if len(ops) > maxBatch {
+		writeResult(w, http.StatusRequestEntityTooLarge, handlerResult{Error: "too many purges"})
+		return
+	}
+
+	if err := m.Purger.Apply(ops...); err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, ErrInvalidOp) {
+			code = http.StatusBadRequest
+		}
+		writeResult(w, code, handlerResult{Error: err.Error()})
+		return
+	}
+	writeResult(w, http.StatusOK, handlerResult{Purged: len(ops)})
+}
+
+// requestOps builds the ops of a PURGE request from its URL and X-Purge-Scope.
+func requestOps(r *http.Request) ([]Op, error) {
+	switch scope := Scope(strings.ToLower(r.Header.Get("X-Purge-Scope"))); scope {
+	case "", ScopeURL:
+		return []Op{{Scope: ScopeURL, Host: r.Host, Path: r.URL.RequestURI()}}, nil
+	case ScopePrefix:
+		return []Op{{Scope: ScopePrefix, Host: r.Host, Path: r.URL.Path}}, nil
+	case ScopeHost:
+		return []Op{{Scope: ScopeHost, Host: r.Host}}, nil
+	case ScopeAll:
+		return []Op{{Scope: ScopeAll}}, nil
+	case ScopeTag:
+		var ops []Op
+		for _, v := range r.Header.Values("Cache-Tag") {
+			for _, tag := range strings.Split(v, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					ops = append(ops, Op{Scope: ScopeTag, Tag: tag})
+				}
+			}
+		}
+		if len(ops) == 0 {
+			return nil, errors.New("purge: no Cache-Tag to purge")
+		}
+		return ops, nil
+	default:
+		return nil, errors.New("purge: unknown X-Purge-Scope " + string(scope))
+	}
+}
+
+// authorized reports whether r passes authorize, or, without one, presents token
+// as its bearer token. With neither configured nothing is authorized.
+func authorized(r *http.Request, token string, authorize func(*http.Request) bool) bool {
+	if authorize != nil {
+		return authorize(r)
+	}
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeResult(w http.ResponseWriter, code int, res handlerResult) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,110 @@
+package purge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/moonrhythm/parapet/pkg/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func purgeReq(method, target, body string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler_Auth(t *testing.T) {
+	tbl := New()
+	assert.Equal(t, http.StatusUnauthorized, serve(&Handler{Purger: tbl}, purgeReq(MethodPurge, "http://a.com/x", "", "Authorization", "Bearer ")).Code,
+		"no token configured refuses everything")
+
+	h := NewHandler(tbl, "s3cret")
+	assert.Equal(t, http.StatusUnauthorized, serve(h, purgeReq(MethodPurge, "http://a.com/x", "")).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(h, purgeReq(MethodPurge, "http://a.com/x", "", "Authorization", "Bearer wrong")).Code)
+	assert.False(t, tbl.active.Load(), "nothing purged")
+
+	w := serve(h, purgeReq(MethodPurge, "http://a.com/x", "", "Authorization", "Bearer s3cret"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"purged":1}`, w.Body.String())
+
+	h.Authorize = func(r *http.Request) bool { return r.Header.Get("X-Admin") == "1" }
+	assert.Equal(t, http.StatusUnauthorized, serve(h, purgeReq(MethodPurge, "http://a.com/x", "", "Authorization", "Bearer s3cret")).Code,
+		"Authorize replaces the token")
+	assert.Equal(t, http.StatusOK, serve(h, purgeReq(MethodPurge, "http://a.com/x", "", "X-Admin", "1")).Code)
+}
+
+func TestHandler_PurgeMethod(t *testing.T) {
+	tbl := New()
+	h := NewHandler(tbl, "k")
+	auth := []string{"Authorization", "Bearer k"}
+
+	fixedClock(tbl, 1000)
+	assert.Equal(t, http.StatusOK, serve(h, purgeReq(MethodPurge, "http://a.com/p?x=1", "", auth...)).Code)
+	assert.EqualValues(t, 1000, epochFor(tbl, "GET", "http://a.com/p?x=1"))
+	assert.EqualValues(t, 0, epochFor(tbl, "GET", "http://a.com/p"), "the URL includes its query")
+
+	fixedClock(tbl, 2000)
+	serve(h, purgeReq(MethodPurge, "http://a.com/blog/", "", append(auth, "X-Purge-Scope", "prefix")...))
+	assert.EqualValues(t, 2000, epochFor(tbl, "GET", "http://a.com/blog/post"))
+	assert.EqualValues(t, 0, epochFor(tbl, "GET", "http://a.com/blogger"))
+
+	fixedClock(tbl, 3000)
+	w := serve(h, purgeReq(MethodPurge, "http://a.com/", "", append(auth, "X-Purge-Scope", "tag", "Cache-Tag", "t1, t2", "Cache-Tag", "t3")...))
+	assert.JSONEq(t, `{"purged":3}`, w.Body.String())
+	assert.EqualValues(t, 3000, tbl.InvalidatedAfterMeta(cache.Meta{Host: "b.com", URI: "/", Tags: []string{"t3"}}))
+
+	assert.Equal(t, http.StatusBadRequest, serve(h, purgeReq(MethodPurge, "http://a.com/", "", append(auth, "X-Purge-Scope", "tag")...)).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(h, purgeReq(MethodPurge, "http://a.com/", "", append(auth, "X-Purge-Scope", "bogus")...)).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(h, purgeReq("GET", "http://a.com/", "", auth...)).Code)
+}
+
+func TestHandler_Batch(t *testing.T) {
+	tbl := New()
+	fixedClock(tbl, 1000)
+	h := NewHandler(tbl, "k")
+	h.MaxBatch = 3
+	auth := []string{"Authorization", "Bearer k"}
+
+	w := serve(h, purgeReq("POST", "/purge", `{"purges":[
+		{"scope":"url","host":"a.com","path":"/a"},
+		{"scope":"host","host":"b.com"},
+		{"scope":"tag","tag":"t"}]}`, auth...))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"purged":3}`, w.Body.String())
+	assert.EqualValues(t, 1000, epochFor(tbl, "GET", "http://a.com/a"))
+	assert.EqualValues(t, 1000, epochFor(tbl, "GET", "http://b.com/z"))
+
+	fixedClock(tbl, 2000)
+	w = serve(h, purgeReq("POST", "/purge", `{"purges":[{"scope":"host","host":"c.com"},{"scope":"url","host":"c.com"}]}`, auth...))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid op")
+	assert.EqualValues(t, 0, epochFor(tbl, "GET", "http://c.com/"), "an invalid op fails the whole batch")
+
+	assert.Equal(t, http.StatusBadRequest, serve(h, purgeReq("POST", "/purge", `{`, auth...)).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve(h, purgeReq("POST", "/purge",
+		`{"purges":[{"scope":"all"},{"scope":"all"},{"scope":"all"},{"scope":"all"}]}`, auth...)).Code)
+	assert.Zero(t, tbl.Stats().Global)
+}
+
+func TestHandler_ServeHandler(t *testing.T) {
+	tbl := New()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	h := NewHandler(tbl, "k").ServeHandler(next)
+
+	assert.Equal(t, http.StatusTeapot, serve(h, purgeReq("GET", "http://a.com/x", "")).Code)
+	assert.Equal(t, http.StatusTeapot, serve(h, purgeReq("POST", "http://a.com/x", "{}")).Code, "only PURGE is intercepted")
+	assert.Equal(t, http.StatusUnauthorized, serve(h, purgeReq(MethodPurge, "http://a.com/x", "")).Code, "never reaches the origin")
+	assert.Equal(t, http.StatusOK, serve(h, purgeReq(MethodPurge, "http://a.com/x", "", "Authorization", "Bearer k")).Code)
+	assert.Positive(t, epochFor(tbl, "GET", "http://a.com/x"))
+}
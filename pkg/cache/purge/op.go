@@ -0,0 +1,81 @@
+package purge
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidOp is returned (wrapped) for an Op with an unknown scope or a missing
+// target.
+var ErrInvalidOp = errors.New("purge: invalid op")
+
+// Scope selects what an Op invalidates.
+type Scope string
+
+// Scopes, one per Table purge method.
+const (
+	ScopeURL    Scope = "url"    // PurgeURL(Host, Path)
+	ScopePrefix Scope = "prefix" // PurgePrefix(Host, Path)
+	ScopeHost   Scope = "host"   // PurgeHost(Host)
+	ScopeTag    Scope = "tag"    // PurgeTag(Tag)
+	ScopeAll    Scope = "all"    // FlushAll()
+)
+
+// Op is one purge as data: the unit the Handler accepts and a Cluster propagates.
+// Path is the request-uri for ScopeURL and the path prefix for ScopePrefix.
+type Op struct {
+	Scope Scope  `json:"scope"`
+	Host  string `json:"host,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+}
+
+// Purger applies purge ops. A Table applies them locally; a Cluster also
+// propagates them to its peers.
+type Purger interface {
+	Apply(ops ...Op) error
+}
+
+// validate reports whether op names a known scope and carries its target.
+func (op Op) validate() error {
+	var ok bool
+	switch op.Scope {
+	case ScopeURL, ScopePrefix:
+		ok = normHost(op.Host) != "" && op.Path != ""
+	case ScopeHost:
+		ok = normHost(op.Host) != ""
+	case ScopeTag:
+		ok = op.Tag != ""
+	case ScopeAll:
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("%w: %+v", ErrInvalidOp, op)
+	}
+	return nil
+}
+
+// Apply validates every op, then applies them in order; an invalid op fails the
+// batch before anything is purged.
+func (t *Table) Apply(ops ...Op) error {
+	for _, op := range ops {
+		if err := op.validate(); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		switch op.Scope {
+		case ScopeURL:
+			t.PurgeURL(op.Host, op.Path)
+		case ScopePrefix:
+			t.PurgePrefix(op.Host, op.Path)
+		case ScopeHost:
+			t.PurgeHost(op.Host)
+		case ScopeTag:
+			t.PurgeTag(op.Tag)
+		case ScopeAll:
+			t.FlushAll()
+		}
+	}
+	return nil
+}
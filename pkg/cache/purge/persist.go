@@ -0,0 +1,293 @@
+package purge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	snapshotFile        = "purge.snapshot"
+	journalFile         = "purge.journal"
+	defaultCompactEvery = 1024
+)
+
+// PersistOptions configures WithPersistence.
+type PersistOptions struct {
+	// CompactEvery is the number of journaled purges after which the table is
+	// compacted into the snapshot file and the journal emptied; <= 0 means 1024.
+	CompactEvery int
+
+	// OnError observes a persistence failure (a journal write, a compaction, an
+	// unreadable state on New); nil ignores it. A purge always takes effect in
+	// memory, whether or not it could be persisted.
+	OnError func(error)
+}
+
+// WithPersistence makes the table durable in dir, created if missing: New
+// restores the state persisted there, and every purge is then appended to a
+// journal (fsync'd before the purge method returns) that is periodically
+// compacted into a snapshot file, written to a temp file, fsync'd and renamed
+// into place. A crash loses at most the purge being written; a journal line torn
+// by it is skipped on restore.
+//
+// State that can't be read back is never silently dropped: New reports it to
+// OnError and flushes everything instead (over-invalidation, never a purged entry
+// served again). One directory serves one table.
+func WithPersistence(dir string, opts PersistOptions) Option {
+	return func(t *Table) {
+		t.journal = &journal{dir: dir, every: opts.CompactEvery, onError: opts.OnError}
+		if t.journal.every <= 0 {
+			t.journal.every = defaultCompactEvery
+		}
+	}
+}
+
+// journalRec is one journaled purge, in the table's stored form: Key is the
+// normalized host (host and prefix scopes), the url key, or the tag.
+type journalRec struct {
+	Scope  Scope  `json:"s"`
+	Key    string `json:"k,omitempty"`
+	Prefix string `json:"p,omitempty"`
+	Epoch  int64  `json:"e"`
+}
+
+// journal persists a Table: its snapshot file plus the purges since.
+type journal struct {
+	dir     string
+	every   int
+	onError func(error)
+
+	mu sync.Mutex
+	f  *os.File // append-only; nil until opened, or after Close
+	n  int      // records appended since the last compaction
+}
+
+func (j *journal) fail(err error) {
+	if j.onError != nil {
+		j.onError(err)
+	}
+}
+
+func (j *journal) snapshotPath() string { return filepath.Join(j.dir, snapshotFile) }
+func (j *journal) journalPath() string  { return filepath.Join(j.dir, journalFile) }
+
+// open restores t from dir, then opens the journal and compacts the restored
+// state into a fresh snapshot, which also drops any torn tail. On failure to
+// open, t runs unpersisted.
+func (j *journal) open(t *Table) {
+	if err := os.MkdirAll(j.dir, 0o755); err != nil {
+		j.fail(fmt.Errorf("purge: persistence disabled: %w", err))
+		return
+	}
+	if err := j.load(t); err != nil {
+		j.fail(fmt.Errorf("purge: restore failed, flushing everything: %w", err))
+		t.FlushAll() // not journaled yet: the compaction below persists it
+	}
+	f, err := os.OpenFile(j.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		j.fail(fmt.Errorf("purge: persistence disabled: %w", err))
+		return
+	}
+	j.f = f
+	t.compact()
+}
+
+// load restores the snapshot file, then replays the journal over it.
+func (j *journal) load(t *Table) error {
+	b, err := os.ReadFile(j.snapshotPath())
+	switch {
+	case err == nil:
+		var s Snapshot
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("%s: %w", snapshotFile, err)
+		}
+		t.Restore(s)
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	f, err := os.Open(j.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return nil // a line without its newline was torn by a crash mid-append
+		}
+		if err != nil {
+			return err
+		}
+		var rec journalRec
+		if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			return fmt.Errorf("%s: %w", journalFile, err)
+		}
+		t.replayLocked(rec)
+	}
+}
+
+// replayLocked applies a journaled purge at its recorded epoch. Records may be
+// out of epoch order (purges are journaled after their stamp, concurrently), so
+// every scope keeps the max. Caller holds t.mu.
+func (t *Table) replayLocked(r journalRec) {
+	keepMax := func(m map[string]int64) {
+		if r.Epoch > m[r.Key] {
+			m[r.Key] = r.Epoch
+		}
+	}
+	switch r.Scope {
+	case ScopeAll:
+		t.global = max(t.global, r.Epoch)
+	case ScopeHost:
+		keepMax(t.host)
+	case ScopeURL:
+		keepMax(t.url)
+	case ScopeTag:
+		keepMax(t.tag)
+	case ScopePrefix:
+		t.applyPrefixLocked(r.Key, r.Prefix, r.Epoch)
+	}
+	if r.Epoch > t.highWater {
+		t.highWater = r.Epoch
+	}
+	if t.highWater > 0 {
+		t.active.Store(true)
+	}
+	t.enforceCapLocked()
+}
+
+// record journals one purge, compacting every CompactEvery records. It runs
+// after the purge's lock is released, so lookups never wait on the fsync.
+func (t *Table) record(r journalRec) {
+	j := t.journal
+	if j == nil {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return
+	}
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		j.fail(err)
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		j.fail(err)
+		return
+	}
+	if j.n++; j.n >= j.every {
+		t.compactLocked()
+	}
+}
+
+// compact writes the table's state to the snapshot file and empties the journal.
+func (t *Table) compact() {
+	j := t.journal
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f != nil {
+		t.compactLocked()
+	}
+}
+
+// compactLocked is compact with j.mu held. Holding it keeps a purge stamped
+// before the snapshot from being journaled after the truncate; a purge stamped
+// after it lands in the emptied journal. A crash between the rename and the
+// truncate only replays records the snapshot already holds.
+func (t *Table) compactLocked() {
+	j := t.journal
+	b, err := json.Marshal(t.Snapshot())
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	if err := writeFileAtomic(j.snapshotPath(), b); err != nil {
+		j.fail(err)
+		return
+	}
+	if err := j.f.Truncate(0); err != nil {
+		j.fail(err)
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		j.fail(err)
+		return
+	}
+	j.n = 0
+}
+
+// Close compacts a persisted table and closes its journal; later purges take
+// effect in memory only. It is a no-op for a table without persistence.
+func (t *Table) Close() error {
+	j := t.journal
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	t.compactLocked()
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// writeFileAtomic writes data to a temp file beside path, fsyncs it, renames it
+// over path and fsyncs the directory — the discipline cache.DiskStorage uses for
+// its entries — so path holds either the old or the new content after a crash.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
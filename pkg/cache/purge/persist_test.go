@@ -0,0 +1,141 @@
+package purge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func journalLines(t *testing.T, dir string) int {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, journalFile))
+	require.NoError(t, err)
+	return strings.Count(string(b), "\n")
+}
+
+func TestPersistence_RestoresOnNew(t *testing.T) {
+	dir := t.TempDir()
+	tbl := New(WithPersistence(dir, PersistOptions{}))
+	fixedClock(tbl, 1000)
+	tbl.PurgeHost("a.com")
+	tbl.PurgeURL("b.com", "/p")
+	tbl.PurgePrefix("c.com", "/sec/")
+	tbl.PurgeTag("sku-7")
+	fixedClock(tbl, 2000)
+	tbl.PurgeHost("a.com")
+	assert.Equal(t, 5, journalLines(t, dir), "journaled, not yet compacted")
+
+	// No Close: as if the process died.
+	got := New(WithPersistence(dir, PersistOptions{}))
+	assert.EqualValues(t, 2000, epochFor(got, "GET", "http://a.com/x"))
+	assert.EqualValues(t, 1000, epochFor(got, "GET", "http://b.com/p"))
+	assert.EqualValues(t, 1000, epochFor(got, "GET", "http://c.com/sec/page"))
+	assert.EqualValues(t, 1000, got.InvalidatedAfterMeta(cache.Meta{Tags: []string{"sku-7"}}))
+	assert.Zero(t, journalLines(t, dir), "restored state compacted into the snapshot")
+
+	fixedClock(got, 1)
+	got.PurgeHost("d.com")
+	assert.EqualValues(t, 2000, epochFor(got, "GET", "http://d.com/"), "the monotonic high-water mark survives")
+	require.NoError(t, got.Close())
+}
+
+func TestPersistence_Compacts(t *testing.T) {
+	dir := t.TempDir()
+	tbl := New(WithPersistence(dir, PersistOptions{CompactEvery: 2}))
+	fixedClock(tbl, 1000)
+	tbl.PurgeHost("a.com")
+	tbl.PurgeHost("b.com")
+	assert.Zero(t, journalLines(t, dir))
+	fixedClock(tbl, 3000)
+	tbl.FlushAll()
+	assert.Equal(t, 1, journalLines(t, dir))
+
+	got := New(WithPersistence(dir, PersistOptions{}))
+	assert.EqualValues(t, 3000, epochFor(got, "GET", "http://z.com/"))
+	assert.Equal(t, Stats{Global: 3000, HostRecs: 2}, got.Stats())
+}
+
+func TestPersistence_TornJournalTail(t *testing.T) {
+	dir := t.TempDir()
+	tbl := New(WithPersistence(dir, PersistOptions{}))
+	fixedClock(tbl, 1000)
+	tbl.PurgeHost("a.com")
+	f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, _ = f.WriteString(`{"s":"host","k":"b.c`)
+	f.Close()
+
+	var errs []error
+	got := New(WithPersistence(dir, PersistOptions{OnError: func(err error) { errs = append(errs, err) }}))
+	assert.Empty(t, errs)
+	assert.EqualValues(t, 1000, epochFor(got, "GET", "http://a.com/"))
+	assert.Zero(t, got.Stats().Global)
+}
+
+func TestPersistence_UnreadableStateFlushes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFile), []byte("{not json"), 0o644))
+
+	var errs []error
+	tbl := New(WithPersistence(dir, PersistOptions{OnError: func(err error) { errs = append(errs, err) }}))
+	require.Len(t, errs, 1)
+	assert.Positive(t, tbl.Stats().Global, "everything cached before is invalidated")
+
+	got := New(WithPersistence(dir, PersistOptions{}))
+	assert.Equal(t, tbl.Stats().Global, got.Stats().Global, "and the flush itself is persisted")
+}
+
+func TestPersistence_MergeAndClose(t *testing.T) {
+	dir := t.TempDir()
+	tbl := New(WithPersistence(dir, PersistOptions{}))
+	tbl.Merge(Snapshot{Tag: map[string]int64{"t": 500}})
+	require.NoError(t, tbl.Close())
+	tbl.PurgeTag("after-close") // in memory only
+	require.NoError(t, tbl.Close())
+
+	got := New(WithPersistence(dir, PersistOptions{}))
+	assert.Equal(t, map[string]int64{"t": 500}, got.Snapshot().Tag)
+	assert.NoError(t, New().Close())
+}
+
+func TestPersistence_PurgedDiskEntryStaysPurgedAfterRestart(t *testing.T) {
+	cacheDir, purgeDir := t.TempDir(), t.TempDir()
+	var calls int
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", "1")
+		w.Write([]byte("v"))
+	})
+	boot := func() (http.Handler, *Table) {
+		store, err := cache.NewDisk(cacheDir, 1<<20)
+		require.NoError(t, err)
+		pt := New(WithPersistence(purgeDir, PersistOptions{}))
+		return cache.New(store, cache.Options{MaxFileSize: 1024, InvalidatedAfter: pt.InvalidatedAfter}).ServeHandler(origin), pt
+	}
+	get := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://a.com/x", nil))
+		return w.Header().Get("X-Cache")
+	}
+
+	h, pt := boot()
+	assert.Equal(t, "MISS", get(h))
+	require.NoError(t, pt.Close())
+	h, pt = boot()
+	assert.Equal(t, "HIT", get(h), "the disk entry outlives a restart")
+	time.Sleep(time.Millisecond) // the purge epoch must follow the fill's Created
+	pt.PurgeURL("a.com", "/x")
+
+	h, _ = boot() // restart, the journal not compacted
+	assert.Equal(t, "MISS", get(h), "the purge outlived the restart")
+	assert.Equal(t, 2, calls)
+}
@@ -16,8 +16,12 @@
 //	pt.PurgeTag("product-42")          // invalidate by surrogate key (Cache-Tag), any host
 //	go func() { for range time.Tick(5 * time.Minute) { pt.Reap(store) } }()
 //
-// A Table persists nothing on its own; Snapshot/Restore serialize its state so a
-// caller can keep purges across restarts however it likes.
+// A Table is in-memory unless created WithPersistence, which journals every purge
+// to a directory and restores it on New; Snapshot/Restore serialize its state for
+// callers keeping it elsewhere.
+//
+// Handler serves purges over HTTP (a PURGE method and a JSON batch endpoint), and
+// Cluster propagates them to peer replicas over a pluggable Transport.
 package purge
 
 import (
@@ -68,6 +72,8 @@ type Table struct {
 	highWater int64  // largest epoch ever stamped (monotonic clamp)
 	folds     uint64 // count of conservative cap-folds (for Stats)
 	maxRecs   int
+	journal   *journal            // nil => not persisted (WithPersistence)
+	normURI   func(string) string // nil => uris as given (WithURINormalizer)
 
 	mu sync.RWMutex
 
@@ -99,6 +105,13 @@ func WithMaxRecords(n int) Option {
 	}
 }
 
+// WithURINormalizer normalizes the uri of each PurgeURL and the prefix of each
+// PurgePrefix the way the cache keys requests, so a purge names the entry the
+// cache stored: pass the cache's Options.Key.NormalizeURI.
+func WithURINormalizer(fn func(uri string) string) Option {
+	return func(t *Table) { t.normURI = fn }
+}
+
 // WithClock overrides the clock used to stamp epochs (mainly for tests).
 func WithClock(now func() time.Time) Option {
 	return func(t *Table) { t.now = now }
@@ -116,6 +129,9 @@ func New(opts ...Option) *Table {
 	for _, o := range opts {
 		o(t)
 	}
+	if t.journal != nil {
+		t.journal.open(t)
+	}
 	return t
 }
 
@@ -136,7 +152,9 @@ func (t *Table) FlushAll() {
 	t.url = map[string]int64{}
 	t.prefix = map[string][]PrefixRec{}
 	t.tag = map[string]int64{}
+	rec := journalRec{Scope: ScopeAll, Epoch: t.global}
 	t.mu.Unlock()
+	t.record(rec)
 }
 
 // PurgeHost invalidates every URL cached under host. The host is normalized
@@ -147,9 +165,11 @@ func (t *Table) PurgeHost(host string) {
 		return
 	}
 	t.mu.Lock()
-	t.host[h] = t.stamp()
+	rec := journalRec{Scope: ScopeHost, Key: h, Epoch: t.stamp()}
+	t.host[h] = rec.Epoch
 	t.enforceCapLocked()
 	t.mu.Unlock()
+	t.record(rec)
 }
 
 // PurgeURL invalidates one URL on host across all methods, schemes, and Vary
@@ -160,10 +180,15 @@ func (t *Table) PurgeURL(host, uri string) {
 	if h == "" {
 		return
 	}
+	if t.normURI != nil {
+		uri = t.normURI(uri)
+	}
 	t.mu.Lock()
-	t.url[urlKey(h, uri)] = t.stamp()
+	rec := journalRec{Scope: ScopeURL, Key: urlKey(h, uri), Epoch: t.stamp()}
+	t.url[rec.Key] = rec.Epoch
 	t.enforceCapLocked()
 	t.mu.Unlock()
+	t.record(rec)
 }
 
 // PurgePrefix invalidates every URL under a path prefix on host, on a path
@@ -174,10 +199,15 @@ func (t *Table) PurgePrefix(host, prefix string) {
 	if h == "" {
 		return
 	}
+	if t.normURI != nil {
+		prefix = t.normURI(prefix)
+	}
 	t.mu.Lock()
-	t.applyPrefixLocked(h, normalizePrefix(prefix), t.stamp())
+	rec := journalRec{Scope: ScopePrefix, Key: h, Prefix: normalizePrefix(prefix), Epoch: t.stamp()}
+	t.applyPrefixLocked(rec.Key, rec.Prefix, rec.Epoch)
 	t.enforceCapLocked()
 	t.mu.Unlock()
+	t.record(rec)
 }
 
 // PurgeTag invalidates every cached response carrying the surrogate key tag (from
@@ -187,17 +217,26 @@ func (t *Table) PurgeTag(tag string) {
 		return
 	}
 	t.mu.Lock()
-	t.tag[tag] = t.stamp()
+	rec := journalRec{Scope: ScopeTag, Key: tag, Epoch: t.stamp()}
+	t.tag[tag] = rec.Epoch
 	t.enforceCapLocked()
 	t.mu.Unlock()
+	t.record(rec)
 }
 
 // InvalidatedAfter is the cache.Options.InvalidatedAfter hook: it returns the
 // invalidation epoch (unix nanos) applying to r — the max of the global, per-host,
 // per-url, per-prefix, and (using the stored entry's surrogate keys) per-tag
 // epochs. The cache treats a hit whose Meta.Created is <= this value as stale.
+// The url is the entry's Meta.URI, as the cache keyed it (see cache.KeyOptions),
+// so every request sharing an entry sees the same purges; r's own request-uri
+// stands in for an entry stored without one.
 func (t *Table) InvalidatedAfter(r *http.Request, m cache.Meta) int64 {
-	return t.epochFor(normHost(r.Host), r.URL.RequestURI(), m.Tags)
+	uri := m.URI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	return t.epochFor(normHost(r.Host), uri, m.Tags)
 }
 
 // InvalidatedAfterMeta is the off-request variant used by Reap: it reads the
@@ -356,41 +395,75 @@ func (t *Table) Snapshot() Snapshot {
 // Restore replaces the table's state with a snapshot's (deep-copied), recomputing
 // the monotonic high-water mark and the active gate so a restored purge keeps
 // gating after a restart. Call it before serving, not concurrently with purges.
+// A persisted table writes the restored state through to its snapshot file.
 func (t *Table) Restore(s Snapshot) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
 	t.host = cloneInt64Map(s.Host)
 	t.url = cloneInt64Map(s.URL)
 	t.prefix = clonePrefixMap(s.Prefix)
 	t.tag = cloneInt64Map(s.Tag)
 	t.global = s.Global
-	hw := s.Global
-	for _, v := range t.host {
-		if v > hw {
-			hw = v
+	t.highWater = s.maxEpoch()
+	if t.highWater > 0 {
+		t.active.Store(true)
+	}
+	t.mu.Unlock()
+	t.compact()
+}
+
+// Merge folds a snapshot into the table, keeping the later epoch of each record,
+// so it never un-purges what the table already holds. Unlike Restore it is safe
+// alongside purges and lookups; a Cluster catches a replica up with it.
+func (t *Table) Merge(s Snapshot) {
+	t.mu.Lock()
+	if s.Global > t.global {
+		t.global = s.Global
+	}
+	mergeInt64Map(t.host, s.Host)
+	mergeInt64Map(t.url, s.URL)
+	mergeInt64Map(t.tag, s.Tag)
+	for h, recs := range s.Prefix {
+		for _, p := range recs {
+			t.applyPrefixLocked(h, p.Prefix, p.Epoch)
 		}
 	}
-	for _, v := range t.url {
-		if v > hw {
-			hw = v
+	if hw := s.maxEpoch(); hw > t.highWater {
+		t.highWater = hw
+	}
+	if t.highWater > 0 {
+		t.active.Store(true)
+	}
+	t.enforceCapLocked()
+	t.mu.Unlock()
+	t.compact()
+}
+
+// maxEpoch returns the largest epoch in the snapshot, or 0 when it is empty.
+func (s Snapshot) maxEpoch() int64 {
+	hw := s.Global
+	for _, m := range []map[string]int64{s.Host, s.URL, s.Tag} {
+		for _, v := range m {
+			if v > hw {
+				hw = v
+			}
 		}
 	}
-	for _, recs := range t.prefix {
+	for _, recs := range s.Prefix {
 		for _, p := range recs {
 			if p.Epoch > hw {
 				hw = p.Epoch
 			}
 		}
 	}
-	for _, v := range t.tag {
-		if v > hw {
-			hw = v
+	return hw
+}
+
+func mergeInt64Map(dst, src map[string]int64) {
+	for k, v := range src {
+		if v > dst[k] {
+			dst[k] = v
 		}
 	}
-	t.highWater = hw
-	if hw > 0 {
-		t.active.Store(true)
-	}
 }
 
 func cloneInt64Map(m map[string]int64) map[string]int64 {
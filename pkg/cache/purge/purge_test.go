@@ -2,6 +2,7 @@ package purge
 
 import (
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
@@ -237,3 +238,30 @@ func TestTable_SnapshotRestoreGlobalFlush(t *testing.T) {
 	dst.Restore(src.Snapshot())
 	assert.EqualValues(t, 9000, epochFor(dst, "GET", "http://anything.com/q"), "global flush survives restore")
 }
+
+func TestTable_URINormalizerMatchesCacheKey(t *testing.T) {
+	key := cache.KeyOptions{ExcludeQuery: []string{"utm_*"}, IgnoreCase: true}
+	tbl := New(WithURINormalizer(key.NormalizeURI))
+	c := cache.New(cache.NewMemory(1<<20), cache.Options{MaxFileSize: 1024, Key: key, InvalidatedAfter: tbl.InvalidatedAfter})
+	h := c.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "1")
+		w.Write([]byte("x"))
+	}))
+	get := func(target string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://a.com"+target, nil))
+		return w.Header().Get("X-Cache")
+	}
+
+	assert.Equal(t, "MISS", get("/Blog/Post?utm_source=mail"))
+	assert.Equal(t, "HIT", get("/blog/post"))
+	time.Sleep(time.Millisecond)
+	tbl.PurgeURL("a.com", "/BLOG/post?utm_medium=x")
+	assert.Equal(t, "MISS", get("/Blog/Post?utm_source=other"), "one purge covers every request sharing the entry")
+
+	assert.Equal(t, "HIT", get("/blog/post"))
+	time.Sleep(time.Millisecond)
+	tbl.PurgePrefix("a.com", "/BLOG")
+	assert.Equal(t, "MISS", get("/blog/post?utm_source=x"))
+}
@@ -110,3 +110,22 @@ func TestReap_NoPurgesIsNoOp(t *testing.T) {
 	assert.Equal(t, 0, tbl.Reap(s), "nothing purged -> nothing reaped")
 	assert.Equal(t, 1, storageLen(s))
 }
+
+func TestReap_TieredStorage(t *testing.T) {
+	l1 := cache.NewMemory(1 << 20)
+	l2, err := cache.NewDisk(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	s := cache.NewTiered(l1, l2, cache.TieredOptions{})
+	fresh := time.Now().Add(time.Hour).UnixNano()
+	putEntry(t, s, "aa01aa01aa01aa01", cache.Meta{Host: "acme.com", URI: "/a", Created: 100, FreshUntil: fresh}, []byte("x"))
+	putEntry(t, s, "bb02bb02bb02bb02", cache.Meta{Host: "acme.com", URI: "/b", Created: 100, FreshUntil: fresh}, []byte("y"))
+	l1.Delete("bb02bb02bb02bb02") // only on disk
+
+	tbl := New()
+	fixedClock(tbl, 200)
+	tbl.PurgeHost("acme.com")
+
+	assert.Equal(t, 2, tbl.Reap(s), "each entry reaped once, whichever tiers hold it")
+	assert.Zero(t, storageLen(l1))
+	assert.Zero(t, storageLen(l2))
+}
@@ -0,0 +1,201 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPeerAttempts  = 3
+	peerRetryBackoff     = 100 * time.Millisecond
+	defaultPubSubChannel = "parapet:purge"
+)
+
+// HTTPPeers is a Transport posting each message to every peer's Cluster.ServeHTTP
+// endpoint, and a SnapshotSource reading theirs. The list may include this
+// replica itself (its own messages are ignored), so every replica can share one
+// list.
+type HTTPPeers struct {
+	// Peers are the URLs the peers' Cluster endpoints are mounted at.
+	Peers []string
+
+	// Token is sent as the bearer token; it must match the peers'
+	// ClusterOptions.Token.
+	Token string
+
+	// Client sends the requests; nil uses http.DefaultClient.
+	Client *http.Client
+
+	// Attempts bounds the tries per peer on a network error or 5xx; <= 0 means 3.
+	// A retried message is applied once, by its ID.
+	Attempts int
+}
+
+// Publish posts msg to every peer at once and returns the failures, joined.
+func (p *HTTPPeers) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(p.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range p.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.post(ctx, peer, body)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *HTTPPeers) post(ctx context.Context, peer string, body []byte) error {
+	attempts := p.Attempts
+	if attempts <= 0 {
+		attempts = defaultPeerAttempts
+	}
+	var err error
+	for i := range attempts {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%s: %w", peer, err)
+			case <-time.After(peerRetryBackoff << (i - 1)):
+			}
+		}
+		var code int
+		code, err = p.send(ctx, http.MethodPost, peer, body, nil)
+		if err == nil && code < 300 {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("status %d", code)
+			if code < 500 {
+				break // the peer refused it; a retry would be refused too
+			}
+		}
+	}
+	return fmt.Errorf("%s: %w", peer, err)
+}
+
+// Snapshot reads every peer's snapshot and merges them, keeping the later epoch
+// of each record; it fails only when no peer answers.
+func (p *HTTPPeers) Snapshot(ctx context.Context) (Snapshot, error) {
+	snaps := make([]*Snapshot, len(p.Peers))
+	errs := make([]error, len(p.Peers))
+	var wg sync.WaitGroup
+	for i, peer := range p.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s Snapshot
+			code, err := p.send(ctx, http.MethodGet, peer, nil, &s)
+			if err == nil && code != http.StatusOK {
+				err = fmt.Errorf("status %d", code)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", peer, err)
+				return
+			}
+			snaps[i] = &s
+		}()
+	}
+	wg.Wait()
+
+	merged := New()
+	answered := false
+	for _, s := range snaps {
+		if s != nil {
+			merged.Merge(*s)
+			answered = true
+		}
+	}
+	if !answered {
+		return Snapshot{}, fmt.Errorf("purge: no peer answered: %w", errors.Join(errs...))
+	}
+	return merged.Snapshot(), nil
+}
+
+// send makes one request to peer, decoding a 200 response into out when set.
+func (p *HTTPPeers) send(ctx context.Context, method, peer string, body []byte, out any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, peer, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// PubSub is the publish/subscribe surface PubSubTransport needs. Inject an
+// adapter over your broker (Redis, NATS, Google Pub/Sub, …) so this package
+// depends on no client.
+type PubSub interface {
+	// Publish sends payload to every subscriber of channel.
+	Publish(ctx context.Context, channel string, payload []byte) error
+
+	// Subscribe calls fn with each payload published to channel until ctx is
+	// done or the subscription fails, and returns why it stopped.
+	Subscribe(ctx context.Context, channel string, fn func(payload []byte)) error
+}
+
+// PubSubTransport is a Transport and Listener over a PubSub channel: every
+// replica publishes to and subscribes on the same channel. Run each replica's
+// Cluster.Run to receive.
+type PubSubTransport struct {
+	PubSub PubSub
+
+	// Channel is the channel the replicas share; "" means "parapet:purge".
+	Channel string
+}
+
+func (p *PubSubTransport) channel() string {
+	if p.Channel == "" {
+		return defaultPubSubChannel
+	}
+	return p.Channel
+}
+
+// Publish implements Transport.
+func (p *PubSubTransport) Publish(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.PubSub.Publish(ctx, p.channel(), payload)
+}
+
+// Listen implements Listener. A payload that isn't a Message is skipped.
+func (p *PubSubTransport) Listen(ctx context.Context, deliver func(Message)) error {
+	return p.PubSub.Subscribe(ctx, p.channel(), func(payload []byte) {
+		var msg Message
+		if json.Unmarshal(payload, &msg) == nil {
+			deliver(msg)
+		}
+	})
+}
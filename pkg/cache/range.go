@@ -0,0 +1,376 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxRanges bounds the ranges one request may ask for. A Range header with more
+// is ignored and the full response served, so a single request can't make the
+// cache assemble thousands of parts.
+const maxRanges = 16
+
+// rangeSpec is one byte-range-spec of a Range header, before the representation
+// length is known: first-last, first- (last -1), or the suffix -n (first -1,
+// last n).
+type rangeSpec struct{ first, last int64 }
+
+// rangeRequest reports a GET whose Range header the cache answers, and its specs.
+// Range is defined for GET only (RFC 9110 §14.2); a malformed header, or one with
+// more than maxRanges specs, is ignored and the request served in full.
+func rangeRequest(r *http.Request) ([]rangeSpec, bool) {
+	if r.Method != http.MethodGet {
+		return nil, false
+	}
+	v := r.Header.Get("Range")
+	if v == "" {
+		return nil, false
+	}
+	return parseRange(v)
+}
+
+// parseRange parses a "bytes=" Range header value.
+func parseRange(s string) ([]rangeSpec, bool) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, false
+	}
+	var specs []rangeSpec
+	for _, el := range strings.Split(set, ",") {
+		el = strings.TrimSpace(el)
+		if el == "" {
+			continue // empty list elements are allowed
+		}
+		first, last, ok := strings.Cut(el, "-")
+		if !ok {
+			return nil, false
+		}
+		var sp rangeSpec
+		switch {
+		case first == "":
+			n, ok := parseDigits(last)
+			if !ok {
+				return nil, false
+			}
+			sp = rangeSpec{first: -1, last: n}
+		default:
+			f, ok := parseDigits(first)
+			if !ok {
+				return nil, false
+			}
+			sp = rangeSpec{first: f, last: -1}
+			if last != "" {
+				l, ok := parseDigits(last)
+				if !ok || l < f {
+					return nil, false
+				}
+				sp.last = l
+			}
+		}
+		if specs = append(specs, sp); len(specs) > maxRanges {
+			return nil, false
+		}
+	}
+	return specs, len(specs) > 0
+}
+
+// parseDigits parses a non-empty run of decimal digits (no sign, unlike
+// strconv.ParseInt).
+func parseDigits(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// byteRange is a satisfiable range [start, end) of a representation.
+type byteRange struct{ start, end int64 }
+
+func (br byteRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(br.start, 10) + "-" + strconv.FormatInt(br.end-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// rangeReply is how a ranged request is answered for a representation of size
+// bytes: one range (206), several (206 multipart/byteranges), none satisfiable
+// (416), or — full — the whole representation as a 200.
+type rangeReply struct {
+	ranges   []byteRange
+	size     int64
+	ctype    string // the representation's Content-Type, repeated in each part
+	boundary string // set for more than one range
+	full     bool
+}
+
+// newRangeReply resolves specs against a representation of size bytes. ok is
+// false when the ranges ask for more bytes than the representation holds (heavily
+// overlapping ranges); the Range header is then ignored like a malformed one.
+func newRangeReply(specs []rangeSpec, size int64, ctype string) (rangeReply, bool) {
+	rr := rangeReply{size: size, ctype: ctype}
+	var total int64
+	for _, sp := range specs {
+		var br byteRange
+		switch {
+		case sp.first < 0:
+			n := min(sp.last, size)
+			if n == 0 {
+				continue
+			}
+			br = byteRange{start: size - n, end: size}
+		case sp.first >= size:
+			continue
+		case sp.last < 0 || sp.last >= size:
+			br = byteRange{start: sp.first, end: size}
+		default:
+			br = byteRange{start: sp.first, end: sp.last + 1}
+		}
+		total += br.end - br.start
+		rr.ranges = append(rr.ranges, br)
+	}
+	if total > size {
+		return rangeReply{}, false
+	}
+	if len(rr.ranges) > 1 {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		rr.boundary = hex.EncodeToString(b[:])
+	}
+	return rr, true
+}
+
+// fullReply answers with the whole representation, ignoring the Range header.
+func fullReply(size int64) rangeReply {
+	return rangeReply{ranges: []byteRange{{0, size}}, size: size, full: true}
+}
+
+// ascending reports whether the ranges come in increasing, non-overlapping order,
+// so the reply can be cut from the representation as it streams by.
+func (rr *rangeReply) ascending() bool {
+	for i := 1; i < len(rr.ranges); i++ {
+		if rr.ranges[i].start < rr.ranges[i-1].end {
+			return false
+		}
+	}
+	return true
+}
+
+func (rr *rangeReply) multipart() bool { return rr.boundary != "" }
+
+// header rewrites h, the full response's headers, for the reply and returns its
+// status.
+func (rr *rangeReply) header(h http.Header) int {
+	h.Del("Content-Range")
+	switch {
+	case rr.full:
+		h.Set("Content-Length", strconv.FormatInt(rr.size, 10))
+		return http.StatusOK
+	case len(rr.ranges) == 0:
+		h.Del("Content-Type")
+		h.Del("Content-Encoding")
+		h.Set("Content-Range", "bytes */"+strconv.FormatInt(rr.size, 10))
+		h.Set("Content-Length", "0")
+		return http.StatusRequestedRangeNotSatisfiable
+	case rr.multipart():
+		h.Set("Content-Type", "multipart/byteranges; boundary="+rr.boundary)
+	default:
+		h.Set("Content-Range", rr.ranges[0].contentRange(rr.size))
+	}
+	h.Set("Content-Length", strconv.FormatInt(rr.contentLength(), 10))
+	return http.StatusPartialContent
+}
+
+func (rr *rangeReply) contentLength() int64 {
+	var n int64
+	for i, br := range rr.ranges {
+		n += int64(len(rr.partHeader(i))) + br.end - br.start
+	}
+	return n + int64(len(rr.closing()))
+}
+
+// partHeader is the multipart framing ahead of range i; empty unless multipart.
+func (rr *rangeReply) partHeader(i int) string {
+	if !rr.multipart() {
+		return ""
+	}
+	var b strings.Builder
+	if i > 0 {
+		b.WriteString("\r\n")
+	}
+	b.WriteString("--" + rr.boundary + "\r\n")
+	if rr.ctype != "" {
+		b.WriteString("Content-Type: " + rr.ctype + "\r\n")
+	}
+	b.WriteString("Content-Range: " + rr.ranges[i].contentRange(rr.size) + "\r\n\r\n")
+	return b.String()
+}
+
+// closing ends a multipart body; empty unless multipart.
+func (rr *rangeReply) closing() string {
+	if !rr.multipart() {
+		return ""
+	}
+	return "\r\n--" + rr.boundary + "--\r\n"
+}
+
+// write writes the reply body; copyRange writes one range of the representation.
+func (rr *rangeReply) write(w io.Writer, copyRange func(w io.Writer, br byteRange) error) error {
+	for i, br := range rr.ranges {
+		if _, err := io.WriteString(w, rr.partHeader(i)); err != nil {
+			return err
+		}
+		if err := copyRange(w, br); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, rr.closing())
+	return err
+}
+
+// ifRange reports whether a ranged request's If-Range, if any, holds for the
+// representation with header h (RFC 9110 §13.1.5): an entity-tag must equal a
+// strong ETag, a date must equal Last-Modified. When it fails the Range header
+// is ignored.
+func ifRange(r *http.Request, h http.Header) bool {
+	v := strings.TrimSpace(r.Header.Get("If-Range"))
+	switch {
+	case v == "":
+		return true
+	case strings.HasPrefix(v, `"`):
+		etag := h.Get("ETag")
+		return etag != "" && etag == v
+	case strings.HasPrefix(v, "W/"):
+		return false // a weak tag never matches
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && t.Equal(lm)
+}
+
+// withoutRange is r as sent to the origin on a fill: without Range and If-Range,
+// so the origin returns the full representation, which can be stored and any
+// range then cut from it.
+func withoutRange(r *http.Request) *http.Request {
+	if r.Header.Get("Range") == "" && r.Header.Get("If-Range") == "" {
+		return r
+	}
+	out := r.Clone(r.Context())
+	out.Header.Del("Range")
+	out.Header.Del("If-Range")
+	return out
+}
+
+// writeStoredRange answers a ranged GET from a stored full 200 entry, reporting
+// false when the request's Range does not apply to it.
+func writeStoredRange(w http.ResponseWriter, r *http.Request, m Meta, body io.ReadSeeker) bool {
+	if m.Status != http.StatusOK {
+		return false
+	}
+	specs, ok := rangeRequest(r)
+	if !ok || !ifRange(r, m.Header) {
+		return false
+	}
+	h := w.Header()
+	rr, ok := newRangeReply(specs, m.Size, h.Get("Content-Type"))
+	if !ok {
+		return false
+	}
+	w.WriteHeader(rr.header(h))
+	_ = rr.write(w, func(w io.Writer, br byteRange) error {
+		if _, err := body.Seek(br.start, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(w, body, br.end-br.start)
+		return err
+	})
+	return true
+}
+
+// rangeWriter answers a ranged GET from the full 200 the origin streams on a
+// miss (the fill asks for the whole representation, see withoutRange): the
+// requested ranges are cut from the body as it passes, while the teeWriter
+// underneath still stores all of it. A response it can't cut — not a 200, no
+// Content-Length, a failed If-Range, or ranges out of order — passes through
+// whole, which is always a valid answer to a Range request.
+type rangeWriter struct {
+	rw    http.ResponseWriter
+	r     *http.Request // the client's request, with its Range
+	specs []rangeSpec
+	reply *rangeReply // nil: passing through
+	off   int64       // representation offset of the next body byte
+	part  int         // the range being written
+
+	wroteHeader bool
+}
+
+func (w *rangeWriter) Header() http.Header { return w.rw.Header() }
+
+func (w *rangeWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.rw.Header()
+	if cl, ok := contentLength(h); ok && code == http.StatusOK && ifRange(w.r, h) {
+		if rr, ok := newRangeReply(w.specs, cl, h.Get("Content-Type")); ok && rr.ascending() {
+			w.reply = &rr
+			code = rr.header(h)
+		}
+	}
+	w.rw.WriteHeader(code)
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.reply == nil {
+		return w.rw.Write(p)
+	}
+
+	n := len(p)
+	for len(p) > 0 && w.part < len(w.reply.ranges) {
+		br := w.reply.ranges[w.part]
+		if w.off+int64(len(p)) <= br.start {
+			break
+		}
+		if skip := br.start - w.off; skip > 0 {
+			p, w.off = p[skip:], br.start
+		}
+		if w.off == br.start {
+			if _, err := io.WriteString(w.rw, w.reply.partHeader(w.part)); err != nil {
+				return 0, err
+			}
+		}
+		k := min(int64(len(p)), br.end-w.off)
+		if _, err := w.rw.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		p, w.off = p[k:], w.off+k
+		if w.off == br.end {
+			if w.part++; w.part == len(w.reply.ranges) {
+				if _, err := io.WriteString(w.rw, w.reply.closing()); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	w.off += int64(len(p))
+	return n, nil
+}
+
+func (w *rangeWriter) Flush() {
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *rangeWriter) Unwrap() http.ResponseWriter { return w.rw }
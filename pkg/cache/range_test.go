@@ -0,0 +1,286 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		in    string
+		specs []rangeSpec
+		ok    bool
+	}{
+		{"bytes=0-3", []rangeSpec{{0, 3}}, true},
+		{"bytes=5-", []rangeSpec{{5, -1}}, true},
+		{"bytes=-4", []rangeSpec{{-1, 4}}, true},
+		{"BYTES = 0-0, ,2-3", []rangeSpec{{0, 0}, {2, 3}}, true},
+		{"bytes=3-1", nil, false},
+		{"bytes=+1-2", nil, false},
+		{"bytes=1", nil, false},
+		{"items=0-3", nil, false},
+		{"bytes=", nil, false},
+		{"bytes=" + strings.Repeat("0-0,", maxRanges+1), nil, false},
+	}
+	for _, tc := range cases {
+		specs, ok := parseRange(tc.in)
+		assert.Equal(t, tc.ok, ok, tc.in)
+		assert.Equal(t, tc.specs, specs, tc.in)
+	}
+}
+
+// rangeOrigin serves body with http.ServeContent, so it answers Range requests
+// itself, and records the Range header of each request.
+func rangeOrigin(body []byte, header http.Header, calls *int32, ranges *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if ranges != nil {
+			*ranges = append(*ranges, r.Header.Get("Range"))
+		}
+		for k, vs := range header {
+			w.Header()[k] = vs
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	})
+}
+
+// readParts decodes a multipart/byteranges response into its parts'
+// Content-Range and body.
+func readParts(t *testing.T, h http.Header, body io.Reader) (ranges, bodies []string) {
+	t.Helper()
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/byteranges", mt)
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return ranges, bodies
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(p)
+		require.NoError(t, err)
+		ranges = append(ranges, p.Header.Get("Content-Range"))
+		bodies = append(bodies, string(b))
+	}
+}
+
+func TestCache_RangeFromStoredEntry(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		var calls int32
+		h := origin(originSpec{body: []byte("0123456789"), header: hdr("Cache-Control", "max-age=60", "Content-Type", "text/plain", "ETag", `"v1"`)}, &calls)
+		assert.Equal(t, "MISS", do(c, h, "GET", "http://acme.com/r", nil).Header().Get("X-Cache"))
+
+		r := do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=2-5"))
+		assert.Equal(t, http.StatusPartialContent, r.Code)
+		assert.Equal(t, "HIT", r.Header().Get("X-Cache"))
+		assert.Equal(t, "bytes 2-5/10", r.Header().Get("Content-Range"))
+		assert.Equal(t, "4", r.Header().Get("Content-Length"))
+		assert.Equal(t, "2345", r.Body.String())
+
+		r = do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=-3"))
+		assert.Equal(t, "bytes 7-9/10", r.Header().Get("Content-Range"))
+		assert.Equal(t, "789", r.Body.String())
+
+		r = do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=8-,0-1"))
+		assert.Equal(t, http.StatusPartialContent, r.Code)
+		assert.Equal(t, r.Body.Len(), int(mustAtoi(t, r.Header().Get("Content-Length"))))
+		ranges, bodies := readParts(t, r.Header(), r.Body)
+		assert.Equal(t, []string{"bytes 8-9/10", "bytes 0-1/10"}, ranges, "parts keep the requested order")
+		assert.Equal(t, []string{"89", "01"}, bodies)
+
+		r = do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=10-"))
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r.Code)
+		assert.Equal(t, "bytes */10", r.Header().Get("Content-Range"))
+		assert.Empty(t, r.Body.String())
+
+		r = do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=0-1", "If-Range", `"v1"`))
+		assert.Equal(t, http.StatusPartialContent, r.Code)
+		r = do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=0-1", "If-Range", `"v0"`))
+		assert.Equal(t, http.StatusOK, r.Code, "a failed If-Range gets the full entry")
+		assert.Equal(t, "0123456789", r.Body.String())
+
+		r = do(c, h, "GET", "http://acme.com/r", hdr("Range", "bytes=oops"))
+		assert.Equal(t, http.StatusOK, r.Code, "a malformed Range is ignored")
+		assert.Equal(t, "0123456789", r.Body.String())
+
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls), "every range served from the one stored entry")
+	})
+}
+
+func TestCache_RangeMissFillsFullEntry(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		var calls int32
+		var ranges []string
+		h := rangeOrigin([]byte("0123456789"), hdr("Cache-Control", "max-age=60"), &calls, &ranges)
+
+		r := do(c, h, "GET", "http://acme.com/m", hdr("Range", "bytes=0-0"))
+		assert.Equal(t, "0", r.Body.String())
+		assert.Equal(t, []string{"bytes=0-0"}, ranges, "the length isn't known yet: the Range is passed through")
+
+		r = do(c, h, "GET", "http://acme.com/m", hdr("Range", "bytes=3-4"))
+		assert.Equal(t, http.StatusPartialContent, r.Code)
+		assert.Equal(t, "MISS", r.Header().Get("X-Cache"))
+		assert.Equal(t, "bytes 3-4/10", r.Header().Get("Content-Range"))
+		assert.Equal(t, "34", r.Body.String())
+		assert.Equal(t, []string{"bytes=0-0", ""}, ranges, "it fits MaxFileSize: the origin is asked for the whole object")
+
+		r = do(c, h, "GET", "http://acme.com/m", nil)
+		assert.Equal(t, "HIT", r.Header().Get("X-Cache"))
+		assert.Equal(t, "0123456789", r.Body.String())
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	})
+}
+
+func TestCache_RangeMissMultipart(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+	var calls int32
+	h := rangeOrigin([]byte("0123456789"), hdr("Cache-Control", "max-age=60", "Content-Type", "text/plain"), &calls, nil)
+	do(c, h, "GET", "http://acme.com/mp", hdr("Range", "bytes=0-0")) // learns the length
+	do(c, h, "GET", "http://acme.com/mp2", hdr("Range", "bytes=0-0"))
+
+	r := do(c, h, "GET", "http://acme.com/mp", hdr("Range", "bytes=0-1,5-6"))
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, r.Body.Len(), int(mustAtoi(t, r.Header().Get("Content-Length"))))
+	ranges, bodies := readParts(t, r.Header(), r.Body)
+	assert.Equal(t, []string{"bytes 0-1/10", "bytes 5-6/10"}, ranges)
+	assert.Equal(t, []string{"01", "56"}, bodies)
+
+	// out of order can't be cut from the stream: the full response is served
+	r = do(c, h, "GET", "http://acme.com/mp2", hdr("Range", "bytes=5-6,0-1"))
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "0123456789", r.Body.String())
+}
+
+func TestCache_RangeMissPassesThrough(t *testing.T) {
+	t.Run("oversize", func(t *testing.T) {
+		c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+		var calls int32
+		var ranges []string
+		h := rangeOrigin(make([]byte, 1<<20), hdr("Cache-Control", "max-age=60"), &calls, &ranges)
+		for range 2 {
+			r := do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=0-99"))
+			assert.Equal(t, http.StatusPartialContent, r.Code)
+			assert.Equal(t, "MISS", r.Header().Get("X-Cache"))
+			assert.Equal(t, "bytes 0-99/1048576", r.Header().Get("Content-Range"))
+			assert.Equal(t, 100, r.Body.Len())
+		}
+		assert.Equal(t, []string{"bytes=0-99", "bytes=0-99"}, ranges, "never fetched whole")
+	})
+
+	t.Run("uncacheable", func(t *testing.T) {
+		c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+		var calls int32
+		var ranges []string
+		h := rangeOrigin([]byte("0123456789"), hdr("Cache-Control", "no-store"), &calls, &ranges)
+		for range 3 {
+			r := do(c, h, "GET", "http://acme.com/ns", hdr("Range", "bytes=3-4"))
+			assert.Equal(t, "34", r.Body.String())
+		}
+		assert.Equal(t, []string{"bytes=3-4", "", "bytes=3-4"}, ranges, "fetched whole once, then passed through")
+	})
+}
+
+func TestCache_RangeMissIfRangeMismatch(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+	var calls int32
+	h := origin(originSpec{body: []byte("0123456789"), header: hdr("Cache-Control", "max-age=60", "ETag", `"v2"`)}, &calls)
+	r := do(c, h, "GET", "http://acme.com/ir", hdr("Range", "bytes=0-1", "If-Range", `"v1"`))
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "0123456789", r.Body.String())
+}
+
+func TestCache_Slices(t *testing.T) {
+	body := make([]byte, 10000)
+	for i := range body {
+		body[i] = byte('a' + i%26)
+	}
+	newCache := func() *Cache {
+		return New(NewMemory(1<<20), Options{MaxFileSize: 4096, SliceSize: 1000})
+	}
+
+	t.Run("fills only the slices read", func(t *testing.T) {
+		c := newCache()
+		var calls int32
+		var ranges []string
+		h := rangeOrigin(body, hdr("Cache-Control", "max-age=60", "ETag", `"v1"`), &calls, &ranges)
+
+		r := do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=5000-5099"))
+		assert.Equal(t, http.StatusPartialContent, r.Code)
+		assert.Equal(t, "MISS", r.Header().Get("X-Cache"))
+		assert.Equal(t, "bytes 5000-5099/10000", r.Header().Get("Content-Range"))
+		assert.Equal(t, body[5000:5100], r.Body.Bytes())
+		assert.Equal(t, []string{"bytes=5000-5999"}, ranges)
+
+		r = do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=5900-6099"))
+		assert.Equal(t, "HIT", r.Header().Get("X-Cache"), "the probe slice was stored")
+		assert.Equal(t, body[5900:6100], r.Body.Bytes())
+		assert.Equal(t, []string{"bytes=5000-5999", "bytes=6000-6999"}, ranges)
+
+		r = do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=5500-6500"))
+		assert.Equal(t, body[5500:6501], r.Body.Bytes())
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls), "both slices served from storage")
+
+		r = do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=-10"))
+		assert.Equal(t, "bytes 9990-9999/10000", r.Header().Get("Content-Range"))
+		assert.Equal(t, body[9990:], r.Body.Bytes())
+
+		r = do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=0-1", "If-Range", `"v0"`))
+		assert.Equal(t, http.StatusOK, r.Code, "a failed If-Range gets the whole object, from slices")
+		assert.Equal(t, "10000", r.Header().Get("Content-Length"))
+		assert.Equal(t, body, r.Body.Bytes())
+	})
+
+	t.Run("origin without range support", func(t *testing.T) {
+		c := newCache()
+		var calls int32
+		h := origin(originSpec{body: body[:100], header: hdr("Cache-Control", "max-age=60")}, &calls)
+		r := do(c, h, "GET", "http://acme.com/norange", hdr("Range", "bytes=10-19"))
+		assert.Equal(t, http.StatusOK, r.Code)
+		assert.Equal(t, "MISS", r.Header().Get("X-Cache"))
+		assert.Equal(t, body[:100], r.Body.Bytes())
+	})
+
+	t.Run("past the end", func(t *testing.T) {
+		c := newCache()
+		var calls int32
+		h := rangeOrigin(body, hdr("Cache-Control", "max-age=60"), &calls, nil)
+		r := do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=20000-"))
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r.Code)
+	})
+
+	t.Run("object changed between slices", func(t *testing.T) {
+		c := newCache()
+		var calls int32
+		etag := `"v1"`
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			rangeOrigin(body, hdr("Cache-Control", "max-age=60"), &calls, nil).ServeHTTP(w, r)
+		})
+		do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=0-9"))
+		etag = `"v2"`
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=900-1099"))
+		})
+		r := do(c, h, "GET", "http://acme.com/big", hdr("Range", "bytes=900-1099"))
+		assert.Equal(t, http.StatusPartialContent, r.Code, "the outdated slice was dropped")
+		assert.Equal(t, `"v2"`, r.Header().Get("ETag"))
+	})
+}
+
+func mustAtoi(t *testing.T, s string) int64 {
+	t.Helper()
+	n, ok := parseDigits(s)
+	require.True(t, ok, s)
+	return n
+}
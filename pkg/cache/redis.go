@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisMaxIdle = 8
+	redisScanCount      = "100"
+	maxRedisBulk        = 512 << 20 // Redis' own string limit
+)
+
+var errRedisProtocol = errors.New("cache: malformed redis reply")
+
+// redisError is an error reply from the server. Unlike a network or protocol
+// error it leaves the connection usable.
+type redisError string
+
+func (e redisError) Error() string { return "cache: redis: " + string(e) }
+
+// RedisKV is a KV (and KVScanner) speaking the Redis protocol (RESP2) itself, for
+// a Redis, Valkey, KeyDB, Dragonfly or any RESP-compatible server, with no Redis
+// client dependency. It keeps a small pool of idle connections; each command runs
+// under its ctx's deadline, and a connection that fails is discarded. Set fields
+// before first use.
+type RedisKV struct {
+	// Addr is the server's host:port.
+	Addr string
+
+	// Password, when set, is sent with AUTH on each new connection; Username
+	// selects an ACL user (Redis 6+).
+	Username string
+	Password string
+
+	// DB, when non-zero, is selected on each new connection.
+	DB int
+
+	// MaxIdle bounds the idle connections kept for reuse; <= 0 means 8.
+	MaxIdle int
+
+	// Dial opens a connection; nil uses a net.Dialer. Use a tls.Dialer's
+	// DialContext for TLS.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// Get implements KV with GET.
+func (k *RedisKV) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := k.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil, false, nil
+	case []byte:
+		return v, true, nil
+	}
+	return nil, false, errRedisProtocol
+}
+
+// Set implements KV with SET … PX, the TTL rounded up to whole milliseconds.
+func (k *RedisKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms := max((ttl+time.Millisecond-1)/time.Millisecond, 1)
+	_, err := k.do(ctx, "SET", key, value, "PX", strconv.FormatInt(int64(ms), 10))
+	return err
+}
+
+// Delete implements KV with DEL.
+func (k *RedisKV) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(keys)+1)
+	args = append(args, "DEL")
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	_, err := k.do(ctx, args...)
+	return err
+}
+
+// Scan implements KVScanner with SCAN … MATCH prefix*.
+func (k *RedisKV) Scan(ctx context.Context, prefix, cursor string) ([]string, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	v, err := k.do(ctx, "SCAN", cursor, "MATCH", globEscape(prefix)+"*", "COUNT", redisScanCount)
+	if err != nil {
+		return nil, "", err
+	}
+	page, ok := v.([]any)
+	if !ok || len(page) != 2 {
+		return nil, "", errRedisProtocol
+	}
+	next, ok := page[0].([]byte)
+	items, ok2 := page[1].([]any)
+	if !ok || !ok2 {
+		return nil, "", errRedisProtocol
+	}
+	keys := make([]string, 0, len(items))
+	for _, it := range items {
+		b, ok := it.([]byte)
+		if !ok {
+			return nil, "", errRedisProtocol
+		}
+		keys = append(keys, string(b))
+	}
+	if string(next) == "0" {
+		return keys, "", nil
+	}
+	return keys, string(next), nil
+}
+
+// globEscape escapes s for a Redis MATCH pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// do runs one command. Arguments are strings or []byte. A pooled connection the
+// server has since closed fails the command; it is retried once on a new
+// connection, which is safe as every command RedisKV sends is idempotent.
+func (k *RedisKV) do(ctx context.Context, args ...any) (any, error) {
+	cn, pooled, err := k.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := cn.roundTrip(ctx, args)
+	if err != nil && pooled && ctx.Err() == nil {
+		cn.c.Close()
+		if cn, err = k.dial(ctx); err != nil {
+			return nil, err
+		}
+		v, err = cn.roundTrip(ctx, args)
+	}
+	if err != nil {
+		cn.c.Close()
+		return nil, err
+	}
+	k.put(cn)
+	if e, ok := v.(redisError); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+func (k *RedisKV) get(ctx context.Context) (cn *redisConn, pooled bool, err error) {
+	k.mu.Lock()
+	if n := len(k.idle); n > 0 {
+		cn = k.idle[n-1]
+		k.idle = k.idle[:n-1]
+		k.mu.Unlock()
+		return cn, true, nil
+	}
+	k.mu.Unlock()
+	cn, err = k.dial(ctx)
+	return cn, false, err
+}
+
+func (k *RedisKV) put(cn *redisConn) {
+	limit := k.MaxIdle
+	if limit <= 0 {
+		limit = defaultRedisMaxIdle
+	}
+	k.mu.Lock()
+	if len(k.idle) < limit {
+		k.idle = append(k.idle, cn)
+		cn = nil
+	}
+	k.mu.Unlock()
+	if cn != nil {
+		cn.c.Close()
+	}
+}
+
+func (k *RedisKV) dial(ctx context.Context) (*redisConn, error) {
+	dial := k.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c, err := dial(ctx, "tcp", k.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{c: c, br: bufio.NewReader(c), bw: bufio.NewWriter(c)}
+	var setup [][]any
+	if k.Password != "" {
+		if k.Username != "" {
+			setup = append(setup, []any{"AUTH", k.Username, k.Password})
+		} else {
+			setup = append(setup, []any{"AUTH", k.Password})
+		}
+	}
+	if k.DB != 0 {
+		setup = append(setup, []any{"SELECT", strconv.Itoa(k.DB)})
+	}
+	for _, args := range setup {
+		v, err := cn.roundTrip(ctx, args)
+		if err == nil {
+			if e, ok := v.(redisError); ok {
+				err = e
+			}
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// roundTrip writes a command and reads its reply, under ctx's deadline.
+func (cn *redisConn) roundTrip(ctx context.Context, args []any) (any, error) {
+	dl, _ := ctx.Deadline()
+	if err := cn.c.SetDeadline(dl); err != nil {
+		return nil, err
+	}
+	cn.bw.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		var b []byte
+		switch a := a.(type) {
+		case string:
+			b = []byte(a)
+		case []byte:
+			b = a
+		}
+		cn.bw.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+		cn.bw.Write(b)
+		cn.bw.WriteString("\r\n")
+	}
+	if err := cn.bw.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(cn.br)
+}
+
+// readRedisReply reads one RESP2 reply: a simple string (string), an error
+// (redisError), an integer (int64), a bulk string ([]byte, or nil), or an array
+// ([]any, or nil).
+func readRedisReply(br *bufio.Reader) (any, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	kind, rest := line[0], string(line[1:len(line)-2])
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n > maxRedisBulk {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		if b[n] != '\r' || b[n+1] != '\n' {
+			return nil, errRedisProtocol
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n > maxRedisBulk {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]any, 0, min(n, 1024))
+		for range n {
+			v, err := readRedisReply(br)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, errRedisProtocol
+}
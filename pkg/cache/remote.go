@@ -0,0 +1,323 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRemotePrefix    = "parapet:cache:"
+	defaultRemoteChunkSize = 512 << 10 // fits memcached's 1 MiB item limit
+	defaultRemoteTimeout   = time.Second
+)
+
+// errRemoteExpired is a RemoteStorage commit of an entry already past its
+// serveable window: there is no TTL to store it with.
+var errRemoteExpired = errors.New("cache: entry already expired")
+
+// KV is the minimal key/value surface RemoteStorage needs. Inject an adapter over
+// your client (go-redis, rueidis, gomemcache, …) so pkg/cache hard-depends on no
+// client, or use [RedisKV], which speaks the Redis protocol itself.
+// Implementations must be safe for concurrent use and honor ctx's deadline.
+type KV interface {
+	// Get returns the value under key; ok=false (and a nil error) when there is
+	// none.
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+
+	// Set stores value under key, expiring after ttl (> 0).
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Delete removes keys; a missing key is not an error.
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// KVScanner is an optional KV extension that lists keys, for RemoteStorage.Range
+// (and so purge.Table.Reap). Without it Range visits nothing: purges still take
+// effect lazily, as each purged entry is looked up.
+type KVScanner interface {
+	// Scan returns one page of the keys starting with prefix, from cursor ("" for
+	// the first page), and the cursor of the next page ("" after the last). A key
+	// may appear on more than one page.
+	Scan(ctx context.Context, prefix, cursor string) (keys []string, next string, err error)
+}
+
+// RemoteOptions configures a RemoteStorage.
+type RemoteOptions struct {
+	// Prefix namespaces the KV keys; "" resolves to "parapet:cache:". Replicas
+	// sharing a cache must share the prefix; separate caches on one KV must not.
+	Prefix string
+
+	// ChunkSize is the largest value written to the KV: a body is split into
+	// chunks of at most this many bytes. <= 0 resolves to 512 KiB, under
+	// memcached's default 1 MiB item limit.
+	ChunkSize int
+
+	// Timeout bounds each KV round-trip; <= 0 resolves to 1s. A slow KV then
+	// reads as a miss instead of stalling the request.
+	Timeout time.Duration
+
+	// OnError observes a KV error (timeout, connection, protocol); nil ignores it.
+	// Every error is otherwise treated as a miss.
+	OnError func(error)
+}
+
+// RemoteStorage is a cache backend on an external key/value service (see KV), so
+// a fleet of replicas shares one cache and fetches each object from the origin
+// once rather than once per replica. Each entry is a metadata record under the
+// cache key plus its body in chunks (RemoteOptions.ChunkSize), all expiring when
+// the entry is no longer serveable; the KV's own eviction bounds total size.
+// Chunks are written before, and keyed by a version named in, the record, so a
+// reader never mixes the bodies of two writes. Fail-static: any KV error reads as
+// a miss, or an uncached fill.
+//
+// A fill buffers the body in RAM (up to MaxFileSize) and uploads it on Commit. It
+// does not implement MetaUpdater: a revalidated entry is rewritten, chunks
+// included, so their TTLs move with the record's. Single-flight is per replica;
+// replicas missing the same object at once each fill it.
+type RemoteStorage struct {
+	kv        KV
+	prefix    string
+	chunkSize int
+	timeout   time.Duration
+	onError   func(error)
+}
+
+// remoteRecord is the value stored under an entry's key.
+type remoteRecord struct {
+	Meta    Meta   `json:"meta"`
+	Version string `json:"v"`
+	Chunks  int    `json:"n"`
+}
+
+// NewRemote creates a RemoteStorage on kv.
+func NewRemote(kv KV, opts RemoteOptions) *RemoteStorage {
+	s := &RemoteStorage{
+		kv:        kv,
+		prefix:    opts.Prefix,
+		chunkSize: opts.ChunkSize,
+		timeout:   opts.Timeout,
+		onError:   opts.OnError,
+	}
+	if s.prefix == "" {
+		s.prefix = defaultRemotePrefix
+	}
+	if s.chunkSize <= 0 {
+		s.chunkSize = defaultRemoteChunkSize
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultRemoteTimeout
+	}
+	return s
+}
+
+func (s *RemoteStorage) recordKey(key string) string { return s.prefix + key }
+
+func (s *RemoteStorage) chunkKey(key, version string, i int) string {
+	return s.prefix + key + ":" + version + ":" + strconv.Itoa(i)
+}
+
+func (s *RemoteStorage) chunkKeys(key string, rec remoteRecord) []string {
+	keys := make([]string, rec.Chunks)
+	for i := range keys {
+		keys[i] = s.chunkKey(key, rec.Version, i)
+	}
+	return keys
+}
+
+func (s *RemoteStorage) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *RemoteStorage) fail(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// record reads key's metadata record. A corrupt record is reported and reads as
+// a miss.
+func (s *RemoteStorage) record(key string) (remoteRecord, bool) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	v, ok, err := s.kv.Get(ctx, s.recordKey(key))
+	if err != nil {
+		s.fail(err)
+		return remoteRecord{}, false
+	}
+	if !ok {
+		return remoteRecord{}, false
+	}
+	var rec remoteRecord
+	if err := json.Unmarshal(v, &rec); err != nil || rec.Chunks < 0 {
+		s.fail(errors.New("cache: corrupt remote record " + key))
+		return remoteRecord{}, false
+	}
+	return rec, true
+}
+
+// Get reads the record, then each chunk; a missing chunk (evicted by the KV) or
+// a body of the wrong size is a miss.
+func (s *RemoteStorage) Get(key string) (Meta, []byte, bool) {
+	rec, ok := s.record(key)
+	if !ok {
+		return Meta{}, nil, false
+	}
+	body := make([]byte, 0, max(rec.Meta.Size, 0))
+	for _, ck := range s.chunkKeys(key, rec) {
+		ctx, cancel := s.ctx()
+		v, ok, err := s.kv.Get(ctx, ck)
+		cancel()
+		if err != nil {
+			s.fail(err)
+			return Meta{}, nil, false
+		}
+		if !ok {
+			return Meta{}, nil, false
+		}
+		body = append(body, v...)
+	}
+	if int64(len(body)) != rec.Meta.Size {
+		return Meta{}, nil, false
+	}
+	return rec.Meta, body, true
+}
+
+// Writer buffers the body; Commit uploads it.
+func (s *RemoteStorage) Writer(key string) (EntryWriter, error) {
+	return &remoteWriter{s: s, key: key}, nil
+}
+
+// Delete removes the record and its chunks. When the record can't be read its
+// chunks are left to expire.
+func (s *RemoteStorage) Delete(key string) {
+	keys := []string{s.recordKey(key)}
+	if rec, ok := s.record(key); ok {
+		keys = append(keys, s.chunkKeys(key, rec)...)
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	if err := s.kv.Delete(ctx, keys...); err != nil {
+		s.fail(err)
+	}
+}
+
+// Range lists the records through KVScanner, when the KV implements it, and
+// calls fn with each; it holds nothing across fn, so fn may Delete. Without a
+// KVScanner it visits nothing. A listing error ends the walk.
+func (s *RemoteStorage) Range(fn func(key string, m Meta) bool) {
+	sc, ok := s.kv.(KVScanner)
+	if !ok {
+		return
+	}
+	seen := map[string]struct{}{}
+	cursor := ""
+	for {
+		ctx, cancel := s.ctx()
+		keys, next, err := sc.Scan(ctx, s.prefix, cursor)
+		cancel()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		for _, k := range keys {
+			key, ok := strings.CutPrefix(k, s.prefix)
+			if !ok || strings.Contains(key, ":") { // a chunk
+				continue
+			}
+			if _, dup := seen[key]; dup {
+				continue
+			}
+			seen[key] = struct{}{}
+			rec, ok := s.record(key)
+			if !ok {
+				continue
+			}
+			if !fn(key, rec.Meta) {
+				return
+			}
+		}
+		if next == "" {
+			return
+		}
+		cursor = next
+	}
+}
+
+type remoteWriter struct {
+	s    *RemoteStorage
+	key  string
+	buf  bytes.Buffer
+	done bool
+}
+
+func (w *remoteWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+// Commit uploads the chunks under a fresh version, then the record naming it,
+// all with the entry's remaining serveable time as TTL; the chunks of the
+// record it replaced are then dropped. A failure leaves any previous entry in
+// place and the new chunks to expire.
+func (w *remoteWriter) Commit(meta Meta) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	s := w.s
+	ttl := time.Until(meta.serveableUntil())
+	if ttl <= 0 {
+		return errRemoteExpired
+	}
+	body := w.buf.Bytes()
+	meta.Size = int64(len(body))
+	var v [8]byte
+	_, _ = rand.Read(v[:])
+	rec := remoteRecord{Meta: meta, Version: hex.EncodeToString(v[:]), Chunks: (len(body) + s.chunkSize - 1) / s.chunkSize}
+	old, hadOld := s.record(w.key)
+
+	for i := range rec.Chunks {
+		chunk := body[i*s.chunkSize : min((i+1)*s.chunkSize, len(body))]
+		if err := w.set(s.chunkKey(w.key, rec.Version, i), chunk, ttl); err != nil {
+			return err
+		}
+	}
+	rb, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := w.set(s.recordKey(w.key), rb, ttl); err != nil {
+		return err
+	}
+	w.buf.Reset()
+	if hadOld && old.Version != rec.Version && old.Chunks > 0 {
+		ctx, cancel := s.ctx()
+		defer cancel()
+		if err := s.kv.Delete(ctx, s.chunkKeys(w.key, old)...); err != nil {
+			s.fail(err)
+		}
+	}
+	return nil
+}
+
+func (w *remoteWriter) set(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := w.s.ctx()
+	defer cancel()
+	if err := w.s.kv.Set(ctx, key, value, ttl); err != nil {
+		w.s.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (w *remoteWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.buf.Reset()
+}
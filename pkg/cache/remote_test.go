@@ -0,0 +1,320 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// redisStandIn is an in-process RESP server over a map, with GET, SET … PX,
+// DEL, SCAN … MATCH, AUTH and SELECT: enough to run RedisKV against.
+type redisStandIn struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	data    map[string]string
+	expires map[string]time.Time
+}
+
+func newRedisStandIn(t *testing.T, password string) *redisStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &redisStandIn{ln: ln, password: password, data: map[string]string{}, expires: map[string]time.Time{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *redisStandIn) addr() string { return s.ln.Addr().String() }
+
+func (s *redisStandIn) serve(c net.Conn) {
+	defer c.Close()
+	br, bw := bufio.NewReader(c), bufio.NewWriter(c)
+	authed := s.password == ""
+	for {
+		v, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+		arr, _ := v.([]any)
+		args := make([]string, len(arr))
+		for i, a := range arr {
+			b, _ := a.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			authed = args[len(args)-1] == s.password
+		}
+		if !authed && cmd != "AUTH" {
+			bw.WriteString("-NOAUTH Authentication required.\r\n")
+		} else {
+			s.reply(bw, cmd, args[1:])
+		}
+		if bw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func bulk(bw *bufio.Writer, s string) {
+	bw.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (s *redisStandIn) reply(bw *bufio.Writer, cmd string, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, exp := range s.expires {
+		if time.Now().After(exp) {
+			delete(s.data, k)
+			delete(s.expires, k)
+		}
+	}
+	switch cmd {
+	case "AUTH":
+		if args[len(args)-1] != s.password {
+			bw.WriteString("-WRONGPASS invalid password\r\n")
+			return
+		}
+		bw.WriteString("+OK\r\n")
+	case "SELECT":
+		bw.WriteString("+OK\r\n")
+	case "GET":
+		v, ok := s.data[args[0]]
+		if !ok {
+			bw.WriteString("$-1\r\n")
+			return
+		}
+		bulk(bw, v)
+	case "SET":
+		s.data[args[0]] = args[1]
+		delete(s.expires, args[0])
+		if len(args) == 4 && strings.EqualFold(args[2], "PX") {
+			ms, _ := strconv.Atoi(args[3])
+			s.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		bw.WriteString("+OK\r\n")
+	case "DEL":
+		n := 0
+		for _, k := range args {
+			if _, ok := s.data[k]; ok {
+				n++
+			}
+			delete(s.data, k)
+			delete(s.expires, k)
+		}
+		bw.WriteString(":" + strconv.Itoa(n) + "\r\n")
+	case "SCAN":
+		// Pages of 2 keys, the cursor an offset into the sorted key set.
+		var keys []string
+		for k := range s.data {
+			if ok, _ := path.Match(args[2], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		from, _ := strconv.Atoi(args[0])
+		to := min(from+2, len(keys))
+		next := strconv.Itoa(to)
+		if to >= len(keys) {
+			next = "0"
+		}
+		bw.WriteString("*2\r\n")
+		bulk(bw, next)
+		bw.WriteString("*" + strconv.Itoa(to-from) + "\r\n")
+		for _, k := range keys[from:to] {
+			bulk(bw, k)
+		}
+	default:
+		bw.WriteString("-ERR unknown command\r\n")
+	}
+}
+
+func (s *redisStandIn) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *redisStandIn) ttl(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Until(s.expires[key])
+}
+
+func TestRedisKV(t *testing.T) {
+	srv := newRedisStandIn(t, "secret")
+	kv := &RedisKV{Addr: srv.addr(), Password: "secret", DB: 2}
+	ctx := context.Background()
+
+	_, ok, err := kv.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	require.NoError(t, kv.Set(ctx, "a", []byte("x\r\ny"), time.Minute))
+	v, ok, err := kv.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "x\r\ny", string(v), "values are binary-safe")
+	assert.InDelta(t, time.Minute, srv.ttl("a"), float64(time.Second))
+
+	require.NoError(t, kv.Set(ctx, "b*", nil, time.Minute))
+	require.NoError(t, kv.Set(ctx, "b*1", nil, time.Minute))
+	require.NoError(t, kv.Set(ctx, "bx", nil, time.Minute))
+	var all []string
+	cursor := ""
+	for {
+		keys, next, err := kv.Scan(ctx, "b*", cursor)
+		require.NoError(t, err)
+		all = append(all, keys...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.ElementsMatch(t, []string{"b*", "b*1"}, all, "the prefix is matched literally")
+
+	require.NoError(t, kv.Delete(ctx, "a", "b*"))
+	_, ok, _ = kv.Get(ctx, "a")
+	assert.False(t, ok)
+
+	bad := &RedisKV{Addr: srv.addr(), Password: "wrong"}
+	_, _, err = bad.Get(ctx, "a")
+	assert.Error(t, err)
+}
+
+func TestRedisKV_ReconnectsPooledConn(t *testing.T) {
+	srv := newRedisStandIn(t, "")
+	kv := &RedisKV{Addr: srv.addr()}
+	ctx := context.Background()
+	require.NoError(t, kv.Set(ctx, "a", []byte("1"), time.Minute))
+	kv.idle[0].c.Close() // as if the server dropped the idle connection
+	_, ok, err := kv.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRemote_StoresChunked(t *testing.T) {
+	srv := newRedisStandIn(t, "")
+	s := NewRemote(&RedisKV{Addr: srv.addr()}, RemoteOptions{Prefix: "p:", ChunkSize: 4})
+	key := "0123456789abcdef0123456789abcdef"
+	m := Meta{Status: http.StatusOK, Header: hdr("X-A", "1"), FreshUntil: time.Now().Add(time.Minute).UnixNano(), StaleIfError: int64(time.Hour)}
+	storePut(t, s, key, m, []byte("0123456789"))
+
+	keys := srv.keys()
+	assert.Len(t, keys, 4, "the record and three chunks")
+	assert.Contains(t, keys, "p:"+key)
+	assert.InDelta(t, time.Hour+time.Minute, srv.ttl("p:"+key), float64(time.Second), "the TTL ends with the serveable window")
+
+	got, body, ok := s.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, "0123456789", string(body))
+	assert.Equal(t, "1", got.Header.Get("X-A"))
+	assert.EqualValues(t, 10, got.Size)
+
+	storePut(t, s, key, m, []byte("abc"))
+	assert.Len(t, srv.keys(), 2, "a rewrite drops the chunks it replaced")
+	_, body, ok = s.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, "abc", string(body))
+
+	var visited []string
+	s.Range(func(k string, _ Meta) bool {
+		visited = append(visited, k)
+		s.Delete(k)
+		return true
+	})
+	assert.Equal(t, []string{key}, visited, "chunks are not entries")
+	assert.Empty(t, srv.keys(), "Delete drops the chunks too")
+}
+
+func TestRemote_MissingChunkIsMiss(t *testing.T) {
+	srv := newRedisStandIn(t, "")
+	s := NewRemote(&RedisKV{Addr: srv.addr()}, RemoteOptions{ChunkSize: 2})
+	key := "0123456789abcdef0123456789abcdef"
+	storePut(t, s, key, Meta{Status: http.StatusOK, FreshUntil: time.Now().Add(time.Minute).UnixNano()}, []byte("abcd"))
+	for _, k := range srv.keys() {
+		if strings.HasSuffix(k, ":1") {
+			require.NoError(t, (&RedisKV{Addr: srv.addr()}).Delete(context.Background(), k))
+		}
+	}
+	_, _, ok := s.Get(key)
+	assert.False(t, ok, "a chunk the KV evicted")
+}
+
+func TestRemote_ExpiredNotStored(t *testing.T) {
+	srv := newRedisStandIn(t, "")
+	s := NewRemote(&RedisKV{Addr: srv.addr()}, RemoteOptions{})
+	ew, err := s.Writer("0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	_, _ = ew.Write([]byte("x"))
+	assert.Error(t, ew.Commit(Meta{Status: http.StatusOK, FreshUntil: time.Now().Add(-time.Second).UnixNano()}))
+	assert.Empty(t, srv.keys())
+}
+
+// failingKV fails every call.
+type failingKV struct{}
+
+func (failingKV) Get(context.Context, string) ([]byte, bool, error) {
+	return nil, false, errors.New("down")
+}
+func (failingKV) Set(context.Context, string, []byte, time.Duration) error { return errors.New("down") }
+func (failingKV) Delete(context.Context, ...string) error                  { return errors.New("down") }
+
+func TestCache_RemoteSharedAcrossReplicas(t *testing.T) {
+	srv := newRedisStandIn(t, "")
+	var calls int32
+	h := origin(originSpec{body: []byte("shared"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+	a := New(NewRemote(&RedisKV{Addr: srv.addr()}, RemoteOptions{}), Options{MaxFileSize: 1024})
+	b := New(NewRemote(&RedisKV{Addr: srv.addr()}, RemoteOptions{}), Options{MaxFileSize: 1024})
+
+	assert.Equal(t, "MISS", do(a, h, "GET", "/x", nil).Header().Get("X-Cache"))
+	rec := do(b, h, "GET", "/x", nil)
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"), "another replica's fill")
+	assert.Equal(t, "shared", rec.Body.String())
+	assert.EqualValues(t, 1, calls)
+}
+
+func TestCache_RemoteFailStatic(t *testing.T) {
+	var errs int
+	c := New(NewRemote(failingKV{}, RemoteOptions{OnError: func(error) { errs++ }}), Options{MaxFileSize: 1024})
+	var calls int32
+	h := origin(originSpec{body: []byte("ok"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+	for range 2 {
+		rec := do(c, h, "GET", "/x", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "ok", rec.Body.String())
+		assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	}
+	assert.EqualValues(t, 2, calls)
+	assert.Positive(t, errs)
+}
@@ -7,9 +7,10 @@ import (
 
 // Result is the cache outcome for one request, reported to Options.OnResult. Its
 // string value matches the X-Cache response header where one is sent (HIT, MISS,
-// STALE) and additionally names the two states X-Cache cannot distinguish: a
+// REVALIDATED, STALE) and additionally names the states X-Cache cannot distinguish: a
 // stale-if-error fallback (vs a stale-while-revalidate serve, both "STALE" on the
-// wire) and a bypass (which sends no X-Cache header at all).
+// wire), a negatively cached error (a "HIT" on the wire), and a bypass (which
+// sends no X-Cache header at all).
 type Result string
 
 const (
@@ -20,6 +21,11 @@ const (
 	// the response was cacheable, stored (X-Cache: MISS).
 	ResultMiss Result = "MISS"
 
+	// ResultRevalidated: the stored entry had expired, the origin answered the
+	// conditional fill (If-None-Match / If-Modified-Since) with 304, and the entry
+	// was refreshed in place and served (X-Cache: REVALIDATED).
+	ResultRevalidated Result = "REVALIDATED"
+
 	// ResultStale: served a stale stored entry under RFC 5861
 	// stale-while-revalidate and refreshed it in the background (X-Cache: STALE).
 	ResultStale Result = "STALE"
@@ -28,8 +34,12 @@ const (
 	// because revalidating with the origin failed (its X-Cache is also "STALE").
 	ResultStaleError Result = "STALE_ERROR"
 
+	// ResultNegative: served an error response stored under Options.Negative
+	// (its X-Cache is "HIT"). An error the origin itself made fresh is a HIT.
+	ResultNegative Result = "NEGATIVE"
+
 	// ResultBypass: the request was ineligible for caching — a non-cacheable method,
-	// a protocol upgrade, a Range request, or Options.Cacheable returned false — and
+	// a protocol upgrade, or Options.Cacheable returned false — and
 	// was proxied straight to the origin. This path sends no X-Cache header, so the
 	// hook is the only way to observe it.
 	ResultBypass Result = "BYPASS"
@@ -37,12 +47,14 @@ const (
 
 // ResultInfo carries the details of one request's cache outcome to a ResultFunc.
 type ResultInfo struct {
-	// Result is the cache decision (HIT, MISS, STALE, STALE_ERROR, BYPASS).
+	// Result is the cache decision (HIT, MISS, REVALIDATED, STALE, STALE_ERROR,
+	// NEGATIVE, BYPASS).
 	Result Result
 
 	// FillDuration is how long the foreground origin fetch took, set only when this
-	// request actually contacted the origin on the serving path: a MISS fill and a
-	// stale-if-error revalidation attempt. It is zero for a HIT, for a
+	// request actually contacted the origin on the serving path: a MISS fill, a
+	// REVALIDATED conditional fill, and a stale-if-error revalidation attempt. It
+	// is zero for a HIT, for a
 	// stale-while-revalidate STALE (served from cache; the background refresh runs
 	// detached and is never reported), and for a BYPASS.
 	FillDuration time.Duration
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// storedEntry is a stored entry a fill may revalidate with a conditional request
+// instead of refetching its body.
+type storedEntry struct {
+	key     string
+	m       Meta
+	body    io.ReadSeeker // open for a revalidation serving a client; nil in the background
+	expired bool          // past every serveable window: dropped unless the origin validates it
+}
+
+// notModifiedKeep are the stored headers a 304 never updates (RFC 9111 §3.2):
+// they describe the stored body, which the 304 does not carry.
+var notModifiedKeep = map[string]struct{}{
+	"Content-Length":   {},
+	"Content-Encoding": {},
+	"Content-Range":    {},
+}
+
+// revalidatable reports whether an expired entry may be revalidated with the
+// origin rather than refetched: it carries a validator and was not invalidated
+// out of band — a purged entry is always refetched, never refreshed by a 304.
+// Only then is the InvalidatedAfter hook consulted for an expired entry.
+func (c *Cache) revalidatable(m Meta, r *http.Request) bool {
+	if m.Header.Get("ETag") == "" && m.Header.Get("Last-Modified") == "" {
+		return false
+	}
+	return !c.invalidated(m, r)
+}
+
+// conditional returns r as sent to the origin to revalidate e: carrying
+// If-None-Match and If-Modified-Since from e's ETag and Last-Modified in place of
+// any the client sent, so a 304 answers for the stored entry rather than for the
+// client's own copy. ok is false when e has no validator; r is then sent as-is.
+func conditional(r *http.Request, e *storedEntry) (out *http.Request, ok bool) {
+	etag := e.m.Header.Get("ETag")
+	lastModified := e.m.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return r, false
+	}
+	out = r.Clone(r.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out, true
+}
+
+// mergeNotModified is the stored header updated with a 304's (RFC 9111 §4.3.4):
+// each header the 304 carries replaces the stored one, except hop-by-hop and
+// body-describing headers.
+func mergeNotModified(stored, h http.Header) http.Header {
+	out := make(http.Header, len(stored))
+	for k, vs := range stored {
+		out[k] = append([]string(nil), vs...)
+	}
+	for k, vs := range sanitizeHeader(h) {
+		if _, keep := notModifiedKeep[http.CanonicalHeaderKey(k)]; keep {
+			continue
+		}
+		out[k] = vs
+	}
+	return out
+}
+
+// revalidating sets tw up to revalidate e, when there is one, and returns the
+// request to send the origin.
+func (tw *teeWriter) revalidating(e *storedEntry) *http.Request {
+	if e == nil {
+		return tw.r
+	}
+	tw.stale = e
+	r, ok := conditional(tw.r, e)
+	tw.validating = ok
+	return r
+}
+
+// notModified handles the origin's 304 to a conditional fill: the stored entry
+// is still current, so its headers and freshness are refreshed (its body left
+// as is) and it is served, tagged REVALIDATED — after the fill lock is released
+// when DecoupleFill engages (see serveLeader). A 304 that makes the entry
+// uncacheable still validates it for this response, but drops it.
+func (tw *teeWriter) notModified() {
+	tw.revalidated = true
+	e := tw.stale
+	h := tw.rw.Header()
+	m := e.m
+	m.Header = mergeNotModified(e.m.Header, h)
+	if dec := tw.c.policy(tw.r, tw.method, m.Status, m.Header); dec.cacheable {
+		m.Vary = append([]string(nil), dec.vary...)
+		sort.Strings(m.Vary)
+		swr, sie := tw.c.staleWindowsFor(dec)
+		m.Tags = parseCacheTags(m.Header)
+		m.Created = time.Now().UnixNano()
+		m.FreshUntil = dec.freshUntil.UnixNano()
+		m.StaleWhileRevalidate = int64(swr)
+		m.StaleIfError = int64(sie)
+		m.Negative = dec.negative
+		tw.c.refresh(e, variantHashFor(tw.primaryHex, m.Vary, tw.r.Header), m)
+	} else {
+		tw.c.storage.Delete(e.key)
+	}
+
+	for k := range h { // the 304's headers are merged into m
+		delete(h, k)
+	}
+	switch {
+	case e.body == nil: // a background revalidation has no client
+	case tw.contended():
+		tw.refreshed = m
+		tw.deferredClient = true
+	default:
+		writeStored(tw.rw, tw.r, m, e.body, "REVALIDATED")
+	}
+}
+
+// refresh stores the revalidated Meta m of e under key: in place when the
+// backend is a MetaUpdater and the key is unchanged, otherwise by rewriting e's
+// body (the origin's Vary changed, or the entry was reaped meanwhile). A
+// background revalidation holds no open body; it reopens e's, unless another
+// fill replaced it meanwhile.
+func (c *Cache) refresh(e *storedEntry, key string, m Meta) {
+	if u, ok := c.storage.(MetaUpdater); ok && key == e.key && u.UpdateMeta(key, m) == nil {
+		c.setPrimaryVary(m.PrimaryHex, m.Vary)
+		return
+	}
+	body := e.body
+	if body == nil {
+		cur, b, ok := openEntry(c.storage, e.key)
+		if !ok {
+			return
+		}
+		defer b.Close()
+		if cur.Created != e.m.Created {
+			return
+		}
+		body = b
+	}
+	if key != e.key {
+		c.storage.Delete(e.key)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	ew, err := c.storage.Writer(key)
+	if err != nil {
+		return
+	}
+	if _, err := io.CopyN(ew, body, e.m.Size); err != nil {
+		ew.Abort()
+		return
+	}
+	if err := ew.Commit(m); err != nil {
+		return
+	}
+	c.setPrimaryVary(m.PrimaryHex, m.Vary)
+}
@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validatingOrigin answers 304 when the request's If-None-Match is etag, and
+// body otherwise. It records the conditional headers it receives.
+type validatingOrigin struct {
+	etag     string
+	body     string
+	calls    atomic.Int32
+	inm, ims atomic.Value
+}
+
+func (o *validatingOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.calls.Add(1)
+	o.inm.Store(r.Header.Get("If-None-Match"))
+	o.ims.Store(r.Header.Get("If-Modified-Since"))
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("X-Version", "2")
+	if r.Header.Get("If-None-Match") == o.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", "3")
+	_, _ = w.Write([]byte(o.body))
+}
+
+func seedValidated(t *testing.T, c *Cache, target string, staleAgo, swr, sie time.Duration) {
+	t.Helper()
+	m := staleMeta(staleAgo, swr, sie)
+	m.Header = http.Header{
+		"Content-Type":   {"text/plain"},
+		"Content-Length": {"3"},
+		"Etag":           {`"v1"`},
+		"X-Version":      {"1"},
+	}
+	seedStale(t, c, "GET", target, m, []byte("old"))
+}
+
+func TestCache_RevalidateExpired(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		var results []Result
+		c.onResult = func(_ *http.Request, info ResultInfo) { results = append(results, info.Result) }
+		seedValidated(t, c, "/x", 5*time.Second, 0, 0)
+		o := &validatingOrigin{etag: `"v1"`, body: "new"}
+
+		rec := do(c, o, "GET", "/x", hdr("If-None-Match", `"client"`))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "REVALIDATED", rec.Header().Get("X-Cache"))
+		assert.Equal(t, "old", rec.Body.String(), "the stored body is served")
+		assert.Equal(t, "2", rec.Header().Get("X-Version"), "the 304's headers are merged")
+		assert.Equal(t, "3", rec.Header().Get("Content-Length"))
+		assert.Equal(t, `"v1"`, o.inm.Load(), "the stored ETag replaces the client's")
+
+		m, ok := storedMeta(t, c, "GET", "/x")
+		require.True(t, ok)
+		assert.Greater(t, m.FreshUntil, time.Now().UnixNano())
+		assert.Equal(t, "2", m.Header.Get("X-Version"))
+		assert.EqualValues(t, 3, m.Size)
+
+		rec = do(c, o, "GET", "/x", nil)
+		assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+		assert.Equal(t, "old", rec.Body.String())
+		assert.EqualValues(t, 1, o.calls.Load())
+		assert.Equal(t, []Result{ResultRevalidated, ResultHit}, results)
+	})
+}
+
+func TestCache_RevalidateChanged(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		seedValidated(t, c, "/x", 5*time.Second, 0, 0)
+		o := &validatingOrigin{etag: `"v2"`, body: "new"}
+
+		rec := do(c, o, "GET", "/x", nil)
+		assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+		assert.Equal(t, "new", rec.Body.String())
+		assert.Equal(t, `"v1"`, o.inm.Load())
+
+		rec = do(c, o, "GET", "/x", nil)
+		assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+		assert.Equal(t, "new", rec.Body.String())
+	})
+}
+
+func TestCache_RevalidateLastModified(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+	lm := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	m := staleMeta(5*time.Second, 0, 0)
+	m.Header = http.Header{"Last-Modified": {lm}}
+	seedStale(t, c, "GET", "/x", m, []byte("old"))
+
+	var ims string
+	o := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ims = r.Header.Get("If-Modified-Since")
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	rec := do(c, o, "GET", "/x", nil)
+	assert.Equal(t, lm, ims)
+	assert.Equal(t, "REVALIDATED", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "old", rec.Body.String())
+}
+
+func TestCache_RevalidateNotModifiedUncacheable(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+	seedValidated(t, c, "/x", 5*time.Second, 0, 0)
+	o := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	rec := do(c, o, "GET", "/x", nil)
+	assert.Equal(t, "REVALIDATED", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "old", rec.Body.String())
+	_, ok := storedMeta(t, c, "GET", "/x")
+	assert.False(t, ok, "an entry the 304 made uncacheable is dropped")
+}
+
+func TestCache_RevalidateStaleWhileRevalidate(t *testing.T) {
+	eachBackend(t, func(t *testing.T, c *Cache) {
+		seedValidated(t, c, "/x", 5*time.Second, 300*time.Second, 0)
+		o := &validatingOrigin{etag: `"v1"`, body: "new"}
+
+		assert.Equal(t, "STALE", do(c, o, "GET", "/x", nil).Header().Get("X-Cache"))
+		require.Eventually(t, func() bool {
+			return do(c, o, "GET", "/x", nil).Header().Get("X-Cache") == "HIT"
+		}, 2*time.Second, 5*time.Millisecond)
+		assert.Equal(t, `"v1"`, o.inm.Load())
+
+		rec := do(c, o, "GET", "/x", nil)
+		assert.Equal(t, "old", rec.Body.String())
+		assert.Equal(t, "2", rec.Header().Get("X-Version"))
+		assert.EqualValues(t, 1, o.calls.Load())
+	})
+}
+
+func TestCache_RevalidateStaleIfError(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024})
+	seedValidated(t, c, "/x", 5*time.Second, 0, 300*time.Second)
+	o := &validatingOrigin{etag: `"v1"`, body: "new"}
+	rec := do(c, o, "GET", "/x", nil)
+	assert.Equal(t, "REVALIDATED", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "old", rec.Body.String())
+}
+
+func TestCache_RevalidateNotAfterInvalidation(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{
+		MaxFileSize:      1024,
+		InvalidatedAfter: func(*http.Request, Meta) int64 { return time.Now().UnixNano() },
+	})
+	seedValidated(t, c, "/x", 5*time.Second, 0, 0)
+	o := &validatingOrigin{etag: `"v1"`, body: "new"}
+	rec := do(c, o, "GET", "/x", nil)
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "new", rec.Body.String())
+	assert.Equal(t, "", o.inm.Load(), "a purged entry is refetched, not revalidated")
+}
+
+func TestStorage_UpdateMeta(t *testing.T) {
+	d, err := NewDisk(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	for name, s := range map[string]Storage{"memory": NewMemory(1 << 20), "disk": d} {
+		t.Run(name, func(t *testing.T) {
+			u := s.(MetaUpdater)
+			key := "0123456789abcdef0123456789abcdef"
+			assert.Error(t, u.UpdateMeta(key, Meta{Status: http.StatusOK}))
+
+			storePut(t, s, key, Meta{Status: http.StatusOK, Size: 4, Header: hdr("X-A", "1")}, []byte("body"))
+			require.NoError(t, u.UpdateMeta(key, Meta{Status: http.StatusOK, Header: hdr("X-A", "2")}))
+			m, body, ok := s.Get(key)
+			require.True(t, ok)
+			assert.Equal(t, "2", m.Header.Get("X-A"))
+			assert.EqualValues(t, 4, m.Size, "Size is the stored body's")
+			assert.Equal(t, "body", string(body))
+		})
+	}
+}
+
+// Under DecoupleFill a revalidated leader with a slow client must not hold the
+// fill lock either: the follower hits the refreshed entry right away.
+func TestCache_RevalidateDecoupleFill(t *testing.T) {
+	c := New(NewMemory(1<<20), Options{MaxFileSize: 1024, DecoupleFill: true, LockTimeout: 30 * time.Second})
+	seedValidated(t, c, "http://acme.com/x", 5*time.Second, 0, 0)
+	entered, gate := make(chan struct{}), make(chan struct{})
+	o := &validatingOrigin{etag: `"v1"`, body: "new"}
+	mw := c.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.calls.Load() == 0 {
+			close(entered)
+			<-gate
+		}
+		o.ServeHTTP(w, r)
+	}))
+
+	leaderRW := &blockingRW{release: make(chan struct{}), written: make(chan struct{})}
+	leaderDone := make(chan struct{})
+	go func() {
+		mw.ServeHTTP(leaderRW, httptest.NewRequest("GET", "http://acme.com/x", nil))
+		close(leaderDone)
+	}()
+	<-entered
+
+	rec := httptest.NewRecorder()
+	followerDone := make(chan struct{})
+	go func() {
+		mw.ServeHTTP(rec, httptest.NewRequest("GET", "http://acme.com/x", nil))
+		close(followerDone)
+	}()
+	require.Eventually(t, func() bool {
+		c.lockMu.Lock()
+		defer c.lockMu.Unlock()
+		for _, l := range c.locks {
+			if l.waiters.Load() == 1 {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, time.Millisecond, "the follower registered on the fill lock")
+
+	close(gate)
+	select {
+	case <-followerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the follower waited on the leader's blocked client")
+	}
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "old", rec.Body.String())
+
+	close(leaderRW.release)
+	<-leaderDone
+	assert.Equal(t, "REVALIDATED", leaderRW.hdr.Get("X-Cache"))
+	assert.Equal(t, "old", leaderRW.body.String())
+	assert.EqualValues(t, 1, o.calls.Load())
+}
@@ -0,0 +1,348 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errSliceMismatch reports a slice that is not part of the same object version
+// as the probe slice of its response.
+var errSliceMismatch = errors.New("cache: slice does not match the object")
+
+// conditionalHeaders are stripped from a slice request: a slice fill needs the
+// origin's 206, never a 304 or 412 meant for the client.
+var conditionalHeaders = []string{"If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// sliceKey is the storage key of slice i of the variant stored under variantHex.
+func sliceKey(variantHex string, i int64) string {
+	sum := sha256.Sum256([]byte(variantHex + "\x00slice\x00" + strconv.FormatInt(i, 10)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// slice is one slice of an object: a stored (or just fetched) 206 whose body
+// holds the object's bytes from start.
+type slice struct {
+	m     Meta
+	body  []byte
+	start int64
+	total int64 // the object's length
+}
+
+// newSlice validates a 206 as slice index start/size: its Content-Range must
+// cover exactly that slice of the object, and the body all of it.
+func newSlice(m Meta, body []byte, start, size int64) (slice, bool) {
+	first, last, total, ok := parseContentRange(m.Header.Get("Content-Range"))
+	if !ok || first != start || last != min(start+size, total)-1 || last-first+1 != int64(len(body)) {
+		return slice{}, false
+	}
+	return slice{m: m, body: body, start: first, total: total}, true
+}
+
+// matches reports whether sl is part of the same object version as probe.
+func (sl slice) matches(probe slice) bool {
+	return sl.total == probe.total &&
+		sl.m.Header.Get("ETag") == probe.m.Header.Get("ETag") &&
+		sl.m.Header.Get("Last-Modified") == probe.m.Header.Get("Last-Modified")
+}
+
+// parseContentRange parses a satisfied "bytes first-last/total" Content-Range.
+func parseContentRange(s string) (first, last, total int64, ok bool) {
+	rest, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	rng, size, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	f, l, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	var ok1, ok2, ok3 bool
+	first, ok1 = parseDigits(f)
+	last, ok2 = parseDigits(l)
+	total, ok3 = parseDigits(size)
+	return first, last, total, ok1 && ok2 && ok3 && first <= last && last < total
+}
+
+// slicer assembles one slice-mode response (Options.SliceSize).
+type slicer struct {
+	c          *Cache
+	r          *http.Request
+	next       http.Handler
+	primaryHex string
+
+	probe      slice
+	probeIndex int64
+	probeKey   string // the probe's storage key when it was served from storage
+	hasProbe   bool
+
+	fetched bool          // the origin was contacted
+	passed  bool          // the origin's answer to the probe went straight to the client
+	fill    time.Duration // time spent fetching slices
+}
+
+// serveSlices answers a ranged GET from slices, filling the missing ones. The
+// probe slice — the one holding the first requested byte, or the first slice for
+// a suffix range — gives the object's length and validators, which every other
+// slice must share. When the origin answers the probe with something other than
+// a 206 (it ignores ranges, errors, or the range starts past the end) that answer
+// is passed to the client as-is; when its 206 is not a usable slice, ok is false
+// and the request is served as without slice mode.
+func (c *Cache) serveSlices(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex string, specs []rangeSpec) (info ResultInfo, ok bool) {
+	s := &slicer{c: c, r: r, next: next, primaryHex: primaryHex}
+	var i int64
+	if specs[0].first >= 0 {
+		i = specs[0].first / c.sliceSize
+	}
+	probe, key, ok := s.get(i, w)
+	if s.passed {
+		return s.result(), true
+	}
+	if !ok {
+		return ResultInfo{}, false
+	}
+	s.probe, s.probeIndex, s.probeKey, s.hasProbe = probe, i, key, true
+
+	h := w.Header()
+	for k, vs := range probe.m.Header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", strconv.FormatInt(servedAgeSeconds(probe.m, time.Now()), 10))
+	if s.fetched {
+		h.Set("X-Cache", "MISS")
+	} else {
+		h.Set("X-Cache", "HIT")
+	}
+	// The probe stands for the whole object, a 200 had it been requested whole.
+	if code := checkPreconditions(r, http.StatusOK, probe.m.Header); code != 0 {
+		writeCondition(w, code)
+		return s.result(), true
+	}
+	rr, ok := newRangeReply(specs, probe.total, h.Get("Content-Type"))
+	if !ok || !ifRange(r, probe.m.Header) {
+		rr = fullReply(probe.total)
+	}
+	w.WriteHeader(rr.header(h))
+	if err := rr.write(w, s.copyRange); errors.Is(err, errSliceMismatch) {
+		// The object changed under the response, and its head is already out: abort
+		// rather than splice two versions together.
+		panic(http.ErrAbortHandler)
+	}
+	return s.result(), true
+}
+
+func (s *slicer) result() ResultInfo {
+	if !s.fetched {
+		return ResultInfo{Result: ResultHit}
+	}
+	return ResultInfo{Result: ResultMiss, FillDuration: s.fill}
+}
+
+func (s *slicer) copyRange(w io.Writer, br byteRange) error {
+	for off := br.start; off < br.end; {
+		sl, err := s.slice(off / s.c.sliceSize)
+		if err != nil {
+			return err
+		}
+		end := min(br.end, sl.start+int64(len(sl.body)))
+		if _, err := w.Write(sl.body[off-sl.start : end-sl.start]); err != nil {
+			return err
+		}
+		off = end
+	}
+	return nil
+}
+
+func (s *slicer) slice(i int64) (slice, error) {
+	if i == s.probeIndex {
+		return s.probe, nil
+	}
+	sl, _, ok := s.get(i, nil)
+	if !ok || !sl.matches(s.probe) {
+		// A fresh slice disagreeing with a stored probe means the probe is the
+		// outdated one; drop it so the next request starts over.
+		if s.probeKey != "" {
+			s.c.storage.Delete(s.probeKey)
+		}
+		return slice{}, errSliceMismatch
+	}
+	return sl, nil
+}
+
+// get returns slice i from storage, or fills it single-flighted like a full
+// entry; a follower that still misses after the leader fetches on its own,
+// uncached. pass is the client's writer for the probe (see sliceRecorder). key
+// is set when the slice came from storage.
+func (s *slicer) get(i int64, pass http.ResponseWriter) (sl slice, key string, ok bool) {
+	key = sliceKey(s.c.variantHash(s.primaryHex, s.r), i)
+	if sl, ok := s.stored(key, i); ok {
+		return sl, key, true
+	}
+	lock, leader := s.c.acquire(key)
+	if !leader {
+		lock.waiters.Add(1)
+		select {
+		case <-lock.done:
+		case <-time.After(s.c.lockTimeout):
+		}
+		lock.waiters.Add(-1)
+		if sl, ok := s.stored(key, i); ok {
+			return sl, key, true
+		}
+		sl, ok := s.fetch(i, pass, false)
+		return sl, "", ok
+	}
+	defer s.c.release(key, lock)
+	sl, ok = s.fetch(i, pass, true)
+	return sl, "", ok
+}
+
+// stored reads slice i from storage. An expired entry, or one of another object
+// version than the probe, is reaped and reads as a miss.
+func (s *slicer) stored(key string, i int64) (slice, bool) {
+	m, body, ok := s.c.storage.Get(key)
+	if !ok {
+		return slice{}, false
+	}
+	if s.c.classify(m, s.r, time.Now()) != stateFresh {
+		s.c.storage.Delete(key)
+		return slice{}, false
+	}
+	sl, ok := newSlice(m, body, i*s.c.sliceSize, s.c.sliceSize)
+	if !ok || (s.hasProbe && !sl.matches(s.probe)) {
+		s.c.storage.Delete(key)
+		return slice{}, false
+	}
+	return sl, true
+}
+
+// fetch asks the origin for slice i, storing it when store is set and the
+// response is cacheable.
+func (s *slicer) fetch(i int64, pass http.ResponseWriter, store bool) (slice, bool) {
+	start := i * s.c.sliceSize
+	fr := s.r.Clone(s.r.Context())
+	for _, k := range conditionalHeaders {
+		fr.Header.Del(k)
+	}
+	fr.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(start+s.c.sliceSize-1, 10))
+
+	rec := &sliceRecorder{h: http.Header{}, pass: pass, max: s.c.sliceSize}
+	begin := time.Now()
+	s.next.ServeHTTP(rec, fr)
+	s.fill += time.Since(begin)
+	s.fetched = true
+	if rec.passing {
+		s.passed = true
+		return slice{}, false
+	}
+	if rec.status != http.StatusPartialContent || rec.over {
+		return slice{}, false
+	}
+
+	m := Meta{Status: http.StatusPartialContent, Header: sanitizeHeader(rec.h), Created: time.Now().UnixNano()}
+	sl, ok := newSlice(m, rec.body.Bytes(), start, s.c.sliceSize)
+	if !ok {
+		return slice{}, false
+	}
+	if store {
+		s.store(fr, i, sl)
+	}
+	return sl, true
+}
+
+// store commits a fetched slice. A slice is checked as the 200 it is part of:
+// 206 is otherwise never a cacheable status, so a stray partial response can't
+// be stored as a full entry.
+func (s *slicer) store(r *http.Request, i int64, sl slice) {
+	dec := s.c.policy(r, http.MethodGet, http.StatusOK, sl.m.Header)
+	if !dec.cacheable {
+		return
+	}
+	vary := append([]string(nil), dec.vary...)
+	sort.Strings(vary)
+	ew, err := s.c.storage.Writer(sliceKey(variantHashFor(s.primaryHex, vary, r.Header), i))
+	if err != nil {
+		return
+	}
+	if _, err := ew.Write(sl.body); err != nil {
+		ew.Abort()
+		return
+	}
+	m := sl.m
+	m.PrimaryHex = s.primaryHex
+	m.Host = normalizeHost(r.Host)
+	m.URI = s.c.key.URI(r)
+	m.Vary = vary
+	m.Tags = parseCacheTags(m.Header)
+	m.FreshUntil = dec.freshUntil.UnixNano()
+	m.Size = int64(len(sl.body))
+	if err := ew.Commit(m); err == nil {
+		s.c.setPrimaryVary(s.primaryHex, vary)
+	}
+}
+
+// sliceRecorder captures the origin's answer to a slice request, keeping a 206
+// body of at most max bytes. For the probe it holds the client's writer in pass:
+// any answer but a 206 is then passed straight through to the client.
+type sliceRecorder struct {
+	h       http.Header
+	pass    http.ResponseWriter
+	body    bytes.Buffer
+	max     int64
+	status  int
+	passing bool
+	over    bool
+}
+
+func (rec *sliceRecorder) Header() http.Header { return rec.h }
+
+func (rec *sliceRecorder) WriteHeader(code int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = code
+	if code == http.StatusPartialContent || rec.pass == nil {
+		return
+	}
+	rec.passing = true
+	h := rec.pass.Header()
+	for k, vs := range rec.h {
+		h[k] = vs
+	}
+	h.Set("X-Cache", "MISS")
+	rec.pass.WriteHeader(code)
+}
+
+func (rec *sliceRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.passing {
+		return rec.pass.Write(p)
+	}
+	if rec.status != http.StatusPartialContent || rec.over {
+		return len(p), nil
+	}
+	if int64(rec.body.Len()+len(p)) > rec.max {
+		rec.over = true
+		rec.body.Reset()
+		return len(p), nil
+	}
+	return rec.body.Write(p)
+}
+
+func (rec *sliceRecorder) Flush() {
+	if f, ok := rec.pass.(http.Flusher); ok && rec.passing {
+		f.Flush()
+	}
+}
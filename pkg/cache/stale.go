@@ -14,15 +14,17 @@ const (
 	stateFresh                             // within FreshUntil: serve as a normal HIT
 	stateStaleRevalidate                   // stale, within stale-while-revalidate: serve stale + refresh
 	stateStaleIfError                      // stale, within stale-if-error only: serve stale on a failed revalidation
+	stateInvalidated                       // invalidated out of band (InvalidatedAfter): reap, never revalidate
 )
 
 // classify decides how a stored entry may be served now: fresh until FreshUntil,
 // then — if the origin offered RFC 5861 windows — serveable stale within
 // stale-while-revalidate, then serveable on error within stale-if-error, then
 // fully expired. Out-of-band invalidation (InvalidatedAfter) overrides any
-// serveable state and forces stateExpired, so a purged entry is never served —
-// fresh or stale. The hook is consulted only for an entry that would otherwise be
-// served, so a time-expired entry is reaped without paying for it.
+// serveable state and forces stateInvalidated, so a purged entry is never served —
+// fresh, stale, or revalidated with a 304. The hook is consulted only for an
+// entry that would otherwise be served, so a time-expired entry is reaped without
+// paying for it (see revalidatable for one that may still be revalidated).
 func (c *Cache) classify(m Meta, r *http.Request, now time.Time) freshState {
 	fresh := time.Unix(0, m.FreshUntil)
 	var state freshState
@@ -36,12 +38,16 @@ func (c *Cache) classify(m Meta, r *http.Request, now time.Time) freshState {
 	default:
 		return stateExpired
 	}
-	if c.invalidatedAfter != nil && m.Created <= c.invalidatedAfter(r, m) {
-		return stateExpired
+	if c.invalidated(m, r) {
+		return stateInvalidated
 	}
 	return state
 }
 
+func (c *Cache) invalidated(m Meta, r *http.Request) bool {
+	return c.invalidatedAfter != nil && m.Created <= c.invalidatedAfter(r, m)
+}
+
 // serveableUntil is the last instant an entry may be served: FreshUntil plus the
 // larger of its RFC 5861 windows. Past it the entry is fully expired and reapable.
 // classify and the disk startup scan share this bound so a stale-but-serveable
@@ -60,8 +66,10 @@ func (m Meta) serveableUntil() time.Time {
 // nothing. The fetch runs on a detached, time-bounded context so it is not
 // cancelled when the triggering client's response completes, and a hung origin
 // can't pin the lock or leak the goroutine. The response is streamed only to
-// storage (a discard client writer), reusing the normal store path.
-func (c *Cache) revalidate(r *http.Request, next http.Handler, primaryHex string) {
+// storage (a discard client writer), reusing the normal store path. The fetch is
+// conditional on the stale entry e, so an unchanged object costs the origin a
+// 304 and the cache only a Meta refresh.
+func (c *Cache) revalidate(r *http.Request, next http.Handler, primaryHex string, e *storedEntry) {
 	variantHex := c.variantHash(primaryHex, r)
 	lock, leader := c.acquire(variantHex)
 	if !leader {
@@ -90,25 +98,28 @@ func (c *Cache) revalidate(r *http.Request, next http.Handler, primaryHex string
 		// no real client to isolate, only the discard writer.
 		tw := &teeWriter{rw: &discardResponseWriter{}, r: rr, c: c, method: rr.Method, primaryHex: primaryHex}
 		defer tw.cleanup()
-		next.ServeHTTP(tw, rr)
+		next.ServeHTTP(tw, tw.revalidating(e))
 		tw.finish()
 	}()
 }
 
-// fillWithStale serves a miss for a stale-if-error-eligible entry: it runs the
-// normal fill (so single-flight, Vary learning, and caching all apply) but routes
-// the client write through a staleGate. If the origin's revalidation produces a
-// server error (status >= 500), the gate suppresses it and the stale entry is
-// served instead. It returns the request's cache outcome: ResultStaleError when it
-// fell back to the stale entry (carrying the failed fetch's duration), otherwise
-// the inner fill's own result (a MISS that successfully revalidated, or a HIT
-// served from a concurrent leader's fill through the gate).
-func (c *Cache) fillWithStale(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex string, m Meta, body []byte) ResultInfo {
-	// gate.m points at this stack-local m; finalize runs synchronously below
-	// (before this frame returns), so the pointer never escapes. fillAndServe and
-	// the teeWriter it builds keep the gate stack-local and do not retain it.
-	gate := &staleGate{rw: w, r: r, m: &m, body: body}
-	info := c.fillAndServe(gate, r, next, primaryHex)
+// fillWithStale serves a miss for a stale-if-error-eligible entry e: it runs the
+// normal, conditional fill (so single-flight, Vary learning, caching, and 304
+// revalidation all apply) but routes the client write through a staleGate. If the
+// origin's revalidation produces a server error (status >= 500, or one fallback
+// accepts when it is non-nil), the gate suppresses it and the stale entry is
+// served instead. It returns the request's
+// cache outcome: ResultStaleError when it fell back to the stale entry (carrying
+// the failed fetch's duration), otherwise the inner fill's own result (a MISS that
+// refetched, a REVALIDATED 304, or a HIT served from a concurrent leader's fill
+// through the gate).
+func (c *Cache) fillWithStale(w http.ResponseWriter, r *http.Request, next http.Handler, primaryHex string, e *storedEntry, fallback func(code int) bool) ResultInfo {
+	// gate.e is the caller's entry, its body open until the caller returns;
+	// finalize runs synchronously below (before this frame returns), so neither
+	// escapes. fillAndServe and the teeWriter it builds keep the gate stack-local
+	// and do not retain it.
+	gate := &staleGate{rw: w, r: r, e: e, fallback: fallback}
+	info := c.fillAndServe(gate, r, next, primaryHex, e)
 	gate.finalize()
 	if gate.fellBack {
 		return ResultInfo{Result: ResultStaleError, FillDuration: info.FillDuration}
@@ -124,12 +135,21 @@ func (c *Cache) fillWithStale(w http.ResponseWriter, r *http.Request, next http.
 type staleGate struct {
 	rw       http.ResponseWriter
 	r        *http.Request
-	m        *Meta
-	body     []byte
+	e        *storedEntry
+	fallback func(code int) bool // which statuses fall back; nil means every 5xx
 	decided  bool
 	fellBack bool
 }
 
+// fallsBack reports whether the gate serves the stale entry in place of an
+// origin response with status code.
+func (g *staleGate) fallsBack(code int) bool {
+	if g.fallback != nil {
+		return g.fallback(code)
+	}
+	return code >= 500
+}
+
 func (g *staleGate) Header() http.Header { return g.rw.Header() }
 
 func (g *staleGate) WriteHeader(code int) {
@@ -137,7 +157,7 @@ func (g *staleGate) WriteHeader(code int) {
 		return
 	}
 	g.decided = true
-	if code >= 500 {
+	if g.fallsBack(code) {
 		g.fellBack = true
 		return
 	}
@@ -165,7 +185,7 @@ func (g *staleGate) finalize() {
 	for k := range h {
 		delete(h, k)
 	}
-	writeStored(g.rw, g.r, *g.m, g.body, "STALE")
+	writeStored(g.rw, g.r, g.e.m, g.e.body, "STALE")
 }
 
 func (g *staleGate) Flush() {
@@ -8,18 +8,26 @@
 // storage error degrades to a cache miss, never an error to the client. The
 // response is tagged X-Cache: HIT|MISS.
 //
+// A GET with a Range header is answered from a stored full entry — 206, a
+// multipart/byteranges 206, or 416, honoring If-Range — and a miss fills the
+// full entry while serving just the requested ranges. Options.SliceSize instead
+// stores very large objects as independently filled slices.
+//
 // Two storage backends ship: an in-memory one ([NewMemory], bodies held in RAM,
 // lost on restart) and a disk-backed one ([NewDisk], survives restarts, streams
 // bodies to disk so it isn't bounded by RSS). Both bound their total size with
-// LRU eviction and a per-object cap. Plug either (or your own [Storage]) into
-// [New].
+// LRU eviction and a per-object cap. [NewTiered] composes them, a memory tier
+// in front of a disk tier, and [NewRemote] shares one cache across replicas
+// through a key/value service such as Redis ([RedisKV]). Plug any of them (or
+// your own [Storage]) into [New].
 //
 //	store, _ := cache.NewDisk("/var/cache/app", 1<<30) // 1 GiB on disk
 //	m := cache.New(store, cache.Options{MaxFileSize: 8 << 20})
 //	srv.Use(m) // mount it ahead of the upstream/handler it should cache
 //
 // Only origin-opted-in (public, fresh) content is cached, so per-user responses
-// must be marked uncacheable by the origin. As a shared cache it additionally
+// must be marked uncacheable by the origin. Options.Negative additionally caches
+// error responses for a short per-status TTL. As a shared cache it additionally
 // follows RFC 9111 §3.5: a response to a request bearing an Authorization header
 // is cached only when the origin explicitly opts in via public, s-maxage, or
 // must-revalidate.
@@ -32,6 +40,8 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net/http"
 )
@@ -50,7 +60,8 @@ type Storage interface {
 	// be counted as a recent use (LRU). The returned Meta (including its Header map
 	// and Vary slice) must be independent of stored state — safe for the caller to
 	// read or modify without affecting the cache; the returned body must not be
-	// mutated. Any internal error is reported as a miss (fail-static).
+	// mutated. Any internal error is reported as a miss (fail-static). Hits are
+	// served through Opener instead, when the Storage implements it.
 	Get(key string) (meta Meta, body []byte, ok bool)
 
 	// Writer begins storing an entry under key. The caller streams the body to the
@@ -75,6 +86,56 @@ type Storage interface {
 	Range(fn func(key string, m Meta) bool)
 }
 
+// Opener is an optional Storage extension: it opens a stored entry's body as a
+// stream instead of reading it whole, so serving a hit costs neither a body-sized
+// allocation nor a copy, whatever MaxFileSize allows. The cache serves every hit
+// through it when the Storage implements it, and through Get otherwise.
+// [DiskStorage] returns the body's *os.File, which net/http sends with
+// sendfile(2).
+type Opener interface {
+	// Open returns the entry stored under key with its body open for reading, or
+	// ok=false on a miss; meta.Size must be the body's length. The caller Closes
+	// body. A hit counts as a recent use, and errors read as a miss, as for Get.
+	Open(key string) (meta Meta, body io.ReadSeekCloser, ok bool)
+}
+
+// openEntry opens the entry under key from s: through Opener when s implements
+// it, otherwise by wrapping the body Get returns.
+func openEntry(s Storage, key string) (Meta, io.ReadSeekCloser, bool) {
+	if o, ok := s.(Opener); ok {
+		return o.Open(key)
+	}
+	m, body, ok := s.Get(key)
+	if !ok {
+		return Meta{}, nil, false
+	}
+	m.Size = int64(len(body))
+	return m, bytesBody(body), true
+}
+
+// bytesBody is an in-memory body as an io.ReadSeekCloser.
+func bytesBody(b []byte) io.ReadSeekCloser {
+	return nopSeekCloser{bytes.NewReader(b)}
+}
+
+type nopSeekCloser struct{ io.ReadSeeker }
+
+func (nopSeekCloser) Close() error { return nil }
+
+// MetaUpdater is an optional Storage extension: it replaces a stored entry's
+// Meta without rewriting its body. The cache uses it to refresh an entry the
+// origin revalidated with a 304; a Storage without it has the entry rewritten
+// through Writer instead. Both shipped backends implement it.
+type MetaUpdater interface {
+	// UpdateMeta replaces the Meta of the entry under key, keeping its body (and
+	// its Size, whatever meta.Size says). It returns an error, changing nothing,
+	// when there is no such entry.
+	UpdateMeta(key string, meta Meta) error
+}
+
+// errNoEntry is MetaUpdater.UpdateMeta's error for a key with no stored entry.
+var errNoEntry = errors.New("cache: no such entry")
+
 // EntryWriter streams one cached body and finalizes it. Exactly one of Commit or
 // Abort must be called; after either, the writer is spent. Abort after Commit (or
 // vice versa) is a no-op. Backends admit the entry to their capacity bound (LRU)
@@ -94,7 +155,7 @@ type Meta struct {
 	Header     http.Header `json:"header"`
 	PrimaryHex string      `json:"primary"`        // primary key hash (host+method+scheme+uri)
 	Host       string      `json:"host,omitempty"` // normalized host (lowercased, port-stripped); for out-of-band Range maintenance
-	URI        string      `json:"uri,omitempty"`  // request-uri (path+query); for out-of-band Range maintenance
+	URI        string      `json:"uri,omitempty"`  // request-uri (path+query) as keyed, normalized by Options.Key; for out-of-band Range maintenance
 	Vary       []string    `json:"vary"`           // lowercased Vary header names
 	Tags       []string    `json:"tags,omitempty"` // surrogate keys from the response Cache-Tag header; for out-of-band tag-scoped Range maintenance
 	Created    int64       `json:"created"`        // unix nanos
@@ -107,4 +168,5 @@ type Meta struct {
 	StaleIfError         int64 `json:"sie,omitempty"`
 	Size                 int64 `json:"size"` // body bytes (== eviction weight)
 	Status               int   `json:"status"`
+	Negative             bool  `json:"neg,omitempty"` // an error response stored under Options.Negative
 }
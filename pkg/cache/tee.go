@@ -34,8 +34,10 @@ type teeWriter struct {
 	ew         EntryWriter // nil = not caching this response
 	r          *http.Request
 	c          *Cache
-	lock       *fillLock // the leader's fill lock; its waiter count gates DecoupleFill
+	lock       *fillLock    // the leader's fill lock; its waiter count gates DecoupleFill
+	stale      *storedEntry // the stored entry this fill revalidates, if any
 	metaHeader http.Header
+	refreshed  Meta // the revalidated entry, served to a deferred client
 	method     string
 	storeKey   string
 	primaryHex string
@@ -50,7 +52,10 @@ type teeWriter struct {
 
 	wroteHeader    bool
 	hasCL          bool
-	deferredClient bool // DecoupleFill: body buffered for the leader; the client is served later
+	deferredClient bool // DecoupleFill: the client is served after the lock is released (see serveLeader)
+	validating     bool // the origin request is conditional on stale's validators
+	revalidated    bool // the origin answered 304: stale was refreshed and served
+	negative       bool // an error response stored under Options.Negative
 }
 
 func (tw *teeWriter) Header() http.Header { return tw.rw.Header() }
@@ -61,17 +66,16 @@ func (tw *teeWriter) WriteHeader(code int) {
 	}
 	tw.wroteHeader = true
 	tw.status = code
+	if tw.validating && code == http.StatusNotModified {
+		tw.notModified()
+		return
+	}
+	if tw.stale != nil && tw.stale.expired {
+		tw.c.storage.Delete(tw.stale.key) // superseded by this response
+	}
 
 	h := tw.rw.Header()
-	reqAuthorized := tw.r.Header.Get("Authorization") != ""
-	now := time.Now()
-	var dec decision
-	if ov := tw.c.overrideFor(tw.r, code, h); ov != nil {
-		dec = decideForced(tw.method, code, h, reqAuthorized, tw.c.maxFileSize, tw.c.cacheChunked, now, ov)
-	} else {
-		dec = decide(tw.method, code, h, reqAuthorized, tw.c.maxFileSize, tw.c.cacheChunked, now)
-	}
-	if dec.cacheable {
+	if dec := tw.c.policy(tw.r, tw.method, code, h); dec.cacheable && !tw.gated(code) {
 		vary := append([]string(nil), dec.vary...)
 		sort.Strings(vary)
 		// Store under the key derived from THIS response's Vary + the request's
@@ -83,19 +87,8 @@ func (tw *teeWriter) WriteHeader(code int) {
 			tw.vary = vary
 			tw.tags = parseCacheTags(h)
 			tw.freshUntil = dec.freshUntil
-			tw.swr = dec.staleWhileRevalidate
-			tw.sie = dec.staleIfError
-			// Apply operator-configured default windows where the origin gave none
-			// (unless the response forbids stale serving). These live only in Meta,
-			// so the served Cache-Control stays the origin's.
-			if !dec.noStale {
-				if tw.swr == 0 {
-					tw.swr = tw.c.defaultSWR
-				}
-				if tw.sie == 0 {
-					tw.sie = tw.c.defaultSIE
-				}
-			}
+			tw.negative = dec.negative
+			tw.swr, tw.sie = tw.c.staleWindowsFor(dec)
 			tw.metaHeader = sanitizeHeader(h)
 			if cl, ok := contentLength(h); ok {
 				tw.hasCL = true
@@ -115,7 +108,7 @@ func (tw *teeWriter) WriteHeader(code int) {
 	// over-cap body would serve the leader a truncated response. Streaming it in
 	// lockstep instead always gives the leader exactly what the origin produced; the
 	// storage copy is still capped+aborted independently.
-	if tw.ew != nil && tw.hasCL && tw.c.decoupleFill && tw.lock != nil && tw.lock.waiters.Load() > 0 {
+	if tw.ew != nil && tw.hasCL && tw.contended() {
 		tw.deferredClient = true
 		return
 	}
@@ -123,10 +116,18 @@ func (tw *teeWriter) WriteHeader(code int) {
 	tw.rw.WriteHeader(code)
 }
 
+// contended reports a DecoupleFill fill with a follower already waiting on it.
+func (tw *teeWriter) contended() bool {
+	return tw.c.decoupleFill && tw.lock != nil && tw.lock.waiters.Load() > 0
+}
+
 func (tw *teeWriter) Write(p []byte) (int, error) {
 	if !tw.wroteHeader {
 		tw.WriteHeader(http.StatusOK)
 	}
+	if tw.revalidated {
+		return len(p), nil // a 304 has no body; the stored one was served
+	}
 	// DecoupleFill: don't touch (or block on) the client now — keep the leader's own
 	// copy of the body (capped at maxFileSize) and, independently, stream to storage.
 	// serveLeader writes the buffered copy to the client after the lock is released,
@@ -171,6 +172,30 @@ func (tw *teeWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// gated reports whether a stale gate swallows a response with status code. Such
+// an error is never stored: it would replace the entry served in its place.
+func (tw *teeWriter) gated(code int) bool {
+	g, ok := tw.rw.(*staleGate)
+	return ok && g.fallsBack(code)
+}
+
+// staleWindowsFor returns dec's RFC 5861 windows, with the operator-configured
+// defaults applied where the origin gave none (unless the response forbids stale
+// serving). These live only in Meta, so the served Cache-Control stays the
+// origin's.
+func (c *Cache) staleWindowsFor(dec decision) (swr, sie time.Duration) {
+	swr, sie = dec.staleWhileRevalidate, dec.staleIfError
+	if !dec.noStale {
+		if swr == 0 {
+			swr = c.defaultSWR
+		}
+		if sie == 0 {
+			sie = c.defaultSIE
+		}
+	}
+	return swr, sie
+}
+
 // abort stops caching this response and discards the in-progress entry.
 func (tw *teeWriter) abort() {
 	if tw.ew != nil {
@@ -182,10 +207,20 @@ func (tw *teeWriter) abort() {
 // finish commits the entry iff the body is complete; a truncated body (written !=
 // Content-Length) or an abort discards it. Runs after the upstream handler
 // returns (the client already has the full response) and before the caller
-// closes the fill lock, so waiting followers find the committed entry.
+// closes the fill lock, so waiting followers find the committed entry. Whether
+// a GET was stored decides if a later ranged miss fetches it whole (see
+// Cache.fillsWhole).
 func (tw *teeWriter) finish() {
+	stored := tw.commit()
+	if tw.method == http.MethodGet && !tw.revalidated && !tw.gated(tw.status) {
+		tw.c.setWholeFill(tw.primaryHex, stored)
+	}
+}
+
+// commit commits a complete entry, reporting whether it was stored.
+func (tw *teeWriter) commit() bool {
 	if tw.ew == nil {
-		return
+		return false
 	}
 	// Completeness: HEAD has no body; a Content-Length body must match exactly (a
 	// truncated one wrote fewer bytes). A chunked body (no Content-Length, only
@@ -198,14 +233,14 @@ func (tw *teeWriter) finish() {
 		(!tw.hasCL && tw.c.cacheChunked)
 	if !complete {
 		tw.abort()
-		return
+		return false
 	}
 	meta := Meta{
 		Status:               tw.status,
 		Header:               tw.metaHeader,
 		PrimaryHex:           tw.primaryHex,
 		Host:                 normalizeHost(tw.r.Host),
-		URI:                  tw.r.URL.RequestURI(),
+		URI:                  tw.c.key.URI(tw.r),
 		Vary:                 tw.vary,
 		Tags:                 tw.tags,
 		Created:              time.Now().UnixNano(),
@@ -213,11 +248,14 @@ func (tw *teeWriter) finish() {
 		StaleWhileRevalidate: int64(tw.swr),
 		StaleIfError:         int64(tw.sie),
 		Size:                 tw.written,
+		Negative:             tw.negative,
 	}
-	if err := tw.ew.Commit(meta); err == nil {
+	err := tw.ew.Commit(meta)
+	if err == nil {
 		tw.c.setPrimaryVary(tw.primaryHex, tw.vary)
 	}
 	tw.ew = nil
+	return err == nil
 }
 
 // serveLeader writes the response to the leader's client AFTER the fill lock has
@@ -227,12 +265,17 @@ func (tw *teeWriter) finish() {
 // sanitized response headers (hop-by-hop stripped, like a stored entry) tagged MISS,
 // since this request contacted the origin. A truncated/over-cap fill simply yields
 // the bytes the origin actually wrote (matching the lockstep path); HEAD and bodiless
-// statuses carry no body.
+// statuses carry no body. A revalidated leader is served the refreshed entry,
+// as notModified would have.
 func (tw *teeWriter) serveLeader() {
 	h := tw.rw.Header()
 	for k := range h { // drop the origin's raw (unsanitized) headers
 		delete(h, k)
 	}
+	if tw.revalidated {
+		writeStored(tw.rw, tw.r, tw.refreshed, tw.stale.body, "REVALIDATED")
+		return
+	}
 	for k, vs := range tw.metaHeader {
 		h[k] = append([]string(nil), vs...)
 	}
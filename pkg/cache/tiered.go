@@ -0,0 +1,512 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultWriteBackConcurrency bounds the background L2 writes of a write-back
+// TieredStorage; a commit past it writes L2 inline.
+const defaultWriteBackConcurrency = 16
+
+// errTierNotUpdater is TieredStorage.UpdateMeta's error when a tier is not a
+// MetaUpdater: the cache then rewrites the entry through Writer, into both tiers.
+var errTierNotUpdater = errors.New("cache: tier does not support UpdateMeta")
+
+// TierResult is the tier a TieredStorage.Get was answered from.
+type TierResult string
+
+// Tier results.
+const (
+	TierL1   TierResult = "L1"   // the memory tier (or a write-back still in flight)
+	TierL2   TierResult = "L2"   // the disk tier; the entry is promoted into L1
+	TierMiss TierResult = "MISS" // neither tier
+)
+
+// TierFunc observes the tier each TieredStorage.Get was answered from.
+type TierFunc func(TierResult)
+
+// TieredOptions configures a TieredStorage.
+type TieredOptions struct {
+	// WriteBack commits a fill to L1 only and writes it to L2 in the background,
+	// so the response never waits on the disk; until then the entry is served
+	// from memory. The default is write-through: a fill is committed to L2, then
+	// L1, and fails when L2 fails. Call Flush before shutdown to finish pending
+	// writes.
+	WriteBack bool
+
+	// MaxPromoteSize caps the body size of an entry held in L1, whether filled or
+	// promoted; larger entries live in L2 only, so a few huge objects can't churn
+	// the memory tier. It is clamped to L1's capacity when L1 reports one (a
+	// MemoryStorage), since a larger entry would only be evicted on arrival; 0
+	// means that capacity, or no cap for another L1.
+	MaxPromoteSize int64
+
+	// WriteBackConcurrency bounds the concurrent background L2 writes in
+	// WriteBack mode; a commit past it writes L2 inline. 0 means 16.
+	WriteBackConcurrency int
+
+	// OnGet, if set, is called with the tier each Get was answered from, e.g. to
+	// export per-tier hit ratios (see prom.CacheTier). It runs on the serving
+	// path and must be fast.
+	OnGet TierFunc
+}
+
+// TieredStorage is a two-tier Storage: a small, fast L1 (typically a
+// [MemoryStorage]) in front of a large L2 (typically a [DiskStorage]). A Get
+// that misses L1 but hits L2 promotes the entry into L1, so hot entries are
+// served from memory; fills are written through to both tiers, or back to L2
+// asynchronously (TieredOptions.WriteBack). Delete, UpdateMeta and Range span
+// both tiers, so purging (including purge.Table.Reap) and revalidation see one
+// store. Each tier bounds its own size; the tiers must not be shared with
+// another Cache or TieredStorage.
+type TieredStorage struct {
+	l1, l2     Storage
+	writeBack  bool
+	maxPromote int64 // the largest body held in L1; < 0 means no cap
+	onGet      TierFunc
+
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	pending map[string]*pendingWrite // write-back entries not yet committed to L2
+
+	deletes atomic.Uint64 // bumped by Delete, so a racing promotion can back out
+
+	l1Hits, l2Hits, misses, promotions, writeBacks atomic.Uint64
+}
+
+// boundedStorage is a Storage that reports its byte capacity, so a
+// TieredStorage never promotes an entry its L1 can't hold.
+type boundedStorage interface {
+	capacity() int64
+}
+
+// pendingWrite is a write-back fill awaiting its L2 commit.
+type pendingWrite struct {
+	meta Meta
+	body []byte
+}
+
+// NewTiered creates a TieredStorage with l1 in front of l2.
+func NewTiered(l1, l2 Storage, opts TieredOptions) *TieredStorage {
+	n := opts.WriteBackConcurrency
+	if n <= 0 {
+		n = defaultWriteBackConcurrency
+	}
+	maxPromote := int64(-1)
+	if opts.MaxPromoteSize > 0 {
+		maxPromote = opts.MaxPromoteSize
+	}
+	if b, ok := l1.(boundedStorage); ok {
+		if c := max(b.capacity(), 0); maxPromote < 0 || c < maxPromote {
+			maxPromote = c
+		}
+	}
+	return &TieredStorage{
+		l1:         l1,
+		l2:         l2,
+		writeBack:  opts.WriteBack,
+		maxPromote: maxPromote,
+		onGet:      opts.OnGet,
+		sem:        make(chan struct{}, n),
+		pending:    map[string]*pendingWrite{},
+	}
+}
+
+// Get returns the entry from L1, a pending write-back, or L2, promoting an L2
+// hit into L1.
+func (t *TieredStorage) Get(key string) (Meta, []byte, bool) {
+	if m, body, ok := t.l1.Get(key); ok {
+		t.observe(TierL1, &t.l1Hits)
+		return m, body, true
+	}
+	if m, body, ok := t.getPending(key); ok { // L1 evicted it before its write-back landed
+		t.observe(TierL1, &t.l1Hits)
+		return m, body, true
+	}
+
+	deletes := t.deletes.Load()
+	m, body, ok := t.l2.Get(key)
+	if !ok {
+		t.observe(TierMiss, &t.misses)
+		return Meta{}, nil, false
+	}
+	t.observe(TierL2, &t.l2Hits)
+	if t.fitsL1(int64(len(body))) {
+		t.promote(key, m, body, deletes)
+	}
+	return m, body, true
+}
+
+// Open is Get streaming the body: an L2 entry too large for L1 is served from
+// its open file, never read whole.
+func (t *TieredStorage) Open(key string) (Meta, io.ReadSeekCloser, bool) {
+	if m, body, ok := openEntry(t.l1, key); ok {
+		t.observe(TierL1, &t.l1Hits)
+		return m, body, true
+	}
+	if m, body, ok := t.getPending(key); ok {
+		t.observe(TierL1, &t.l1Hits)
+		return m, bytesBody(body), true
+	}
+
+	deletes := t.deletes.Load()
+	m, body, ok := openEntry(t.l2, key)
+	if !ok {
+		t.observe(TierMiss, &t.misses)
+		return Meta{}, nil, false
+	}
+	t.observe(TierL2, &t.l2Hits)
+	if t.fitsL1(m.Size) {
+		b, err := io.ReadAll(body)
+		if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil || int64(len(b)) != m.Size {
+			body.Close()
+			return Meta{}, nil, false
+		}
+		t.promote(key, m, b, deletes)
+	}
+	return m, body, true
+}
+
+// getPending returns key's write-back awaiting its L2 commit, if any.
+func (t *TieredStorage) getPending(key string) (Meta, []byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.pending[key]
+	if p == nil {
+		return Meta{}, nil, false
+	}
+	return cloneMeta(p.meta), p.body, true
+}
+
+func (t *TieredStorage) observe(tier TierResult, n *atomic.Uint64) {
+	n.Add(1)
+	if t.onGet != nil {
+		t.onGet(tier)
+	}
+}
+
+func (t *TieredStorage) fitsL1(size int64) bool {
+	return t.maxPromote < 0 || size <= t.maxPromote
+}
+
+// promote copies an L2 hit into L1. A Delete since deletes was read may have
+// missed the new L1 copy, so it is dropped again and not counted.
+func (t *TieredStorage) promote(key string, m Meta, body []byte, deletes uint64) {
+	ew, err := t.l1.Writer(key)
+	if err != nil {
+		return
+	}
+	if _, err := ew.Write(body); err != nil {
+		ew.Abort()
+		return
+	}
+	if ew.Commit(cloneMeta(m)) != nil {
+		return
+	}
+	if t.deletes.Load() != deletes {
+		t.l1.Delete(key)
+		return
+	}
+	t.promotions.Add(1)
+}
+
+// Writer streams a fill into the tiers: to both for write-through, to L1 (and a
+// buffer for the later L2 write) for write-back. A body outgrowing
+// MaxPromoteSize is dropped from L1 and written through to L2.
+func (t *TieredStorage) Writer(key string) (EntryWriter, error) {
+	tw := &tieredWriter{t: t, key: key}
+	l1, err := t.l1.Writer(key)
+	if err == nil {
+		tw.l1 = l1
+	}
+	if !t.writeBack || tw.l1 == nil {
+		if err := tw.openL2(); err != nil {
+			tw.Abort()
+			return nil, err
+		}
+	}
+	return tw, nil
+}
+
+// Delete removes the entry from both tiers and cancels its pending write-back.
+func (t *TieredStorage) Delete(key string) {
+	t.deletes.Add(1)
+	t.mu.Lock()
+	delete(t.pending, key)
+	t.mu.Unlock()
+	t.l1.Delete(key)
+	t.l2.Delete(key)
+}
+
+// UpdateMeta replaces the entry's Meta in every tier holding it. It fails,
+// changing nothing, when either tier is not a MetaUpdater, and with errNoEntry
+// when no tier holds the entry.
+func (t *TieredStorage) UpdateMeta(key string, meta Meta) error {
+	u1, ok1 := t.l1.(MetaUpdater)
+	u2, ok2 := t.l2.(MetaUpdater)
+	if !ok1 || !ok2 {
+		return errTierNotUpdater
+	}
+	updated := false
+	t.mu.Lock()
+	if p := t.pending[key]; p != nil {
+		meta.Size = p.meta.Size
+		p.meta = cloneMeta(meta)
+		updated = true
+	}
+	t.mu.Unlock()
+	if u1.UpdateMeta(key, meta) == nil {
+		updated = true
+	}
+	if u2.UpdateMeta(key, meta) == nil {
+		updated = true
+	}
+	if !updated {
+		return errNoEntry
+	}
+	return nil
+}
+
+// Range visits each key once across both tiers and pending write-backs. fn may
+// Delete the key, which removes it from every tier.
+func (t *TieredStorage) Range(fn func(key string, m Meta) bool) {
+	seen := map[string]struct{}{}
+	stopped := false
+	visit := func(key string, m Meta) bool {
+		if _, ok := seen[key]; ok {
+			return true
+		}
+		seen[key] = struct{}{}
+		if !fn(key, m) {
+			stopped = true
+		}
+		return !stopped
+	}
+	t.l1.Range(visit)
+	if stopped {
+		return
+	}
+	t.mu.Lock()
+	pending := make(map[string]Meta, len(t.pending))
+	for k, p := range t.pending {
+		pending[k] = cloneMeta(p.meta)
+	}
+	t.mu.Unlock()
+	for k, m := range pending {
+		if !visit(k, m) {
+			return
+		}
+	}
+	t.l2.Range(visit)
+}
+
+// Flush waits for the pending write-backs to reach L2.
+func (t *TieredStorage) Flush() {
+	t.wg.Wait()
+}
+
+// TierStats is a snapshot of a TieredStorage's counters.
+type TierStats struct {
+	L1Hits     uint64 // Gets answered from L1
+	L2Hits     uint64 // Gets answered from L2
+	Misses     uint64 // Gets answered by neither tier
+	Promotions uint64 // L2 hits copied into L1
+	WriteBacks uint64 // fills written to L2 in the background
+}
+
+// L1HitRatio is the share of all Gets answered from L1.
+func (s TierStats) L1HitRatio() float64 {
+	return ratio(s.L1Hits, s.L1Hits+s.L2Hits+s.Misses)
+}
+
+// L2HitRatio is the share of the Gets that missed L1 answered from L2.
+func (s TierStats) L2HitRatio() float64 {
+	return ratio(s.L2Hits, s.L2Hits+s.Misses)
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Stats returns a snapshot of the tier counters.
+func (t *TieredStorage) Stats() TierStats {
+	return TierStats{
+		L1Hits:     t.l1Hits.Load(),
+		L2Hits:     t.l2Hits.Load(),
+		Misses:     t.misses.Load(),
+		Promotions: t.promotions.Load(),
+		WriteBacks: t.writeBacks.Load(),
+	}
+}
+
+// writeBackL2 hands a committed write-back fill to a background L2 write, or
+// writes it inline when WriteBackConcurrency writes are already running.
+func (t *TieredStorage) writeBackL2(key string, meta Meta, body []byte) {
+	p := &pendingWrite{meta: cloneMeta(meta), body: body}
+	t.mu.Lock()
+	t.pending[key] = p
+	t.mu.Unlock()
+	t.writeBacks.Add(1)
+	t.wg.Add(1)
+	select {
+	case t.sem <- struct{}{}:
+		go func() {
+			defer func() { <-t.sem }()
+			t.flushL2(key, p)
+		}()
+	default:
+		t.flushL2(key, p)
+	}
+}
+
+// flushL2 writes p to L2 unless a Delete or a newer fill superseded it
+// meanwhile. The commit happens under t.mu, so a Delete either cancels it or
+// follows it.
+func (t *TieredStorage) flushL2(key string, p *pendingWrite) {
+	defer t.wg.Done()
+	ew, err := t.l2.Writer(key)
+	if err != nil {
+		t.dropPending(key, p)
+		return
+	}
+	if _, err := ew.Write(p.body); err != nil {
+		ew.Abort()
+		t.dropPending(key, p)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[key] != p {
+		ew.Abort()
+		return
+	}
+	delete(t.pending, key)
+	_ = ew.Commit(p.meta)
+}
+
+func (t *TieredStorage) dropPending(key string, p *pendingWrite) {
+	t.mu.Lock()
+	if t.pending[key] == p {
+		delete(t.pending, key)
+	}
+	t.mu.Unlock()
+}
+
+// commitL2 commits a written-through fill to L2. In WriteBack mode (a body too
+// large for L1) it cancels any pending write-back of the key and commits under
+// t.mu, so an older write-back can't land over it.
+func (t *TieredStorage) commitL2(key string, ew EntryWriter, meta Meta) error {
+	if !t.writeBack {
+		return ew.Commit(meta)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, key)
+	return ew.Commit(meta)
+}
+
+// tieredWriter is TieredStorage's EntryWriter. l1 is nil once the body outgrew
+// MaxPromoteSize (or L1 failed); l2 is nil while a write-back fill is held in
+// memory, its body in buf.
+type tieredWriter struct {
+	t    *TieredStorage
+	key  string
+	l1   EntryWriter
+	l2   EntryWriter
+	buf  bytes.Buffer
+	n    int64
+	done bool
+}
+
+func (w *tieredWriter) openL2() error {
+	l2, err := w.t.l2.Writer(w.key)
+	if err != nil {
+		return err
+	}
+	w.l2 = l2
+	if w.buf.Len() > 0 {
+		_, err = l2.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+	return err
+}
+
+// dropL1 gives up on L1 for this fill; a write-back fill becomes write-through.
+func (w *tieredWriter) dropL1() error {
+	w.l1.Abort()
+	w.l1 = nil
+	if w.l2 == nil {
+		return w.openL2()
+	}
+	return nil
+}
+
+func (w *tieredWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	if w.l1 != nil && !w.t.fitsL1(w.n) {
+		if err := w.dropL1(); err != nil {
+			return 0, err
+		}
+	}
+	if w.l1 != nil {
+		if _, err := w.l1.Write(p); err != nil {
+			if err := w.dropL1(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if w.l2 != nil {
+		return w.l2.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+// Commit commits L2 before L1 when writing through, so an entry is in L1 only if
+// L2 took it; a write-back fill commits L1 and queues its L2 write.
+func (w *tieredWriter) Commit(meta Meta) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.l2 == nil {
+		if err := w.l1.Commit(meta); err != nil {
+			return err
+		}
+		w.t.writeBackL2(w.key, meta, bytes.Clone(w.buf.Bytes()))
+		return nil
+	}
+	if err := w.t.commitL2(w.key, w.l2, meta); err != nil {
+		if w.l1 != nil {
+			w.l1.Abort()
+		}
+		return err
+	}
+	if w.l1 != nil {
+		return w.l1.Commit(meta)
+	}
+	// The new body skipped L1: drop any older copy there.
+	w.t.l1.Delete(w.key)
+	return nil
+}
+
+func (w *tieredWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	if w.l1 != nil {
+		w.l1.Abort()
+	}
+	if w.l2 != nil {
+		w.l2.Abort()
+	}
+	w.buf.Reset()
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTiered(t *testing.T, opts TieredOptions) (*TieredStorage, *MemoryStorage, *DiskStorage) {
+	t.Helper()
+	l1 := NewMemory(1 << 20)
+	l2, err := NewDisk(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	return NewTiered(l1, l2, opts), l1, l2
+}
+
+func tierMeta(size int) Meta {
+	return Meta{Status: http.StatusOK, Header: http.Header{}, FreshUntil: time.Now().Add(time.Hour).UnixNano(), Size: int64(size)}
+}
+
+func TestTiered_WriteThroughAndPromote(t *testing.T) {
+	var tiers []TierResult
+	s, l1, l2 := newTiered(t, TieredOptions{OnGet: func(r TierResult) { tiers = append(tiers, r) }})
+	key := "0123456789abcdef0123456789abcdef"
+	storePut(t, s, key, tierMeta(3), []byte("abc"))
+	_, _, ok := l1.Get(key)
+	assert.True(t, ok, "written to L1")
+	_, _, ok = l2.Get(key)
+	assert.True(t, ok, "written through to L2")
+
+	l1.Delete(key) // as if L1 evicted it
+	_, body, ok := s.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, "abc", string(body))
+	_, _, ok = l1.Get(key)
+	assert.True(t, ok, "an L2 hit is promoted")
+	_, _, ok = s.Get(key)
+	assert.True(t, ok)
+	_, _, ok = s.Get("ffffffffffffffffffffffffffffffff")
+	assert.False(t, ok)
+
+	assert.Equal(t, []TierResult{TierL2, TierL1, TierMiss}, tiers)
+	st := s.Stats()
+	assert.Equal(t, TierStats{L1Hits: 1, L2Hits: 1, Misses: 1, Promotions: 1}, st)
+	assert.InDelta(t, 1.0/3, st.L1HitRatio(), 1e-9)
+	assert.InDelta(t, 0.5, st.L2HitRatio(), 1e-9)
+}
+
+func TestTiered_MaxPromoteSize(t *testing.T) {
+	s, l1, l2 := newTiered(t, TieredOptions{MaxPromoteSize: 4})
+	small, large := "00000000000000000000000000000001", "00000000000000000000000000000002"
+	storePut(t, s, small, tierMeta(3), []byte("abc"))
+	storePut(t, s, large, tierMeta(6), []byte("abcdef"))
+
+	_, _, ok := l1.Get(large)
+	assert.False(t, ok, "too large for L1")
+	_, body, ok := s.Get(large)
+	require.True(t, ok)
+	assert.Equal(t, "abcdef", string(body))
+	_, _, ok = l1.Get(large)
+	assert.False(t, ok, "too large to promote")
+	_, _, ok = l2.Get(small)
+	assert.True(t, ok)
+}
+
+func TestTiered_Open(t *testing.T) {
+	s, l1, _ := newTiered(t, TieredOptions{MaxPromoteSize: 4})
+	small, large := "00000000000000000000000000000001", "00000000000000000000000000000002"
+	storePut(t, s, small, tierMeta(3), []byte("abc"))
+	storePut(t, s, large, tierMeta(6), []byte("abcdef"))
+	l1.Delete(small)
+
+	_, body, ok := s.Open(large)
+	require.True(t, ok)
+	assert.IsType(t, (*os.File)(nil), body, "too large for L1: streamed from L2")
+	b, _ := io.ReadAll(body)
+	assert.Equal(t, "abcdef", string(b))
+	body.Close()
+
+	m, body, ok := s.Open(small)
+	require.True(t, ok)
+	b, _ = io.ReadAll(body)
+	assert.Equal(t, "abc", string(b), "read from the start after promotion")
+	assert.EqualValues(t, 3, m.Size)
+	body.Close()
+	_, _, ok = l1.Get(small)
+	assert.True(t, ok, "promoted")
+	assert.Equal(t, TierStats{L2Hits: 2, Promotions: 1}, s.Stats())
+}
+
+func TestTiered_PromoteWithinL1Capacity(t *testing.T) {
+	l1 := NewMemory(4)
+	l2, err := NewDisk(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	s := NewTiered(l1, l2, TieredOptions{}) // no MaxPromoteSize: L1's capacity caps it
+	small, large := "00000000000000000000000000000001", "00000000000000000000000000000002"
+	storePut(t, s, small, tierMeta(3), []byte("abc"))
+	storePut(t, s, large, tierMeta(6), []byte("abcdef"))
+	l1.Delete(small)
+
+	_, body, ok := s.Open(large)
+	require.True(t, ok)
+	assert.IsType(t, (*os.File)(nil), body, "larger than L1: streamed from L2, not read whole")
+	body.Close()
+	_, _, ok = s.Get(large)
+	require.True(t, ok)
+	_, _, ok = s.Get(small)
+	require.True(t, ok)
+	_, _, ok = l1.Get(small)
+	assert.True(t, ok, "promoted")
+	assert.Equal(t, TierStats{L2Hits: 3, Promotions: 1}, s.Stats(), "only the kept promotion counts")
+}
+
+func TestTiered_WriteBack(t *testing.T) {
+	s, l1, l2 := newTiered(t, TieredOptions{WriteBack: true, MaxPromoteSize: 4})
+	key := "0123456789abcdef0123456789abcdef"
+	storePut(t, s, key, tierMeta(3), []byte("abc"))
+	_, _, ok := l1.Get(key)
+	assert.True(t, ok)
+	s.Flush()
+	_, body, ok := l2.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, "abc", string(body))
+	assert.EqualValues(t, 1, s.Stats().WriteBacks)
+
+	large := "00000000000000000000000000000002"
+	storePut(t, s, large, tierMeta(6), []byte("abcdef"))
+	_, _, ok = l2.Get(large)
+	assert.True(t, ok, "a body too large for L1 is written through")
+	assert.EqualValues(t, 1, s.Stats().WriteBacks)
+}
+
+func TestTiered_WriteBackPendingServedAndDeleted(t *testing.T) {
+	s, l1, l2 := newTiered(t, TieredOptions{WriteBack: true})
+	key := "0123456789abcdef0123456789abcdef"
+	p := &pendingWrite{meta: tierMeta(3), body: []byte("abc")}
+	s.pending[key] = p // a write-back not yet flushed, already evicted from L1
+
+	_, body, ok := s.Get(key)
+	require.True(t, ok)
+	assert.Equal(t, "abc", string(body))
+	n := 0
+	s.Range(func(string, Meta) bool { n++; return true })
+	assert.Equal(t, 1, n)
+
+	s.Delete(key)
+	s.wg.Add(1)
+	s.flushL2(key, p)
+	_, _, ok = l2.Get(key)
+	assert.False(t, ok, "a deleted write-back never lands")
+	_, _, ok = l1.Get(key)
+	assert.False(t, ok)
+}
+
+func TestTiered_DeleteRangeUpdateMeta(t *testing.T) {
+	s, l1, l2 := newTiered(t, TieredOptions{})
+	a, b := "00000000000000000000000000000001", "00000000000000000000000000000002"
+	storePut(t, s, a, tierMeta(1), []byte("a"))
+	storePut(t, s, b, tierMeta(1), []byte("b"))
+	l1.Delete(b) // b only in L2
+
+	var keys []string
+	s.Range(func(key string, _ Meta) bool {
+		keys = append(keys, key)
+		s.Delete(key)
+		return true
+	})
+	assert.ElementsMatch(t, []string{a, b}, keys, "each key visited once")
+	for _, st := range []Storage{l1, l2} {
+		n := 0
+		st.Range(func(string, Meta) bool { n++; return true })
+		assert.Zero(t, n, "Delete spans both tiers")
+	}
+
+	assert.Error(t, s.UpdateMeta(a, tierMeta(1)))
+	storePut(t, s, a, tierMeta(1), []byte("a"))
+	m := tierMeta(1)
+	m.Header.Set("X-A", "2")
+	require.NoError(t, s.UpdateMeta(a, m))
+	for _, st := range []Storage{l1, l2} {
+		got, _, ok := st.Get(a)
+		require.True(t, ok)
+		assert.Equal(t, "2", got.Header.Get("X-A"))
+	}
+}
+
+func TestCache_Tiered(t *testing.T) {
+	s, l1, _ := newTiered(t, TieredOptions{})
+	c := New(s, Options{MaxFileSize: 1024})
+	var calls int32
+	h := origin(originSpec{body: []byte("hello"), header: hdr("Cache-Control", "max-age=60")}, &calls)
+
+	assert.Equal(t, "MISS", do(c, h, "GET", "/x", nil).Header().Get("X-Cache"))
+	l1.Range(func(key string, _ Meta) bool { l1.Delete(key); return true })
+	rec := do(c, h, "GET", "/x", nil)
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.EqualValues(t, 1, calls)
+	assert.EqualValues(t, 1, s.Stats().Promotions)
+}
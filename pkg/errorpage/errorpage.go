@@ -0,0 +1,215 @@
+package errorpage
+
+import (
+	"bufio"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/moonrhythm/parapet/pkg/header"
+)
+
+// StatusMatcher reports whether a response status is replaced.
+type StatusMatcher func(code int) bool
+
+// Status matches the given status codes.
+func Status(codes ...int) StatusMatcher {
+	return func(code int) bool {
+		return slices.Contains(codes, code)
+	}
+}
+
+// StatusRange matches status codes from min to max, inclusive.
+func StatusRange(min, max int) StatusMatcher {
+	return func(code int) bool {
+		return code >= min && code <= max
+	}
+}
+
+// Rule replaces the responses it matches with Page.
+type Rule struct {
+	Status      StatusMatcher // required
+	ContentType []string      // origin media types to match (e.g. "text/html"); empty matches any
+	Host        []string      // request hosts to match, without port; empty matches any
+	Page        Page
+	StatusCode  int // status to answer with; 0 keeps the origin's
+}
+
+func (rule *Rule) match(r *http.Request, code int, h http.Header) bool {
+	if !rule.Status(code) {
+		return false
+	}
+	if len(rule.ContentType) > 0 {
+		ct, _, _ := mime.ParseMediaType(header.Get(h, header.ContentType))
+		if !slices.Contains(rule.ContentType, ct) {
+			return false
+		}
+	}
+	if len(rule.Host) > 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !slices.ContainsFunc(rule.Host, func(s string) bool { return strings.EqualFold(s, host) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// New creates new error page middleware
+func New(rules ...Rule) *ErrorPage {
+	return &ErrorPage{Rules: rules}
+}
+
+// ErrorPage replaces responses from the rest of the chain by status, for
+// example an origin's 404 or 5xx, with its own pages. It intercepts at
+// WriteHeader like headers.ResponseInterceptor: a matched response's headers and
+// body are discarded and the first matching Rule's Page is served instead, while
+// any other response streams through untouched.
+type ErrorPage struct {
+	Rules []Rule
+}
+
+// ServeHandler implements middleware interface
+func (m ErrorPage) ServeHandler(h http.Handler) http.Handler {
+	for _, rule := range m.Rules {
+		if rule.Status == nil || rule.Page == nil {
+			panic("errorpage: Rule.Status and Rule.Page must be set")
+		}
+	}
+	if len(m.Rules) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nw := responseWriter{
+			ResponseWriter: w,
+			m:              &m,
+			r:              r,
+			base:           w.Header().Clone(),
+			header:         w.Header().Clone(),
+		}
+		defer nw.finish()
+
+		h.ServeHTTP(&nw, r)
+	})
+}
+
+// responseWriter holds the chain's headers in its own map until the status is
+// known. The headers set ahead of the middleware are kept in base, so a replaced
+// response starts over from them rather than from the origin's.
+type responseWriter struct {
+	http.ResponseWriter
+
+	m           *ErrorPage
+	r           *http.Request
+	base        http.Header
+	header      http.Header
+	rule        *Rule
+	status      int
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	if w.wroteHeader && w.rule == nil {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// an informational response (103 Early Hints) goes out as is
+		w.sync(w.header)
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.wroteHeader = true
+	w.status = code
+	for i := range w.m.Rules {
+		if w.m.Rules[i].match(w.r, code, w.header) {
+			w.rule = &w.m.Rules[i]
+			return // served in finish, once the origin is done
+		}
+	}
+	w.sync(w.header)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// sync makes the underlying header map equal h.
+func (w *responseWriter) sync(h http.Header) {
+	dst := w.ResponseWriter.Header()
+	clear(dst)
+	maps.Copy(dst, h)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rule != nil {
+		return len(p), nil // the replaced body is discarded
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) finish() {
+	if !w.wroteHeader && !w.hijacked {
+		// a handler that only set headers still sends them, with the implicit 200
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rule == nil {
+		return
+	}
+	w.sync(w.base)
+	status := w.status
+	if w.rule.StatusCode != 0 {
+		status = w.rule.StatusCode
+	}
+	w.rule.Page(w.ResponseWriter, w.r, status)
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Push implements Pusher interface
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if w, ok := w.ResponseWriter.(http.Pusher); ok {
+		return w.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Flush implements Flusher interface
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rule != nil {
+		return
+	}
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+// Hijack implements Hijacker interface
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		conn, rw, err := hj.Hijack()
+		w.hijacked = err == nil
+		return conn, rw, err
+	}
+	return nil, nil, http.ErrNotSupported
+}
@@ -0,0 +1,191 @@
+package errorpage_test
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/moonrhythm/parapet/pkg/errorpage"
+	"github.com/moonrhythm/parapet/pkg/requestid"
+)
+
+func origin(status int, contentType, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Origin", "1")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+		w.WriteHeader(http.StatusTeapot) // a second WriteHeader is ignored
+	})
+}
+
+func TestErrorPage_Template(t *testing.T) {
+	t.Parallel()
+
+	tmpl := template.Must(template.New("").Parse(`<h1>{{.StatusCode}} {{.StatusText}}</h1><p>{{.Path}} {{.RequestID}}</p>`))
+	m := New(Rule{Status: Status(http.StatusNotFound), Page: Template(tmpl)})
+	h := requestid.New().ServeHandler(m.ServeHandler(origin(http.StatusNotFound, "text/plain", "origin 404")))
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "<h1>404 Not Found</h1><p>/missing req-1</p>", w.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("X-Origin"), "the origin's headers are discarded")
+	assert.Equal(t, "req-1", w.Header().Get("X-Request-Id"), "headers set ahead are kept")
+}
+
+func TestErrorPage_PassThrough(t *testing.T) {
+	t.Parallel()
+
+	m := New(Rule{Status: StatusRange(500, 599), Page: Template(template.Must(template.New("").Parse("x")))})
+	h := m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Origin", "1")
+		io.WriteString(w, "chunk")
+		w.(http.Flusher).Flush()
+		assert.Equal(t, "1", w.Header().Get("X-Origin"))
+		w.Header().Set("X-Late", "1") // too late: headers are sent
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "chunk", w.Body.String())
+	assert.True(t, w.Flushed, "streaming is preserved")
+	assert.Equal(t, "1", w.Header().Get("X-Origin"))
+}
+
+func TestErrorPage_HeadersOnly(t *testing.T) {
+	t.Parallel()
+
+	m := New(Rule{Status: Status(http.StatusNotFound), Page: Template(template.Must(template.New("").Parse("x")))})
+	h := m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Add("Set-Cookie", "a=1")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "the implicit 200 keeps the handler's headers")
+	assert.Equal(t, "a=1", w.Header().Get("Set-Cookie"))
+}
+
+func TestErrorPage_File(t *testing.T) {
+	t.Parallel()
+
+	fn := filepath.Join(t.TempDir(), "50x.html")
+	os.WriteFile(fn, []byte("<p>down for maintenance</p>"), 0o644)
+
+	m := New(Rule{Status: StatusRange(500, 599), Page: File(fn), StatusCode: http.StatusServiceUnavailable})
+	w := httptest.NewRecorder()
+	m.ServeHandler(origin(http.StatusBadGateway, "text/plain", "bad gateway")).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "<p>down for maintenance</p>", w.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+
+	t.Run("detected type, concurrently", func(t *testing.T) {
+		fn := filepath.Join(t.TempDir(), "page")
+		os.WriteFile(fn, []byte("<html><p>oops</p></html>"), 0o644)
+		h := New(Rule{Status: Status(500), Page: File(fn)}).ServeHandler(origin(500, "text/plain", "boom"))
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		m := New(Rule{Status: Status(500), Page: File(filepath.Join(t.TempDir(), "none.html"))})
+		w := httptest.NewRecorder()
+		m.ServeHandler(origin(500, "text/plain", "boom")).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, 500, w.Code)
+		assert.Equal(t, "Internal Server Error\n", w.Body.String())
+	})
+}
+
+func TestErrorPage_Match(t *testing.T) {
+	t.Parallel()
+
+	page := func(w http.ResponseWriter, _ *http.Request, status int) {
+		w.WriteHeader(status)
+		io.WriteString(w, "replaced")
+	}
+	m := New(Rule{
+		Status:      Status(http.StatusNotFound),
+		ContentType: []string{"text/html"},
+		Host:        []string{"www.example.com"},
+		Page:        page,
+	})
+
+	for _, tc := range []struct {
+		name, host, ct string
+		want           string
+	}{
+		{"match", "www.example.com:8080", "text/html; charset=utf-8", "replaced"},
+		{"other content type", "www.example.com", "application/json", "origin"},
+		{"other host", "api.example.com", "text/html", "origin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = tc.host
+			w := httptest.NewRecorder()
+			m.ServeHandler(origin(http.StatusNotFound, tc.ct, "origin")).ServeHTTP(w, r)
+			assert.Equal(t, http.StatusNotFound, w.Code)
+			assert.Equal(t, tc.want, w.Body.String())
+		})
+	}
+}
+
+func TestErrorPage_SubRequest(t *testing.T) {
+	t.Parallel()
+
+	pages := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GET", r.Method)
+		if r.URL.Path != "/errors/502.html" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<p>we'll be right back</p>")
+	})
+
+	m := New(
+		Rule{Status: Status(http.StatusBadGateway), Page: SubRequest(pages, "/errors/502.html")},
+		Rule{Status: Status(http.StatusInternalServerError), Page: SubRequest(pages, "/errors/missing.html")},
+	)
+
+	w := httptest.NewRecorder()
+	m.ServeHandler(origin(http.StatusBadGateway, "text/plain", "origin")).ServeHTTP(w, httptest.NewRequest("POST", "/api", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "<p>we'll be right back</p>", w.Body.String())
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	m.ServeHandler(origin(http.StatusInternalServerError, "text/plain", "origin")).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "Internal Server Error\n", w.Body.String(), "a failed sub-request falls back")
+}
+
+func TestErrorPage_Panics(t *testing.T) {
+	t.Parallel()
+
+	assert.Panics(t, func() { New(Rule{Status: Status(404)}).ServeHandler(http.NotFoundHandler()) })
+}
@@ -0,0 +1,37 @@
+package errorpage_test
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/errorpage"
+	"github.com/moonrhythm/parapet/pkg/fileserver"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+// Replace an origin's HTML 404 with a branded template, and any 5xx, including
+// the proxy's own 502/504, with a static maintenance page served as a 503.
+// Responses that match no rule, such as a JSON 404 from an API, stream through.
+func ExampleNew() {
+	notFound := template.Must(template.New("404").Parse(
+		`<h1>{{.StatusText}}</h1><p>{{.Path}} was not found (request {{.RequestID}})</p>`,
+	))
+
+	pages := fileserver.New("/var/www/errors").ServeHandler(http.NotFoundHandler())
+
+	s := parapet.New()
+	s.Use(errorpage.New(
+		errorpage.Rule{
+			Status:      errorpage.Status(404),
+			ContentType: []string{"text/html"},
+			Page:        errorpage.Template(notFound),
+		},
+		errorpage.Rule{
+			Status:     errorpage.StatusRange(500, 599),
+			Page:       errorpage.SubRequest(pages, "/maintenance.html"),
+			StatusCode: 503,
+		},
+	))
+	s.Use(upstream.SingleHost("10.0.0.1:8080", &upstream.HTTPTransport{}))
+}
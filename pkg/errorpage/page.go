@@ -0,0 +1,144 @@
+package errorpage
+
+import (
+	"bytes"
+	"html/template"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/moonrhythm/parapet/pkg/header"
+	"github.com/moonrhythm/parapet/pkg/requestid"
+)
+
+// Page writes a replacement response with the given status. The response's
+// headers start from those set ahead of the ErrorPage middleware.
+type Page func(w http.ResponseWriter, r *http.Request, status int)
+
+// Data is the value a Template page is executed with.
+type Data struct {
+	StatusCode int
+	StatusText string
+	Host       string
+	Path       string
+	RequestID  string // the pkg/requestid id, or "" without that middleware
+}
+
+// File serves the named file. It is read on every use, so the page can be
+// edited in place; the Content-Type comes from the file extension. A file that
+// cannot be read falls back to the plain status text.
+func File(name string) Page {
+	ct := mime.TypeByExtension(filepath.Ext(name))
+	return func(w http.ResponseWriter, r *http.Request, status int) {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		ctype := ct
+		if ctype == "" {
+			ctype = http.DetectContentType(b)
+		}
+		write(w, ctype, status, b)
+	}
+}
+
+// Template executes t with a Data for the response as an HTML page. An
+// execution error falls back to the plain status text.
+func Template(t *template.Template) Page {
+	return func(w http.ResponseWriter, r *http.Request, status int) {
+		id, _ := requestid.FromContext(r.Context())
+		var buf bytes.Buffer
+		err := t.Execute(&buf, Data{
+			StatusCode: status,
+			StatusText: http.StatusText(status),
+			Host:       r.Host,
+			Path:       r.URL.Path,
+			RequestID:  id,
+		})
+		if err != nil {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		write(w, "text/html; charset=utf-8", status, buf.Bytes())
+	}
+}
+
+// SubRequest serves the page with an internal GET for path through h, such as a
+// fileserver or another upstream. The sub-request keeps the original headers
+// and context, and its 2xx response is sent with the replaced status; any
+// other answer falls back to the plain status text.
+func SubRequest(h http.Handler, path string) Page {
+	return func(w http.ResponseWriter, r *http.Request, status int) {
+		sr := r.Clone(r.Context())
+		sr.Method = http.MethodGet
+		sr.URL.Path, sr.URL.RawPath, sr.URL.RawQuery = path, "", ""
+		sr.RequestURI = path
+		sr.Body, sr.ContentLength = http.NoBody, 0
+		header.Del(sr.Header, header.ContentLength)
+		// a conditional or partial answer would be wrong for an error page
+		for _, k := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"} {
+			sr.Header.Del(k)
+		}
+
+		base := w.Header().Clone()
+		sw := subWriter{ResponseWriter: w, status: status}
+		h.ServeHTTP(&sw, sr)
+		if !sw.ok {
+			clear(w.Header())
+			maps.Copy(w.Header(), base)
+			http.Error(w, http.StatusText(status), status)
+		}
+	}
+}
+
+func write(w http.ResponseWriter, contentType string, status int, b []byte) {
+	h := w.Header()
+	header.Set(h, header.ContentType, contentType)
+	header.Set(h, header.ContentLength, strconv.Itoa(len(b)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// subWriter sends a 2xx sub-response with the replaced status, and discards
+// any other.
+type subWriter struct {
+	http.ResponseWriter
+
+	status      int
+	wroteHeader bool
+	ok          bool
+}
+
+func (w *subWriter) Header() http.Header {
+	if w.wroteHeader && !w.ok {
+		return http.Header{} // the discarded answer's headers go nowhere
+	}
+	return w.ResponseWriter.Header()
+}
+
+func (w *subWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code < 200 || code > 299 {
+		return
+	}
+	w.ok = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *subWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.ok {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
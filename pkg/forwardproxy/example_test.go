@@ -0,0 +1,25 @@
+package forwardproxy_test
+
+import (
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/authn"
+	"github.com/moonrhythm/parapet/pkg/forwardproxy"
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+// An egress proxy for workloads that may only reach the payment provider's API
+// and the package mirror, never the private network, even through a name that
+// resolves there. The metadata endpoint and loopback are refused by default.
+func ExampleNew() {
+	basic := authn.Basic("ci", "s3cret")
+	basic.Realm = "egress"
+
+	m := forwardproxy.New()
+	m.AllowHosts = []string{"api.stripe.com", "*.debian.org"}
+	m.DenyCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	m.Auth = authn.Proxy(basic)
+
+	s := parapet.New()
+	s.Use(logger.Stdout())
+	s.Use(m)
+}
@@ -0,0 +1,407 @@
+package forwardproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/host"
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+// ErrDenied is the dial error for a destination the policy does not allow.
+var ErrDenied = errors.New("forwardproxy: destination denied")
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	defaultIdleTimeout = 5 * time.Minute
+)
+
+// New creates new forward proxy
+func New() *ForwardProxy {
+	return &ForwardProxy{}
+}
+
+// ForwardProxy is a forward (egress) proxy: it serves CONNECT tunnels and
+// absolute-form requests ("GET http://example.com/ HTTP/1.1"), and passes every
+// other request to the rest of the chain.
+//
+// A destination must pass the policy. Its name is checked against the host
+// patterns, and the address actually dialed against the CIDRs, so a name that
+// resolves into a denied network is refused too. A deny always wins. When any
+// allow list is set, the destination must match AllowHosts or dial into
+// AllowCIDRs. A refused destination is answered with 403.
+//
+// Loopback, link-local and cloud metadata addresses (127.0.0.0/8, ::1,
+// 169.254.0.0/16 with 169.254.169.254, fe80::/10, fd00:ec2::254,
+// 100.100.100.200 and the unspecified address) are refused by default, however
+// the destination was named, so the proxy can't be turned on the host it runs
+// on. Reaching one takes an AllowCIDRs entry covering it; as with any allow list,
+// everything else must then be allowed too.
+type ForwardProxy struct {
+	AllowHosts []string // patterns as in host.New, e.g. "api.example.com", "*.example.com"
+	DenyHosts  []string
+	AllowCIDRs []string // networks as in host.NewCIDR, e.g. "10.0.0.0/8"; also the only way past the default deny
+	DenyCIDRs  []string
+	Ports      []int // destination ports allowed; empty allows 80 and 443
+
+	// Auth authenticates proxy requests, e.g. authn.Proxy(authn.Basic(...)),
+	// which answers 407 with Proxy-Authenticate. nil allows any client.
+	Auth parapet.Middleware
+
+	DialTimeout time.Duration // default 10s
+	IdleTimeout time.Duration // a tunnel with no traffic either way is closed; default 5m
+}
+
+// ServeHandler implements middleware interface
+func (m ForwardProxy) ServeHandler(h http.Handler) http.Handler {
+	if m.DialTimeout <= 0 {
+		m.DialTimeout = defaultDialTimeout
+	}
+	if m.IdleTimeout <= 0 {
+		m.IdleTimeout = defaultIdleTimeout
+	}
+	if len(m.Ports) == 0 {
+		m.Ports = []int{80, 443}
+	}
+
+	p := policy{
+		allowHosts: matchHost(m.AllowHosts),
+		denyHosts:  matchHost(m.DenyHosts),
+		allowCIDRs: matchCIDR(m.AllowCIDRs),
+		hasCIDRs:   len(m.AllowCIDRs) > 0,
+		denyCIDRs:  matchCIDR(m.DenyCIDRs),
+		ports:      m.Ports,
+		restricted: len(m.AllowHosts) > 0 || len(m.AllowCIDRs) > 0,
+	}
+	dialer := &net.Dialer{Timeout: m.DialTimeout}
+
+	// dial connects to a destination that passed the name check; nameAllowed
+	// says whether its name was on the allow list.
+	dial := func(ctx context.Context, network, addr string, nameAllowed bool) (net.Conn, error) {
+		d := *dialer
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			if !p.allowAddr(address, nameAllowed) {
+				return ErrDenied
+			}
+			return nil
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr, ctx.Value(nameAllowedContextKey{}).(bool))
+		},
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   m.DialTimeout,
+		ExpectContinueTimeout: time.Second,
+		DisableCompression:    true,
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Host = pr.In.URL.Host
+		},
+		Transport:    tr,
+		ErrorLog:     discardLog,
+		ErrorHandler: writeDialError,
+	}
+
+	next := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := destination(r)
+		if !ok {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		logger.Set(r.Context(), "proxyDestination", addr)
+
+		nameAllowed, ok := p.allowName(addr)
+		if !ok {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodConnect {
+			ctx := context.WithValue(r.Context(), nameAllowedContextKey{}, nameAllowed)
+			rp.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), m.DialTimeout)
+		conn, err := dial(ctx, "tcp", addr, nameAllowed)
+		cancel()
+		if err != nil {
+			writeDialError(w, r, err)
+			return
+		}
+		m.tunnel(w, r, conn)
+	}))
+	if m.Auth != nil {
+		next = m.Auth.ServeHandler(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodConnect && !r.URL.IsAbs()) || r.Header.Get(":protocol") != "" {
+			// an extended CONNECT (RFC 8441), e.g. a WebSocket over HTTP/2, is
+			// for this server, not a tunnel
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type nameAllowedContextKey struct{}
+
+var discardLog = log.New(io.Discard, "", 0)
+
+// destination returns the host:port a proxy request is for.
+func destination(r *http.Request) (string, bool) {
+	if r.Method == http.MethodConnect {
+		hostname, port, err := net.SplitHostPort(r.Host)
+		if err != nil || hostname == "" || port == "" {
+			return "", false
+		}
+		return r.Host, true
+	}
+
+	var port string
+	switch r.URL.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	default:
+		return "", false
+	}
+	if r.URL.Port() != "" {
+		port = r.URL.Port()
+	}
+	if r.URL.Hostname() == "" {
+		return "", false
+	}
+	return net.JoinHostPort(r.URL.Hostname(), port), true
+}
+
+func writeDialError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Set(r.Context(), "proxyError", err.Error())
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrDenied):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		// client canceled request
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+}
+
+// tunnel answers a CONNECT with 200 and relays bytes between the client and
+// conn until both sides are done or the tunnel idles out.
+func (m *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request, conn net.Conn) {
+	defer conn.Close()
+
+	var sent, received atomic.Int64
+	var client io.ReadWriteCloser
+	if r.ProtoMajor >= 2 {
+		// an HTTP/2 CONNECT is a stream: the request body and the response
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		client = &streamConn{r: r.Body, w: w, rc: rc}
+	} else {
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			return
+		}
+		client = c
+		logger.Set(r.Context(), "status", http.StatusOK) // written past the logger
+		if n := brw.Reader.Buffered(); n > 0 {
+			// bytes the client sent ahead of the 200, e.g. a TLS ClientHello
+			b, _ := brw.Reader.Peek(n)
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+			sent.Add(int64(n))
+		}
+	}
+
+	start := time.Now()
+	idle := time.AfterFunc(m.IdleTimeout, func() {
+		client.Close()
+		conn.Close()
+	})
+	defer idle.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyActive(conn, client, &sent, idle, m.IdleTimeout)
+		closeWrite(conn)
+	}()
+	go func() {
+		defer wg.Done()
+		copyActive(client, conn, &received, idle, m.IdleTimeout)
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	logger.Set(r.Context(), "tunnelBytesSent", sent.Load())
+	logger.Set(r.Context(), "tunnelBytesReceived", received.Load())
+	logger.Set(r.Context(), "tunnelDuration", time.Since(start).Nanoseconds())
+}
+
+// copyActive copies src to dst, counting the bytes into n and pushing the idle
+// deadline back on each chunk.
+func copyActive(dst io.Writer, src io.Reader, n *atomic.Int64, idle *time.Timer, timeout time.Duration) {
+	buf := make([]byte, 32*1024)
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			idle.Reset(timeout)
+			nw, werr := dst.Write(buf[:nr])
+			n.Add(int64(nw))
+			if werr != nil {
+				return
+			}
+		}
+		if rerr != nil {
+			return
+		}
+	}
+}
+
+// closeWrite half-closes c after its last byte, or closes it when it cannot.
+func closeWrite(c io.Closer) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// streamConn is the client side of an HTTP/2 tunnel.
+type streamConn struct {
+	r  io.ReadCloser
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	return c.r.Close()
+}
+
+type policy struct {
+	allowHosts func(string) bool
+	denyHosts  func(string) bool
+	allowCIDRs func(string) bool
+	denyCIDRs  func(string) bool
+	ports      []int
+	restricted bool
+	hasCIDRs   bool
+}
+
+// allowName checks the destination's name and port, before it is dialed. It
+// returns whether the name is on the allow list.
+func (p *policy) allowName(addr string) (nameAllowed, ok bool) {
+	hostname, portStr, _ := net.SplitHostPort(addr)
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !slices.Contains(p.ports, port) {
+		return false, false
+	}
+	if p.denyHosts(hostname) {
+		return false, false
+	}
+	nameAllowed = !p.restricted || p.allowHosts(hostname)
+	if !nameAllowed && !p.allowCIDRs(hostname) && net.ParseIP(hostname) != nil {
+		return false, false // an IP literal outside every allowed network
+	}
+	return nameAllowed, true
+}
+
+// allowAddr checks the resolved ip:port about to be dialed.
+func (p *policy) allowAddr(addr string, nameAllowed bool) bool {
+	ip, _, _ := net.SplitHostPort(addr)
+	if p.denyCIDRs(ip) {
+		return false
+	}
+	if deniedByDefault(ip) {
+		return p.hasCIDRs && p.allowCIDRs(ip)
+	}
+	return nameAllowed || p.allowCIDRs(ip)
+}
+
+// metadataAddrs are cloud instance metadata endpoints outside the link-local
+// ranges: AWS's IPv6 one and Alibaba Cloud's.
+var metadataAddrs = []netip.Addr{
+	netip.MustParseAddr("fd00:ec2::254"),
+	netip.MustParseAddr("100.100.100.200"),
+}
+
+// deniedByDefault reports an address on the host itself or its link: loopback,
+// unspecified, link-local (which holds the usual 169.254.169.254 metadata
+// server), or another metadata endpoint.
+func deniedByDefault(ip string) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true // the dialer only hands over IP addresses
+	}
+	a = a.Unmap()
+	return a.IsLoopback() || a.IsUnspecified() || a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast() ||
+		slices.Contains(metadataAddrs, a.WithZone(""))
+}
+
+// matchHost reuses host.New's matching: exact names, "*.example.com" and "*".
+func matchHost(patterns []string) func(string) bool {
+	b := host.New(patterns...)
+	if b.Match == nil {
+		return func(string) bool { return true } // "*"
+	}
+	return func(hostname string) bool {
+		return b.Match(&http.Request{Host: hostname})
+	}
+}
+
+// matchCIDR reuses host.NewCIDR's matching; it panics on an invalid CIDR.
+func matchCIDR(cidrs []string) func(string) bool {
+	b := host.NewCIDR(cidrs...)
+	return func(ip string) bool {
+		return b.Match(&http.Request{Host: ip})
+	}
+}
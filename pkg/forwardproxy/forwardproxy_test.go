@@ -0,0 +1,269 @@
+package forwardproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/moonrhythm/parapet/pkg/authn"
+	. "github.com/moonrhythm/parapet/pkg/forwardproxy"
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+func port(t *testing.T, rawURL string) int {
+	t.Helper()
+
+	u, _ := url.Parse(rawURL)
+	p, _ := strconv.Atoi(u.Port())
+	return p
+}
+
+// syncBuffer collects the logger's records.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func startProxy(t *testing.T, m *ForwardProxy) (*httptest.Server, *syncBuffer) {
+	t.Helper()
+
+	var logs syncBuffer
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "not a proxy request")
+	})
+	ts := httptest.NewServer(logger.Logger{Writer: &logs}.ServeHandler(m.ServeHandler(next)))
+	t.Cleanup(ts.Close)
+	return ts, &logs
+}
+
+func proxyClient(proxy string) *http.Client {
+	u, _ := url.Parse(proxy)
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func TestForwardProxy_AbsoluteForm(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	proxy, _ := startProxy(t, &ForwardProxy{Ports: []int{port(t, origin.URL)}, AllowCIDRs: loopback})
+
+	resp, err := proxyClient(proxy.URL).Get(origin.URL + "/a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello /a", string(b))
+
+	// an origin-form request is not proxied
+	resp, err = http.Get(proxy.URL + "/")
+	if assert.NoError(t, err) {
+		b, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "not a proxy request", string(b))
+	}
+}
+
+func TestForwardProxy_Connect(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer origin.Close()
+
+	proxy, logs := startProxy(t, &ForwardProxy{Ports: []int{port(t, origin.URL)}, AllowCIDRs: loopback})
+
+	client := proxyClient(proxy.URL)
+	resp, err := client.Get(origin.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "secret", string(b))
+
+	client.CloseIdleConnections() // end the tunnel, so its record is written
+
+	assert.Eventually(t, func() bool { return strings.Contains(logs.String(), "tunnelBytesReceived") }, 2*time.Second, 10*time.Millisecond)
+	var rec map[string]any
+	json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &rec)
+	assert.Equal(t, "CONNECT", rec["requestMethod"])
+	assert.EqualValues(t, 200, rec["status"])
+	assert.Greater(t, rec["tunnelBytesSent"], float64(0))
+	assert.Greater(t, rec["tunnelBytesReceived"], float64(0))
+	assert.Equal(t, strings.TrimPrefix(origin.URL, "https://"), rec["proxyDestination"])
+}
+
+// connect sends a CONNECT for addr over a raw connection and returns the
+// response status and the connection.
+func connect(t *testing.T, proxy, addr string, hdr string) (int, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n"+hdr+"\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, conn, br
+}
+
+// loopback lets the tests reach their local origins past the default deny.
+var loopback = []string{"127.0.0.0/8", "::1/128"}
+
+func TestForwardProxy_Policy(t *testing.T) {
+	t.Parallel()
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	addr := ln.Addr().String()
+	p := port(t, "http://"+addr)
+
+	for _, tc := range []struct {
+		name string
+		m    ForwardProxy
+		addr string
+		want int
+	}{
+		{"loopback denied by default", ForwardProxy{Ports: []int{p}}, addr, http.StatusForbidden},
+		{"loopback by name denied by default", ForwardProxy{Ports: []int{p}}, "localhost:" + strconv.Itoa(p), http.StatusForbidden},
+		{"allowed", ForwardProxy{Ports: []int{p}, AllowCIDRs: loopback}, addr, http.StatusOK},
+		{"metadata server denied by default", ForwardProxy{Ports: []int{p}}, "169.254.169.254:" + strconv.Itoa(p), http.StatusForbidden},
+		{"metadata server denied though on the host list", ForwardProxy{Ports: []int{p}, AllowHosts: []string{"100.100.100.200"}}, "100.100.100.200:" + strconv.Itoa(p), http.StatusForbidden},
+		{"loopback needs an allowed network, not name", ForwardProxy{Ports: []int{p}, AllowHosts: []string{"localhost"}}, "localhost:" + strconv.Itoa(p), http.StatusForbidden},
+		{"port not allowed", ForwardProxy{}, addr, http.StatusForbidden},
+		{"denied host", ForwardProxy{Ports: []int{p}, DenyHosts: []string{"*.internal"}}, "db.internal:" + strconv.Itoa(p), http.StatusForbidden},
+		{"not on the allow list", ForwardProxy{Ports: []int{p}, AllowHosts: []string{"example.com"}}, addr, http.StatusForbidden},
+		{"allowed network", ForwardProxy{Ports: []int{p}, AllowHosts: []string{"example.com"}, AllowCIDRs: []string{"127.0.0.0/8"}}, addr, http.StatusOK},
+		{"denied network", ForwardProxy{Ports: []int{p}, AllowCIDRs: loopback, DenyCIDRs: []string{"127.0.0.0/8"}}, addr, http.StatusForbidden},
+		{"name resolving into a denied network", ForwardProxy{Ports: []int{p}, AllowHosts: []string{"localhost"}, DenyCIDRs: []string{"127.0.0.0/8", "::1/128"}}, "localhost:" + strconv.Itoa(p), http.StatusForbidden},
+		{"no port", ForwardProxy{}, "example.com", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := tc.m
+			proxy, _ := startProxy(t, &m)
+			code, _, _ := connect(t, proxy.URL, tc.addr, "")
+			assert.Equal(t, tc.want, code)
+		})
+	}
+}
+
+func TestForwardProxy_Auth(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"), "proxy credentials are not forwarded")
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer origin.Close()
+
+	basic := authn.Basic("alice", "secret")
+	basic.Realm = "egress"
+	proxy, _ := startProxy(t, &ForwardProxy{Ports: []int{port(t, origin.URL)}, AllowCIDRs: loopback, Auth: authn.Proxy(basic)})
+
+	resp, err := proxyClient(proxy.URL).Get(origin.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		assert.Equal(t, `Basic realm="egress"`, resp.Header.Get("Proxy-Authenticate"))
+		assert.Empty(t, resp.Header.Get("Www-Authenticate"))
+	}
+
+	u, _ := url.Parse(proxy.URL)
+	u.User = url.UserPassword("alice", "secret")
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Authorization", "Bearer for-the-origin")
+	resp, err = proxyClient(u.String()).Do(req)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "Bearer for-the-origin", string(b), "the client's Authorization reaches the origin")
+	}
+
+	code, _, _ := connect(t, proxy.URL, strings.TrimPrefix(origin.URL, "http://"), "Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestForwardProxy_IdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c) // echo
+		}
+	}()
+
+	proxy, _ := startProxy(t, &ForwardProxy{Ports: []int{port(t, "http://"+ln.Addr().String())}, AllowCIDRs: loopback, IdleTimeout: 200 * time.Millisecond})
+	code, conn, br := connect(t, proxy.URL, ln.Addr().String(), "")
+	if !assert.Equal(t, http.StatusOK, code) {
+		return
+	}
+
+	// traffic keeps the tunnel open past the idle timeout
+	for range 3 {
+		io.WriteString(conn, "ping\n")
+		line, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "ping\n", line)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF, "an idle tunnel is closed")
+}
@@ -0,0 +1,17 @@
+package grpcweb_test
+
+import (
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/cors"
+	"github.com/moonrhythm/parapet/pkg/grpcweb"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+// Serve browser gRPC-Web clients from a native gRPC backend. The bridge rewrites
+// gRPC-Web calls to gRPC for the upstream and lets every other request through;
+// the CORS policy gets the gRPC-Web headers merged in, so cors.New() suffices.
+func ExampleGRPCWeb() {
+	s := parapet.New()
+	s.Use(&grpcweb.GRPCWeb{CORS: cors.New()})
+	s.Use(upstream.SingleHost("10.0.0.1:50051", &upstream.H2CTransport{}))
+}
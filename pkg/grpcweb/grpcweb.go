@@ -0,0 +1,357 @@
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/moonrhythm/parapet/pkg/cors"
+	"github.com/moonrhythm/parapet/pkg/header"
+)
+
+// Content types
+const (
+	contentTypeGRPC    = "application/grpc"
+	contentTypeWeb     = "application/grpc-web"
+	contentTypeWebText = "application/grpc-web-text"
+)
+
+// trailerFlag marks a gRPC-Web frame that carries the trailers instead of a
+// message.
+const trailerFlag = 0x80
+
+// AllowHeaders are the request headers a gRPC-Web client sends cross-origin; they
+// are merged into the CORS policy's AllowHeaders.
+var AllowHeaders = []string{header.ContentType, "X-Grpc-Web", "X-User-Agent", "Grpc-Timeout"}
+
+// ExposeHeaders are the response headers a gRPC-Web client reads; they are merged
+// into the CORS policy's ExposeHeaders. A trailers-only response carries the
+// status in these headers rather than in a trailer frame.
+var ExposeHeaders = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// GRPCWeb translates gRPC-Web (application/grpc-web and the base64
+// application/grpc-web-text) into native gRPC for the next handler, usually an
+// upstream.Upstream over an H2CTransport, and encodes the response trailers back
+// into the gRPC-Web trailer frame. Other requests pass through untouched.
+type GRPCWeb struct {
+	// CORS, when set, answers gRPC-Web preflights and decorates gRPC-Web
+	// responses. AllowHeaders, ExposeHeaders and the POST method are added to it,
+	// so a plain cors.New() is enough.
+	CORS *cors.CORS
+}
+
+// New creates new grpc-web bridge middleware
+func New() *GRPCWeb {
+	return &GRPCWeb{}
+}
+
+// ServeHandler implements middleware interface
+func (m GRPCWeb) ServeHandler(h http.Handler) http.Handler {
+	bridge := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		text, suffix, ok := parseContentType(header.Get(r.Header, header.ContentType))
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		header.Set(r.Header, header.ContentType, contentTypeGRPC+suffix)
+		r.Header.Set("Te", "trailers")
+		r.Header.Del("X-Grpc-Web")
+		if text {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{&textDecoder{r: r.Body}, r.Body}
+			r.ContentLength = -1
+			r.GetBody = nil
+			header.Del(r.Header, header.ContentLength)
+		}
+
+		ww := &responseWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			text:           text,
+		}
+		h.ServeHTTP(ww, r)
+		ww.finish()
+	})
+
+	if m.CORS == nil {
+		return bridge
+	}
+
+	c := *m.CORS
+	c.AllowHeaders = merge(c.AllowHeaders, AllowHeaders)
+	c.ExposeHeaders = merge(c.ExposeHeaders, ExposeHeaders)
+	c.AllowMethods = merge(c.AllowMethods, []string{http.MethodPost})
+	withCORS := c.ServeHandler(bridge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, isWeb := parseContentType(header.Get(r.Header, header.ContentType))
+		preflight := r.Method == http.MethodOptions && header.Exists(r.Header, header.AccessControlRequestMethod)
+		if isWeb || preflight {
+			withCORS.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseContentType reports whether ct is a gRPC-Web content type, whether it is
+// the base64 text variant, and its codec suffix ("+proto", or "").
+func parseContentType(ct string) (text bool, suffix string, ok bool) {
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	switch {
+	case strings.HasPrefix(ct, contentTypeWebText):
+		text, suffix = true, ct[len(contentTypeWebText):]
+	case strings.HasPrefix(ct, contentTypeWeb):
+		suffix = ct[len(contentTypeWeb):]
+	default:
+		return false, "", false
+	}
+	if suffix != "" && suffix[0] != '+' {
+		return false, "", false
+	}
+	return text, suffix, true
+}
+
+func merge(dst, src []string) []string {
+	out := slices.Clone(dst)
+	for _, v := range src {
+		if !slices.ContainsFunc(out, func(s string) bool { return strings.EqualFold(s, v) }) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// responseWriter rewrites a native gRPC response as gRPC-Web. The next handler
+// writes into its own header map, so trailers set after WriteHeader — announced
+// or http.TrailerPrefix'd, as httputil.ReverseProxy does — stay there until
+// finish encodes them into the body.
+type responseWriter struct {
+	http.ResponseWriter
+
+	header      http.Header
+	trailers    []string // announced trailer names
+	enc         *textEncoder
+	text        bool
+	wroteHeader bool
+	grpc        bool // the response is gRPC and needs a trailer frame
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		if k == "Trailer" {
+			for _, vv := range v {
+				for _, t := range strings.Split(vv, ",") {
+					if t = strings.TrimSpace(t); t != "" {
+						w.trailers = append(w.trailers, t)
+					}
+				}
+			}
+			continue
+		}
+		h[k] = v
+	}
+
+	if ct := header.Get(w.header, header.ContentType); strings.HasPrefix(ct, contentTypeGRPC) {
+		web := contentTypeWeb
+		if w.text {
+			web = contentTypeWebText
+			w.enc = &textEncoder{w: w.ResponseWriter}
+		}
+		header.Set(h, header.ContentType, web+ct[len(contentTypeGRPC):])
+		header.Del(h, header.ContentLength)
+		// a trailers-only response already carries its status in the headers
+		w.grpc = !header.Exists(w.header, "Grpc-Status")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes the trailer frame once the next handler has returned.
+func (w *responseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.grpc {
+		if w.enc != nil {
+			w.enc.Flush()
+		}
+		return
+	}
+
+	var block strings.Builder
+	writeTrailer := func(k string, v []string) {
+		for _, vv := range v {
+			block.WriteString(strings.ToLower(k))
+			block.WriteString(": ")
+			block.WriteString(vv)
+			block.WriteString("\r\n")
+		}
+	}
+	for _, k := range w.trailers {
+		writeTrailer(k, w.header.Values(k))
+	}
+	for k, v := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			writeTrailer(k[len(http.TrailerPrefix):], v)
+		}
+	}
+
+	frame := make([]byte, 5+block.Len())
+	frame[0] = trailerFlag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(block.Len()))
+	copy(frame[5:], block.String())
+	w.Write(frame)
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements Flusher interface
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+// textEncoder base64-encodes a stream. Whole 3-byte groups are written as they
+// arrive; Flush pads out the remainder, which clients accept since they decode
+// in 4-character groups.
+type textEncoder struct {
+	w    io.Writer
+	rest []byte
+	buf  []byte
+}
+
+func (e *textEncoder) Write(b []byte) (int, error) {
+	n := len(b)
+	if len(e.rest) > 0 {
+		fill := min(3-len(e.rest), len(b))
+		e.rest = append(e.rest, b[:fill]...)
+		b = b[fill:]
+		if len(e.rest) < 3 {
+			return n, nil
+		}
+		if err := e.encode(e.rest); err != nil {
+			return 0, err
+		}
+		e.rest = e.rest[:0]
+	}
+	whole := len(b) / 3 * 3
+	if whole > 0 {
+		if err := e.encode(b[:whole]); err != nil {
+			return 0, err
+		}
+	}
+	e.rest = append(e.rest, b[whole:]...)
+	return n, nil
+}
+
+func (e *textEncoder) Flush() error {
+	if len(e.rest) == 0 {
+		return nil
+	}
+	err := e.encode(e.rest)
+	e.rest = e.rest[:0]
+	return err
+}
+
+func (e *textEncoder) encode(b []byte) error {
+	e.buf = slices.Grow(e.buf[:0], base64.StdEncoding.EncodedLen(len(b)))[:base64.StdEncoding.EncodedLen(len(b))]
+	base64.StdEncoding.Encode(e.buf, b)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// textDecoder decodes a base64 request body. A client may send several padded
+// chunks back to back, so each 4-character group is allowed to end in padding.
+type textDecoder struct {
+	r   io.Reader
+	in  []byte // undecoded input, less than one group after a decode
+	out []byte // decoded, not yet read
+	err error
+}
+
+func (d *textDecoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && len(d.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, d.err
+		}
+
+		var buf [4096]byte
+		n, err := d.r.Read(buf[:])
+		d.err = err
+		for _, c := range buf[:n] {
+			if c != '\r' && c != '\n' {
+				d.in = append(d.in, c)
+			}
+		}
+
+		whole := len(d.in) / 4 * 4
+		dec := make([]byte, 0, base64.StdEncoding.DecodedLen(whole))
+		for i := 0; i < whole; {
+			// decode up to and including the next padded group
+			end := whole
+			if j := bytes.IndexByte(d.in[i:whole], '='); j >= 0 {
+				end = i + (j/4+1)*4
+			}
+			chunk := make([]byte, base64.StdEncoding.DecodedLen(end-i))
+			m, err := base64.StdEncoding.Decode(chunk, d.in[i:end])
+			if err != nil {
+				d.err = err
+				return 0, err
+			}
+			dec = append(dec, chunk[:m]...)
+			i = end
+		}
+		d.in = append(d.in[:0], d.in[whole:]...)
+		d.out = dec
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
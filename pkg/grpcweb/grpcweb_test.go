@@ -0,0 +1,206 @@
+package grpcweb_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moonrhythm/parapet/pkg/cors"
+	. "github.com/moonrhythm/parapet/pkg/grpcweb"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+func frame(flag byte, payload string) []byte {
+	b := make([]byte, 5+len(payload))
+	b[0] = flag
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(payload)))
+	copy(b[5:], payload)
+	return b
+}
+
+// grpcServer stands in for a native gRPC origin: it echoes the request message
+// back and sends grpc-status in the trailers.
+func grpcServer(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/grpc+proto", r.Header.Get("Content-Type"))
+		assert.Equal(t, "trailers", r.Header.Get("Te"))
+		assert.Empty(t, r.Header.Get("X-Grpc-Web"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	})
+}
+
+func TestGRPCWeb_Binary(t *testing.T) {
+	t.Parallel()
+
+	msg := frame(0, "hello")
+	r := httptest.NewRequest("POST", "/pkg.Echo/Say", strings.NewReader(string(msg)))
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	r.Header.Set("X-Grpc-Web", "1")
+	w := httptest.NewRecorder()
+	New().ServeHandler(grpcServer(t)).ServeHTTP(w, r)
+
+	assert.Equal(t, "application/grpc-web+proto", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Trailer"))
+	want := append(msg, frame(0x80, "grpc-status: 0\r\ngrpc-message: ok\r\n")...)
+	assert.Equal(t, want, w.Body.Bytes())
+}
+
+func TestGRPCWeb_Text(t *testing.T) {
+	t.Parallel()
+
+	// two separately padded base64 chunks, as a client may send them
+	msg := frame(0, "hello")
+	body := base64.StdEncoding.EncodeToString(msg[:4]) + base64.StdEncoding.EncodeToString(msg[4:])
+	r := httptest.NewRequest("POST", "/pkg.Echo/Say", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/grpc-web-text+proto")
+	w := httptest.NewRecorder()
+	New().ServeHandler(grpcServer(t)).ServeHTTP(w, r)
+
+	assert.Equal(t, "application/grpc-web-text+proto", w.Header().Get("Content-Type"))
+	dec, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, w.Body))
+	require.NoError(t, err)
+	want := append(msg, frame(0x80, "grpc-status: 0\r\ngrpc-message: ok\r\n")...)
+	assert.Equal(t, want, dec)
+}
+
+func TestGRPCWeb_TrailersOnly(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("POST", "/pkg.Echo/Say", nil)
+	r.Header.Set("Content-Type", "application/grpc-web")
+	w := httptest.NewRecorder()
+	New().ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "12")
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(w, r)
+
+	assert.Equal(t, "application/grpc-web", w.Header().Get("Content-Type"))
+	assert.Equal(t, "12", w.Header().Get("Grpc-Status"))
+	assert.Empty(t, w.Body.Bytes(), "the status is in the headers, no trailer frame")
+}
+
+func TestGRPCWeb_PassThrough(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	New().ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		w.Write([]byte("ok"))
+	})).ServeHTTP(w, r)
+	assert.Equal(t, "ok", w.Body.String())
+}
+
+func TestGRPCWeb_CORS(t *testing.T) {
+	t.Parallel()
+
+	m := &GRPCWeb{CORS: &cors.CORS{AllowOrigins: cors.AllowOrigins("https://app.example.com")}}
+	h := m.ServeHandler(grpcServer(t))
+
+	t.Run("preflight", func(t *testing.T) {
+		r := httptest.NewRequest("OPTIONS", "/pkg.Echo/Say", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		r.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web,x-user-agent")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "X-Grpc-Web")
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "POST")
+	})
+
+	t.Run("call", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/pkg.Echo/Say", strings.NewReader(string(frame(0, "hi"))))
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Content-Type", "application/grpc-web+proto")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "Grpc-Status")
+	})
+
+	t.Run("other requests skip the policy", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Origin", "https://evil.example.com")
+		w := httptest.NewRecorder()
+		m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("ok"))
+		})).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestGRPCWeb_Upstream(t *testing.T) {
+	t.Parallel()
+
+	// a server-streaming origin over h2c that only sends its second message once
+	// the client has seen the first
+	next := make(chan struct{})
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(frame(0, "one"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write(frame(0, "two"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	origin.Config.Protocols = new(http.Protocols)
+	origin.Config.Protocols.SetUnencryptedHTTP2(true)
+	origin.Start()
+	defer origin.Close()
+
+	up := upstream.SingleHost(strings.TrimPrefix(origin.URL, "http://"), &upstream.H2CTransport{})
+	front := httptest.NewServer(New().ServeHandler(up.ServeHandler(nil)))
+	defer front.Close()
+
+	req, _ := http.NewRequest("POST", front.URL+"/pkg.Feed/Watch", strings.NewReader(string(frame(0, ""))))
+	req.Header.Set("Content-Type", "application/grpc-web")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/grpc-web", resp.Header.Get("Content-Type"))
+
+	br := bufio.NewReader(resp.Body)
+	readFrame := func() (byte, string) {
+		var hdr [5]byte
+		_, err := io.ReadFull(br, hdr[:])
+		require.NoError(t, err)
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+		_, err = io.ReadFull(br, payload)
+		require.NoError(t, err)
+		return hdr[0], string(payload)
+	}
+
+	flag, msg := readFrame()
+	assert.Equal(t, byte(0), flag)
+	assert.Equal(t, "one", msg, "flushed before the stream ends")
+	close(next)
+
+	_, msg = readFrame()
+	assert.Equal(t, "two", msg)
+	flag, msg = readFrame()
+	assert.Equal(t, byte(0x80), flag)
+	assert.Equal(t, "grpc-status: 0\r\n", msg)
+}
@@ -16,6 +16,8 @@ const (
 	ContentLength                 = "Content-Length"
 	ContentType                   = "Content-Type"
 	Origin                        = "Origin"
+	ProxyAuthenticate             = "Proxy-Authenticate"
+	ProxyAuthorization            = "Proxy-Authorization"
 	RetryAfter                    = "Retry-After"
 	SecWebsocketKey               = "Sec-Websocket-Key"
 	StrictTransportSecurity       = "Strict-Transport-Security"
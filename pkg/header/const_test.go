@@ -25,6 +25,8 @@ func TestHeaders(t *testing.T) {
 		header.ContentLength,
 		header.ContentType,
 		header.Origin,
+		header.ProxyAuthenticate,
+		header.ProxyAuthorization,
 		header.RetryAfter,
 		header.SecWebsocketKey,
 		header.StrictTransportSecurity,
@@ -2,7 +2,10 @@ package healthz_test
 
 import (
 	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/cache"
 	"github.com/moonrhythm/parapet/pkg/healthz"
+	"github.com/moonrhythm/parapet/pkg/mirror"
+	"github.com/moonrhythm/parapet/pkg/upstream"
 )
 
 // Expose the default /healthz endpoint. By default it answers liveness on
@@ -41,3 +44,29 @@ func ExampleHealthz_Set() {
 	s := parapet.New()
 	s.Use(m)
 }
+
+// Gate readiness on dependencies: the instance drains while under half of its
+// upstream pool is probe-up, the mirror queue is saturated, or the cache volume
+// stops accepting writes. GET /healthz?ready=1&verbose=1 lists each check as JSON,
+// and /healthz?startup=1 serves a Kubernetes startup probe that latches once every
+// check has passed.
+func ExampleHealthz_AddCheck() {
+	targets := []*upstream.Target{{Host: "10.0.0.1:8080"}, {Host: "10.0.0.2:8080"}}
+	ahc := upstream.NewActiveHealthCheck(targets, upstream.NewRoundRobinLoadBalancer(targets))
+
+	canary := mirror.New()
+	disk, _ := cache.NewDisk("/var/cache/parapet", 1<<30)
+
+	m := healthz.New()
+	m.AddCheck("upstream", ahc.ReadyCheck(0.5))
+	m.AddCheck("mirror", canary.QueueCheck(0.9))
+	m.AddCheck("cache", disk.WritableCheck())
+
+	s := parapet.New()
+	s.Use(m)
+	s.Use(canary)
+	s.Use(upstream.New(ahc))
+	// liveness:  GET /healthz
+	// readiness: GET /healthz?ready=1  (add &verbose=1 for JSON)
+	// startup:   GET /healthz?startup=1
+}
@@ -1,22 +1,52 @@
 package healthz
 
 import (
+	"context"
+	"encoding/json"
 	"net"
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/moonrhythm/parapet"
 )
 
+// defaultCheckTimeout bounds one round of readiness checks when CheckTimeout is unset.
+const defaultCheckTimeout = 2 * time.Second
+
+// Check is a pluggable readiness check; a nil error means ready. It must honor ctx,
+// which carries the CheckTimeout deadline. Packages expose checks as plain funcs
+// (e.g. upstream.ActiveHealthCheck.ReadyCheck, mirror.Mirror.QueueCheck,
+// cache.DiskStorage.WritableCheck) so they need no healthz import.
+type Check func(ctx context.Context) error
+
 // Healthz middleware
+//
+// It answers liveness on Path, readiness on Path?ready=1 and the startup probe on
+// Path?startup=1. Add ?verbose=1 to any of them for a JSON body listing each check
+// and its status.
 type Healthz struct {
-	Path     string
-	Host     bool // allow request with Host header
+	Path string
+	Host bool // allow request with Host header
+
+	// CheckTimeout bounds one round of readiness checks; a check still running at the
+	// deadline fails. Default 2s.
+	CheckTimeout time.Duration
+
 	ready    int32
 	healthy  int32
 	shutdown int32
+	started  int32
 	once     sync.Once
+
+	mu     sync.RWMutex
+	checks []namedCheck
+}
+
+type namedCheck struct {
+	name  string
+	check Check
 }
 
 // New creates new healthz
@@ -46,6 +76,112 @@ func (m *Healthz) Set(healthy bool) {
 	atomic.StoreInt32(&m.healthy, val)
 }
 
+// AddCheck registers a readiness check under name. Every check must pass for
+// readiness (and, until it first passes, for the startup probe); liveness never
+// runs checks, so a failing dependency drains the instance instead of restarting
+// it. Checks run concurrently on every readiness request. Safe to call while
+// serving.
+func (m *Healthz) AddCheck(name string, check Check) {
+	m.mu.Lock()
+	m.checks = append(m.checks, namedCheck{name: name, check: check})
+	m.mu.Unlock()
+}
+
+// CheckStatus is one entry of the verbose output.
+type CheckStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "ok" or "fail"
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the verbose (?verbose=1) response body.
+type Report struct {
+	Status string        `json:"status"` // "ok" or "fail"
+	Checks []CheckStatus `json:"checks"`
+}
+
+func flagStatus(name string, ok bool, reason string) CheckStatus {
+	if ok {
+		return CheckStatus{Name: name, Status: "ok"}
+	}
+	return CheckStatus{Name: name, Status: "fail", Error: reason}
+}
+
+// runChecks runs every registered check concurrently under CheckTimeout and
+// returns their statuses in registration order.
+func (m *Healthz) runChecks(ctx context.Context) ([]CheckStatus, bool) {
+	m.mu.RLock()
+	checks := m.checks
+	m.mu.RUnlock()
+	if len(checks) == 0 {
+		return nil, true
+	}
+
+	timeout := m.CheckTimeout
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	errs := make([]chan error, len(checks))
+	for i, c := range checks {
+		errs[i] = make(chan error, 1) // buffered: a late check never blocks
+		go func() { errs[i] <- c.check(ctx) }()
+	}
+
+	ok := true
+	res := make([]CheckStatus, len(checks))
+	for i, c := range checks {
+		var err error
+		select {
+		case err = <-errs[i]:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			ok = false
+			res[i] = CheckStatus{Name: c.name, Status: "fail", Error: err.Error()}
+			continue
+		}
+		res[i] = CheckStatus{Name: c.name, Status: "ok"}
+	}
+	return res, ok
+}
+
+func (m *Healthz) liveness() ([]CheckStatus, bool) {
+	ok := atomic.LoadInt32(&m.healthy) > 0
+	return []CheckStatus{flagStatus("live", ok, "marked unhealthy")}, ok
+}
+
+func (m *Healthz) readiness(ctx context.Context) ([]CheckStatus, bool) {
+	notShutdown := atomic.LoadInt32(&m.shutdown) == 0
+	ready := atomic.LoadInt32(&m.ready) > 0
+	res := []CheckStatus{
+		flagStatus("shutdown", notShutdown, "shutting down"),
+		flagStatus("ready", ready, "marked not ready"),
+	}
+	checks, ok := m.runChecks(ctx)
+	return append(res, checks...), ok && notShutdown && ready
+}
+
+// startup latches: it passes once the ready flag is set and every check has
+// passed together, then stays passing (a later dependency blip is readiness's
+// job, and must not make the kubelet restart a started container).
+func (m *Healthz) startup(ctx context.Context) ([]CheckStatus, bool) {
+	if atomic.LoadInt32(&m.started) > 0 {
+		return []CheckStatus{flagStatus("started", true, "")}, true
+	}
+	ready := atomic.LoadInt32(&m.ready) > 0
+	res := []CheckStatus{flagStatus("ready", ready, "marked not ready")}
+	checks, ok := m.runChecks(ctx)
+	ok = ok && ready
+	if ok {
+		atomic.StoreInt32(&m.started, 1)
+	}
+	return append(res, checks...), ok
+}
+
 // ServeHandler implements middleware interface
 func (m *Healthz) ServeHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -74,24 +210,42 @@ func (m *Healthz) ServeHandler(h http.Handler) http.Handler {
 			return
 		}
 
-		var ok bool
+		var (
+			checks []CheckStatus
+			ok     bool
+		)
 
-		if r.URL.Query().Get("ready") != "" {
-			localShutdown := atomic.LoadInt32(&m.shutdown)
-			localReady := atomic.LoadInt32(&m.ready)
-			ok = localShutdown == 0 && localReady > 0
-		} else {
-			localLive := atomic.LoadInt32(&m.healthy)
-			ok = localLive > 0
+		q := r.URL.Query()
+		switch {
+		case q.Get("startup") != "":
+			checks, ok = m.startup(r.Context())
+		case q.Get("ready") != "":
+			checks, ok = m.readiness(r.Context())
+		default:
+			checks, ok = m.liveness()
 		}
 
+		status := http.StatusOK
 		if !ok {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Service Unavailable"))
+			status = http.StatusServiceUnavailable
+		}
+
+		if q.Get("verbose") != "" {
+			rp := Report{Status: "ok", Checks: checks}
+			if !ok {
+				rp.Status = "fail"
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(rp)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(status)
+		if !ok {
+			w.Write([]byte("Service Unavailable"))
+			return
+		}
 		w.Write([]byte("OK"))
 	})
 }
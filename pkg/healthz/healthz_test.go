@@ -1,9 +1,14 @@
 package healthz_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -110,3 +115,90 @@ func TestHealthz(t *testing.T) {
 		assert.EqualValues(t, http.StatusOK, resp.StatusCode)
 	}
 }
+
+func serveHealthz(m *Healthz, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	m.ServeHandler(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func TestHealthzChecks(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+	m.Host = true
+	var dbDown atomic.Bool
+	dbDown.Store(true)
+	m.AddCheck("cache", func(context.Context) error { return nil })
+	m.AddCheck("db", func(context.Context) error {
+		if dbDown.Load() {
+			return errors.New("db: connection refused")
+		}
+		return nil
+	})
+
+	assert.Equal(t, http.StatusServiceUnavailable, serveHealthz(m, "/healthz?ready=1").Code, "a failing check fails readiness")
+	assert.Equal(t, http.StatusOK, serveHealthz(m, "/healthz").Code, "liveness never runs checks")
+
+	w := serveHealthz(m, "/healthz?ready=1&verbose=1")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	var rp Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rp))
+	assert.Equal(t, Report{Status: "fail", Checks: []CheckStatus{
+		{Name: "shutdown", Status: "ok"},
+		{Name: "ready", Status: "ok"},
+		{Name: "cache", Status: "ok"},
+		{Name: "db", Status: "fail", Error: "db: connection refused"},
+	}}, rp)
+
+	dbDown.Store(false)
+	assert.Equal(t, http.StatusOK, serveHealthz(m, "/healthz?ready=1").Code)
+}
+
+func TestHealthzCheckTimeout(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+	m.Host = true
+	m.CheckTimeout = 20 * time.Millisecond
+	m.AddCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	w := serveHealthz(m, "/healthz?ready=1&verbose=1")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"error":"context deadline exceeded"`)
+}
+
+func TestHealthzStartup(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+	m.Host = true
+	var failing atomic.Bool
+	failing.Store(true)
+	m.AddCheck("warmup", func(context.Context) error {
+		if failing.Load() {
+			return errors.New("warming up")
+		}
+		return nil
+	})
+
+	assert.Equal(t, http.StatusServiceUnavailable, serveHealthz(m, "/healthz?startup=1").Code)
+
+	failing.Store(false)
+	m.SetReady(false)
+	assert.Equal(t, http.StatusServiceUnavailable, serveHealthz(m, "/healthz?startup=1").Code, "startup also waits for the ready flag")
+
+	m.SetReady(true)
+	assert.Equal(t, http.StatusOK, serveHealthz(m, "/healthz?startup=1").Code)
+
+	failing.Store(true)
+	assert.Equal(t, http.StatusOK, serveHealthz(m, "/healthz?startup=1").Code, "startup latches once passed")
+	assert.Equal(t, http.StatusServiceUnavailable, serveHealthz(m, "/healthz?ready=1").Code)
+
+	w := serveHealthz(m, "/healthz?startup=1&verbose=1")
+	assert.JSONEq(t, `{"status":"ok","checks":[{"name":"started","status":"ok"}]}`, w.Body.String())
+}
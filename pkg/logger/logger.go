@@ -78,6 +78,10 @@ func (m Logger) ServeHandler(h http.Handler) http.Handler {
 			now := time.Now()
 			duration := now.Sub(start)
 			status := nw.statusCode
+			if status == 0 {
+				// a handler that hijacked the connection reports its own
+				status, _ = d.Get("status").(int)
+			}
 			if status == 0 && ctx.Err() == context.Canceled {
 				status = 499
 			}
@@ -0,0 +1,10 @@
+package mirror
+
+// StartUnbufferedForTest is a white-box hook for the external (mirror_test)
+// QueueCheck test: it starts m with a zero-capacity job queue, which QueueSize's
+// default otherwise makes unreachable. Exported test-only identifiers here are
+// visible to the sibling mirror_test package and stay out of the shipped API.
+func (m *Mirror) StartUnbufferedForTest() {
+	m.jobs = make(chan *mirrorJob)
+	m.started.Store(true)
+}
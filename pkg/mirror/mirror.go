@@ -7,6 +7,7 @@ package mirror
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"math/rand/v2"
@@ -62,6 +63,7 @@ func New() *Mirror { return &Mirror{} }
 type Mirror struct {
 	once    sync.Once
 	jobs    chan *mirrorJob
+	started atomic.Bool         // published after jobs, so QueueCheck may read it
 	handler http.Handler        // built from ms in init()
 	ms      parapet.Middlewares // the mirror destination chain
 
@@ -159,6 +161,7 @@ func (m *Mirror) init() {
 	// chain with no upstream just 404s into the discard writer (harmless).
 	m.handler = m.ms.ServeHandler(http.NotFoundHandler())
 	m.jobs = make(chan *mirrorJob, m.QueueSize)
+	m.started.Store(true)
 	for range m.Workers {
 		go m.worker()
 	}
@@ -349,6 +352,30 @@ func (m *Mirror) Stats() (dispatched, dropFull, dropOversize, completed, panicke
 		m.completed.Load(), m.panicked.Load()
 }
 
+// QueueCheck returns a readiness check (see healthz.Check) that fails while the job
+// queue is at least maxFill full (a fraction in (0,1]; 0 means 0.9). A saturated
+// queue means the canary cannot keep up and mirrors are being dropped. Before the
+// first request the queue is empty and the check passes, as it does for a queue
+// with no capacity, which never holds a job to measure.
+func (m *Mirror) QueueCheck(maxFill float64) func(ctx context.Context) error {
+	if maxFill <= 0 {
+		maxFill = 0.9
+	}
+	return func(context.Context) error {
+		if !m.started.Load() {
+			return nil
+		}
+		n, c := len(m.jobs), cap(m.jobs)
+		if c == 0 {
+			return nil // nothing to measure; don't lean on 0/0 = NaN comparing false
+		}
+		if fill := float64(n) / float64(c); fill >= maxFill {
+			return fmt.Errorf("mirror: queue %.0f%% full (%d/%d)", fill*100, n, c)
+		}
+		return nil
+	}
+}
+
 // discardResponseWriter swallows the mirror's response (status/headers/body), like
 // cache/stale.go's discardResponseWriter on a background revalidation. Header() is
 // lazily stable so the proxy can set headers safely; Write drops the body; a no-op
@@ -526,3 +526,26 @@ func TestDisableMark(t *testing.T) {
 }
 
 var _ parapet.Middleware = (*recorder)(nil)
+
+func TestQueueCheck(t *testing.T) {
+	t.Parallel()
+	rc := newRecorder()
+	rc.gate = make(chan struct{}) // workers block, so the queue fills
+	defer close(rc.gate)
+	m := newMirror(rc) // Workers=4, QueueSize=16
+	check := m.QueueCheck(0.5)
+
+	assert.NoError(t, check(context.Background()), "an unstarted mirror has an empty queue")
+
+	for range 4 + 8 { // occupy every worker, then half the queue
+		serve(m, func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) },
+			httptest.NewRequest("GET", "/", nil))
+	}
+	assert.Eventually(t, func() bool { return check(context.Background()) != nil }, time.Second, 5*time.Millisecond,
+		"a half-full queue fails at maxFill 0.5")
+	assert.ErrorContains(t, check(context.Background()), "mirror: queue")
+
+	unbuffered := mirror.New()
+	unbuffered.StartUnbufferedForTest()
+	assert.NoError(t, unbuffered.QueueCheck(0.5)(context.Background()), "a zero-capacity queue is never measured full")
+}
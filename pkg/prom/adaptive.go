@@ -0,0 +1,88 @@
+package prom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/moonrhythm/parapet/pkg/ratelimit"
+)
+
+// adaptiveMetrics is a single process-global scrape-time Collector fed by a list of
+// adaptive limits (the prom.UpstreamInflight shape): one collector registered once,
+// so several limits can be observed without a duplicate-Desc panic.
+//
+//nolint:govet // fields grouped for readability, not pointer-packing
+type adaptiveMetrics struct {
+	once     sync.Once
+	limit    *prometheus.Desc
+	inflight *prometheus.Desc
+	mu       sync.Mutex
+	limits   []*ratelimit.AdaptiveLimit
+}
+
+var _adaptive adaptiveMetrics
+
+func (p *adaptiveMetrics) init() {
+	p.once.Do(func() {
+		p.limit = prometheus.NewDesc(
+			Namespace+"_adaptive_concurrency_limit",
+			"Current adaptive concurrency limit.",
+			[]string{"name"}, nil)
+		p.inflight = prometheus.NewDesc(
+			Namespace+"_adaptive_concurrency_inflight",
+			"Current in-flight requests held against the adaptive concurrency limit.",
+			[]string{"name"}, nil)
+		reg.MustRegister(p)
+	})
+}
+
+func (p *adaptiveMetrics) add(ls []*ratelimit.AdaptiveLimit) {
+	p.mu.Lock()
+	p.limits = append(p.limits, ls...)
+	p.mu.Unlock()
+}
+
+func (p *adaptiveMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.limit
+	ch <- p.inflight
+}
+
+func (p *adaptiveMetrics) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	limits := append([]*ratelimit.AdaptiveLimit(nil), p.limits...)
+	p.mu.Unlock()
+	// Dedup by name so a reused name cannot emit a duplicate label set and fail the
+	// scrape. First registered wins.
+	seen := make(map[string]struct{})
+	for _, l := range limits {
+		if _, dup := seen[l.Name]; dup {
+			continue
+		}
+		seen[l.Name] = struct{}{}
+		ch <- prometheus.MustNewConstMetric(p.limit, prometheus.GaugeValue, float64(l.Limit()), l.Name)
+		ch <- prometheus.MustNewConstMetric(p.inflight, prometheus.GaugeValue, float64(l.Inflight()), l.Name)
+	}
+}
+
+// AdaptiveLimit registers adaptive concurrency limits with a scrape-time collector
+// that exports their live state on the shared registry:
+//
+//	rl := ratelimit.Adaptive("api")
+//	prom.AdaptiveLimit(rl.Limit)
+//	s.Use(rl)
+//
+// It exports two gauges, read at scrape time — nothing runs on the request path:
+//
+//	{namespace}_adaptive_concurrency_limit{name}     the limit the algorithm settled on
+//	{namespace}_adaptive_concurrency_inflight{name}  slots held right now
+//
+// The name label is AdaptiveLimit.Name (upstream.NewAdaptiveTransport names it after
+// the target host); names must be unique across registered limits, a duplicate is
+// dropped from the scrape. Count the resulting sheds with prom.RateLimit on
+// AdaptiveConcurrency.Observe (per route) or prom.Upstream's fast-reject counter (per
+// target).
+func AdaptiveLimit(limits ...*ratelimit.AdaptiveLimit) {
+	_adaptive.init()
+	_adaptive.add(limits)
+}
@@ -0,0 +1,34 @@
+package prom_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moonrhythm/parapet/pkg/ratelimit"
+
+	. "github.com/moonrhythm/parapet/pkg/prom"
+)
+
+var (
+	adaptiveOnce  sync.Once
+	adaptiveLimit = &ratelimit.AdaptiveLimit{Name: "prom-adaptive", InitialLimit: 7}
+)
+
+func TestAdaptiveLimit(t *testing.T) {
+	adaptiveOnce.Do(func() {
+		AdaptiveLimit(adaptiveLimit)
+		// a duplicate name is dropped from the scrape, not a failed Gather
+		AdaptiveLimit(&ratelimit.AdaptiveLimit{Name: "prom-adaptive", InitialLimit: 99})
+	})
+
+	lbl := map[string]string{"name": "prom-adaptive"}
+	assert.EqualValues(t, 7, gaugeValue(t, "parapet_adaptive_concurrency_limit", lbl))
+
+	require.True(t, adaptiveLimit.Acquire())
+	assert.EqualValues(t, 1, gaugeValue(t, "parapet_adaptive_concurrency_inflight", lbl))
+	adaptiveLimit.Cancel()
+	assert.EqualValues(t, 0, gaugeValue(t, "parapet_adaptive_concurrency_inflight", lbl))
+}
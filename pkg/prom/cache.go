@@ -59,10 +59,11 @@ func (p *cacheMetrics) observe(r *http.Request, info cache.ResultInfo) {
 // It registers two metrics (lazily, once per process):
 //
 //	{namespace}_cache_total{host,result}             counter of cache outcomes
-//	    (result = HIT|MISS|STALE|STALE_ERROR|BYPASS — a hit ratio is
+//	    (result = HIT|MISS|REVALIDATED|STALE|STALE_ERROR|NEGATIVE|BYPASS — a hit ratio is
 //	     sum(HIT) / sum(all), the otherwise-invisible BYPASS path included)
 //	{namespace}_cache_fill_duration_seconds{host}    histogram of origin-fill latency
-//	    (observed only when the origin was contacted, i.e. MISS and stale-if-error)
+//	    (observed only when the origin was contacted, i.e. MISS, REVALIDATED and
+//	     stale-if-error)
 //
 // The host label matches prom.Requests so the two can be joined. Keeping the metric
 // wiring here leaves pkg/cache free of any Prometheus dependency. Compose it with
@@ -79,3 +80,46 @@ func Cache() cache.ResultFunc {
 	_cache.init()
 	return _cache.observe
 }
+
+//nolint:govet
+type cacheTierMetrics struct {
+	once  sync.Once
+	total *prometheus.CounterVec
+}
+
+var _cacheTier cacheTierMetrics
+
+func (p *cacheTierMetrics) init() {
+	p.once.Do(func() {
+		p.total = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "cache_tier_total",
+		}, []string{"tier"})
+		reg.MustRegister(p.total)
+	})
+}
+
+func (p *cacheTierMetrics) observe(tier cache.TierResult) {
+	if counter, err := p.total.GetMetricWith(prometheus.Labels{"tier": string(tier)}); err == nil {
+		counter.Inc()
+	}
+}
+
+// CacheTier returns a cache.TierFunc that counts the tier each lookup of a
+// cache.TieredStorage was answered from, for wiring into
+// cache.TieredOptions.OnGet:
+//
+//	store := cache.NewTiered(mem, disk, cache.TieredOptions{OnGet: prom.CacheTier()})
+//
+// It registers one metric (lazily, once per process):
+//
+//	{namespace}_cache_tier_total{tier}   counter of storage lookups
+//	    (tier = L1|L2|MISS — the L1 hit ratio is sum(L1) / sum(all), the L2 one
+//	     sum(L2) / (sum(L2) + sum(MISS)))
+//
+// A request can look its entry up more than once (e.g. a collapsed miss re-reads
+// it after the fill), so the counts need not match cache_total's.
+func CacheTier() cache.TierFunc {
+	_cacheTier.init()
+	return _cacheTier.observe
+}
@@ -89,6 +89,19 @@ func TestCache(t *testing.T) {
 		"a hit/bypass contributes no fill-latency sample")
 }
 
+func TestCacheTier(t *testing.T) {
+	observe := CacheTier()
+	require.NotNil(t, observe)
+	before := counterValue(t, "parapet_cache_tier_total", map[string]string{"tier": "L2"})
+
+	observe(cache.TierL1)
+	observe(cache.TierL2)
+	observe(cache.TierL2)
+
+	assert.EqualValues(t, max(before, 0)+2, counterValue(t, "parapet_cache_tier_total", map[string]string{"tier": "L2"}))
+	assert.Positive(t, counterValue(t, "parapet_cache_tier_total", map[string]string{"tier": "L1"}))
+}
+
 // Cache observability: count outcomes and fill latency, and tag access logs.
 func ExampleCache() {
 	store := cache.NewMemory(256 << 20)
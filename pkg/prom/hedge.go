@@ -0,0 +1,53 @@
+package prom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+//nolint:govet
+type hedgeMetrics struct {
+	once   sync.Once
+	events *prometheus.CounterVec
+	delay  prometheus.Histogram
+}
+
+var _hedge hedgeMetrics
+
+func (p *hedgeMetrics) init() {
+	p.once.Do(func() {
+		p.events = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "upstream_hedges_total",
+		}, []string{"event"})
+		p.delay = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "upstream_hedge_delay_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14), // 1ms .. ~8s
+		})
+		reg.MustRegister(p.events, p.delay)
+	})
+}
+
+func (p *hedgeMetrics) observe(info upstream.HedgeInfo) {
+	if c, err := p.events.GetMetricWith(prometheus.Labels{"event": info.Event.String()}); err == nil {
+		c.Inc()
+	}
+	if info.Event == upstream.HedgeLaunched {
+		p.delay.Observe(info.Delay.Seconds())
+	}
+}
+
+// Hedge returns an upstream.HedgeFunc that records hedging metrics on the shared
+// registry, for wiring into HedgingLoadBalancer.OnHedge. upstream_hedges_total{event}
+// counts launched / won / budget_denied hedges — won over launched is the hedge
+// win rate, budget_denied the hedges HedgeBudget held back — and
+// upstream_hedge_delay_seconds observes the delay each hedge waited out (the
+// adaptive percentile, or the fixed HedgeDelay).
+func Hedge() upstream.HedgeFunc {
+	_hedge.init()
+	return _hedge.observe
+}
@@ -0,0 +1,43 @@
+package prom_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+
+	. "github.com/moonrhythm/parapet/pkg/prom"
+)
+
+func TestHedge(t *testing.T) {
+	observe := Hedge()
+	require.NotNil(t, observe)
+
+	events := []string{"launched", "won", "budget_denied"}
+	base := map[string]float64{}
+	for _, e := range events {
+		base[e] = max(0, counterValue(t, "parapet_upstream_hedges_total", map[string]string{"event": e}))
+	}
+	baseDelay := histogramCount(t, "parapet_upstream_hedge_delay_seconds", nil)
+
+	observe(upstream.HedgeInfo{Event: upstream.HedgeLaunched, Delay: 20 * time.Millisecond})
+	observe(upstream.HedgeInfo{Event: upstream.HedgeWon, Delay: 20 * time.Millisecond})
+	observe(upstream.HedgeInfo{Event: upstream.HedgeBudgetDenied, Delay: 20 * time.Millisecond})
+
+	for _, e := range events {
+		assert.EqualValues(t, base[e]+1, counterValue(t, "parapet_upstream_hedges_total", map[string]string{"event": e}),
+			"event %q counted once", e)
+	}
+	assert.EqualValues(t, baseDelay+1, histogramCount(t, "parapet_upstream_hedge_delay_seconds", nil),
+		"only a launched hedge contributes a delay sample")
+}
+
+func ExampleHedge() {
+	h := upstream.NewHedgingLoadBalancer(upstream.NewRoundRobinLoadBalancer(nil))
+	h.HedgePercentile = 0.95
+	h.OnHedge = Hedge() // prom.Hedge(): count launches / wins / budget denials
+	_ = h               // s.Use(upstream.New(h))
+}
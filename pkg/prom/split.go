@@ -0,0 +1,58 @@
+package prom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/moonrhythm/parapet/pkg/split"
+)
+
+//nolint:govet
+type splitMetrics struct {
+	once     sync.Once
+	requests *prometheus.CounterVec
+}
+
+var _split splitMetrics
+
+func (p *splitMetrics) init() {
+	p.once.Do(func() {
+		p.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "split_requests_total",
+		}, []string{"name", "backend", "reason"})
+		reg.MustRegister(p.requests)
+	})
+}
+
+func (p *splitMetrics) observe(e split.Event) {
+	if c, err := p.requests.GetMetricWith(prometheus.Labels{
+		"name":    e.Name,
+		"backend": e.Backend,
+		"reason":  e.Reason.String(),
+	}); err == nil {
+		c.Inc()
+	}
+}
+
+// Split returns a split.ObserveFunc that records traffic-split decisions on the
+// shared registry, for wiring into Split.Observe — keeping pkg/split
+// Prometheus-free (the prom.Mirror/prom.RateLimit convention).
+//
+//	sp := split.New(canary, stable)
+//	sp.Name = "checkout"
+//	sp.Observe = prom.Split()
+//	s.Use(sp)
+//
+// It records one metric (lazily, once per process):
+//
+//	{namespace}_split_requests_total{name,backend,reason}  counter of routed requests
+//	    (reason = weight | route | sticky)
+//
+// Every label is bounded: name and backend are operator-set and reason is a closed
+// set. The canary's live share is sum by (backend) over the rate of this counter.
+func Split() split.ObserveFunc {
+	_split.init()
+	return _split.observe
+}
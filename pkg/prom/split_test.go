@@ -0,0 +1,36 @@
+package prom_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moonrhythm/parapet/pkg/split"
+
+	. "github.com/moonrhythm/parapet/pkg/prom"
+)
+
+func TestSplit(t *testing.T) {
+	observe := Split()
+	require.NotNil(t, observe)
+
+	const name = "prom-split-test"
+	canary := map[string]string{"name": name, "backend": "canary", "reason": "route"}
+	stable := map[string]string{"name": name, "backend": "stable", "reason": "weight"}
+	baseCanary := counterValue(t, "parapet_split_requests_total", canary)
+	baseStable := counterValue(t, "parapet_split_requests_total", stable)
+
+	observe(split.Event{Name: name, Backend: "canary", Reason: split.ReasonRoute})
+	observe(split.Event{Name: name, Backend: "stable", Reason: split.ReasonWeight})
+	observe(split.Event{Name: name, Backend: "stable", Reason: split.ReasonWeight})
+
+	assert.EqualValues(t, 1, countDelta(baseCanary, counterValue(t, "parapet_split_requests_total", canary)))
+	assert.EqualValues(t, 2, countDelta(baseStable, counterValue(t, "parapet_split_requests_total", stable)))
+}
+
+func ExampleSplit() {
+	sp := split.New(&split.Backend{Name: "canary", Weight: 5}, &split.Backend{Name: "stable", Weight: 95})
+	sp.Observe = Split() // prom.Split(): count routed requests by backend and reason
+	_ = sp               // s.Use(sp)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -17,8 +18,18 @@ type upstreamMetrics struct {
 	requests    *prometheus.CounterVec
 	duration    *prometheus.HistogramVec
 	fastRejects *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+
+	grpcRequests *prometheus.CounterVec
+	grpcDuration *prometheus.HistogramVec
+	grpcMethods  sync.Map // "service/method" the origin has served -> struct{}
+	grpcKnown    atomic.Int32
 }
 
+// maxGRPCMethods caps the distinct service/method label pairs, a backstop against
+// a backend that answers every path.
+const maxGRPCMethods = 1000
+
 var _upstream upstreamMetrics
 
 func (p *upstreamMetrics) init() {
@@ -36,7 +47,20 @@ func (p *upstreamMetrics) init() {
 			Namespace: Namespace,
 			Name:      "upstream_fast_rejects_total",
 		}, []string{"host"})
-		reg.MustRegister(p.requests, p.duration, p.fastRejects)
+		p.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "upstream_errors_total",
+		}, []string{"host", "kind"})
+		p.grpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "upstream_grpc_requests",
+		}, []string{"host", "service", "method", "code"})
+		p.grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "upstream_grpc_request_duration_seconds",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"host", "service", "method"})
+		reg.MustRegister(p.requests, p.duration, p.fastRejects, p.errors, p.grpcRequests, p.grpcDuration)
 	})
 }
 
@@ -64,6 +88,55 @@ func (p *upstreamMetrics) observe(_ *http.Request, info upstream.RoundTripInfo)
 			c.Inc()
 		}
 	}
+	if info.Err != nil {
+		if c, err := p.errors.GetMetricWith(prometheus.Labels{
+			"host": info.Host,
+			"kind": info.ErrorKind.String(),
+		}); err == nil {
+			c.Inc()
+		}
+	}
+	if info.GRPC {
+		p.observeGRPC(info)
+	}
+}
+
+// grpcLabels returns the service/method labels for a gRPC call. They come from the
+// client's request path, so they are only used once the origin has served that
+// method — answered it with a status other than UNIMPLEMENTED — and are "unknown"
+// otherwise. A scan of made-up paths therefore cannot grow the label set.
+func (p *upstreamMetrics) grpcLabels(info upstream.RoundTripInfo) (service, method string) {
+	key := info.GRPCService + "/" + info.GRPCMethod
+	if _, ok := p.grpcMethods.Load(key); ok {
+		return info.GRPCService, info.GRPCMethod
+	}
+	served := info.Err == nil && info.Status == http.StatusOK && info.GRPCStatus != upstream.GRPCUnimplemented
+	if served && p.grpcKnown.Load() < maxGRPCMethods {
+		if _, loaded := p.grpcMethods.LoadOrStore(key, struct{}{}); !loaded {
+			p.grpcKnown.Add(1)
+		}
+		return info.GRPCService, info.GRPCMethod
+	}
+	return "unknown", "unknown"
+}
+
+func (p *upstreamMetrics) observeGRPC(info upstream.RoundTripInfo) {
+	service, method := p.grpcLabels(info)
+	if c, err := p.grpcRequests.GetMetricWith(prometheus.Labels{
+		"host":    info.Host,
+		"service": service,
+		"method":  method,
+		"code":    info.GRPCStatus.String(),
+	}); err == nil {
+		c.Inc()
+	}
+	if h, err := p.grpcDuration.GetMetricWith(prometheus.Labels{
+		"host":    info.Host,
+		"service": service,
+		"method":  method,
+	}); err == nil {
+		h.Observe(info.Duration.Seconds())
+	}
 }
 
 // Upstream returns an upstream.RoundTripFunc that records per-backend origin
@@ -73,7 +146,7 @@ func (p *upstreamMetrics) observe(_ *http.Request, info upstream.RoundTripInfo)
 //	u.OnRoundTrip = prom.Upstream()
 //	s.Use(u)
 //
-// It registers two metrics (lazily, once per process):
+// It registers its metrics lazily, once per process:
 //
 //	{namespace}_upstream_requests{host,status}                  counter of attempts
 //	    (status = the origin's numeric code, or "error" for a transport failure;
@@ -84,6 +157,15 @@ func (p *upstreamMetrics) observe(_ *http.Request, info upstream.RoundTripInfo)
 //	    a reliability balancer shed before any round-trip (ErrUnavailable). The host
 //	    is "" for a shed before any pick; pair with prom.UpstreamState for circuit
 //	    and ejection state.
+//	{namespace}_upstream_errors_total{host,kind}                counter of failed
+//	    attempts by upstream.ErrorKind (timeout, connect, tls, reset, shed,
+//	    canceled, other): which failures became a 504 and which a 502
+//	{namespace}_upstream_grpc_requests{host,service,method,code} counter of gRPC
+//	    calls by grpc-status name (e.g. "OK", "UNAVAILABLE"); the proxy's own
+//	    answer on a transport error. service/method are "unknown" until the origin
+//	    has served that method, so client-chosen paths cannot explode the labels.
+//	{namespace}_upstream_grpc_request_duration_seconds{host,service,method}
+//	    histogram of a gRPC call's time to response headers
 //
 // It fires once per attempt, so retries are counted individually. The host label is
 // the resolved upstream target (operator-configured, bounded), distinct from the
@@ -82,10 +82,10 @@ func (p *upstreamStateMetrics) observe(c upstream.StateChange) {
 // sample. The host label is the operator-configured upstream target (bounded).
 //
 // The probe_down counter breaks ActiveHealthCheck down-events out by classified
-// failure cause (one of: timeout, refused, reset, dns, tls, status, error — a bounded
-// closed set) for mid-incident triage; it is populated only by
-// ActiveHealthCheck.OnStateChange and never by the circuit-breaker or ejecting
-// balancers. Probe transitions still flow into transitions_total as
+// failure cause (one of: timeout, refused, reset, dns, tls, status, header, body,
+// not_serving, error — a bounded closed set) for mid-incident triage; it is
+// populated only by ActiveHealthCheck.OnStateChange and never by the
+// circuit-breaker or ejecting balancers. Probe transitions still flow into transitions_total as
 // reason="probe_down"/"probe_recover" with no change to that counter.
 func UpstreamState() upstream.StateChangeFunc {
 	_upstreamState.init()
@@ -25,18 +25,58 @@ func TestUpstream(t *testing.T) {
 
 	observe(r, upstream.RoundTripInfo{Host: host, Status: 200, Duration: 5 * time.Millisecond})
 	observe(r, upstream.RoundTripInfo{Host: host, Status: 502, Duration: 3 * time.Millisecond})
-	observe(r, upstream.RoundTripInfo{Host: host, Err: errors.New("dial fail"), Duration: time.Millisecond})
+	observe(r, upstream.RoundTripInfo{Host: host, Err: errors.New("dial fail"), ErrorKind: upstream.KindConnect, Duration: time.Millisecond})
 
 	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_requests", map[string]string{"host": host, "status": "200"}))
 	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_requests", map[string]string{"host": host, "status": "502"}),
 		"an origin 5xx is countable by status")
 	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_requests", map[string]string{"host": host, "status": "error"}),
 		"a transport failure is countable as error")
+	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_errors_total", map[string]string{"host": host, "kind": "connect"}))
+	assert.EqualValues(t, -1, counterValue(t, "parapet_upstream_errors_total", map[string]string{"host": host, "kind": "none"}),
+		"a response is not an error")
 
 	// Every attempt — success or failure — contributes a TTFB sample.
 	assert.EqualValues(t, 3, histogramCount(t, "parapet_upstream_request_duration_seconds", map[string]string{"host": host}))
 }
 
+func TestUpstream_GRPC(t *testing.T) {
+	observe := Upstream()
+
+	const host = "prom-upstream-grpc-test.backend"
+	r := httptest.NewRequest("POST", "/", nil)
+	grpc := func(service, method string, code upstream.GRPCCode, err error) upstream.RoundTripInfo {
+		info := upstream.RoundTripInfo{
+			Host: host, Err: err, Duration: time.Millisecond,
+			GRPC: true, GRPCService: service, GRPCMethod: method, GRPCStatus: code,
+		}
+		if err == nil {
+			info.Status = 200
+		}
+		return info
+	}
+	labels := func(service, method, code string) map[string]string {
+		return map[string]string{"host": host, "service": service, "method": method, "code": code}
+	}
+
+	// Before the origin has served a method, client-chosen names stay "unknown".
+	observe(r, grpc("pkg.Users", "Get", upstream.GRPCUnavailable, errors.New("dial fail")))
+	observe(r, grpc("pkg.Users", "Scan1234", upstream.GRPCUnimplemented, nil))
+	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_grpc_requests", labels("unknown", "unknown", "UNAVAILABLE")))
+	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_grpc_requests", labels("unknown", "unknown", "UNIMPLEMENTED")))
+
+	// Once served, the method is labelled, errors included.
+	observe(r, grpc("pkg.Users", "Get", upstream.GRPCNotFound, nil))
+	observe(r, grpc("pkg.Users", "Get", upstream.GRPCUnavailable, errors.New("dial fail")))
+	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_grpc_requests", labels("pkg.Users", "Get", "NOT_FOUND")))
+	assert.EqualValues(t, 1, counterValue(t, "parapet_upstream_grpc_requests", labels("pkg.Users", "Get", "UNAVAILABLE")))
+	assert.EqualValues(t, 2, histogramCount(t, "parapet_upstream_grpc_request_duration_seconds",
+		map[string]string{"host": host, "service": "pkg.Users", "method": "Get"}))
+
+	// The HTTP view still counts every call.
+	assert.EqualValues(t, 2, counterValue(t, "parapet_upstream_requests", map[string]string{"host": host, "status": "200"}))
+}
+
 // Per-backend origin metrics: request count by status and time-to-first-byte.
 func ExampleUpstream() {
 	lb := upstream.NewRoundRobinLoadBalancer([]*upstream.Target{
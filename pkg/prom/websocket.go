@@ -0,0 +1,87 @@
+package prom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/moonrhythm/parapet/pkg/websocket"
+)
+
+//nolint:govet
+type webSocketMetrics struct {
+	once        sync.Once
+	connections *prometheus.GaugeVec
+	closed      *prometheus.CounterVec
+	rejected    *prometheus.CounterVec
+	messages    *prometheus.CounterVec
+	bytes       *prometheus.CounterVec
+}
+
+var _webSocket webSocketMetrics
+
+func (p *webSocketMetrics) init() {
+	p.once.Do(func() {
+		p.connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "websocket_connections",
+		}, []string{"name"})
+		p.closed = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_closed_total",
+		}, []string{"name", "reason"})
+		p.rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_rejected_total",
+		}, []string{"name", "reason"})
+		p.messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_messages_total",
+		}, []string{"name", "direction"})
+		p.bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "websocket_bytes_total",
+		}, []string{"name", "direction"})
+		reg.MustRegister(p.connections, p.closed, p.rejected, p.messages, p.bytes)
+	})
+}
+
+func (p *webSocketMetrics) observe(e websocket.Event) {
+	switch e.Type {
+	case websocket.EventOpened:
+		p.connections.WithLabelValues(e.Name).Inc()
+	case websocket.EventRejected:
+		p.rejected.WithLabelValues(e.Name, e.Reason.String()).Inc()
+	case websocket.EventClosed:
+		p.connections.WithLabelValues(e.Name).Dec()
+		p.closed.WithLabelValues(e.Name, e.Reason.String()).Inc()
+		p.messages.WithLabelValues(e.Name, "received").Add(float64(e.MessagesReceived))
+		p.messages.WithLabelValues(e.Name, "sent").Add(float64(e.MessagesSent))
+		p.bytes.WithLabelValues(e.Name, "received").Add(float64(e.BytesReceived))
+		p.bytes.WithLabelValues(e.Name, "sent").Add(float64(e.BytesSent))
+	}
+}
+
+// WebSocket returns a websocket.ObserveFunc that records WebSocket connections
+// on the shared registry, for wiring into WebSocket.Observe — keeping
+// pkg/websocket Prometheus-free (the prom.RateLimit convention).
+//
+//	ws := websocket.New()
+//	ws.Name = "chat"
+//	ws.Observe = prom.WebSocket()
+//
+// It records (lazily, once per process):
+//
+//	{namespace}_websocket_connections{name}                gauge, open connections
+//	{namespace}_websocket_closed_total{name,reason}        counter, reason = client | upstream | abnormal | idle | lifetime | shutdown
+//	{namespace}_websocket_rejected_total{name,reason}      counter, reason = route_limit | client_limit | shutdown
+//	{namespace}_websocket_messages_total{name,direction}   counter, direction = received (from the client) | sent
+//	{namespace}_websocket_bytes_total{name,direction}      counter
+//
+// Messages and bytes are added when a connection closes, so a long-lived
+// connection shows up in them only then; the logger record has the same
+// counters per connection.
+func WebSocket() websocket.ObserveFunc {
+	_webSocket.init()
+	return _webSocket.observe
+}
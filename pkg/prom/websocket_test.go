@@ -0,0 +1,54 @@
+package prom_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/moonrhythm/parapet/pkg/prom"
+	"github.com/moonrhythm/parapet/pkg/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	observe := WebSocket()
+
+	name := map[string]string{"name": "prom-test"}
+	labels := func(k, v string) map[string]string {
+		return map[string]string{"name": "prom-test", k: v}
+	}
+
+	// baselines, as the registry is process-global (-count=N)
+	value := func(f func(*testing.T, string, map[string]string) float64, metric string, l map[string]string) float64 {
+		return max(f(t, metric, l), 0) // -1 for a series not created yet
+	}
+	baseConns := value(gaugeValue, "parapet_websocket_connections", name)
+	baseRejected := value(counterValue, "parapet_websocket_rejected_total", labels("reason", "client_limit"))
+	baseClosed := value(counterValue, "parapet_websocket_closed_total", labels("reason", "idle"))
+	baseReceived := value(counterValue, "parapet_websocket_messages_total", labels("direction", "received"))
+	baseSent := value(counterValue, "parapet_websocket_messages_total", labels("direction", "sent"))
+	baseBytes := value(counterValue, "parapet_websocket_bytes_total", labels("direction", "sent"))
+
+	observe(websocket.Event{Name: "prom-test", Type: websocket.EventOpened})
+	observe(websocket.Event{Name: "prom-test", Type: websocket.EventOpened})
+	assert.EqualValues(t, baseConns+2, gaugeValue(t, "parapet_websocket_connections", name))
+
+	observe(websocket.Event{Name: "prom-test", Type: websocket.EventRejected, Reason: websocket.ReasonClientLimit})
+	assert.EqualValues(t, baseRejected+1, counterValue(t, "parapet_websocket_rejected_total", labels("reason", "client_limit")))
+
+	observe(websocket.Event{
+		Name:             "prom-test",
+		Type:             websocket.EventClosed,
+		Reason:           websocket.ReasonIdle,
+		Duration:         time.Minute,
+		MessagesReceived: 3,
+		MessagesSent:     5,
+		BytesReceived:    30,
+		BytesSent:        50,
+	})
+	assert.EqualValues(t, baseConns+1, gaugeValue(t, "parapet_websocket_connections", name))
+	assert.EqualValues(t, baseClosed+1, counterValue(t, "parapet_websocket_closed_total", labels("reason", "idle")))
+	assert.EqualValues(t, baseReceived+3, counterValue(t, "parapet_websocket_messages_total", labels("direction", "received")))
+	assert.EqualValues(t, baseSent+5, counterValue(t, "parapet_websocket_messages_total", labels("direction", "sent")))
+	assert.EqualValues(t, baseBytes+50, counterValue(t, "parapet_websocket_bytes_total", labels("direction", "sent")))
+}
@@ -0,0 +1,346 @@
+package ratelimit
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/header"
+)
+
+// Adaptive limit defaults.
+const (
+	defaultAdaptiveInitialLimit = 20
+	defaultAdaptiveMinLimit     = 1
+	defaultAdaptiveMaxLimit     = 1000
+	defaultAdaptiveTolerance    = 2.0
+	defaultAdaptiveSmoothing    = 0.2
+	defaultAdaptiveLongWindow   = 600
+	defaultAdaptiveBackoff      = 0.9
+	defaultAdaptiveRetryAfter   = time.Second
+)
+
+// AdaptiveAlgorithm selects how an AdaptiveLimit moves its limit.
+type AdaptiveAlgorithm uint8
+
+const (
+	// AdaptiveGradient scales the limit by the ratio of the long-term RTT to the
+	// latest sample (a gradient, in the style of Netflix's gradient2): while latency
+	// holds near its baseline the limit grows by a small queue allowance, and as
+	// latency climbs past Tolerance x baseline the limit shrinks in proportion.
+	AdaptiveGradient AdaptiveAlgorithm = iota
+
+	// AdaptiveAIMD grows the limit by one per in-use success and multiplies it by
+	// Backoff on a drop or a sample slower than the latency threshold — the TCP
+	// congestion-control shape; coarser, but very predictable.
+	AdaptiveAIMD
+)
+
+// AdaptiveLimit is a concurrency limit that discovers its own value from observed
+// round-trip latency instead of a hand-tuned cap. Callers Acquire a slot before
+// the work and Release it with the measured RTT afterwards; the limit rises while
+// latency stays near its long-term baseline and falls when latency grows (queueing
+// at the origin) or the origin reports overload (a drop).
+//
+// The limit only grows while it is actually in use (at least half of it
+// in-flight), so an idle or lightly-loaded period cannot inflate it past what the
+// origin has been shown to sustain.
+//
+// One AdaptiveLimit guards one resource: give each AdaptiveConcurrency middleware
+// (a per-route limit) or upstream.AdaptiveTransport (a per-target limit) its own.
+// Configuration fields are read once, before the first Acquire; set them before
+// serving. It is safe for concurrent use.
+//
+//nolint:govet // fields grouped by role (state, then config) for readability
+type AdaptiveLimit struct {
+	once     sync.Once
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	longRTT  float64 // EWMA of RTT samples, ns; 0 = unseeded
+
+	// Name is an operator-set, bounded label for metrics (see prom.AdaptiveLimit);
+	// "" is fine.
+	Name string
+
+	// Algorithm selects the limit update rule. Defaults to AdaptiveGradient.
+	Algorithm AdaptiveAlgorithm
+
+	// InitialLimit is the starting limit. Defaults to 20.
+	InitialLimit int
+
+	// MinLimit and MaxLimit bound the limit. Default 1 and 1000.
+	MinLimit int
+	MaxLimit int
+
+	// Tolerance is how far latency may rise above its long-term baseline before
+	// the limit shrinks: a sample slower than Tolerance x baseline reduces it.
+	// Must be >= 1. Defaults to 2.0.
+	Tolerance float64
+
+	// Smoothing blends each new gradient limit into the current one (0 < s <= 1);
+	// lower is steadier. Gradient only. Defaults to 0.2.
+	Smoothing float64
+
+	// LongWindow is the sample count of the long-term RTT average that serves as
+	// the no-load baseline. Defaults to 600.
+	LongWindow int
+
+	// LatencyThreshold is the AIMD slow-sample cutoff: a success slower than it
+	// backs off as if dropped. 0 uses Tolerance x the long-term baseline. AIMD only.
+	LatencyThreshold time.Duration
+
+	// Backoff is the multiplicative decrease applied on a drop (both algorithms)
+	// and on a slow AIMD sample, in (0,1). Defaults to 0.9.
+	Backoff float64
+}
+
+func (l *AdaptiveLimit) init() {
+	if l.MinLimit <= 0 {
+		l.MinLimit = defaultAdaptiveMinLimit
+	}
+	if l.MaxLimit <= 0 {
+		l.MaxLimit = defaultAdaptiveMaxLimit
+	}
+	if l.MaxLimit < l.MinLimit {
+		l.MaxLimit = l.MinLimit
+	}
+	if l.InitialLimit <= 0 {
+		l.InitialLimit = defaultAdaptiveInitialLimit
+	}
+	if l.Tolerance < 1 {
+		l.Tolerance = defaultAdaptiveTolerance
+	}
+	if l.Smoothing <= 0 || l.Smoothing > 1 {
+		l.Smoothing = defaultAdaptiveSmoothing
+	}
+	if l.LongWindow <= 0 {
+		l.LongWindow = defaultAdaptiveLongWindow
+	}
+	if l.Backoff <= 0 || l.Backoff >= 1 {
+		l.Backoff = defaultAdaptiveBackoff
+	}
+	l.limit = l.clamp(float64(l.InitialLimit))
+}
+
+func (l *AdaptiveLimit) clamp(v float64) float64 {
+	return math.Max(float64(l.MinLimit), math.Min(float64(l.MaxLimit), v))
+}
+
+// Acquire takes an in-flight slot, reporting false when the limit is reached —
+// the caller should shed the request. Every successful Acquire must be paired
+// with exactly one Release or Cancel.
+func (l *AdaptiveLimit) Acquire() bool {
+	l.once.Do(l.init)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Release returns a slot and feeds the round-trip sample into the limit. rtt is
+// the time the work took (for a proxy, the time to response headers); dropped
+// reports that the origin signalled overload — a transport failure, a timeout, or
+// a 503/504 — which shrinks the limit regardless of latency.
+func (l *AdaptiveLimit) Release(rtt time.Duration, dropped bool) {
+	l.once.Do(l.init)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inflight := l.inflight // the load this sample was taken under
+	if l.inflight > 0 {
+		l.inflight--
+	}
+
+	if dropped {
+		l.limit = l.clamp(l.limit * l.Backoff)
+		return
+	}
+	sample := float64(rtt)
+	if sample <= 0 {
+		return
+	}
+	if l.longRTT == 0 {
+		l.longRTT = sample
+	} else {
+		l.longRTT += (sample - l.longRTT) / float64(l.LongWindow)
+	}
+
+	// Only grow a limit that is actually in use; an app-limited sample says
+	// nothing about how much more the origin can take.
+	inUse := float64(inflight)*2 >= l.limit
+
+	switch l.Algorithm {
+	case AdaptiveAIMD:
+		threshold := float64(l.LatencyThreshold)
+		if threshold <= 0 {
+			threshold = l.Tolerance * l.longRTT
+		}
+		if sample > threshold {
+			l.limit = l.clamp(l.limit * l.Backoff)
+		} else if inUse {
+			l.limit = l.clamp(l.limit + 1)
+		}
+	default:
+		gradient := math.Max(0.5, math.Min(1, l.Tolerance*l.longRTT/sample))
+		if gradient >= 1 && !inUse {
+			return
+		}
+		next := l.limit*gradient + math.Sqrt(l.limit) // sqrt(limit) is the queue allowance
+		l.limit = l.clamp(l.limit*(1-l.Smoothing) + next*l.Smoothing)
+	}
+}
+
+// Cancel returns a slot without a sample, for work abandoned before it produced a
+// meaningful RTT (e.g. a client cancel).
+func (l *AdaptiveLimit) Cancel() {
+	l.once.Do(l.init)
+	l.mu.Lock()
+	if l.inflight > 0 {
+		l.inflight--
+	}
+	l.mu.Unlock()
+}
+
+// Limit returns the current concurrency limit.
+func (l *AdaptiveLimit) Limit() int {
+	l.once.Do(l.init)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Inflight returns the number of slots currently held.
+func (l *AdaptiveLimit) Inflight() int {
+	l.once.Do(l.init)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight
+}
+
+// Adaptive creates a per-route adaptive concurrency limiter middleware with a
+// gradient limit named name.
+func Adaptive(name string) *AdaptiveConcurrency {
+	return &AdaptiveConcurrency{Limit: &AdaptiveLimit{Name: name}}
+}
+
+// AdaptiveConcurrency is a middleware that bounds in-flight requests through the
+// rest of the chain with an AdaptiveLimit. Each request's time to response headers
+// is the RTT sample; a 503 or 504 from the chain counts as a drop. Requests over
+// the limit are shed by ExceededHandler — by default a 503 with Retry-After.
+//
+// Install it inside a location/host block for a per-route limit; for a
+// per-target limit wrap a Target.Transport with upstream.AdaptiveTransport
+// instead.
+type AdaptiveConcurrency struct {
+	Limit           *AdaptiveLimit
+	ExceededHandler ExceededHandler
+
+	// Observe, if set, is fired on every admission decision (allowed/limited) with
+	// Limit.Name as the Event name; nil disables it. See prom.RateLimit.
+	Observe ObserveFunc
+
+	// RetryAfter is the Retry-After hint passed to ExceededHandler. Defaults to 1s.
+	RetryAfter time.Duration
+}
+
+func defaultAdaptiveExceededHandler(w http.ResponseWriter, _ *http.Request, after time.Duration) {
+	if after > 0 {
+		header.Set(w.Header(), header.RetryAfter, strconv.FormatInt(int64(math.Ceil(after.Seconds())), 10))
+	}
+	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+}
+
+// ServeHandler implements middleware interface
+func (m AdaptiveConcurrency) ServeHandler(h http.Handler) http.Handler {
+	if m.Limit == nil {
+		m.Limit = &AdaptiveLimit{}
+	}
+	if m.ExceededHandler == nil {
+		m.ExceededHandler = defaultAdaptiveExceededHandler
+	}
+	if m.RetryAfter <= 0 {
+		m.RetryAfter = defaultAdaptiveRetryAfter
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.Limit.Acquire() {
+			m.observe(ResultLimited)
+			m.ExceededHandler(w, r, m.RetryAfter)
+			return
+		}
+		m.observe(ResultAllowed)
+
+		nw := &adaptiveResponseWriter{ResponseWriter: w, limit: m.Limit, start: time.Now()}
+		defer nw.release(r) // always return the slot, even on panic
+		h.ServeHTTP(nw, r)
+	})
+}
+
+func (m AdaptiveConcurrency) observe(result Result) {
+	if m.Observe != nil {
+		m.Observe(Event{Name: m.Limit.Name, Result: result})
+	}
+}
+
+// adaptiveResponseWriter releases its slot at the response headers, so the
+// sample is time-to-headers like upstream.RoundTripInfo.Duration.
+type adaptiveResponseWriter struct {
+	http.ResponseWriter
+	limit    *AdaptiveLimit
+	start    time.Time
+	released bool
+}
+
+func (w *adaptiveResponseWriter) release(r *http.Request) {
+	if w.released {
+		return
+	}
+	w.released = true
+	if r.Context().Err() != nil {
+		w.limit.Cancel() // the client left (or timed out) before any response
+		return
+	}
+	w.limit.Release(time.Since(w.start), false)
+}
+
+func (w *adaptiveResponseWriter) WriteHeader(statusCode int) {
+	if !w.released {
+		w.released = true
+		dropped := statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+		w.limit.Release(time.Since(w.start), dropped)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *adaptiveResponseWriter) Write(p []byte) (int, error) {
+	if !w.released {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *adaptiveResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements Flusher interface
+func (w *adaptiveResponseWriter) Flush() {
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+// Hijack implements Hijacker interface
+func (w *adaptiveResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return w.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
@@ -0,0 +1,165 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/moonrhythm/parapet/pkg/ratelimit"
+)
+
+func TestAdaptiveLimit_AcquireRelease(t *testing.T) {
+	t.Parallel()
+
+	l := &AdaptiveLimit{InitialLimit: 2}
+	assert.True(t, l.Acquire())
+	assert.True(t, l.Acquire())
+	assert.False(t, l.Acquire(), "at the limit")
+	assert.Equal(t, 2, l.Inflight())
+
+	l.Cancel()
+	assert.Equal(t, 1, l.Inflight())
+	assert.True(t, l.Acquire())
+}
+
+func TestAdaptiveLimit_GradientGrowsUnderSteadyLatency(t *testing.T) {
+	t.Parallel()
+
+	l := &AdaptiveLimit{InitialLimit: 10, MaxLimit: 100}
+	for range 200 {
+		// Keep the limit in use so growth is allowed.
+		n := 0
+		for l.Acquire() {
+			n++
+		}
+		for range n {
+			l.Release(10*time.Millisecond, false)
+		}
+	}
+	assert.Equal(t, 100, l.Limit(), "steady latency grows the limit to MaxLimit")
+}
+
+func TestAdaptiveLimit_GradientShrinksOnLatencyRise(t *testing.T) {
+	t.Parallel()
+
+	l := &AdaptiveLimit{InitialLimit: 50, LongWindow: 1000}
+	// Establish a 10ms baseline.
+	require.True(t, l.Acquire())
+	l.Release(10*time.Millisecond, false)
+
+	for range 50 {
+		require.True(t, l.Acquire())
+		l.Release(200*time.Millisecond, false) // 20x the baseline
+	}
+	assert.Less(t, l.Limit(), 20)
+}
+
+func TestAdaptiveLimit_AppLimitedDoesNotGrow(t *testing.T) {
+	t.Parallel()
+
+	l := &AdaptiveLimit{InitialLimit: 10}
+	for range 100 {
+		require.True(t, l.Acquire()) // only 1 of 10 in use
+		l.Release(10*time.Millisecond, false)
+	}
+	assert.Equal(t, 10, l.Limit())
+}
+
+func TestAdaptiveLimit_DropBacksOff(t *testing.T) {
+	t.Parallel()
+
+	for _, alg := range []AdaptiveAlgorithm{AdaptiveGradient, AdaptiveAIMD} {
+		l := &AdaptiveLimit{Algorithm: alg, InitialLimit: 100, MinLimit: 5, Backoff: 0.5}
+		for range 10 {
+			require.True(t, l.Acquire())
+			l.Release(time.Millisecond, true)
+		}
+		assert.Equal(t, 5, l.Limit(), "drops back off to MinLimit (alg %d)", alg)
+	}
+}
+
+func TestAdaptiveLimit_AIMD(t *testing.T) {
+	t.Parallel()
+
+	l := &AdaptiveLimit{Algorithm: AdaptiveAIMD, InitialLimit: 2, LatencyThreshold: 50 * time.Millisecond}
+	require.True(t, l.Acquire())
+	require.True(t, l.Acquire())
+	l.Release(10*time.Millisecond, false) // in use (2 of 2): +1
+	l.Release(10*time.Millisecond, false) // 1 of 3 in use: no growth
+	assert.Equal(t, 3, l.Limit())
+
+	require.True(t, l.Acquire())
+	l.Release(100*time.Millisecond, false) // slower than the threshold: x0.9
+	assert.Equal(t, 2, l.Limit())
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sheds with 503 and Retry-After", func(t *testing.T) {
+		m := Adaptive("test")
+		m.Limit.InitialLimit = 1
+		var events []Event
+		m.Observe = func(e Event) { events = append(events, e) }
+
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		h := m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		var wg sync.WaitGroup
+		wg.Go(func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		})
+		<-entered
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+		close(release)
+		wg.Wait()
+		assert.Equal(t, 0, m.Limit.Inflight())
+		require.Len(t, events, 2)
+		assert.Equal(t, Event{Name: "test", Result: ResultAllowed}, events[0])
+		assert.Equal(t, Event{Name: "test", Result: ResultLimited}, events[1])
+	})
+
+	t.Run("503 from the chain is a drop", func(t *testing.T) {
+		m := AdaptiveConcurrency{Limit: &AdaptiveLimit{InitialLimit: 10, Backoff: 0.5}}
+		h := m.ServeHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, 5, m.Limit.Limit())
+		assert.Equal(t, 0, m.Limit.Inflight())
+	})
+
+	t.Run("releases on panic and on a cancelled request", func(t *testing.T) {
+		m := AdaptiveConcurrency{Limit: &AdaptiveLimit{InitialLimit: 1}}
+		h := m.ServeHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			panic("boom")
+		}))
+		assert.Panics(t, func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		})
+		assert.Equal(t, 0, m.Limit.Inflight())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		h = m.ServeHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		assert.Equal(t, 0, m.Limit.Inflight())
+		assert.Equal(t, 1, m.Limit.Limit())
+	})
+}
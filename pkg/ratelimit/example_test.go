@@ -100,3 +100,15 @@ func ExampleRateLimiter_exceededHandler() {
 	s := parapet.New()
 	s.Use(m)
 }
+
+// Adaptive bounds in-flight requests through a route without a hand-tuned cap:
+// the limit grows while latency holds near its baseline and shrinks as the
+// backend starts queueing or answers 503/504. Over the limit, requests get a 503
+// with Retry-After.
+func ExampleAdaptive() {
+	rl := ratelimit.Adaptive("api")
+	rl.Limit.MaxLimit = 200
+
+	s := parapet.New()
+	s.Use(rl)
+}
@@ -1,6 +1,7 @@
 package requestid
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gofrs/uuid"
@@ -51,10 +52,19 @@ func (m RequestID) ServeHandler(h http.Handler) http.Handler {
 		header.Set(w.Header(), m.Header, id)
 		logger.Set(r.Context(), "requestId", id)
 
-		h.ServeHTTP(w, r)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
 	})
 }
 
+type requestIDContextKey struct{}
+
+// FromContext returns the request id that RequestID stored on the request
+// context, if the request passed through it.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDContextKey{}).(string)
+	return id, ok
+}
+
 // isValidRequestID accepts only a conservative charset so a client cannot
 // inject control characters or oversized values into logs and upstream headers.
 func isValidRequestID(s string) bool {
@@ -44,6 +44,21 @@ func TestRequestID(t *testing.T) {
 		assert.NotEmpty(t, w.Header().Get(header))
 	})
 
+	t.Run("Context", func(t *testing.T) {
+		m := RequestID{}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		m.ServeHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			id, ok := FromContext(r.Context())
+			assert.True(t, ok)
+			assert.Equal(t, r.Header.Get(DefaultHeader), id)
+		})).ServeHTTP(w, r)
+
+		_, ok := FromContext(r.Context())
+		assert.False(t, ok)
+	})
+
 	t.Run("Trust Proxy", func(t *testing.T) {
 		value := "123aaa"
 
@@ -0,0 +1,44 @@
+package sign_test
+
+import (
+	"os"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/sign"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+// Serve a private S3 bucket. The Host must be the bucket's, since it is signed;
+// uploads stream aws-chunked instead of being buffered to hash them.
+func ExampleSigV4() {
+	s3 := &sign.SigV4{
+		Credentials: sign.Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		},
+		Region:  "us-east-1",
+		Service: "s3",
+		Payload: sign.PayloadStreaming,
+	}
+
+	u := upstream.SingleHost("my-bucket.s3.us-east-1.amazonaws.com", sign.NewTransport(s3, &upstream.HTTPSTransport{}))
+	u.Host = "my-bucket.s3.us-east-1.amazonaws.com"
+
+	s := parapet.New()
+	s.Use(u)
+}
+
+// Call an IAM-protected Cloud Run service as the proxy's service account,
+// keeping the client's own Authorization header for the service.
+func ExampleGCPIDToken() {
+	const service = "https://api-abc123-uc.a.run.app"
+
+	u := upstream.SingleHost("api-abc123-uc.a.run.app", sign.NewTransport(&sign.GCPIDToken{
+		Audience: service,
+		Header:   "X-Serverless-Authorization",
+	}, &upstream.HTTPSTransport{}))
+	u.Host = "api-abc123-uc.a.run.app"
+
+	s := parapet.New()
+	s.Use(u)
+}
@@ -0,0 +1,20 @@
+package sign
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// SetNewIDTokenSourceForTest replaces the default ID token source constructor
+// for the external (sign_test) tests, which can't reach a metadata server, and
+// returns a func restoring it. Exported test-only identifiers here are visible
+// to the sibling sign_test package and stay out of the shipped API.
+func SetNewIDTokenSourceForTest(fn func(ctx context.Context, audience string) (oauth2.TokenSource, error)) (restore func()) {
+	prev := newIDTokenSource
+	newIDTokenSource = func(ctx context.Context, audience string, _ ...option.ClientOption) (oauth2.TokenSource, error) {
+		return fn(ctx, audience)
+	}
+	return func() { newIDTokenSource = prev }
+}
@@ -0,0 +1,112 @@
+// Package sign signs outbound requests for origins that authenticate the proxy
+// itself: AWS SigV4 (S3-compatible stores and other AWS APIs), generic HMAC
+// schemes of partner APIs, and Google-signed ID tokens for IAM-protected Cloud
+// Run and Cloud Functions services.
+//
+// A Signer is applied by Transport, a Target.Transport wrapper:
+//
+//	upstream.SingleHost("bucket.s3.amazonaws.com:443", sign.NewTransport(&sign.SigV4{...}, &upstream.HTTPSTransport{}))
+//
+// The signature is computed in RoundTrip, so every retry or hedge attempt that
+// Upstream or HedgingLoadBalancer re-issues is signed afresh, with the target
+// and timestamp of that attempt.
+package sign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Signer adds authentication to an outbound request. r is the copy Transport
+// sends, so Sign may change its headers and replace its Body.
+type Signer interface {
+	Sign(r *http.Request) error
+}
+
+// SignerFunc adapts a function to a Signer.
+type SignerFunc func(r *http.Request) error
+
+// Sign implements Signer
+func (f SignerFunc) Sign(r *http.Request) error {
+	return f(r)
+}
+
+// NewTransport wraps a target's transport with signer.
+func NewTransport(signer Signer, transport http.RoundTripper) *Transport {
+	return &Transport{
+		Transport: transport,
+		Signer:    signer,
+	}
+}
+
+// Transport is a Target.Transport wrapper that signs each round-trip with Signer
+// before passing it to Transport. It signs a clone, so the request Upstream
+// re-issues on a retry is never left carrying a stale signature. A signing
+// failure fails the round-trip, which Upstream answers with 502.
+type Transport struct {
+	Transport http.RoundTripper
+	Signer    Signer
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	if err := t.Signer.Sign(r); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	return t.Transport.RoundTrip(r)
+}
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// BodySHA256 returns the hex SHA-256 of r's body, for a custom canonicalization.
+// A body that r.GetBody can replay is hashed from a fresh copy; any other is read
+// into memory and r.Body replaced with it, so r can still be sent.
+func BodySHA256(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return emptySHA256, nil
+	}
+
+	h := sha256.New()
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	b, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	r.ContentLength = int64(len(b))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// requestHost is the host the request is sent with.
+func requestHost(r *http.Request) string {
+	if r.Host != "" {
+		return r.Host
+	}
+	return r.URL.Host
+}
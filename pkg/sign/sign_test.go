@@ -0,0 +1,163 @@
+package sign_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	. "github.com/moonrhythm/parapet/pkg/sign"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestTransport_ResignsEachAttempt(t *testing.T) {
+	t.Parallel()
+
+	var tick atomic.Int64
+	signer := &HMAC{
+		Key:             []byte("secret"),
+		TimestampHeader: "X-Timestamp",
+		SignedHeaders:   []string{"X-Timestamp"},
+		Now:             func() time.Time { return time.Unix(1700000000+tick.Add(1), 0) },
+	}
+
+	var sigs, stamps []string
+	inner := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sigs = append(sigs, r.Header.Get("X-Signature"))
+		stamps = append(stamps, r.Header.Get("X-Timestamp"))
+		if len(sigs) == 1 {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}}, nil
+	})
+
+	u := upstream.SingleHost("partner.example.com", NewTransport(signer, inner))
+	u.Retries = 1
+	u.BackoffFactor = time.Millisecond
+	w := httptest.NewRecorder()
+	u.ServeHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/v1/orders", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, sigs, 2)
+	assert.NotEqual(t, stamps[0], stamps[1], "each attempt is signed afresh")
+	assert.NotEqual(t, sigs[0], sigs[1])
+}
+
+func TestTransport_SignError(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	tr := NewTransport(SignerFunc(func(*http.Request) error { return errors.New("no credentials") }),
+		roundTripFunc(func(*http.Request) (*http.Response, error) { called = true; return nil, nil }))
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	_, err := tr.RoundTrip(r)
+	assert.EqualError(t, err, "sign: no credentials")
+	assert.False(t, called)
+}
+
+func TestHMAC(t *testing.T) {
+	t.Parallel()
+
+	mac := func(msg string) string {
+		h := hmac.New(sha256.New, []byte("secret"))
+		h.Write([]byte(msg))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	t.Run("default canonicalization", func(t *testing.T) {
+		s := HMAC{
+			Key:             []byte("secret"),
+			TimestampHeader: "X-Timestamp",
+			SignedHeaders:   []string{"Host", "X-Timestamp", "Content-Type"},
+			SignBody:        true,
+			Now:             func() time.Time { return time.Unix(1700000000, 0) },
+		}
+		r := httptest.NewRequest("POST", "http://api.example.com/v1/orders?id=1&x=a%20b", strings.NewReader(`{"a":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		assert.NoError(t, s.Sign(r))
+
+		body := sha256.Sum256([]byte(`{"a":1}`))
+		want := "POST\n/v1/orders?id=1&x=a%20b\napi.example.com\n1700000000\napplication/json\n" + hex.EncodeToString(body[:])
+		assert.Equal(t, mac(want), r.Header.Get("X-Signature"))
+		assert.Equal(t, "1700000000", r.Header.Get("X-Timestamp"))
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"a":1}`, string(b), "the body is still sent")
+	})
+
+	t.Run("custom canonicalization and format", func(t *testing.T) {
+		s := HMAC{
+			Key:    []byte("secret"),
+			Header: "Authorization",
+			Canonicalize: func(r *http.Request) (string, error) {
+				return r.Method + " " + r.URL.Path, nil
+			},
+			Format: func(sig []byte) string {
+				return "HMAC keyId=partner,signature=" + base64.StdEncoding.EncodeToString(sig)
+			},
+		}
+		r := httptest.NewRequest("DELETE", "http://api.example.com/v1/orders/1", nil)
+		assert.NoError(t, s.Sign(r))
+
+		h := hmac.New(sha256.New, []byte("secret"))
+		h.Write([]byte("DELETE /v1/orders/1"))
+		assert.Equal(t, "HMAC keyId=partner,signature="+base64.StdEncoding.EncodeToString(h.Sum(nil)), r.Header.Get("Authorization"))
+	})
+}
+
+type countingSource struct {
+	calls atomic.Int32
+}
+
+func (s *countingSource) Token() (*oauth2.Token, error) {
+	s.calls.Add(1)
+	return &oauth2.Token{AccessToken: "id-token", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func TestGCPIDToken(t *testing.T) {
+	t.Parallel()
+
+	src := &countingSource{}
+	s := &GCPIDToken{Audience: "https://api.example.run.app", TokenSource: src, Header: "X-Serverless-Authorization"}
+	for range 3 {
+		r := httptest.NewRequest("GET", "http://api.example.run.app/", nil)
+		assert.NoError(t, s.Sign(r))
+		assert.Equal(t, "Bearer id-token", r.Header.Get("X-Serverless-Authorization"))
+	}
+	assert.EqualValues(t, 1, src.calls.Load(), "the token is cached until it expires")
+}
+
+// Not parallel: it swaps the package's default token source constructor.
+func TestGCPIDToken_RetriesFailedInit(t *testing.T) {
+	var inits atomic.Int32
+	defer SetNewIDTokenSourceForTest(func(_ context.Context, audience string) (oauth2.TokenSource, error) {
+		if inits.Add(1) == 1 {
+			return nil, errors.New("metadata server unavailable")
+		}
+		return &countingSource{}, nil
+	})()
+
+	s := &GCPIDToken{Audience: "https://api.example.run.app"}
+	r := httptest.NewRequest("GET", "http://api.example.run.app/", nil)
+	assert.EqualError(t, s.Sign(r), "metadata server unavailable")
+	assert.NoError(t, s.Sign(r), "a failed init is retried")
+	assert.Equal(t, "Bearer id-token", r.Header.Get("Authorization"))
+	assert.NoError(t, s.Sign(r))
+	assert.EqualValues(t, 2, inits.Load(), "a success is cached")
+}
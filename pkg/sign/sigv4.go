@@ -0,0 +1,350 @@
+package sign
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload selects how a SigV4 signature covers the request body.
+type Payload uint8
+
+const (
+	// PayloadSigned hashes the whole body into the signature. A body r.GetBody
+	// cannot replay is buffered in memory to hash it.
+	PayloadSigned Payload = iota
+
+	// PayloadUnsigned signs with UNSIGNED-PAYLOAD and streams the body as is,
+	// leaving it unauthenticated (TLS still protects it in transit).
+	PayloadUnsigned
+
+	// PayloadStreaming sends the body aws-chunked with a signature per chunk
+	// (STREAMING-AWS4-HMAC-SHA256-PAYLOAD), so it is authenticated without being
+	// buffered. S3 requires a known Content-Length for it.
+	PayloadStreaming
+)
+
+// Credentials is an AWS access key.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // for temporary credentials; sent as X-Amz-Security-Token
+}
+
+// SigV4 signs requests with AWS Signature Version 4 in the Authorization
+// header, for S3-compatible stores (Service "s3") and other AWS APIs.
+//
+// Every request header present at signing is signed, except Authorization,
+// User-Agent and hop-by-hop headers, so set Upstream.Host to the origin's name
+// (such as "bucket.s3.amazonaws.com"): the client's Host would not verify.
+type SigV4 struct {
+	Credentials Credentials
+
+	// CredentialsFunc, if set, supplies the credentials for each request instead
+	// of Credentials, for keys that rotate. It should cache them.
+	CredentialsFunc func(ctx context.Context) (Credentials, error)
+
+	Region  string // e.g. "us-east-1"
+	Service string // e.g. "s3"
+	Payload Payload
+
+	ChunkSize int              // PayloadStreaming chunk size; default 64 KiB
+	Now       func() time.Time // for tests; default time.Now
+}
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	defaultChunkSize = 64 << 10
+)
+
+// sigV4Unsigned are the headers never signed: Authorization carries the
+// signature, and the others may be changed or dropped on the way.
+var sigV4Unsigned = map[string]bool{
+	"Authorization":     true,
+	"User-Agent":        true,
+	"X-Amzn-Trace-Id":   true,
+	"Expect":            true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Sign implements Signer
+func (s *SigV4) Sign(r *http.Request) error {
+	cred := s.Credentials
+	if s.CredentialsFunc != nil {
+		var err error
+		cred, err = s.CredentialsFunc(r.Context())
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	amzDate := now().UTC().Format(sigV4TimeFormat)
+	scope := amzDate[:8] + "/" + s.Region + "/" + s.Service + "/aws4_request"
+
+	h := r.Header
+	h.Del("Authorization")
+	h.Set("X-Amz-Date", amzDate)
+	h.Del("X-Amz-Security-Token")
+	if cred.SessionToken != "" {
+		h.Set("X-Amz-Security-Token", cred.SessionToken)
+	}
+
+	chunkSize := int64(s.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	hasBody := r.Body != nil && r.Body != http.NoBody
+
+	var payload string
+	switch {
+	case s.Payload == PayloadUnsigned:
+		payload = unsignedPayload
+	case s.Payload == PayloadStreaming && hasBody:
+		if r.ContentLength < 0 {
+			return errors.New("streaming payload needs a known Content-Length")
+		}
+		payload = streamingPayload
+		if ce := h.Get("Content-Encoding"); ce != "" {
+			h.Set("Content-Encoding", "aws-chunked,"+ce)
+		} else {
+			h.Set("Content-Encoding", "aws-chunked")
+		}
+		h.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		r.ContentLength = chunkedLength(r.ContentLength, chunkSize)
+		r.GetBody = nil // the chunks' signatures are not reproducible without re-signing
+	default:
+		var err error
+		payload, err = BodySHA256(r)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Service == "s3" || s.Payload != PayloadSigned {
+		h.Set("X-Amz-Content-Sha256", payload)
+	}
+
+	canonical, signed := s.canonicalRequest(r, payload)
+	key := sigV4Key(cred.SecretAccessKey, amzDate[:8], s.Region, s.Service)
+	sts := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonical))
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+
+	h.Set("Authorization", sigV4Algorithm+" Credential="+cred.AccessKeyID+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+
+	if payload == streamingPayload {
+		r.Body = &chunkedBody{
+			body:    r.Body,
+			buf:     make([]byte, chunkSize),
+			key:     key,
+			prefix:  sigV4Algorithm + "-PAYLOAD\n" + amzDate + "\n" + scope + "\n",
+			prevSig: sig,
+		}
+	}
+	return nil
+}
+
+// canonicalRequest returns the SigV4 canonical request and its signed header
+// list.
+func (s *SigV4) canonicalRequest(r *http.Request, payload string) (string, string) {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	path = uriEncode(path, false)
+	if s.Service != "s3" {
+		path = uriEncode(path, false) // every service but S3 encodes the path twice
+	}
+
+	var params [][2]string
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			params = append(params, [2]string{uriEncode(k, true), uriEncode(v, true)})
+		}
+	}
+	slices.SortFunc(params, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+
+	headers := map[string]string{"host": requestHost(r)}
+	if r.ContentLength > 0 {
+		headers["content-length"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for k, vs := range r.Header {
+		// Host and Content-Length are sent from r.Host and r.ContentLength, not
+		// the header map
+		if sigV4Unsigned[k] || k == "Host" || k == "Content-Length" || len(vs) == 0 {
+			continue
+		}
+		values := make([]string, len(vs))
+		for i, v := range vs {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(k)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(path)
+	b.WriteByte('\n')
+	for i, p := range params {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(p[1])
+	}
+	b.WriteByte('\n')
+	for _, k := range names {
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(headers[k])
+		b.WriteByte('\n')
+	}
+	signed := strings.Join(names, ";")
+	b.WriteByte('\n')
+	b.WriteString(signed)
+	b.WriteByte('\n')
+	b.WriteString(payload)
+	return b.String(), signed
+}
+
+func sigV4Key(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// uriEncode escapes s the SigV4 way: everything but the unreserved characters,
+// and "/" only when encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~',
+			c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+// chunkLength is the aws-chunked size of a chunk carrying n bytes.
+func chunkLength(n int64) int64 {
+	return int64(len(strconv.FormatInt(n, 16))) + int64(len(";chunk-signature=")) + 64 + 2 + n + 2
+}
+
+// chunkedLength is the aws-chunked size of an n-byte body, the final empty
+// chunk included.
+func chunkedLength(n, chunkSize int64) int64 {
+	l := n/chunkSize*chunkLength(chunkSize) + chunkLength(0)
+	if rem := n % chunkSize; rem > 0 {
+		l += chunkLength(rem)
+	}
+	return l
+}
+
+// chunkedBody encodes body aws-chunked, each chunk signed over the previous
+// one's signature, starting from the request's.
+type chunkedBody struct {
+	body    io.ReadCloser
+	buf     []byte
+	key     []byte
+	prefix  string // the chunk string-to-sign up to the previous signature
+	prevSig string
+	out     []byte // the encoded chunks of one read
+	pending []byte // the unread rest of out
+	done    bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		b.out = b.out[:0]
+		n, err := io.ReadFull(b.body, b.buf)
+		switch err {
+		case nil:
+			b.frame(b.buf[:n])
+		case io.EOF, io.ErrUnexpectedEOF:
+			if n > 0 {
+				b.frame(b.buf[:n])
+			}
+			b.frame(nil)
+			b.done = true
+		default:
+			return 0, err
+		}
+		b.pending = b.out
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *chunkedBody) frame(data []byte) {
+	sts := b.prefix + b.prevSig + "\n" + emptySHA256 + "\n" + hexSHA256(data)
+	b.prevSig = hex.EncodeToString(hmacSHA256(b.key, sts))
+
+	b.out = strconv.AppendInt(b.out, int64(len(data)), 16)
+	b.out = append(b.out, ";chunk-signature="...)
+	b.out = append(b.out, b.prevSig...)
+	b.out = append(b.out, "\r\n"...)
+	b.out = append(b.out, data...)
+	b.out = append(b.out, "\r\n"...)
+}
+
+func (b *chunkedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,38 @@
+package split_test
+
+import (
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/prom"
+	"github.com/moonrhythm/parapet/pkg/split"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/moonrhythm/parapet/pkg/waf"
+)
+
+// Send 5% of traffic — plus every request carrying X-Canary: 1 or matching a CEL
+// predicate — to a canary pool, pinning each client to the version it first hit.
+// The stable backend has no Handler, so it falls through to the rest of the chain.
+func ExampleNew() {
+	beta, err := waf.NewPredicate(`request.cookies["plan"] == "beta"`)
+	if err != nil {
+		panic(err)
+	}
+
+	sp := split.New(
+		&split.Backend{Name: "canary", Weight: 5, Handler: upstream.SingleHost("canary:8080", &upstream.HTTPTransport{})},
+		&split.Backend{Name: "stable", Weight: 95},
+	)
+	sp.Routes = []split.Route{
+		{Match: split.Header("X-Canary", "1"), Backend: "canary"},
+		{Match: beta.Match, Backend: "canary"},
+	}
+	sp.StickyCookie = "version"
+	sp.Observe = prom.Split()
+
+	s := parapet.NewFrontend()
+	s.Use(sp)
+	s.Use(upstream.SingleHost("prod:8080", &upstream.HTTPTransport{}))
+
+	// Progressive rollout: shift weight at runtime, no chain rebuild.
+	sp.SetWeight("canary", 25)
+	sp.SetWeight("stable", 75)
+}
@@ -0,0 +1,349 @@
+// Package split provides a traffic-splitting middleware for canary releases: it
+// sends a weighted share of requests — or the requests matching a header, cookie,
+// or CEL predicate — to one of several named backends, optionally pinning a client
+// to the backend it first landed on.
+package split
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+// Split defaults.
+const (
+	defaultLogField     = "split"
+	defaultStickyMaxAge = 24 * time.Hour
+)
+
+// New creates a traffic-split middleware over the given backends. Configure the
+// routing rules, stickiness, and observer fields before serving.
+func New(backends ...*Backend) *Split {
+	return &Split{Backends: backends}
+}
+
+// Backend is one named traffic-split destination.
+type Backend struct {
+	// Name identifies the backend in rules, the sticky cookie, the logger record,
+	// and metrics. It must be unique within a Split and is operator-set, so it is a
+	// bounded metric label.
+	Name string
+
+	// Weight is the backend's initial share of the weighted split: it receives
+	// Weight/sum(Weight) of the requests no rule or sticky pin decided. 0 takes it
+	// out of the weighted pool (it is still reachable via a Route); negative
+	// values count as 0. Change it at runtime with Split.SetWeight.
+	Weight int
+
+	// Handler is the destination chain — typically an *upstream.Upstream, or any
+	// http.Handler adapted with parapet.Handler(h.ServeHTTP). nil falls through to
+	// the next handler in the outer chain, so the "stable" backend can simply be the
+	// rest of the chain.
+	Handler parapet.Middleware
+}
+
+// Route sends every request that Match accepts to the named Backend, ahead of the
+// sticky pin and the weighted split.
+type Route struct {
+	Match   func(r *http.Request) bool
+	Backend string
+}
+
+// Reason classifies why a request was routed to its backend, reported via Observe.
+type Reason uint8
+
+const (
+	// ReasonWeight: the weighted split picked the backend.
+	ReasonWeight Reason = iota
+	// ReasonRoute: a Route matched the request.
+	ReasonRoute
+	// ReasonSticky: the request carried a sticky cookie naming a live backend.
+	ReasonSticky
+)
+
+// String renders a Reason as a stable, bounded metric-label value.
+func (r Reason) String() string {
+	switch r {
+	case ReasonRoute:
+		return "route"
+	case ReasonSticky:
+		return "sticky"
+	default:
+		return "weight"
+	}
+}
+
+// Event reports one routing decision to Split.Observe. Every field is bounded:
+// Name and Backend are operator-set and Reason is a closed set.
+type Event struct {
+	Name    string // the operator-set Split.Name (may be "")
+	Backend string // the chosen Backend.Name
+	Reason  Reason
+}
+
+// ObserveFunc is the traffic-split observation-hook shape, returned by prom.Split
+// for wiring into Split.Observe. It fires once per routed request on the request
+// goroutine — keep it cheap.
+type ObserveFunc func(Event)
+
+// Split is a traffic-splitting Middleware. For each request it picks one backend:
+//
+//  1. the first Route whose Match accepts the request, else
+//  2. the backend named by the sticky cookie (when StickyCookie is set and the named
+//     backend still has a positive weight), else
+//  3. a weighted pick over the backends' current weights — a random draw, or a
+//     hash of Key(r) when Key is set so a given user always lands on the same
+//     bucket.
+//
+// The chosen backend's name is recorded in the logger record (LogField) and
+// reported to Observe. When every weight is 0 and no rule decided, the request
+// falls through to the next handler untouched.
+//
+// Weights are runtime-mutable through SetWeight, so a progressive rollout can
+// shift traffic without rebuilding the chain. With Key set, each key maps to a
+// fixed fraction of the weight range and the buckets are laid out in Backends
+// order, so growing the FIRST backend's weight only moves users into it — put the
+// canary first to keep already-canaried users on the canary as it grows.
+//
+// Config fields and the backend chains are read once on the first ServeHandler;
+// set them before serving.
+//
+//nolint:govet // fields grouped by role (state, then config) for readability
+type Split struct {
+	once   sync.Once
+	peers  []*peer
+	byName map[string]*peer
+
+	// Backends is the set of named destinations.
+	Backends []*Backend
+
+	// Routes override the weighted split for matching requests, checked in order.
+	// A route naming an unknown backend is skipped.
+	Routes []Route
+
+	// Key, when set, makes the weighted pick deterministic: the request lands on the
+	// bucket its hashed Key falls into, so a user keyed by, say, a session ID or user
+	// ID stays on one version without a cookie. A request whose Key is "" falls back
+	// to a random draw.
+	Key func(r *http.Request) string
+
+	// StickyCookie, when set, pins a client to the backend it first landed on: the
+	// choice is written to this cookie and honored on later requests while that
+	// backend keeps a positive weight. Setting its weight to 0 releases its pinned
+	// clients.
+	StickyCookie string
+
+	// StickyMaxAge is the sticky cookie lifetime. Defaults to 24h.
+	StickyMaxAge time.Duration
+
+	// Name is an operator-set, bounded label carried on every Event so several
+	// splits are distinguishable in metrics; "" is fine.
+	Name string
+
+	// LogField is the logger record field the chosen backend is written to.
+	// Defaults to "split".
+	LogField string
+
+	// Observe, if set, is fired once per routed request; nil disables it. See
+	// prom.Split.
+	Observe ObserveFunc
+}
+
+// peer is one backend's live state. weight is the only field mutated after init.
+type peer struct {
+	backend *Backend
+	weight  atomic.Int64
+	idx     int // position in peers, indexes the per-chain handler slice
+}
+
+// Use appends a backend. SETUP ONLY: it must be called before the first request.
+func (m *Split) Use(b *Backend) {
+	m.Backends = append(m.Backends, b)
+}
+
+func (m *Split) init() {
+	if m.LogField == "" {
+		m.LogField = defaultLogField
+	}
+	if m.StickyMaxAge <= 0 {
+		m.StickyMaxAge = defaultStickyMaxAge
+	}
+
+	m.peers = make([]*peer, 0, len(m.Backends))
+	m.byName = make(map[string]*peer, len(m.Backends))
+	for _, b := range m.Backends {
+		if b == nil {
+			continue
+		}
+		p := &peer{backend: b, idx: len(m.peers)}
+		p.weight.Store(normalizeWeight(b.Weight))
+		m.peers = append(m.peers, p)
+		m.byName[b.Name] = p
+	}
+}
+
+func normalizeWeight(w int) int64 {
+	if w < 0 {
+		return 0
+	}
+	return int64(w)
+}
+
+// SetWeight changes a backend's weight at runtime; it is safe to call
+// concurrently with serving and takes effect on the next request. It reports
+// false when no backend has that name.
+func (m *Split) SetWeight(name string, weight int) bool {
+	m.once.Do(m.init)
+	p := m.byName[name]
+	if p == nil {
+		return false
+	}
+	p.weight.Store(normalizeWeight(weight))
+	return true
+}
+
+// Weight returns a backend's current weight, or -1 when no backend has that name.
+func (m *Split) Weight(name string) int {
+	m.once.Do(m.init)
+	p := m.byName[name]
+	if p == nil {
+		return -1
+	}
+	return int(p.weight.Load())
+}
+
+// ServeHandler implements middleware interface
+func (m *Split) ServeHandler(h http.Handler) http.Handler {
+	m.once.Do(m.init)
+
+	handlers := make([]http.Handler, len(m.peers))
+	for i, p := range m.peers {
+		if p.backend.Handler == nil {
+			handlers[i] = h
+			continue
+		}
+		handlers[i] = p.backend.Handler.ServeHandler(h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, reason := m.pick(r)
+		if p == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		name := p.backend.Name
+		if m.StickyCookie != "" && reason != ReasonSticky {
+			http.SetCookie(w, &http.Cookie{
+				Name:     m.StickyCookie,
+				Value:    name,
+				Path:     "/",
+				MaxAge:   int(m.StickyMaxAge / time.Second),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		logger.Set(r.Context(), m.LogField, name)
+		if m.Observe != nil {
+			m.Observe(Event{Name: m.Name, Backend: name, Reason: reason})
+		}
+		handlers[p.idx].ServeHTTP(w, r)
+	})
+}
+
+// pick chooses the backend for r, or nil when nothing is routable.
+func (m *Split) pick(r *http.Request) (*peer, Reason) {
+	for _, rt := range m.Routes {
+		if rt.Match == nil || !rt.Match(r) {
+			continue
+		}
+		if p := m.byName[rt.Backend]; p != nil {
+			return p, ReasonRoute
+		}
+	}
+
+	if m.StickyCookie != "" {
+		if c, err := r.Cookie(m.StickyCookie); err == nil {
+			if p := m.byName[c.Value]; p != nil && p.weight.Load() > 0 {
+				return p, ReasonSticky
+			}
+		}
+	}
+
+	return m.pickWeighted(r), ReasonWeight
+}
+
+// pickWeighted lays the backends' current weights end to end and returns the
+// backend owning the drawn point: a random one, or the hashed Key when set. The
+// weights are loaded once per call, so a concurrent SetWeight never yields a
+// point past the end of the range.
+func (m *Split) pickWeighted(r *http.Request) *peer {
+	var buf [8]int64
+	weights := buf[:0]
+	if len(m.peers) > cap(buf) {
+		weights = make([]int64, 0, len(m.peers))
+	}
+	var total int64
+	for _, p := range m.peers {
+		w := p.weight.Load()
+		weights = append(weights, w)
+		total += w
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	var point int64
+	if k := m.key(r); k != "" {
+		// Scale the hash into [0,total) by its fraction of the 64-bit range rather
+		// than a modulo, so a key keeps its relative position when the total changes.
+		hi, _ := bits.Mul64(hashKey(k), uint64(total))
+		point = int64(hi)
+	} else {
+		point = rand.Int64N(total)
+	}
+	for i, w := range weights {
+		if point < w {
+			return m.peers[i]
+		}
+		point -= w
+	}
+	return nil // unreachable: point < total
+}
+
+func (m *Split) key(r *http.Request) string {
+	if m.Key == nil {
+		return ""
+	}
+	return m.Key(r)
+}
+
+func hashKey(k string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	return h.Sum64()
+}
+
+// Header returns a Route matcher accepting requests whose header name equals
+// value.
+func Header(name, value string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		return r.Header.Get(name) == value
+	}
+}
+
+// Cookie returns a Route matcher accepting requests carrying cookie name with the
+// given value.
+func Cookie(name, value string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		c, err := r.Cookie(name)
+		return err == nil && c.Value == value
+	}
+}
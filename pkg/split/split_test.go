@@ -0,0 +1,249 @@
+package split_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/logger"
+	. "github.com/moonrhythm/parapet/pkg/split"
+)
+
+// named is a terminal backend that answers with its own name.
+func named(name string) parapet.Middleware {
+	return parapet.Handler(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(name))
+	})
+}
+
+var fallthroughHandler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	w.Write([]byte("next"))
+})
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestSplit_Weighted(t *testing.T) {
+	t.Parallel()
+
+	m := New(
+		&Backend{Name: "canary", Weight: 1, Handler: named("canary")},
+		&Backend{Name: "stable", Weight: 3, Handler: named("stable")},
+	)
+	h := m.ServeHandler(fallthroughHandler)
+
+	counts := map[string]int{}
+	for range 4000 {
+		counts[serve(h, httptest.NewRequest("GET", "/", nil)).Body.String()]++
+	}
+	assert.InDelta(t, 1000, counts["canary"], 200)
+	assert.InDelta(t, 3000, counts["stable"], 200)
+	assert.Zero(t, counts["next"])
+}
+
+func TestSplit_NilHandlerFallsThrough(t *testing.T) {
+	t.Parallel()
+
+	m := New(&Backend{Name: "stable", Weight: 1})
+	h := m.ServeHandler(fallthroughHandler)
+	assert.Equal(t, "next", serve(h, httptest.NewRequest("GET", "/", nil)).Body.String())
+}
+
+func TestSplit_AllZeroWeightFallsThrough(t *testing.T) {
+	t.Parallel()
+
+	var events int
+	m := New(&Backend{Name: "canary", Handler: named("canary")})
+	m.Observe = func(Event) { events++ }
+	h := m.ServeHandler(fallthroughHandler)
+	assert.Equal(t, "next", serve(h, httptest.NewRequest("GET", "/", nil)).Body.String())
+	assert.Zero(t, events, "an unrouted request is not observed")
+}
+
+func TestSplit_SetWeight(t *testing.T) {
+	t.Parallel()
+
+	m := New(
+		&Backend{Name: "canary", Weight: 0, Handler: named("canary")},
+		&Backend{Name: "stable", Weight: 1, Handler: named("stable")},
+	)
+	h := m.ServeHandler(fallthroughHandler)
+	assert.Equal(t, "stable", serve(h, httptest.NewRequest("GET", "/", nil)).Body.String())
+
+	require.True(t, m.SetWeight("canary", 1))
+	require.True(t, m.SetWeight("stable", 0))
+	assert.Equal(t, 1, m.Weight("canary"))
+	assert.Equal(t, "canary", serve(h, httptest.NewRequest("GET", "/", nil)).Body.String())
+
+	assert.False(t, m.SetWeight("unknown", 1))
+	assert.Equal(t, -1, m.Weight("unknown"))
+}
+
+func TestSplit_SetWeightConcurrent(t *testing.T) {
+	t.Parallel()
+
+	m := New(
+		&Backend{Name: "canary", Weight: 1, Handler: named("canary")},
+		&Backend{Name: "stable", Weight: 1, Handler: named("stable")},
+	)
+	h := m.ServeHandler(fallthroughHandler)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 1000 {
+			m.SetWeight("canary", i%3)
+		}
+	})
+	for range 1000 {
+		body := serve(h, httptest.NewRequest("GET", "/", nil)).Body.String()
+		assert.Contains(t, []string{"canary", "stable"}, body)
+	}
+	wg.Wait()
+}
+
+func TestSplit_Routes(t *testing.T) {
+	t.Parallel()
+
+	m := New(
+		&Backend{Name: "canary", Weight: 0, Handler: named("canary")},
+		&Backend{Name: "stable", Weight: 1, Handler: named("stable")},
+	)
+	m.Routes = []Route{
+		{Match: Header("X-Canary", "unknown-target"), Backend: "missing"},
+		{Match: Header("X-Canary", "1"), Backend: "canary"},
+		{Match: Cookie("beta", "yes"), Backend: "canary"},
+	}
+	var got []Event
+	m.Observe = func(e Event) { got = append(got, e) }
+	h := m.ServeHandler(fallthroughHandler)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Canary", "1")
+	assert.Equal(t, "canary", serve(h, r).Body.String())
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "beta", Value: "yes"})
+	assert.Equal(t, "canary", serve(h, r).Body.String())
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Canary", "unknown-target")
+	assert.Equal(t, "stable", serve(h, r).Body.String(), "a route to an unknown backend is skipped")
+
+	require.Len(t, got, 3)
+	assert.Equal(t, Event{Backend: "canary", Reason: ReasonRoute}, got[0])
+	assert.Equal(t, Event{Backend: "stable", Reason: ReasonWeight}, got[2])
+}
+
+func TestSplit_StickyCookie(t *testing.T) {
+	t.Parallel()
+
+	m := New(
+		&Backend{Name: "canary", Weight: 1, Handler: named("canary")},
+		&Backend{Name: "stable", Weight: 1, Handler: named("stable")},
+	)
+	m.StickyCookie = "split"
+	var reasons []Reason
+	m.Observe = func(e Event) { reasons = append(reasons, e.Reason) }
+	h := m.ServeHandler(fallthroughHandler)
+
+	w := serve(h, httptest.NewRequest("GET", "/", nil))
+	first := w.Body.String()
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "split", cookies[0].Name)
+	assert.Equal(t, first, cookies[0].Value)
+
+	for range 20 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		w := serve(h, r)
+		assert.Equal(t, first, w.Body.String())
+		assert.Empty(t, w.Result().Cookies(), "an honored pin is not re-set")
+	}
+	assert.Equal(t, ReasonSticky, reasons[len(reasons)-1])
+
+	// Draining the pinned backend releases its clients.
+	m.SetWeight(first, 0)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	w = serve(h, r)
+	assert.NotEqual(t, first, w.Body.String())
+	require.Len(t, w.Result().Cookies(), 1)
+	assert.Equal(t, w.Body.String(), w.Result().Cookies()[0].Value)
+}
+
+func TestSplit_KeyIsDeterministic(t *testing.T) {
+	t.Parallel()
+
+	m := New(
+		&Backend{Name: "canary", Weight: 10, Handler: named("canary")},
+		&Backend{Name: "stable", Weight: 90, Handler: named("stable")},
+	)
+	m.Key = func(r *http.Request) string { return r.Header.Get("X-User") }
+	h := m.ServeHandler(fallthroughHandler)
+
+	request := func(user string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		return serve(h, r).Body.String()
+	}
+
+	before := map[string]string{}
+	for i := range 500 {
+		u := strconv.Itoa(i)
+		before[u] = request(u)
+		assert.Equal(t, before[u], request(u), "same key, same backend")
+	}
+
+	// Growing the first backend keeps every already-canaried user on the canary.
+	m.SetWeight("canary", 50)
+	m.SetWeight("stable", 50)
+	for u, b := range before {
+		if b == "canary" {
+			assert.Equal(t, "canary", request(u), "user %s", u)
+		}
+	}
+}
+
+func TestSplit_LogField(t *testing.T) {
+	t.Parallel()
+
+	m := New(&Backend{Name: "canary", Weight: 1})
+	var logged any
+	h := m.ServeHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		logged = logger.Get(r.Context(), "split")
+	}))
+
+	var buf syncBuffer
+	lg := logger.Logger{Writer: &buf}
+	lg.ServeHandler(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "canary", logged)
+	assert.Contains(t, buf.String(), `"split":"canary"`)
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.b = append(s.b, p...)
+	return len(p), nil
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.b)
+}
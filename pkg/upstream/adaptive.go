@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/ratelimit"
+)
+
+// NewAdaptiveTransport wraps a target's transport with a per-target adaptive
+// concurrency limit (a gradient ratelimit.AdaptiveLimit named after host).
+func NewAdaptiveTransport(host string, transport http.RoundTripper) *AdaptiveTransport {
+	return &AdaptiveTransport{
+		Transport: transport,
+		Limit:     &ratelimit.AdaptiveLimit{Name: host},
+	}
+}
+
+// AdaptiveTransport is a Target.Transport wrapper that bounds the target's
+// in-flight round-trips with an adaptive limit — a self-tuning alternative to the
+// static Target.MaxConcurrent bulkhead that works under any balancer. Each
+// round-trip's time to response headers is the RTT sample, the same timing as
+// RoundTripInfo.Duration; a transport error (other than a client cancel) or a
+// 503/504 from the origin counts as a drop and shrinks the limit.
+//
+// A round-trip over the limit fails fast with ErrLimited, before any connection is
+// made. ErrLimited is an ErrUnavailable, so Upstream answers it with 503 (plus
+// Retry-After) and prom.Upstream counts it as a fast reject; an idempotent request
+// is first retried per Upstream.Retries, landing on whichever target the balancer
+// picks next. The package balancers do not count ErrLimited as a target failure,
+// so a busy target is shed, not ejected or tripped.
+//
+// The slot is held only until the response headers arrive, not until the body is
+// closed, so the limit bounds concurrent time-to-first-byte waits.
+type AdaptiveTransport struct {
+	Transport http.RoundTripper
+	Limit     *ratelimit.AdaptiveLimit
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *AdaptiveTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.Limit.Acquire() {
+		return nil, ErrLimited
+	}
+
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(r)
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		t.Limit.Cancel()
+	case err != nil:
+		t.Limit.Release(time.Since(start), true)
+	default:
+		dropped := resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		t.Limit.Release(time.Since(start), dropped)
+	}
+	return resp, err
+}
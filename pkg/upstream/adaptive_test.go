@@ -0,0 +1,124 @@
+package upstream_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/moonrhythm/parapet/pkg/ratelimit"
+
+	. "github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+func TestAdaptiveTransport(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sheds over the limit with ErrLimited", func(t *testing.T) {
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		tr := &AdaptiveTransport{
+			Limit: &ratelimit.AdaptiveLimit{InitialLimit: 1},
+			Transport: &mockTransport{roundTripFunc: func(*http.Request) (*http.Response, error) {
+				close(entered)
+				<-release
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			}},
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tr.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		}()
+		<-entered
+
+		_, err := tr.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		assert.ErrorIs(t, err, ErrLimited)
+		assert.ErrorIs(t, err, ErrUnavailable, "a shed is an ErrUnavailable")
+
+		close(release)
+		<-done
+		assert.Equal(t, 0, tr.Limit.Inflight())
+	})
+
+	t.Run("overload responses and errors back off, a cancel does not", func(t *testing.T) {
+		var status int
+		var rerr error
+		tr := &AdaptiveTransport{
+			Limit: &ratelimit.AdaptiveLimit{InitialLimit: 16, Backoff: 0.5},
+			Transport: &mockTransport{roundTripFunc: func(*http.Request) (*http.Response, error) {
+				if rerr != nil {
+					return nil, rerr
+				}
+				return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+			}},
+		}
+
+		status = http.StatusServiceUnavailable
+		tr.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, 8, tr.Limit.Limit())
+
+		status, rerr = 0, errors.New("dial fail")
+		tr.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, 4, tr.Limit.Limit())
+
+		rerr = context.Canceled
+		tr.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, 4, tr.Limit.Limit())
+		assert.Equal(t, 0, tr.Limit.Inflight())
+	})
+}
+
+func TestAdaptiveTransport_UpstreamSheds503(t *testing.T) {
+	t.Parallel()
+
+	tr := &AdaptiveTransport{
+		Limit: &ratelimit.AdaptiveLimit{InitialLimit: 1},
+		Transport: &mockTransport{roundTripFunc: func(*http.Request) (*http.Response, error) {
+			panic("unreachable: the limit is held")
+		}},
+	}
+	require.True(t, tr.Limit.Acquire()) // saturate the target
+
+	var attempts atomic.Int32
+	u := New(SingleHost("target", tr).Transport)
+	u.Retries = 1
+	u.BackoffFactor = time.Millisecond
+	u.OnRoundTrip = func(_ *http.Request, info RoundTripInfo) {
+		attempts.Add(1)
+		assert.ErrorIs(t, info.Err, ErrLimited)
+	}
+
+	w := httptest.NewRecorder()
+	u.ServeHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.EqualValues(t, 2, attempts.Load(), "an idempotent shed is retried")
+}
+
+func TestEjectingLoadBalancer_LimitedIsNotAFailure(t *testing.T) {
+	t.Parallel()
+
+	limit := &ratelimit.AdaptiveLimit{InitialLimit: 1}
+	require.True(t, limit.Acquire()) // the target is always saturated
+	var changes atomic.Int32
+	lb := NewEjectingLoadBalancer([]*Target{{
+		Host:      "a",
+		Transport: &AdaptiveTransport{Limit: limit, Transport: http.DefaultTransport},
+	}})
+	lb.MaxFails = 1
+	lb.OnStateChange = func(StateChange) { changes.Add(1) }
+
+	for range 5 {
+		_, err := lb.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		assert.ErrorIs(t, err, ErrLimited)
+	}
+	assert.Zero(t, changes.Load(), "a shed must not eject the target")
+}
@@ -118,11 +118,12 @@ type CircuitBreakingLoadBalancer struct {
 	HalfOpenMaxProbes int32
 
 	// IsFailure decides whether a round-trip result counts as a failure. When nil,
-	// any transport error other than a client-canceled request counts. Set it to
-	// also treat responses such as 5xx as failures. In HALF-OPEN a non-failure
-	// counts as a probe success, so by default a client-canceled probe nudges the
-	// breaker toward closing rather than being treated as neutral (a wrongly closed
-	// but still-broken target simply re-trips on the next real failure).
+	// any transport error other than a client-canceled request or an adaptive-limit
+	// shed (ErrLimited) counts. Set it to also treat responses such as 5xx as
+	// failures. In HALF-OPEN a non-failure counts as a probe success, so by default
+	// a client-canceled probe nudges the breaker toward closing rather than being
+	// treated as neutral (a wrongly closed but still-broken target simply re-trips
+	// on the next real failure).
 	IsFailure func(resp *http.Response, err error) bool
 
 	// OnStateChange observes per-target circuit state transitions (nil disables);
@@ -344,7 +345,7 @@ func (l *CircuitBreakingLoadBalancer) failed(resp *http.Response, err error) boo
 	if l.IsFailure != nil {
 		return l.IsFailure(resp, err)
 	}
-	return err != nil && !errors.Is(err, context.Canceled)
+	return err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrLimited)
 }
 
 // cbExternal maps the internal packed state to the public State.
@@ -22,16 +22,21 @@
 //	                                  failures, backed-off cooldown
 //	  CircuitBreakingLoadBalancer     fail-FAST: reject an open target with no
 //	                                  round-trip; Closed/Open/HalfOpen
+//	  SuccessRateEjectingLoadBalancer eject on a sliding-window error ratio vs the
+//	                                  pool mean/stddev (or a fixed threshold)
 //
 //	Latency-based reliability
 //	  LatencyEjectingLoadBalancer     eject a "gray failure" (200s but slow) on a
 //	                                  decayed-mean TTFB vs the pool median
-//	  HedgingLoadBalancer             speculative retry after HedgeDelay to cut
-//	                                  tail latency (wraps any balancer)
+//	  HedgingLoadBalancer             speculative retry after HedgeDelay (or an
+//	                                  adaptive latency percentile, under a hedge
+//	                                  budget) to cut tail latency (wraps any
+//	                                  balancer)
 //
 //	Active probing (wraps any balancer)
-//	  ActiveHealthCheck               out-of-band probes; gates the wrapped
-//	                                  balancer's pick, only ever REMOVES candidates
+//	  ActiveHealthCheck               out-of-band HTTP, TCP-connect or gRPC health
+//	                                  probes; gates the wrapped balancer's pick,
+//	                                  only ever REMOVES candidates
 //
 // # Choosing a primitive by failure mode
 //
@@ -44,6 +49,9 @@
 //	flaky backend, hard 5xx/errors   EjectingLoadBalancer (keeps routing during a
 //	                                 total outage) — or CircuitBreakingLoadBalancer
 //	                                 if you would rather shed than hammer
+//	intermittent errors: one host    SuccessRateEjectingLoadBalancer (windowed
+//	fails 1 in 5, interleaved with   error ratio vs the pool; consecutive-failure
+//	successes                        ejection never sees it)
 //	dead / brownout origin, want     CircuitBreakingLoadBalancer (fail fast; an
 //	to fail fast and shed            open target costs no connect+timeout)
 //	tail latency (p99) on an         HedgingLoadBalancer (race a duplicate after
@@ -53,17 +61,22 @@
 //	overload: a slow backend         Target.MaxConcurrent on LeastConnLoadBalancer
 //	draining the pool                (hard per-target bulkhead cap) + a total-
 //	                                 request-deadline middleware (see "Overload")
+//	overload, capacity unknown or    AdaptiveTransport per target (a latency-driven
+//	shifting                         limit, any balancer) or ratelimit.Adaptive
+//	                                 per route; sheds 503 + Retry-After
 //	cold deploy / readiness /        ActiveHealthCheck (probe out-of-band; route
 //	black-holing a fresh pod         only to answering targets) — wraps any balancer
 //	uneven backend capacity          WeightedRoundRobinLoadBalancer (by request
 //	                                 count) or LeastConnLoadBalancer (by concurrency)
 //
-// Error ejection (EjectingLoadBalancer / CircuitBreakingLoadBalancer) is driven by
-// the IsFailure hook, which by default counts only transport errors other than a
-// client cancel; set it to also treat 5xx as failures. LatencyEjectingLoadBalancer
-// is latency-ONLY — a transport error is not timed and does not eject — so if hard
-// errors are your dominant mode, use an error balancer instead of (or, via an
-// ActiveHealthCheck gate, alongside) it.
+// Error ejection (EjectingLoadBalancer / CircuitBreakingLoadBalancer /
+// SuccessRateEjectingLoadBalancer) is driven by the IsFailure hook, which by
+// default counts only transport errors other than a client cancel; set it to also
+// treat 5xx as failures. LatencyEjectingLoadBalancer is latency-ONLY — a
+// transport error is not timed and does not eject — so if hard errors are your
+// dominant mode, use an error balancer instead of (or, via an ActiveHealthCheck
+// gate, alongside) it. For a gRPC pool set IsFailure to IsGRPCFailure: a gRPC
+// backend reports UNAVAILABLE in a 200, so a status-code rule never sees it.
 //
 // # All-down semantics — the load-bearing distinction
 //
@@ -78,7 +91,7 @@
 //	LeastConnLoadBalancer (health)  healthy pool). Empty pool -> ErrUnavailable.
 //	EjectingLoadBalancer            FAIL OPEN — all ejected -> route anyway, so a
 //	LatencyEjectingLoadBalancer     transient outage / systemic slowdown can't
-//	                                black-hole all traffic (slow-but-up beats 503).
+//	SuccessRateEjecting             black-hole all traffic (slow-but-up beats 503).
 //
 //	LeastConnLoadBalancer           SHEDS 503 — when every target is at its
 //	  (capacity, MaxConcurrent)     MaxConcurrent cap (the bulkhead contract;
@@ -154,15 +167,18 @@
 //
 // # Observability
 //
-// Two hooks make the stack observable; both are nil-by-default (zero hot-path cost)
+// Three hooks make the stack observable; all are nil-by-default (zero hot-path cost)
 // and the callee owns its own concurrency. Wire them to pkg/prom and leave
 // pkg/upstream free of any Prometheus dependency:
 //
 //   - Upstream.OnRoundTrip (a RoundTripFunc) fires once per attempt (each retry
-//     included) with the resolved host, status, time-to-headers, and error. Assign
-//     prom.Upstream() to it for upstream_requests{host,status},
-//     upstream_request_duration_seconds{host}, and upstream_fast_rejects_total{host}
-//     (the all-down 503s shed before any round-trip).
+//     included) with the resolved host, status, time-to-headers, and error (and its
+//     ErrorKind). Assign prom.Upstream() to it for upstream_requests{host,status},
+//     upstream_request_duration_seconds{host}, upstream_fast_rejects_total{host}
+//     (the all-down 503s shed before any round-trip), and
+//     upstream_errors_total{host,kind}. A gRPC call adds
+//     upstream_grpc_requests{host,service,method,code} and
+//     upstream_grpc_request_duration_seconds{host,service,method}.
 //
 //   - A balancer's OnStateChange (a StateChangeFunc) fires once per per-target
 //     transition (concurrent threshold crossers collapse to one), after the new
@@ -171,8 +187,13 @@
 //     upstream_state_transitions_total{host,from,to,reason} (the authoritative
 //     signal — alert on it), and upstream_probe_down_total{host,cause}. The cause
 //     label is ActiveHealthCheck's classified probe-down reason — one of timeout,
-//     refused, reset, dns, tls, status, error (a bounded closed set) — for telling a
-//     bad probe path from a dead backend from a too-tight Timeout mid-incident.
+//     refused, reset, dns, tls, status, header, body, not_serving, error (a
+//     bounded closed set) — for telling a bad probe path from a dead backend from
+//     a too-tight Timeout mid-incident.
+//
+//   - HedgingLoadBalancer.OnHedge (a HedgeFunc) reports hedge launches, hedge wins
+//     and HedgeBudget denials. Assign prom.Hedge() to it for
+//     upstream_hedges_total{event} and upstream_hedge_delay_seconds.
 //
 // The ejecting balancers report ReasonEject / ReasonRecover; the circuit breaker
 // reports the full Closed/Open/HalfOpen edge set (ReasonTrip, ReasonReopen,
@@ -59,8 +59,9 @@ type EjectingLoadBalancer struct {
 	MaxEjectTimeout time.Duration
 
 	// IsFailure decides whether a round-trip result counts as a failure. When
-	// nil, any transport error other than a client-canceled request counts.
-	// Set it to also treat responses such as 5xx as failures.
+	// nil, any transport error other than a client-canceled request or an
+	// adaptive-limit shed (ErrLimited) counts. Set it to also treat responses such
+	// as 5xx as failures.
 	IsFailure func(resp *http.Response, err error) bool
 
 	// OnStateChange observes a target being ejected (ReasonEject) or returned to
@@ -170,7 +171,7 @@ func (l *EjectingLoadBalancer) failed(resp *http.Response, err error) bool {
 	if l.IsFailure != nil {
 		return l.IsFailure(resp, err)
 	}
-	return err != nil && !errors.Is(err, context.Canceled)
+	return err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrLimited)
 }
 
 // eject takes a target out of rotation for an exponentially backed-off cooldown.
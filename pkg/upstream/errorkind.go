@@ -0,0 +1,142 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/moonrhythm/parapet/pkg/header"
+	"github.com/moonrhythm/parapet/pkg/requestid"
+)
+
+// ErrorKind classifies WHY a proxied round-trip failed, and so which status the
+// client gets. Like ProbeCause it is a CLOSED set, safe as a metric label: an
+// error matching none of the specific cases is KindOther.
+type ErrorKind uint8
+
+const (
+	KindNone     ErrorKind = iota // no error (the zero value)
+	KindTimeout                   // dial, TLS handshake or response-header timeout, or a context deadline: 504
+	KindConnect                   // the dial failed: refused, unreachable, DNS: 502
+	KindTLS                       // TLS handshake, certificate or pin failure, or the origin rejected our client certificate: 502
+	KindReset                     // the origin reset or closed the connection mid-request: 502
+	KindShed                      // no target, or a concurrency limit shed it (ErrUnavailable): 503
+	KindCanceled                  // the request was canceled; nothing is written once the client has gone, else 502
+	KindOther                     // any other transport error: 502
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindTimeout:
+		return "timeout"
+	case KindConnect:
+		return "connect"
+	case KindTLS:
+		return "tls"
+	case KindReset:
+		return "reset"
+	case KindShed:
+		return "shed"
+	case KindCanceled:
+		return "canceled"
+	case KindOther:
+		return "other"
+	default:
+		return "none"
+	}
+}
+
+// StatusCode is the status the proxy answers a failure of this kind with, or 0
+// for KindNone.
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case KindNone:
+		return 0
+	case KindTimeout:
+		return http.StatusGatewayTimeout
+	case KindShed:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// ClassifyError maps a round-trip error to its ErrorKind. The ladder is
+// most-specific-first and traverses wrapping via errors.Is/errors.As.
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return KindNone
+	}
+	if errors.Is(err, context.Canceled) {
+		return KindCanceled
+	}
+	if errors.Is(err, ErrUnavailable) {
+		return KindShed
+	}
+	// a resolver timeout is still a DNS failure, as in classifyProbeCause
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return KindConnect
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return KindTimeout
+	}
+	if isTLSError(err) {
+		return KindTLS
+	}
+	var opErr *net.OpError
+	if errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return KindConnect
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return KindReset
+	}
+	return KindOther
+}
+
+// ProxyError describes a request the proxy could not complete, to an
+// ErrorResponder.
+type ProxyError struct {
+	Err        error
+	Kind       ErrorKind
+	StatusCode int    // Kind.StatusCode()
+	RequestID  string // the pkg/requestid id, or "" without that middleware
+}
+
+// ErrorResponder writes the response for a request the proxy could not
+// complete. Assign one to Upstream.ErrorResponder to render branded error
+// pages; a Retry-After header is already set for a concurrency-limit shed. It is
+// not called for a gRPC call, which is always answered with a gRPC status.
+type ErrorResponder func(w http.ResponseWriter, r *http.Request, e ProxyError)
+
+// DefaultErrorResponder writes a plain-text error with e.StatusCode, the
+// ErrorResponder used when Upstream.ErrorResponder is nil.
+func DefaultErrorResponder(w http.ResponseWriter, _ *http.Request, e ProxyError) {
+	http.Error(w, http.StatusText(e.StatusCode), e.StatusCode)
+}
+
+// writeProxyError answers a failed non-gRPC request.
+func (m *Upstream) writeProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := ClassifyError(err)
+	if kind == KindCanceled && r.Context().Err() != nil {
+		return // client canceled request
+	}
+	if errors.Is(err, ErrLimited) {
+		header.Set(w.Header(), header.RetryAfter, limitedRetryAfter)
+	}
+	respond := m.ErrorResponder
+	if respond == nil {
+		respond = DefaultErrorResponder
+	}
+	id, _ := requestid.FromContext(r.Context())
+	respond(w, r, ProxyError{
+		Err:        err,
+		Kind:       kind,
+		StatusCode: kind.StatusCode(),
+		RequestID:  id,
+	})
+}
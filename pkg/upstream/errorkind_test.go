@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/moonrhythm/parapet/pkg/requestid"
+)
+
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err  error
+		want ErrorKind
+	}{
+		{nil, KindNone},
+		{context.Canceled, KindCanceled},
+		{ErrUnavailable, KindShed},
+		{ErrLimited, KindShed},
+		{context.DeadlineExceeded, KindTimeout},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, KindConnect},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, KindConnect},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, KindConnect},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, KindConnect},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, KindReset},
+		{fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), KindReset},
+		{errors.New("something else"), KindOther},
+	} {
+		assert.Equal(t, tc.want, ClassifyError(tc.err), "%v", tc.err)
+	}
+
+	assert.Equal(t, http.StatusGatewayTimeout, KindTimeout.StatusCode())
+	assert.Equal(t, http.StatusServiceUnavailable, KindShed.StatusCode())
+	assert.Equal(t, http.StatusBadGateway, KindReset.StatusCode())
+	assert.Equal(t, "connect", KindConnect.String())
+}
+
+func TestClassifyError_Transport(t *testing.T) {
+	t.Parallel()
+
+	t.Run("response header timeout", func(t *testing.T) {
+		done := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-done }))
+		defer ts.Close()
+		defer close(done) // before Close, which waits for the handler
+
+		tr := &HTTPTransport{ResponseHeaderTimeout: 20 * time.Millisecond}
+		_, err := tr.RoundTrip(httptest.NewRequest("GET", ts.URL, nil))
+		assert.Equal(t, KindTimeout, ClassifyError(err), "%v", err)
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := ln.Addr().String()
+		ln.Close()
+
+		_, err := (&HTTPTransport{}).RoundTrip(httptest.NewRequest("GET", "http://"+addr, nil))
+		assert.Equal(t, KindConnect, ClassifyError(err), "%v", err)
+	})
+
+	t.Run("tls to a plaintext port", func(t *testing.T) {
+		ts := httptest.NewServer(http.NotFoundHandler())
+		defer ts.Close()
+
+		r := httptest.NewRequest("GET", ts.URL, nil)
+		_, err := (&HTTPSTransport{}).RoundTrip(r)
+		assert.Equal(t, KindTLS, ClassifyError(err), "%v", err)
+	})
+}
+
+func TestUpstream_ErrorResponder(t *testing.T) {
+	t.Parallel()
+
+	fail := func(err error) *Upstream {
+		u := New(probeRT(func(*http.Request) (*http.Response, error) { return nil, err }))
+		u.ErrorLog = discardLog
+		u.Retries = 0
+		return u
+	}
+
+	t.Run("default statuses", func(t *testing.T) {
+		for err, want := range map[error]int{
+			context.DeadlineExceeded:                            http.StatusGatewayTimeout,
+			&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}: http.StatusBadGateway,
+			ErrUnavailable:                                      http.StatusServiceUnavailable,
+			ErrLimited:                                          http.StatusServiceUnavailable,
+		} {
+			w := httptest.NewRecorder()
+			fail(err).ServeHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			assert.Equal(t, want, w.Code, "%v", err)
+			assert.Equal(t, http.StatusText(want)+"\n", w.Body.String())
+			assert.Equal(t, errors.Is(err, ErrLimited), w.Header().Get("Retry-After") != "", "%v", err)
+		}
+	})
+
+	t.Run("custom responder gets the request id", func(t *testing.T) {
+		u := fail(context.DeadlineExceeded)
+		u.ErrorResponder = func(w http.ResponseWriter, _ *http.Request, e ProxyError) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(e.StatusCode)
+			json.NewEncoder(w).Encode(map[string]string{"error": e.Kind.String(), "requestId": e.RequestID})
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-Id", "req-42")
+		requestid.New().ServeHandler(u.ServeHandler(nil)).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		assert.JSONEq(t, `{"error":"timeout","requestId":"req-42"}`, w.Body.String())
+	})
+
+	t.Run("kind in RoundTripInfo and the log record", func(t *testing.T) {
+		u := fail(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})
+		var kind ErrorKind
+		u.OnRoundTrip = func(_ *http.Request, info RoundTripInfo) { kind = info.ErrorKind }
+
+		var buf strings.Builder
+		lg := logger.Logger{Writer: &buf}
+		lg.ServeHandler(u.ServeHandler(nil)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, KindConnect, kind)
+		assert.Contains(t, buf.String(), `"upstreamError":"connect"`)
+	})
+
+	t.Run("gRPC keeps its status", func(t *testing.T) {
+		u := fail(context.DeadlineExceeded)
+		called := false
+		u.ErrorResponder = func(http.ResponseWriter, *http.Request, ProxyError) { called = true }
+		w := httptest.NewRecorder()
+		u.ServeHandler(nil).ServeHTTP(w, grpcRequest(nil))
+		assert.False(t, called)
+		assert.Equal(t, "4", w.Header().Get("Grpc-Status"))
+	})
+}
@@ -1,10 +1,14 @@
 package upstream_test
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"net/http"
+	"regexp"
 	"time"
 
 	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/requestid"
 	"github.com/moonrhythm/parapet/pkg/upstream"
 )
 
@@ -156,6 +160,26 @@ func ExampleNewHedgingLoadBalancer() {
 	s.Use(upstream.New(h)) // h is the proxy's transport, like any balancer
 }
 
+// Hedge adaptively instead of hand-tuning HedgeDelay: the delay tracks the p95 of
+// recent round-trips (40ms until 100 samples arrive), and hedges are capped at 10%
+// of primary requests so a slow pool cannot double its own load.
+func ExampleHedgingLoadBalancer_adaptive() {
+	tr := &upstream.HTTPTransport{}
+	lb := upstream.NewRoundRobinLoadBalancer([]*upstream.Target{
+		{Host: "10.0.0.1:8080", Transport: tr},
+		{Host: "10.0.0.2:8080", Transport: tr},
+	})
+	h := upstream.NewHedgingLoadBalancer(lb)
+	h.HedgePercentile = 0.95
+	h.HedgeDelay = 40 * time.Millisecond // used while the histogram warms up
+	h.MaxHedgeDelay = time.Second
+	h.HedgeBudget = 0.1
+	// h.OnHedge = prom.Hedge() exports hedge launches, wins and budget denials
+
+	s := parapet.New()
+	s.Use(upstream.New(h))
+}
+
 // Add ACTIVE health checking: probe each target out-of-band and route only to those
 // answering, on top of any balancer's own (passive) strategy. Pass the SAME []*Target
 // to both the balancer and the wrapper so the health gate's indices line up. Active
@@ -258,3 +282,139 @@ func ExampleTransport() {
 		DisableCompression: true,
 	}))
 }
+
+// Give each target its own adaptive concurrency limit. A target at its limit
+// fails fast with ErrLimited (a 503 after retries), and the balancer sheds it
+// rather than ejecting it.
+func ExampleNewAdaptiveTransport() {
+	lb := upstream.NewEjectingLoadBalancer([]*upstream.Target{
+		{Host: "10.0.0.1:8080", Transport: upstream.NewAdaptiveTransport("10.0.0.1:8080", &upstream.HTTPTransport{})},
+		{Host: "10.0.0.2:8080", Transport: upstream.NewAdaptiveTransport("10.0.0.2:8080", &upstream.HTTPTransport{})},
+	})
+
+	s := parapet.New()
+	s.Use(upstream.New(lb))
+}
+
+// Eject a host whose error ratio stands out from its peers even when its failures
+// are interleaved with successes. Counting 5xx as failures is usually what you
+// want here.
+func ExampleNewSuccessRateEjectingLoadBalancer() {
+	tr := &upstream.HTTPTransport{}
+	lb := upstream.NewSuccessRateEjectingLoadBalancer([]*upstream.Target{
+		{Host: "10.0.0.1:8080", Transport: tr},
+		{Host: "10.0.0.2:8080", Transport: tr},
+		{Host: "10.0.0.3:8080", Transport: tr},
+		{Host: "10.0.0.4:8080", Transport: tr},
+		{Host: "10.0.0.5:8080", Transport: tr},
+	})
+	lb.IsFailure = func(resp *http.Response, err error) bool {
+		return err != nil || (resp != nil && resp.StatusCode >= 500)
+	}
+	lb.Window = time.Minute
+
+	s := parapet.New()
+	s.Use(upstream.New(lb))
+}
+
+// Assert on more than the status code, and probe one target differently: the pool
+// gets an HTTP probe that must see a JSON "ok" body and a readiness header, while
+// the gRPC backend is probed with grpc.health.v1 on its own port. Jitter keeps the
+// probers from ticking in lockstep.
+func ExampleNewActiveHealthCheck_probes() {
+	targets := []*upstream.Target{
+		{Host: "10.0.0.1:8080", Transport: &upstream.HTTPTransport{}},
+		{Host: "10.0.0.2:8080", Transport: &upstream.HTTPTransport{}},
+		{
+			Host:      "10.0.0.3:50051",
+			Transport: &upstream.H2CTransport{},
+			Probe:     &upstream.Probe{Type: upstream.ProbeGRPC, GRPCService: "api.v1.Users"},
+		},
+	}
+	ahc := upstream.NewActiveHealthCheck(targets, upstream.NewRoundRobinLoadBalancer(targets))
+	ahc.Path = "/healthz"
+	ahc.Host = "api.internal"
+	ahc.Header = http.Header{"X-Health-Check": {"parapet"}}
+	ahc.ExpectBodyRegexp = regexp.MustCompile(`"status":\s*"ok"`)
+	ahc.ExpectHeader = http.Header{"X-Ready": {"true"}}
+	ahc.Jitter = 0.2
+
+	s := parapet.New()
+	s.Use(upstream.New(ahc))
+}
+
+// Proxy gRPC over h2c. Upstream recognises a gRPC call by its Content-Type: a
+// proxy-side failure is answered as a trailers-only gRPC status rather than an
+// HTTP 5xx, grpc-timeout bounds the upstream call, and IsGRPCFailure lets the
+// balancer eject a backend that answers UNAVAILABLE with a 200.
+func ExampleIsGRPCFailure() {
+	targets := []*upstream.Target{
+		{Host: "10.0.0.1:50051", Transport: &upstream.H2CTransport{}},
+		{Host: "10.0.0.2:50051", Transport: &upstream.H2CTransport{}},
+	}
+	lb := upstream.NewEjectingLoadBalancer(targets)
+	lb.IsFailure = upstream.IsGRPCFailure
+
+	s := parapet.New()
+	s.Use(upstream.New(lb))
+}
+
+// Serve a PHP app from php-fpm. FastCGITransport is an ordinary Target.Transport,
+// so FastCGI pools sit behind any balancer; a Host containing a slash is a Unix
+// socket path.
+func ExampleFastCGITransport() {
+	tr := &upstream.FastCGITransport{
+		Root: "/var/www/app/public", // SCRIPT_FILENAME = Root + script path
+		Env:  map[string]string{"APP_ENV": "production"},
+	}
+	lb := upstream.NewRoundRobinLoadBalancer([]*upstream.Target{
+		{Host: "10.0.0.1:9000", Transport: tr},
+		{Host: "10.0.0.2:9000", Transport: tr},
+	})
+
+	s := parapet.New()
+	s.Use(upstream.New(lb))
+}
+
+// Verify each backend against a private CA and present a client certificate
+// for mutual TLS. The targets are addressed by IP, so ServerName names the
+// certificate to expect; the key pair is re-read when cert-manager rotates it.
+func ExampleTLSConfig() {
+	newTarget := func(host string) *upstream.Target {
+		return &upstream.Target{Host: host, Transport: &upstream.HTTPSTransport{
+			TLS: &upstream.TLSConfig{
+				CAFile:     "/etc/parapet/tls/ca.pem",
+				ServerName: "api.internal",
+				CertFile:   "/etc/parapet/tls/client.pem",
+				KeyFile:    "/etc/parapet/tls/client-key.pem",
+				MinVersion: tls.VersionTLS13,
+			},
+		}}
+	}
+	lb := upstream.NewRoundRobinLoadBalancer([]*upstream.Target{
+		newTarget("10.0.0.1:443"),
+		newTarget("10.0.0.2:443"),
+	})
+
+	s := parapet.New()
+	s.Use(upstream.New(lb))
+}
+
+// Render proxy failures as JSON carrying the request ID. The responder gets the
+// classified ErrorKind and its status — 504 for a timeout, 503 when shed, 502
+// otherwise — and requestid must run ahead of the proxy for RequestID to be set.
+func ExampleUpstream_errorResponder() {
+	up := upstream.SingleHost("10.0.0.1:8080", &upstream.HTTPTransport{})
+	up.ErrorResponder = func(w http.ResponseWriter, _ *http.Request, e upstream.ProxyError) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.StatusCode)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":     e.Kind.String(),
+			"requestId": e.RequestID,
+		})
+	}
+
+	s := parapet.New()
+	s.Use(requestid.New())
+	s.Use(up)
+}
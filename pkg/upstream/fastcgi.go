@@ -0,0 +1,554 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/header"
+)
+
+const (
+	defaultFastCGIIndex = "index.php"
+
+	fcgiVersion         = 1
+	fcgiBeginRequest    = 1
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiResponder       = 1
+	fcgiKeepConn        = 1
+	fcgiRequestID       = 1 // one request per connection at a time
+	fcgiMaxRecord       = 65535
+	fcgiHeaderLen       = 8
+	fcgiRequestComplete = 0
+)
+
+// errFastCGIUpgrade is returned for a protocol upgrade, which CGI cannot carry.
+var errFastCGIUpgrade = errors.New("upstream: fastcgi does not support protocol upgrades")
+
+// FastCGITransport is an http.RoundTripper that speaks FastCGI to a responder
+// such as php-fpm, so it can be a Target.Transport behind any balancer. The
+// target Host is a TCP host:port, or a Unix socket path in the form UnixTransport
+// accepts. Connections are kept alive and pooled per target.
+//
+// The script is resolved from the request path: the path is split after the
+// first SplitPath extension into SCRIPT_NAME and PATH_INFO, a directory path
+// gets Index appended, and SCRIPT_FILENAME is SCRIPT_NAME under Root. The client
+// address and scheme are taken from X-Real-Ip and X-Forwarded-Proto, which
+// parapet sets on every request.
+//
+//nolint:govet
+type FastCGITransport struct {
+	once sync.Once
+	mu   sync.Mutex
+	idle map[string][]fcgiIdleConn
+
+	Root      string            // document root on the FastCGI server's filesystem
+	Index     string            // script for a directory path; default index.php
+	SplitPath []string          // script extensions to split PATH_INFO after; default .php
+	Env       map[string]string // extra parameters, set last so they override
+
+	DialTimeout           time.Duration
+	DisableKeepAlives     bool
+	MaxIdleConns          int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// ErrorLog receives what the application writes to FastCGI stderr (PHP
+	// warnings, for one). nil uses the log package's standard logger.
+	ErrorLog *log.Logger
+
+	// DialContext, if non-nil, replaces the default net.Dialer used to open
+	// connections to the FastCGI server. A custom dialer is responsible for
+	// honoring its own timeouts; DialTimeout is ignored when DialContext is set.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type fcgiIdleConn struct {
+	c *fcgiConn
+	t time.Time
+}
+
+type fcgiConn struct {
+	net.Conn
+	addr string
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+// RoundTrip implement http.RoundTripper
+func (t *FastCGITransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.once.Do(func() {
+		if t.Index == "" {
+			t.Index = defaultFastCGIIndex
+		}
+		if t.SplitPath == nil {
+			t.SplitPath = []string{".php"}
+		}
+		if t.DialTimeout == 0 {
+			t.DialTimeout = defaultDialTimeout
+		}
+		if t.MaxIdleConns == 0 {
+			t.MaxIdleConns = defaultMaxIdleConns
+		}
+		if t.IdleConnTimeout == 0 {
+			t.IdleConnTimeout = defaultIdleConnTimeout
+		}
+		if t.ResponseHeaderTimeout == 0 {
+			t.ResponseHeaderTimeout = defaultResponseHeaderTimeout
+		}
+		if t.DialContext == nil {
+			t.DialContext = (&net.Dialer{Timeout: t.DialTimeout}).DialContext
+		}
+		t.idle = make(map[string][]fcgiIdleConn)
+	})
+
+	if header.Exists(r.Header, header.Upgrade) {
+		return nil, errFastCGIUpgrade
+	}
+
+	params := t.params(r)
+	for {
+		c, reused, err := t.getConn(r.Context(), r.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+		resp, started, err := t.roundTrip(c, r, params)
+		if err == nil {
+			return resp, nil
+		}
+		// a pooled connection the server has since closed fails before any
+		// response; try the next one, or a fresh one, if the body allows
+		if !reused || started || r.Context().Err() != nil {
+			return nil, err
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			if r.GetBody == nil {
+				return nil, err
+			}
+			body, gerr := r.GetBody()
+			if gerr != nil {
+				return nil, err
+			}
+			r = r.Clone(r.Context())
+			r.Body = body
+		}
+	}
+}
+
+// roundTrip sends one request on c. started reports whether any response bytes
+// arrived, after which the request must not be retried.
+func (t *FastCGITransport) roundTrip(c *fcgiConn, r *http.Request, params []byte) (resp *http.Response, started bool, err error) {
+	ctx := r.Context()
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(time.Unix(1, 0)) // unblock any read or write
+	})
+	fail := func(err error) (*http.Response, bool, error) {
+		stop()
+		c.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, started, err
+	}
+
+	var flags byte
+	if !t.DisableKeepAlives {
+		flags = fcgiKeepConn
+	}
+	if err := c.writeRecord(fcgiBeginRequest, []byte{0, fcgiResponder, flags, 0, 0, 0, 0, 0}); err != nil {
+		return fail(err)
+	}
+	if err := c.writeStream(fcgiParams, params); err != nil {
+		return fail(err)
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		buf := bytesPool.Get()
+		_, err := io.CopyBuffer(&fcgiStreamWriter{c: c, typ: fcgiStdin}, r.Body, buf)
+		bytesPool.Put(buf)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := c.writeRecord(fcgiStdin, nil); err != nil {
+		return fail(err)
+	}
+	if err := c.bw.Flush(); err != nil {
+		return fail(err)
+	}
+
+	if t.ResponseHeaderTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(t.ResponseHeaderTimeout))
+	}
+	stdout := &fcgiStdoutReader{c: c, stderr: t.stderr}
+	br := bufio.NewReader(stdout)
+	if _, err := br.Peek(1); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fail(err)
+	}
+	started = true
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return fail(fmt.Errorf("upstream: malformed fastcgi response header: %w", err))
+	}
+	c.SetReadDeadline(time.Time{})
+
+	resp = &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(h),
+		ContentLength: -1,
+		Request:       r,
+	}
+	if s := h.Get("Status"); s != "" {
+		code, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(strings.TrimSpace(s), " ", 2)[0]))
+		if err != nil || code < 100 || code > 999 {
+			return fail(fmt.Errorf("upstream: malformed fastcgi status %q", s))
+		}
+		resp.StatusCode = code
+		resp.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+		h.Del("Status")
+	} else if h.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+		resp.Status = "302 Found"
+	}
+	if cl, err := strconv.ParseInt(h.Get(header.ContentLength), 10, 64); err == nil && cl >= 0 {
+		resp.ContentLength = cl
+	}
+	resp.Body = &fcgiBody{t: t, c: c, r: br, stdout: stdout, stop: stop}
+	return resp, true, nil
+}
+
+func (t *FastCGITransport) stderr(b []byte) {
+	msg := strings.TrimRight(string(b), "\r\n")
+	if msg == "" {
+		return
+	}
+	if t.ErrorLog == nil {
+		log.Printf("fastcgi: %s", msg)
+		return
+	}
+	t.ErrorLog.Printf("fastcgi: %s", msg)
+}
+
+func (t *FastCGITransport) getConn(ctx context.Context, addr string) (*fcgiConn, bool, error) {
+	t.mu.Lock()
+	for list := t.idle[addr]; len(list) > 0; list = t.idle[addr] {
+		ic := list[len(list)-1]
+		t.idle[addr] = list[:len(list)-1]
+		if time.Since(ic.t) < t.IdleConnTimeout {
+			t.mu.Unlock()
+			return ic.c, true, nil
+		}
+		ic.c.Close()
+	}
+	t.mu.Unlock()
+
+	network, dialAddr := dialNetwork(addr)
+	conn, err := t.DialContext(ctx, network, dialAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	return &fcgiConn{
+		Conn: conn,
+		addr: addr,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+	}, false, nil
+}
+
+func (t *FastCGITransport) putConn(c *fcgiConn) {
+	if t.DisableKeepAlives {
+		c.Close()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[c.addr]) >= t.MaxIdleConns {
+		c.Close()
+		return
+	}
+	t.idle[c.addr] = append(t.idle[c.addr], fcgiIdleConn{c: c, t: time.Now()})
+}
+
+// params builds the CGI/1.1 parameters for r.
+func (t *FastCGITransport) params(r *http.Request) []byte {
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+		p += "/"
+	}
+	scriptName, pathInfo := t.splitPath(p)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := header.Get(r.Header, header.XForwardedProto); p != "" {
+		scheme = p
+	}
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	if ip := header.Get(r.Header, header.XRealIP); ip != "" {
+		remoteAddr, remotePort = ip, ""
+	}
+	serverName, serverPort, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		serverName, serverPort = r.Host, "80"
+		if scheme == "https" {
+			serverPort = "443"
+		}
+	}
+
+	root := filepath.Clean(t.Root)
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "parapet",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"REQUEST_SCHEME":    scheme,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     root,
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   filepath.Join(root, scriptName),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      header.Get(r.Header, header.ContentType),
+		"HTTP_HOST":         r.Host,
+	}
+	if pathInfo != "" {
+		env["PATH_TRANSLATED"] = filepath.Join(root, pathInfo)
+	}
+	if scheme == "https" {
+		env["HTTPS"] = "on"
+	}
+	if r.ContentLength > 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for k, v := range r.Header {
+		switch k {
+		case header.ContentType, header.ContentLength, "Proxy": // Proxy: httpoxy
+			continue
+		}
+		env["HTTP_"+strings.ToUpper(strings.ReplaceAll(k, "-", "_"))] = strings.Join(v, ", ")
+	}
+	for k, v := range t.Env {
+		env[k] = v
+	}
+
+	var b []byte
+	for k, v := range env {
+		b = appendFCGILen(b, len(k))
+		b = appendFCGILen(b, len(v))
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+	return b
+}
+
+// splitPath splits a clean request path into the script and the PATH_INFO after
+// it, at the first SplitPath extension that ends a path segment.
+func (t *FastCGITransport) splitPath(p string) (script, pathInfo string) {
+	lower := strings.ToLower(p)
+	for _, ext := range t.SplitPath {
+		ext = strings.ToLower(ext)
+		for off := 0; ; {
+			i := strings.Index(lower[off:], ext)
+			if i < 0 {
+				break
+			}
+			end := off + i + len(ext)
+			if end == len(p) || p[end] == '/' {
+				return p[:end], p[end:]
+			}
+			off = end
+		}
+	}
+	if strings.HasSuffix(p, "/") {
+		return p + t.Index, ""
+	}
+	return p, ""
+}
+
+// dialNetwork maps a target Host to a dial network and address: a Unix socket
+// path in the form UnixTransport accepts ("/path.sock" or "path.sock:80"), or
+// TCP.
+func dialNetwork(host string) (network, addr string) {
+	if strings.Contains(host, "/") {
+		return "unix", "/" + strings.TrimPrefix(strings.TrimSuffix(host, ":80"), "/")
+	}
+	return "tcp", host
+}
+
+func appendFCGILen(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+func (c *fcgiConn) writeRecord(typ byte, content []byte) error {
+	pad := -len(content) & 7
+	h := [fcgiHeaderLen]byte{fcgiVersion, typ, 0, fcgiRequestID, 0, 0, byte(pad), 0}
+	binary.BigEndian.PutUint16(h[4:6], uint16(len(content)))
+	if _, err := c.bw.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write(content); err != nil {
+		return err
+	}
+	var zero [8]byte
+	_, err := c.bw.Write(zero[:pad])
+	return err
+}
+
+// writeStream writes b as a stream of records and its empty terminator.
+func (c *fcgiConn) writeStream(typ byte, b []byte) error {
+	if _, err := (&fcgiStreamWriter{c: c, typ: typ}).Write(b); err != nil {
+		return err
+	}
+	return c.writeRecord(typ, nil)
+}
+
+type fcgiStreamWriter struct {
+	c   *fcgiConn
+	typ byte
+}
+
+func (w *fcgiStreamWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		chunk := b[:min(len(b), fcgiMaxRecord)]
+		if err := w.c.writeRecord(w.typ, chunk); err != nil {
+			return 0, err
+		}
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// fcgiStdoutReader reads the FastCGI stdout stream, passing stderr records to
+// stderr, until the server's end-request record.
+type fcgiStdoutReader struct {
+	c      *fcgiConn
+	stderr func([]byte)
+	rest   int // content left in the current stdout record
+	pad    int // padding after it
+	done   bool
+}
+
+func (s *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for s.rest == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if _, err := s.c.br.Discard(s.pad); err != nil {
+			return 0, err
+		}
+		s.pad = 0
+
+		var h [fcgiHeaderLen]byte
+		if _, err := io.ReadFull(s.c.br, h[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		n, pad := int(binary.BigEndian.Uint16(h[4:6])), int(h[6])
+		switch h[1] {
+		case fcgiStdout:
+			s.rest, s.pad = n, pad
+		case fcgiStderr:
+			b := make([]byte, n)
+			if _, err := io.ReadFull(s.c.br, b); err != nil {
+				return 0, err
+			}
+			s.stderr(b)
+			s.pad = pad
+		case fcgiEndRequest:
+			var body [8]byte
+			if n < len(body) {
+				return 0, errors.New("upstream: malformed fastcgi end request")
+			}
+			if _, err := io.ReadFull(s.c.br, body[:]); err != nil {
+				return 0, err
+			}
+			if body[4] != fcgiRequestComplete {
+				return 0, fmt.Errorf("upstream: fastcgi request not complete (status %d)", body[4])
+			}
+			s.pad = n - len(body) + pad
+			if _, err := s.c.br.Discard(s.pad); err != nil {
+				return 0, err
+			}
+			s.pad = 0
+			s.done = true
+		default:
+			s.pad = n + pad
+		}
+	}
+
+	n, err := s.c.br.Read(p[:min(len(p), s.rest)])
+	s.rest -= n
+	return n, err
+}
+
+// fcgiBody is the response body. Read to the end, it returns the connection to
+// the pool; closed early, the connection is dropped.
+type fcgiBody struct {
+	t      *FastCGITransport
+	c      *fcgiConn
+	r      io.Reader
+	stdout *fcgiStdoutReader
+	stop   func() bool
+	once   sync.Once
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.release(err == io.EOF)
+	}
+	return n, err
+}
+
+func (b *fcgiBody) Close() error {
+	b.release(false)
+	return nil
+}
+
+func (b *fcgiBody) release(clean bool) {
+	b.once.Do(func() {
+		if b.stop() && clean && b.stdout.done {
+			b.t.putConn(b.c)
+			return
+		}
+		b.c.Close()
+	})
+}
@@ -0,0 +1,181 @@
+package upstream
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingListener counts accepted connections and can drop all of them.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *countingListener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+func fcgiServer(t *testing.T, network, addr string, h http.Handler) *countingListener {
+	t.Helper()
+	ln, err := net.Listen(network, addr)
+	require.NoError(t, err)
+	l := &countingListener{Listener: ln}
+	go fcgi.Serve(l, h)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestFastCGITransport(t *testing.T) {
+	t.Parallel()
+
+	var env map[string]string
+	var mu sync.Mutex
+	l := fcgiServer(t, "tcp", "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		env = fcgi.ProcessEnv(r)
+		mu.Unlock()
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/app/index.php/users/42", r.URL.Path)
+		assert.Equal(t, "a=1", r.URL.RawQuery)
+		assert.Equal(t, "example.com", r.Host)
+		assert.Equal(t, "203.0.113.7:0", r.RemoteAddr, "X-Real-Ip, no port")
+		assert.NotNil(t, r.TLS, "HTTPS=on from X-Forwarded-Proto")
+		assert.Equal(t, "v", r.Header.Get("X-Custom"))
+		assert.Empty(t, r.Header.Get("Proxy"), "httpoxy")
+		body, _ := io.ReadAll(r.Body)
+		assert.Len(t, body, 200000, "a body larger than one record")
+
+		w.Header().Set("X-Php", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	}))
+
+	tr := &FastCGITransport{Root: "/srv/www", Env: map[string]string{"APP_ENV": "test"}}
+	u := SingleHost(l.Addr().String(), tr)
+	r := httptest.NewRequest("POST", "http://example.com/app/index.php/users/42?a=1", bytes.NewReader(make([]byte, 200000)))
+	r.Header.Set("X-Real-Ip", "203.0.113.7")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Custom", "v")
+	r.Header.Set("Proxy", "http://evil")
+	w := httptest.NewRecorder()
+	u.ServeHandler(nil).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "yes", w.Header().Get("X-Php"))
+	assert.Equal(t, "created", w.Body.String())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "/srv/www/app/index.php", env["SCRIPT_FILENAME"])
+	assert.Equal(t, "/srv/www", env["DOCUMENT_ROOT"])
+	assert.Equal(t, "test", env["APP_ENV"])
+}
+
+func TestFastCGITransport_KeepAlive(t *testing.T) {
+	t.Parallel()
+
+	l := fcgiServer(t, "tcp", "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	tr := &FastCGITransport{}
+	get := func() {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Host = l.Addr().String()
+		resp, err := tr.RoundTrip(r)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(body))
+	}
+
+	for range 3 {
+		get()
+	}
+	assert.EqualValues(t, 1, l.accepted.Load(), "the connection is pooled")
+
+	l.dropAll()
+	get()
+	assert.EqualValues(t, 2, l.accepted.Load(), "a stale pooled connection is replaced")
+}
+
+func TestFastCGITransport_Unix(t *testing.T) {
+	t.Parallel()
+
+	fn := filepath.Join(os.TempDir(), "parapet-test-tr-fcgi")
+	os.Remove(fn)
+	fcgiServer(t, "unix", fn, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer os.Remove(fn)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Host = fn
+	resp, err := (&FastCGITransport{}).RoundTrip(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Status"))
+}
+
+func TestFastCGITransport_Params(t *testing.T) {
+	t.Parallel()
+
+	tr := &FastCGITransport{Index: "index.php", SplitPath: []string{".php"}}
+	for p, want := range map[string][2]string{
+		"/index.php":            {"/index.php", ""},
+		"/index.php/a/b":        {"/index.php", "/a/b"},
+		"/INDEX.PHP/a":          {"/INDEX.PHP", "/a"},
+		"/x.phpx/y.php/z":       {"/x.phpx/y.php", "/z"},
+		"/blog/":                {"/blog/index.php", ""},
+		"/assets/app.css":       {"/assets/app.css", ""},
+		"/admin/users.php/edit": {"/admin/users.php", "/edit"},
+	} {
+		s, i := tr.splitPath(p)
+		assert.Equal(t, want, [2]string{s, i}, p)
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/blog/", nil)
+	assert.Contains(t, string(tr.params(r)), "SCRIPT_NAME/blog/index.php", "the trailing slash survives cleaning")
+
+	r = httptest.NewRequest("GET", "http://example.com/a.php", nil)
+	r.Header.Set("Content-Type", "text/plain")
+	params := string(tr.params(r))
+	assert.Contains(t, params, "SCRIPT_NAME/a.php")
+	assert.Contains(t, params, "CONTENT_TYPEtext/plain")
+	assert.NotContains(t, params, "HTTP_CONTENT_TYPE")
+	assert.Contains(t, params, "SERVER_PORT80")
+
+	assert.Equal(t, []byte{5}, appendFCGILen(nil, 5))
+	assert.Equal(t, []byte{0x80, 0, 1, 0}, appendFCGILen(nil, 256))
+}
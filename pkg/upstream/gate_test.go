@@ -27,7 +27,7 @@ func gateTargets(rec http.RoundTripper, hosts ...string) []*Target {
 }
 
 // gateBuilders is every gateable balancer paired with its documented all-down
-// policy (sheds 503 vs fails open). Shared by the gate tests so each of the six is
+// policy (sheds 503 vs fails open). Shared by the gate tests so each of the seven is
 // exercised by name — must-fix #5: gate ALL balancers, with no silent no-op.
 var gateBuilders = []struct {
 	name         string
@@ -38,6 +38,7 @@ var gateBuilders = []struct {
 	{"Weighted", func(ts []*Target) gatedBalancer { return NewWeightedRoundRobinLoadBalancer(ts) }, false},
 	{"Ejecting", func(ts []*Target) gatedBalancer { return NewEjectingLoadBalancer(ts) }, false},
 	{"LatencyEjecting", func(ts []*Target) gatedBalancer { return NewLatencyEjectingLoadBalancer(ts) }, false},
+	{"SuccessRateEjecting", func(ts []*Target) gatedBalancer { return NewSuccessRateEjectingLoadBalancer(ts) }, false},
 	{"LeastConn", func(ts []*Target) gatedBalancer { return NewLeastConnLoadBalancer(ts) }, false},
 	{"CircuitBreaking", func(ts []*Target) gatedBalancer { return NewCircuitBreakingLoadBalancer(ts) }, true},
 }
@@ -0,0 +1,386 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+// GRPCCode is a gRPC status code (the grpc-status trailer).
+type GRPCCode uint32
+
+// gRPC status codes, as defined by the gRPC protocol.
+const (
+	GRPCOK GRPCCode = iota
+	GRPCCanceled
+	GRPCUnknown
+	GRPCInvalidArgument
+	GRPCDeadlineExceeded
+	GRPCNotFound
+	GRPCAlreadyExists
+	GRPCPermissionDenied
+	GRPCResourceExhausted
+	GRPCFailedPrecondition
+	GRPCAborted
+	GRPCOutOfRange
+	GRPCUnimplemented
+	GRPCInternal
+	GRPCUnavailable
+	GRPCDataLoss
+	GRPCUnauthenticated
+)
+
+var grpcCodeNames = [...]string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION",
+	"ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// String returns the canonical code name (e.g. "UNAVAILABLE"), a bounded metric
+// label; a code outside the protocol's set is "UNKNOWN".
+func (c GRPCCode) String() string {
+	if int(c) < len(grpcCodeNames) {
+		return grpcCodeNames[c]
+	}
+	return "UNKNOWN"
+}
+
+// grpcPushbackMs is the grpc-retry-pushback-ms hint sent with an ErrLimited shed,
+// the gRPC counterpart of limitedRetryAfter.
+const grpcPushbackMs = "1000"
+
+// IsGRPC reports whether r is a native gRPC call (Content-Type application/grpc,
+// optionally with a +proto/+json subtype). gRPC-Web is not native gRPC.
+func IsGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return false
+	}
+	rest := ct[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// grpcMethod splits a gRPC request path "/pkg.Service/Method" into its service
+// and method. It reads the LAST two segments, so an Upstream.Path prefix does not
+// shift them.
+func grpcMethod(p string) (service, method string) {
+	p = strings.TrimSuffix(p, "/")
+	i := strings.LastIndexByte(p, '/')
+	if i <= 0 {
+		return "", strings.TrimPrefix(p, "/")
+	}
+	method = p[i+1:]
+	p = p[:i]
+	return p[strings.LastIndexByte(p, '/')+1:], method
+}
+
+// GRPCStatus returns a gRPC response's status: from the headers of a
+// trailers-only response (how servers and proxies answer an immediate error), or
+// from the trailers once the body has been read to EOF. ok is false while the
+// status is not yet known.
+func GRPCStatus(resp *http.Response) (code GRPCCode, ok bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Grpc-Status")
+	if v == "" {
+		v = resp.Trailer.Get("Grpc-Status")
+	}
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return GRPCUnknown, true
+	}
+	return GRPCCode(n), true
+}
+
+// IsGRPCFailure is an IsFailure for the ejecting and circuit-breaking balancers
+// when they front gRPC backends. On top of the default rule (a transport error
+// other than a client cancel or an ErrLimited shed) it counts a 5xx and a
+// server-fault grpc-status — UNKNOWN, DEADLINE_EXCEEDED, INTERNAL, UNAVAILABLE,
+// DATA_LOSS — as failures; caller-fault codes (INVALID_ARGUMENT, NOT_FOUND, ...)
+// are not. Balancers judge at the response headers, so only a trailers-only
+// status is visible here: an error a server reports in the trailers after
+// streaming a body is not counted.
+func IsGRPCFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, ErrLimited)
+	}
+	if resp == nil {
+		return false
+	}
+	if resp.StatusCode >= 500 {
+		return true
+	}
+	code, ok := GRPCStatus(resp)
+	if !ok {
+		return false
+	}
+	switch code {
+	case GRPCUnknown, GRPCDeadlineExceeded, GRPCInternal, GRPCUnavailable, GRPCDataLoss:
+		return true
+	}
+	return false
+}
+
+// GRPCError is returned by Upstream.RoundTrip in place of a trailers-only
+// UNAVAILABLE answer from the origin while the call may still be retried, so the
+// proxy retries it like a transport error. If the retries run out, the client
+// receives the origin's own status and message.
+type GRPCError struct {
+	Code    GRPCCode
+	Message string
+}
+
+func (e *GRPCError) Error() string {
+	return "upstream: grpc status " + e.Code.String() + ": " + e.Message
+}
+
+// parseGRPCTimeout parses a grpc-timeout header: at most 8 digits and a unit
+// (H, M, S, m, u, n). A value past the longest time.Duration, which some
+// clients send to mean no deadline, is clamped to it, as grpc-go does.
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	if n > uint64(math.MaxInt64/unit) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcErrorCode maps a proxy-side failure to the status a gRPC client sees, the
+// gRPC counterpart of the 502/503 mapping.
+func grpcErrorCode(err error) GRPCCode {
+	var gerr *GRPCError
+	switch {
+	case errors.As(err, &gerr):
+		return gerr.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return GRPCDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return GRPCCanceled
+	default: // ErrUnavailable, ErrLimited, and a failed connect alike
+		return GRPCUnavailable
+	}
+}
+
+// writeGRPCError answers a gRPC call the proxy could not complete with a
+// trailers-only response (status in the headers, HTTP 200, no body), which a gRPC
+// client decodes as the call's status instead of a protocol error.
+func writeGRPCError(w http.ResponseWriter, r *http.Request, err error) {
+	code := grpcErrorCode(err)
+	msg := "upstream: " + strings.ToLower(strings.ReplaceAll(code.String(), "_", " "))
+	var gerr *GRPCError
+	if errors.As(err, &gerr) {
+		msg = gerr.Message
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.FormatUint(uint64(code), 10))
+	if msg != "" {
+		h.Set("Grpc-Message", encodeGRPCMessage(msg))
+	}
+	if errors.Is(err, ErrLimited) {
+		h.Set("Grpc-Retry-Pushback-Ms", grpcPushbackMs)
+	}
+	logger.Set(r.Context(), "grpcStatus", int(code))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value: bytes outside printable
+// ASCII, and '%' itself.
+func encodeGRPCMessage(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
+
+// decodeGRPCMessage reverses encodeGRPCMessage; a malformed escape is kept as is.
+func decodeGRPCMessage(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// grpcBody defers a gRPC call's OnRoundTrip until its status is known: the
+// trailers arrive only after the body, so the observation fires at body EOF (or a
+// read error, or Close) with the trailer status filled in.
+type grpcBody struct {
+	io.ReadCloser
+	resp *http.Response
+	r    *http.Request
+	info RoundTripInfo
+	emit func(r *http.Request, info RoundTripInfo)
+	once sync.Once
+}
+
+func (b *grpcBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *grpcBody) Close() error {
+	b.finish(nil)
+	return b.ReadCloser.Close()
+}
+
+func (b *grpcBody) finish(err error) {
+	b.once.Do(func() {
+		if code, ok := GRPCStatus(b.resp); ok {
+			b.info.GRPCStatus = code
+		} else if err != nil && err != io.EOF {
+			b.info.GRPCStatus = grpcErrorCode(err) // broken mid-stream
+		} else {
+			b.info.GRPCStatus = GRPCUnknown // closed early, or no status sent
+		}
+		logger.Set(b.r.Context(), "grpcStatus", int(b.info.GRPCStatus))
+		if b.emit != nil {
+			b.emit(b.r, b.info)
+		}
+	})
+}
+
+// observeGRPC labels a gRPC round-trip's log record and RoundTripInfo, and
+// returns the response to hand the proxy, or an error that makes the proxy retry
+// a trailers-only UNAVAILABLE. deferred reports that OnRoundTrip now fires from the
+// body instead.
+func (m *Upstream) observeGRPC(r *http.Request, resp *http.Response, err error, info *RoundTripInfo) (_ *http.Response, deferred bool, _ error) {
+	info.GRPC = true
+	info.GRPCService, info.GRPCMethod = grpcMethod(r.URL.Path)
+	logger.Set(r.Context(), "grpcService", info.GRPCService)
+	logger.Set(r.Context(), "grpcMethod", info.GRPCMethod)
+
+	if err != nil {
+		info.GRPCStatus = grpcErrorCode(err)
+		return resp, false, err
+	}
+	if code, ok := GRPCStatus(resp); ok { // trailers-only: the status is already here
+		info.GRPCStatus = code
+		logger.Set(r.Context(), "grpcStatus", int(code))
+		if code == GRPCUnavailable && info.Attempt < m.Retries && m.retryableGRPC(r) {
+			msg := decodeGRPCMessage(resp.Header.Get("Grpc-Message"))
+			drainClose(resp)
+			return nil, false, &GRPCError{Code: code, Message: msg}
+		}
+		return resp, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		info.GRPCStatus = grpcHTTPCode(resp.StatusCode)
+		logger.Set(r.Context(), "grpcStatus", int(info.GRPCStatus))
+		return resp, false, nil
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		info.GRPCStatus = GRPCUnknown
+		return resp, false, nil
+	}
+	resp.Body = &grpcBody{ReadCloser: resp.Body, resp: resp, r: r, info: *info, emit: m.OnRoundTrip}
+	return resp, true, nil
+}
+
+// grpcHTTPCode maps a non-200 HTTP answer to a gRPC call (e.g. from an HTTP-only
+// hop) to the status a gRPC client derives from it.
+func grpcHTTPCode(status int) GRPCCode {
+	switch status {
+	case http.StatusBadRequest:
+		return GRPCInternal
+	case http.StatusUnauthorized:
+		return GRPCUnauthenticated
+	case http.StatusForbidden:
+		return GRPCPermissionDenied
+	case http.StatusNotFound:
+		return GRPCUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GRPCUnavailable
+	default:
+		return GRPCUnknown
+	}
+}
+
+// retryableGRPC is the retry rule for a gRPC call. gRPC methods carry no
+// idempotency signal, so by default a call is retried only when the origin
+// certainly did not act on it — the balancer shed it before any round-trip, or
+// the origin refused it with a trailers-only UNAVAILABLE — and only if its body
+// can be rewound (GetBody). RetryPolicy, when set, decides instead.
+func (m *Upstream) retryableGRPC(r *http.Request) bool {
+	if m.RetryPolicy != nil {
+		return m.RetryPolicy(r)
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// grpcRetryable reports whether a failed gRPC attempt may be retried.
+func (m *Upstream) grpcRetryable(r *http.Request, err error) bool {
+	var gerr *GRPCError
+	if !errors.Is(err, ErrUnavailable) && !errors.As(err, &gerr) {
+		return false
+	}
+	return m.retryableGRPC(r)
+}
+
+// withGRPCTimeout applies a gRPC call's grpc-timeout as the request deadline.
+func withGRPCTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	d, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout"))
+	if !ok {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,275 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var discardLog = log.New(io.Discard, "", 0)
+
+func grpcRequest(body io.Reader) *http.Request {
+	r := httptest.NewRequest("POST", "/pkg.Users/Get", body)
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	return r
+}
+
+func trailersOnly(code string) *http.Response {
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", code)
+	w.Header().Set("Grpc-Message", "backend%20draining")
+	w.WriteHeader(http.StatusOK)
+	return w.Result()
+}
+
+func TestIsGRPC(t *testing.T) {
+	t.Parallel()
+
+	for ct, want := range map[string]bool{
+		"application/grpc":               true,
+		"application/grpc+proto":         true,
+		"application/grpc;charset=utf-8": true,
+		"application/grpc-web":           false,
+		"application/grpc-web-text":      false,
+		"application/json":               false,
+		"":                               false,
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("Content-Type", ct)
+		assert.Equal(t, want, IsGRPC(r), ct)
+	}
+}
+
+func TestGRPCHelpers(t *testing.T) {
+	t.Parallel()
+
+	for p, want := range map[string][2]string{
+		"/pkg.Users/Get":        {"pkg.Users", "Get"},
+		"/api/v1/pkg.Users/Get": {"pkg.Users", "Get"},
+		"/Get":                  {"", "Get"},
+	} {
+		s, m := grpcMethod(p)
+		assert.Equal(t, want, [2]string{s, m}, p)
+	}
+
+	for v, want := range map[string]time.Duration{
+		"1H":        time.Hour,
+		"2M":        2 * time.Minute,
+		"3S":        3 * time.Second,
+		"250m":      250 * time.Millisecond,
+		"10u":       10 * time.Microsecond,
+		"99999999n": 99999999 * time.Nanosecond,
+		"99999999H": math.MaxInt64, // clamped, not wrapped negative
+	} {
+		d, ok := parseGRPCTimeout(v)
+		assert.True(t, ok, v)
+		assert.Equal(t, want, d, v)
+	}
+	for _, v := range []string{"", "S", "100", "1x", "123456789S", "-1S"} {
+		_, ok := parseGRPCTimeout(v)
+		assert.False(t, ok, v)
+	}
+
+	msg := "héllo 100% done\n"
+	assert.Equal(t, "h%C3%A9llo 100%25 done%0A", encodeGRPCMessage(msg))
+	assert.Equal(t, msg, decodeGRPCMessage(encodeGRPCMessage(msg)))
+	assert.Equal(t, "50%", decodeGRPCMessage("50%"), "a malformed escape is kept")
+
+	assert.Equal(t, "UNAVAILABLE", GRPCUnavailable.String())
+	assert.Equal(t, "UNKNOWN", GRPCCode(99).String())
+}
+
+func TestIsGRPCFailure(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, IsGRPCFailure(nil, errors.New("dial tcp: connection refused")))
+	assert.False(t, IsGRPCFailure(nil, context.Canceled))
+	assert.False(t, IsGRPCFailure(nil, ErrLimited))
+	assert.True(t, IsGRPCFailure(&http.Response{StatusCode: 503, Header: http.Header{}}, nil))
+
+	for code, want := range map[string]bool{
+		"0": false, "2": true, "3": false, "4": true, "5": false, "13": true, "14": true, "15": true, "16": false,
+	} {
+		assert.Equal(t, want, IsGRPCFailure(trailersOnly(code), nil), "grpc-status %s", code)
+	}
+
+	streamed := &http.Response{StatusCode: 200, Header: http.Header{}, Trailer: http.Header{}}
+	assert.False(t, IsGRPCFailure(streamed, nil), "a trailer status is not known at the headers")
+}
+
+func TestUpstream_GRPCErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		code     string
+		pushback bool
+	}{
+		{"unavailable", ErrUnavailable, "14", false},
+		{"limited", ErrLimited, "14", true},
+		{"connect", errors.New("dial tcp: connection refused"), "14", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u := New(probeRT(func(*http.Request) (*http.Response, error) { return nil, tc.err }))
+			u.ErrorLog = discardLog
+			u.Retries = 0
+			w := httptest.NewRecorder()
+			u.ServeHandler(nil).ServeHTTP(w, grpcRequest(nil))
+
+			assert.Equal(t, http.StatusOK, w.Code, "a gRPC error is a trailers-only 200")
+			assert.Equal(t, "application/grpc", w.Header().Get("Content-Type"))
+			assert.Equal(t, tc.code, w.Header().Get("Grpc-Status"))
+			assert.NotEmpty(t, w.Header().Get("Grpc-Message"))
+			assert.Equal(t, tc.pushback, w.Header().Get("Grpc-Retry-Pushback-Ms") != "")
+			assert.Empty(t, w.Body.String())
+		})
+	}
+
+	t.Run("plain HTTP unchanged", func(t *testing.T) {
+		u := New(probeRT(func(*http.Request) (*http.Response, error) { return nil, ErrUnavailable }))
+		u.ErrorLog = discardLog
+		w := httptest.NewRecorder()
+		u.ServeHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Empty(t, w.Header().Get("Grpc-Status"))
+	})
+}
+
+func TestUpstream_GRPCTimeout(t *testing.T) {
+	t.Parallel()
+
+	var deadline atomic.Bool
+	u := New(probeRT(func(r *http.Request) (*http.Response, error) {
+		_, ok := r.Context().Deadline()
+		deadline.Store(ok)
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}))
+	u.ErrorLog = discardLog
+	r := grpcRequest(nil)
+	r.Header.Set("Grpc-Timeout", "20m")
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	u.ServeHandler(nil).ServeHTTP(w, r)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, deadline.Load(), "grpc-timeout becomes the request deadline")
+	assert.Equal(t, "4", w.Header().Get("Grpc-Status"), "DEADLINE_EXCEEDED")
+}
+
+func TestUpstream_GRPCRetry(t *testing.T) {
+	t.Parallel()
+
+	t.Run("trailers-only UNAVAILABLE with a rewindable body", func(t *testing.T) {
+		var calls atomic.Int32
+		u := New(probeRT(func(r *http.Request) (*http.Response, error) {
+			io.Copy(io.Discard, r.Body)
+			if calls.Add(1) == 1 {
+				return trailersOnly("14"), nil
+			}
+			return trailersOnly("0"), nil
+		}))
+		u.BackoffFactor = time.Millisecond
+		r := grpcRequest(strings.NewReader("msg"))
+		r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("msg")), nil }
+		w := httptest.NewRecorder()
+		u.ServeHandler(nil).ServeHTTP(w, r)
+		assert.EqualValues(t, 2, calls.Load())
+		assert.Equal(t, "0", w.Header().Get("Grpc-Status"))
+	})
+
+	t.Run("retries exhausted surface the origin status", func(t *testing.T) {
+		var calls atomic.Int32
+		u := New(probeRT(func(*http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return trailersOnly("14"), nil
+		}))
+		u.ErrorLog = discardLog
+		u.BackoffFactor = time.Millisecond
+		u.Retries = 2
+		w := httptest.NewRecorder()
+		u.ServeHandler(nil).ServeHTTP(w, grpcRequest(nil))
+		assert.EqualValues(t, 3, calls.Load())
+		assert.Equal(t, "14", w.Header().Get("Grpc-Status"))
+		assert.Equal(t, "backend%20draining", w.Header().Get("Grpc-Message"))
+	})
+
+	t.Run("a streamed body is not retried", func(t *testing.T) {
+		var calls atomic.Int32
+		u := New(probeRT(func(*http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return trailersOnly("14"), nil
+		}))
+		w := httptest.NewRecorder()
+		u.ServeHandler(nil).ServeHTTP(w, grpcRequest(strings.NewReader("msg")))
+		assert.EqualValues(t, 1, calls.Load())
+		assert.Equal(t, "14", w.Header().Get("Grpc-Status"), "the origin's answer passes through")
+	})
+
+	t.Run("a transport error is not retried", func(t *testing.T) {
+		var calls atomic.Int32
+		u := New(probeRT(func(*http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return nil, errors.New("read: connection reset by peer")
+		}))
+		u.ErrorLog = discardLog
+		u.BackoffFactor = time.Millisecond
+		w := httptest.NewRecorder()
+		u.ServeHandler(nil).ServeHTTP(w, grpcRequest(nil))
+		assert.EqualValues(t, 1, calls.Load(), "the origin may have acted on it")
+		assert.Equal(t, "14", w.Header().Get("Grpc-Status"))
+	})
+}
+
+func TestUpstream_GRPCObserveTrailerStatus(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "5")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	var (
+		mu    sync.Mutex
+		infos []RoundTripInfo
+	)
+	u := SingleHost(strings.TrimPrefix(srv.URL, "http://"), &H2CTransport{})
+	u.OnRoundTrip = func(_ *http.Request, info RoundTripInfo) {
+		mu.Lock()
+		infos = append(infos, info)
+		mu.Unlock()
+	}
+	w := httptest.NewRecorder()
+	u.ServeHandler(nil).ServeHTTP(w, grpcRequest(nil))
+
+	assert.Equal(t, "5", w.Result().Trailer.Get("Grpc-Status"), "trailers are proxied")
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, infos, 1, "fires once, after the body")
+	assert.True(t, infos[0].GRPC)
+	assert.Equal(t, "pkg.Users", infos[0].GRPCService)
+	assert.Equal(t, "Get", infos[0].GRPCMethod)
+	assert.Equal(t, GRPCNotFound, infos[0].GRPCStatus, "read from the trailers")
+	assert.Equal(t, http.StatusOK, infos[0].Status)
+}
@@ -2,11 +2,12 @@ package upstream
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -70,6 +71,7 @@ func NewActiveHealthCheck(targets []*Target, inner http.RoundTripper) *ActiveHea
 //nolint:govet // fields grouped by role (state, then config) for readability
 type ActiveHealthCheck struct {
 	mu        sync.Mutex // guards the (closed, cancel, spawn) lifecycle decision
+	initOnce  sync.Once
 	startOnce sync.Once
 	lazyOnce  sync.Once
 	wg        sync.WaitGroup
@@ -88,11 +90,24 @@ type ActiveHealthCheck struct {
 	// the internal gate interface (all package balancers do).
 	Balancer http.RoundTripper
 
+	// Type selects the probe: ProbeHTTP (the default), ProbeTCP, or ProbeGRPC. A
+	// Target.Probe overrides this and the other probe fields below per target.
+	Type ProbeType
+
 	// Path and Method are the probe request's URL path and HTTP method. Default "/"
-	// and GET.
+	// and GET. HTTP probes only.
 	Path   string
 	Method string
 
+	// Host overrides the probe request's Host header (and a gRPC probe's
+	// :authority); empty derives it from the target's Host. Set it for a backend
+	// that routes by virtual host.
+	Host string
+
+	// Header is added to every HTTP and gRPC probe request (e.g. an auth token or a
+	// health-check marker the backend recognises).
+	Header http.Header
+
 	// Scheme is the probe URL scheme. It matters ONLY for targets backed by the
 	// dynamic multi-scheme Transport, which dispatches on it (use "h2c" or "unix" to
 	// match an h2c/unix data path); the dedicated transports (HTTPTransport,
@@ -104,6 +119,12 @@ type ActiveHealthCheck struct {
 	// Interval is the time between probes for a target. Default 10s.
 	Interval time.Duration
 
+	// Jitter spreads each wait uniformly over +/- Jitter/2 x Interval, so probers
+	// started together (across targets, and across a fleet of proxies restarted at
+	// once) drift apart instead of probing in lockstep. 0.2 is a sensible value.
+	// Default 0 (a fixed Interval); values are clamped to [0,1].
+	Jitter float64
+
 	// Timeout bounds a single probe (a per-probe context deadline). Default 5s.
 	Timeout time.Duration
 
@@ -129,10 +150,26 @@ type ActiveHealthCheck struct {
 	// misconfigured probe path cannot black-hole a fresh deploy.
 	StartUnhealthy bool
 
-	// IsHealthy decides whether a probe result is healthy; nil treats a non-error
-	// response with status < 400 as healthy.
+	// IsHealthy decides whether an HTTP probe result is healthy; nil treats a
+	// non-error response with status < 400 as healthy. The assertions below still
+	// apply after it, so an IsHealthy that reads the body defeats the body checks.
 	IsHealthy func(resp *http.Response, err error) bool
 
+	// ExpectHeader lists response headers an HTTP probe requires: each must be
+	// present and, if values are given, carry one of them exactly. A miss fails the
+	// probe with CauseHeader.
+	ExpectHeader http.Header
+
+	// ExpectBody and ExpectBodyRegexp require the HTTP probe response body (its
+	// first 64 KiB) to contain the substring / match the pattern. A miss fails the
+	// probe with CauseBody.
+	ExpectBody       string
+	ExpectBodyRegexp *regexp.Regexp
+
+	// GRPCService is the service name a ProbeGRPC probe asks about; "" checks the
+	// server's overall health.
+	GRPCService string
+
 	// OnStateChange observes this target's active-health gate flipping: ReasonProbeDown
 	// (UnhealthyThld consecutive failing probes took an up target down, From StateClosed
 	// To StateOpen, carrying a classified ProbeCause) and ReasonProbeRecover (HealthyThld
@@ -149,9 +186,11 @@ type ActiveHealthCheck struct {
 
 // probeTarget holds one target's probe state. up is the only cross-goroutine field
 // (a pointer into the wrapper's gate slice); okRun/failRun are touched solely by
-// that target's own probe goroutine, so they are plain ints (single-writer).
+// that target's own probe goroutine, so they are plain ints (single-writer). probe
+// is the target's resolved probe config, fixed at init.
 type probeTarget struct {
 	target  *Target
+	probe   *Probe
 	up      *atomic.Bool
 	okRun   int
 	failRun int
@@ -172,6 +211,9 @@ func (a *ActiveHealthCheck) init() {
 	if a.Path[0] != '/' {
 		a.Path = "/" + a.Path
 	}
+	if a.Type == 0 {
+		a.Type = ProbeHTTP
+	}
 	if a.Method == "" {
 		a.Method = defaultHCProbeMethod
 	}
@@ -190,12 +232,13 @@ func (a *ActiveHealthCheck) init() {
 	if a.UnhealthyThld <= 0 {
 		a.UnhealthyThld = defaultHCUnhealthyThreshold
 	}
+	a.Jitter = max(0, min(1, a.Jitter))
 
 	a.up = make([]atomic.Bool, len(a.Targets))
 	a.probes = make([]*probeTarget, len(a.Targets))
 	for i := range a.Targets {
 		a.up[i].Store(!a.StartUnhealthy) // fail-open by default
-		a.probes[i] = &probeTarget{target: a.Targets[i], up: &a.up[i]}
+		a.probes[i] = &probeTarget{target: a.Targets[i], probe: a.resolveProbe(a.Targets[i]), up: &a.up[i]}
 	}
 	if g, ok := a.Balancer.(activeHealthGate); ok {
 		g.setHealthGate(a.up) // inner balancer now skips probe-down targets in its pick
@@ -223,7 +266,7 @@ func (a *ActiveHealthCheck) Start(ctx context.Context) {
 // cancels and drains them.
 func (a *ActiveHealthCheck) start() {
 	a.startOnce.Do(func() {
-		a.init()
+		a.initOnce.Do(a.init)
 
 		a.mu.Lock()
 		if a.closed {
@@ -265,6 +308,35 @@ func (a *ActiveHealthCheck) Close() error {
 	return nil
 }
 
+// HealthyFraction reports the fraction of Targets the active gate currently marks
+// up, in [0,1]; an empty pool reports 0. It never starts probing: before the first
+// probe it reflects the initial gate (all up, or all down with StartUnhealthy).
+func (a *ActiveHealthCheck) HealthyFraction() float64 {
+	a.initOnce.Do(a.init)
+	if len(a.up) == 0 {
+		return 0
+	}
+	n := 0
+	for i := range a.up {
+		if a.up[i].Load() {
+			n++
+		}
+	}
+	return float64(n) / float64(len(a.up))
+}
+
+// ReadyCheck returns a readiness check (see healthz.Check) that fails while fewer
+// than minFraction of the Targets are probe-up, so an instance whose pool has gone
+// dark drains instead of serving 502s.
+func (a *ActiveHealthCheck) ReadyCheck(minFraction float64) func(ctx context.Context) error {
+	return func(context.Context) error {
+		if f := a.HealthyFraction(); f < minFraction {
+			return fmt.Errorf("upstream: %.0f%% of targets healthy, want at least %.0f%%", f*100, minFraction*100)
+		}
+		return nil
+	}
+}
+
 // RoundTrip starts probing (once), wires graceful shutdown on the lazy path, then
 // defers to the wrapped balancer — the gate already filters its pick, so this never
 // reroutes.
@@ -289,8 +361,8 @@ func (a *ActiveHealthCheck) RoundTrip(r *http.Request) (*http.Response, error) {
 }
 
 // loop probes one target immediately (fast cold-start convergence) then every
-// Interval, until ctx is cancelled. Sequential, so a slow probe delays the next
-// tick for its own target only and probes never stack.
+// (jittered) Interval, until ctx is cancelled. Sequential, so a slow probe delays
+// the next tick for its own target only and probes never stack.
 func (a *ActiveHealthCheck) loop(ctx context.Context, pt *probeTarget) {
 	defer a.wg.Done()
 	if ctx.Err() != nil {
@@ -298,7 +370,7 @@ func (a *ActiveHealthCheck) loop(ctx context.Context, pt *probeTarget) {
 	}
 	a.probe(ctx, pt)
 
-	t := time.NewTicker(a.Interval)
+	t := time.NewTimer(a.nextInterval(pt))
 	defer t.Stop()
 	for {
 		select {
@@ -306,59 +378,36 @@ func (a *ActiveHealthCheck) loop(ctx context.Context, pt *probeTarget) {
 			return
 		case <-t.C:
 			a.probe(ctx, pt)
+			t.Reset(a.nextInterval(pt))
 		}
 	}
 }
 
-// probe issues one health request to pt's target and feeds the verdict to observe.
+// probe runs one probe of pt's type against its target and feeds the verdict to
+// observe.
 func (a *ActiveHealthCheck) probe(ctx context.Context, pt *probeTarget) {
-	pctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	pctx, cancel := context.WithTimeout(ctx, pt.probe.Timeout)
 	defer cancel()
 
-	// Build with a placeholder authority, then assign the real Host and scheme directly
-	// (as the balancers do, r.URL.Host = t.Host) so a unix-socket path Host is never
-	// parsed from a URL string, and the dynamic Transport dispatches on the right scheme.
-	req, err := http.NewRequestWithContext(pctx, a.Method, "http://"+probePlaceholderHost+a.Path, http.NoBody)
-	if err != nil {
-		// A malformed request config is a real failure, not a backend verdict — but
-		// check the parent ctx first so a Close racing here is still suppressed.
-		if ctx.Err() == nil {
-			a.observe(pt, false, CauseError)
-		}
-		return
-	}
-	req.URL.Scheme = a.Scheme
-	req.URL.Host = pt.target.Host
-	// Derive the Host header from URL.Host (the target's dial authority), not the
-	// placeholder. Note this differs from the data path (which forwards the client's
-	// Host): a backend that vhost-routes per request may need a custom IsHealthy or a
-	// probe path that does not depend on the Host header.
-	req.Host = ""
-
-	tr := a.ProbeTransport
-	if tr == nil {
-		tr = pt.target.Transport
-	}
-	resp, rerr := tr.RoundTrip(req)
-	if resp != nil && resp.Body != nil {
-		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, probeDrainLimit))
-		_ = resp.Body.Close()
+	var ok bool
+	var cause ProbeCause
+	switch pt.probe.Type {
+	case ProbeTCP:
+		ok, cause = a.probeTCP(pctx, pt)
+	case ProbeGRPC:
+		ok, cause = a.probeGRPC(pctx, pt)
+	default:
+		ok, cause = a.probeHTTP(pctx, pt)
 	}
 
 	// Shutting down: the PARENT ctx (prober lifetime) was cancelled by Close /
-	// graceful shutdown, so the in-flight RoundTrip returns context.Canceled. That is
+	// graceful shutdown, so the in-flight probe returns context.Canceled. That is
 	// not a backend verdict — drop it so Close never darkens the gate or fires a
 	// spurious ReasonProbeDown on the way out. A per-probe Timeout differs: only pctx
 	// expired, ctx.Err() is nil here, so it falls through as a real failure.
 	if ctx.Err() != nil {
 		return
 	}
-
-	ok := a.healthy(resp, rerr)
-	var cause ProbeCause
-	if !ok {
-		cause = classifyProbeCause(resp, rerr)
-	}
 	a.observe(pt, ok, cause)
 }
 
@@ -420,10 +469,8 @@ func classifyProbeCause(resp *http.Response, err error) ProbeCause {
 	if errors.Is(err, context.DeadlineExceeded) {
 		return CauseTimeout // the per-probe pctx deadline (non-DNS); parent-cancel was already filtered in probe()
 	}
-	var certErr *tls.CertificateVerificationError
-	var recErr tls.RecordHeaderError
-	if errors.As(err, &certErr) || errors.As(err, &recErr) {
-		return CauseTLS // cert distrust/expiry, or TLS spoken to a plaintext port (or vice-versa)
+	if isTLSError(err) {
+		return CauseTLS // cert distrust/expiry or pin mismatch, TLS spoken to a plaintext port (or vice-versa), or the origin rejected our client cert
 	}
 	if errors.Is(err, syscall.ECONNREFUSED) {
 		return CauseRefused
@@ -170,6 +170,7 @@ func TestActiveHealthCheck_ProbeSuppressedOnParentCancel(t *testing.T) {
 	}
 	pt := hcPeer("t", true)
 	pt.target.Transport = &healthFake{healthPath: "/hz", delay: time.Hour}
+	pt.probe = a.resolveProbe(pt.target)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel() // shutting down before the probe runs
@@ -191,6 +192,7 @@ func TestActiveHealthCheck_ProbeTimeoutClassifiesTimeout(t *testing.T) {
 	}
 	pt := hcPeer("t", true)
 	pt.target.Transport = &healthFake{healthPath: "/hz", delay: 200 * time.Millisecond}
+	pt.probe = a.resolveProbe(pt.target)
 
 	a.probe(context.Background(), pt) // parent alive; pctx deadline fires at 20ms
 
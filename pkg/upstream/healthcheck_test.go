@@ -371,3 +371,25 @@ func TestActiveHealthCheck_ProbeCarriesScheme(t *testing.T) {
 		assert.Equal(t, "unix", *p, "the probe uses the configured Scheme for the dynamic Transport's dispatch")
 	}
 }
+
+func TestActiveHealthCheck_HealthyFraction(t *testing.T) {
+	t.Parallel()
+	targets := []*Target{{Host: "a"}, {Host: "b"}, {Host: "c"}, {Host: "d"}}
+	ahc := NewActiveHealthCheck(targets, NewRoundRobinLoadBalancer(targets))
+	check := ahc.ReadyCheck(0.5)
+
+	assert.Equal(t, 1.0, ahc.HealthyFraction(), "targets begin up")
+	assert.NoError(t, check(context.Background()))
+
+	ahc.up[0].Store(false)
+	ahc.up[1].Store(false)
+	assert.Equal(t, 0.5, ahc.HealthyFraction())
+	assert.NoError(t, check(context.Background()), "at the floor is still ready")
+
+	ahc.up[2].Store(false)
+	assert.Equal(t, 0.25, ahc.HealthyFraction())
+	assert.EqualError(t, check(context.Background()), "upstream: 25% of targets healthy, want at least 50%")
+
+	empty := NewActiveHealthCheck(nil, NewRoundRobinLoadBalancer(nil))
+	assert.Zero(t, empty.HealthyFraction(), "an empty pool is not healthy")
+}
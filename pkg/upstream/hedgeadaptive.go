@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Adaptive hedging defaults.
+const (
+	defaultHedgeWindow     = 30 * time.Second
+	defaultHedgeMinSamples = 100
+	defaultMinHedgeDelay   = time.Millisecond
+
+	// hedgeBudgetBurst caps the hedge tokens a quiet period can bank, so a long run
+	// of fast requests cannot pay for a sudden storm of hedges.
+	hedgeBudgetBurst = 10
+
+	// latency histogram layout: log-spaced buckets, latPerOctave per doubling from
+	// latMin, so a bucket is ~9% wide; latBuckets octaves reach past a minute.
+	latMin       = 100 * time.Microsecond
+	latPerOctave = 8
+	latBuckets   = 20 * latPerOctave
+
+	// latRecompute is how many samples pass between percentile recomputations once
+	// the histogram is warm; the hot path only ever reads the cached delay.
+	latRecompute = 16
+)
+
+// HedgeEvent classifies one hedging decision, reported via OnHedge.
+type HedgeEvent uint8
+
+const (
+	// HedgeLaunched: a hedge leg was sent (the primary is not counted).
+	HedgeLaunched HedgeEvent = iota + 1
+	// HedgeWon: a hedge leg, not the primary, won the race.
+	HedgeWon
+	// HedgeBudgetDenied: a hedge was due but HedgeBudget had no token for it.
+	HedgeBudgetDenied
+)
+
+// String returns the event's bounded metric label.
+func (e HedgeEvent) String() string {
+	switch e {
+	case HedgeLaunched:
+		return "launched"
+	case HedgeWon:
+		return "won"
+	case HedgeBudgetDenied:
+		return "budget_denied"
+	default:
+		return "unknown"
+	}
+}
+
+// HedgeInfo reports one hedging decision to a HedgeFunc.
+type HedgeInfo struct {
+	Event HedgeEvent
+	Delay time.Duration // the hedge delay in effect for the request
+}
+
+// HedgeFunc observes hedging decisions. Assign one to HedgingLoadBalancer.OnHedge —
+// see prom.Hedge. It is invoked synchronously on the request goroutine; the callee
+// owns its own concurrency. Nil disables it at zero hot-path cost.
+type HedgeFunc func(HedgeInfo)
+
+// latencyHistogram is a streaming, decaying latency histogram: two generations of
+// log-spaced atomic buckets, each covering one window (the srBucket epoch scheme),
+// so a percentile reflects the last one to two windows. The percentile is
+// recomputed every latRecompute samples and cached, so reading it is one load.
+type latencyHistogram struct {
+	window     int64 // nanos
+	minSamples uint64
+	percentile float64
+	gens       [2]latGen
+	cached     atomic.Int64 // nanos; 0 = not enough samples yet
+}
+
+type latGen struct {
+	epoch  atomic.Int64
+	total  atomic.Uint64
+	counts [latBuckets]atomic.Uint64
+}
+
+func latBucket(d time.Duration) int {
+	if d <= latMin {
+		return 0
+	}
+	i := int(math.Log2(float64(d)/float64(latMin)) * latPerOctave)
+	return min(i, latBuckets-1)
+}
+
+// latUpper is bucket i's upper bound, the value a percentile landing in it reports.
+func latUpper(i int) time.Duration {
+	return time.Duration(float64(latMin) * math.Exp2(float64(i+1)/latPerOctave))
+}
+
+func (h *latencyHistogram) record(now int64, d time.Duration) {
+	epoch := now / h.window
+	g := &h.gens[epoch%2]
+	if cur := g.epoch.Load(); cur != epoch && g.epoch.CompareAndSwap(cur, epoch) {
+		for i := range g.counts {
+			g.counts[i].Store(0)
+		}
+		g.total.Store(0)
+	}
+	g.counts[latBucket(d)].Add(1)
+	if g.total.Add(1)%latRecompute == 0 || h.cached.Load() == 0 { // every sample until warm
+		h.cached.Store(int64(h.quantile(epoch)))
+	}
+}
+
+// quantile returns the percentile over the generations still inside the window
+// ending at epoch, or 0 with fewer than minSamples samples.
+func (h *latencyHistogram) quantile(epoch int64) time.Duration {
+	var sum [latBuckets]uint64
+	var total uint64
+	for gi := range h.gens {
+		g := &h.gens[gi]
+		if e := g.epoch.Load(); e != epoch && e != epoch-1 {
+			continue
+		}
+		for i := range g.counts {
+			c := g.counts[i].Load()
+			sum[i] += c
+			total += c
+		}
+	}
+	if total == 0 || total < h.minSamples {
+		return 0
+	}
+	rank := uint64(math.Ceil(h.percentile * float64(total)))
+	var seen uint64
+	for i, c := range sum {
+		seen += c
+		if seen >= rank {
+			return latUpper(i)
+		}
+	}
+	return latUpper(latBuckets - 1)
+}
+
+// hedgeBudget is a token bucket in milli-tokens: every hedgeable primary deposits
+// ratio of a token, a hedge spends a whole one. It starts empty, so hedges never
+// exceed ratio x primaries.
+type hedgeBudget struct {
+	deposit int64 // milli-tokens per primary
+	tokens  atomic.Int64
+}
+
+func (b *hedgeBudget) credit() {
+	for {
+		cur := b.tokens.Load()
+		next := min(cur+b.deposit, hedgeBudgetBurst*1000)
+		if next == cur || b.tokens.CompareAndSwap(cur, next) {
+			return
+		}
+	}
+}
+
+func (b *hedgeBudget) spend() bool {
+	for {
+		cur := b.tokens.Load()
+		if cur < 1000 {
+			return false
+		}
+		if b.tokens.CompareAndSwap(cur, cur-1000) {
+			return true
+		}
+	}
+}
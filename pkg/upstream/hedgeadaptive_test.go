@@ -0,0 +1,182 @@
+package upstream
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type hedgeRecorder struct {
+	mu     sync.Mutex
+	events []HedgeEvent
+}
+
+func (h *hedgeRecorder) fn() HedgeFunc {
+	return func(info HedgeInfo) {
+		h.mu.Lock()
+		h.events = append(h.events, info.Event)
+		h.mu.Unlock()
+	}
+}
+
+func (h *hedgeRecorder) count(ev HedgeEvent) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, e := range h.events {
+		if e == ev {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	t.Parallel()
+
+	h := &latencyHistogram{window: int64(time.Minute), minSamples: 50, percentile: 0.95}
+	now := time.Now().UnixNano()
+	epoch := now / h.window
+	for i := 1; i <= 49; i++ {
+		h.record(now, time.Duration(i)*time.Millisecond)
+	}
+	assert.Zero(t, h.quantile(epoch), "fewer than minSamples is not trusted")
+
+	for i := 50; i <= 100; i++ {
+		h.record(now, time.Duration(i)*time.Millisecond)
+	}
+	q := h.quantile(epoch)
+	assert.InDelta(t, float64(95*time.Millisecond), float64(q), float64(10*time.Millisecond), "p95 of 1..100ms")
+	assert.InDelta(t, float64(q), float64(h.cached.Load()), float64(10*time.Millisecond),
+		"the cached delay is refreshed as samples arrive")
+
+	assert.Equal(t, q, h.quantile(epoch+1), "the previous window still counts")
+	assert.Zero(t, h.quantile(epoch+2), "samples two windows old have decayed")
+
+	assert.Equal(t, 0, latBucket(0))
+	assert.Equal(t, latBuckets-1, latBucket(time.Hour), "clamped to the last bucket")
+	for _, d := range []time.Duration{time.Millisecond, 37 * time.Millisecond, 2 * time.Second} {
+		assert.GreaterOrEqual(t, latUpper(latBucket(d)), d, "a bucket's upper bound covers its samples")
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	t.Parallel()
+
+	b := &hedgeBudget{deposit: 250}
+	assert.False(t, b.spend(), "starts empty")
+	for range 3 {
+		b.credit()
+	}
+	assert.False(t, b.spend())
+	b.credit()
+	assert.True(t, b.spend(), "four primaries at 25% pay for one hedge")
+	assert.False(t, b.spend())
+
+	for range 1000 {
+		b.credit()
+	}
+	n := 0
+	for b.spend() {
+		n++
+	}
+	assert.Equal(t, hedgeBudgetBurst, n, "a quiet period banks at most the burst")
+}
+
+func TestHedging_AdaptiveDelay(t *testing.T) {
+	t.Parallel()
+
+	f := &ctxFake{delay: 5 * time.Millisecond}
+	h := NewHedgingLoadBalancer(rrLB(f, f))
+	h.HedgePercentile = 0.9
+	h.HedgeMinSamples = 20
+	var rec hedgeRecorder
+	h.OnHedge = rec.fn()
+
+	assert.Zero(t, h.CurrentDelay(), "no fixed fallback: not hedged while warming up")
+	for range 20 {
+		resp, err := h.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 20, f.calls.Load(), "warm-up requests are timed, not hedged")
+	assert.Zero(t, rec.count(HedgeLaunched))
+
+	d := h.CurrentDelay()
+	assert.GreaterOrEqual(t, d, 5*time.Millisecond, "the delay tracks the observed latency")
+	assert.Less(t, d, time.Second)
+
+	h.MaxHedgeDelay = 2 * time.Millisecond
+	assert.Equal(t, 2*time.Millisecond, h.CurrentDelay(), "clamped to MaxHedgeDelay")
+}
+
+func TestHedging_AdaptiveWarmupFallback(t *testing.T) {
+	t.Parallel()
+
+	h := NewHedgingLoadBalancer(rrLB(&ctxFake{}))
+	h.HedgePercentile = 0.95
+	h.HedgeDelay = 40 * time.Millisecond
+	assert.Equal(t, 40*time.Millisecond, h.CurrentDelay(), "HedgeDelay until the histogram warms up")
+	assert.Equal(t, defaultHedgeMinSamples, h.HedgeMinSamples)
+	assert.Equal(t, defaultHedgeWindow, h.HedgeWindow)
+	assert.Equal(t, defaultMinHedgeDelay, h.MinHedgeDelay)
+}
+
+func TestHedging_Budget(t *testing.T) {
+	t.Parallel()
+
+	slow := &ctxFake{delay: 50 * time.Millisecond}
+	h := NewHedgingLoadBalancer(rrLB(slow, slow))
+	h.HedgeDelay = time.Millisecond
+	h.HedgeBudget = 0.25
+	var rec hedgeRecorder
+	h.OnHedge = rec.fn()
+
+	for range 20 {
+		resp, err := h.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, 5, rec.count(HedgeLaunched), "hedges never exceed 25% of primaries")
+	assert.Equal(t, 15, rec.count(HedgeBudgetDenied))
+	assert.EqualValues(t, 25, slow.calls.Load())
+}
+
+func TestHedging_HedgeWonEvent(t *testing.T) {
+	t.Parallel()
+
+	h := NewHedgingLoadBalancer(rrLB(&ctxFake{delay: time.Second}, &ctxFake{}))
+	h.HedgeDelay = 10 * time.Millisecond
+	var rec hedgeRecorder
+	h.OnHedge = rec.fn()
+
+	resp, err := h.RoundTrip(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, rec.count(HedgeLaunched))
+	assert.Equal(t, 1, rec.count(HedgeWon))
+}
+
+func TestHedging_BudgetDeniedOnErrorReturns(t *testing.T) {
+	t.Parallel()
+
+	fast := &ctxFake{}
+	h := NewHedgingLoadBalancer(rrLB(&ctxFake{err: errors.New("dial fail")}, fast))
+	h.HedgeDelay = 10 * time.Second
+	h.HedgeBudget = 0.01
+	var rec hedgeRecorder
+	h.OnHedge = rec.fn()
+
+	start := time.Now()
+	resp, err := h.RoundTrip(httptest.NewRequest("GET", "/", nil))
+	assert.Nil(t, resp)
+	assert.EqualError(t, err, "dial fail", "a refused fail-fast hedge surfaces the primary's error")
+	assert.Less(t, time.Since(start), h.HedgeDelay/2, "without waiting out HedgeDelay")
+	assert.Equal(t, 1, rec.count(HedgeBudgetDenied))
+	assert.Zero(t, fast.calls.Load())
+}
@@ -40,7 +40,15 @@ func NewHedgingLoadBalancer(next http.RoundTripper) *HedgingLoadBalancer {
 // share one reader — hedging a body-bearing request without per-leg GetBody rewind
 // would let a leg send a consumed/empty body. A request already inside the proxy's
 // retry loop is not additionally hedged — retries and hedges layer, never multiply.
-// HedgeDelay <= 0 disables hedging entirely (no timer, no clone, no goroutine).
+// HedgeDelay <= 0 with HedgePercentile unset disables hedging entirely (no timer,
+// no clone, no goroutine).
+//
+// Adaptive mode (HedgePercentile > 0) replaces the hand-tuned delay: the wrapper
+// keeps a streaming, decaying latency histogram of the wrapped balancer's
+// round-trips (time to headers, hedgeable requests only) and hedges at that
+// percentile of it, clamped to [MinHedgeDelay, MaxHedgeDelay]. HedgeBudget caps
+// hedges at a fraction of primary requests, so a slow pool cannot double its own
+// load.
 //
 // The wrapped balancer's Next.RoundTrip MUST honor request-context cancellation
 // (every transport in this package does): a hedge cancels the losing legs, so a
@@ -53,16 +61,45 @@ func NewHedgingLoadBalancer(next http.RoundTripper) *HedgingLoadBalancer {
 //
 //nolint:govet // fields grouped by role (state, then config) for readability
 type HedgingLoadBalancer struct {
-	once sync.Once
+	once   sync.Once
+	hist   *latencyHistogram // nil unless HedgePercentile > 0
+	budget *hedgeBudget      // nil unless HedgeBudget > 0
 
 	// Next is the wrapped balancer. Each attempt calls Next.RoundTrip, which picks
 	// and advances past a target, so a hedge lands on a different one.
 	Next http.RoundTripper
 
 	// HedgeDelay is how long to wait for the in-flight request before launching a
-	// hedge. <= 0 disables hedging (pure pass-through to Next.RoundTrip).
+	// hedge. <= 0 disables hedging (pure pass-through to Next.RoundTrip), unless
+	// HedgePercentile is set, where it is the delay used until the histogram has
+	// HedgeMinSamples (0 = don't hedge while warming up).
 	HedgeDelay time.Duration
 
+	// HedgePercentile, in (0,1], turns on adaptive mode: the hedge delay tracks this
+	// percentile (e.g. 0.95) of recent round-trip latencies. 0 uses the fixed
+	// HedgeDelay.
+	HedgePercentile float64
+
+	// HedgeWindow is the histogram decay window; the percentile covers the last one
+	// to two windows. Default 30s. Adaptive mode only.
+	HedgeWindow time.Duration
+
+	// HedgeMinSamples is the number of samples in the window before the percentile
+	// is trusted. Default 100. Adaptive mode only.
+	HedgeMinSamples int
+
+	// MinHedgeDelay and MaxHedgeDelay clamp the adaptive delay, so a very fast pool
+	// does not hedge on scheduling noise and a very slow one still hedges.
+	// MinHedgeDelay defaults to 1ms; MaxHedgeDelay 0 means no cap.
+	MinHedgeDelay time.Duration
+	MaxHedgeDelay time.Duration
+
+	// HedgeBudget caps hedges at this fraction of hedgeable primary requests (0.1 =
+	// at most one hedge per ten primaries, counted over the life of the wrapper with
+	// a small burst allowance). A hedge the budget refuses is simply not sent. 0
+	// means unlimited.
+	HedgeBudget float64
+
 	// MaxHedge is the number of extra speculative attempts beyond the original (each
 	// HedgeDelay-spaced). Defaults to 1 (at most one hedge -> 2x fan-out).
 	MaxHedge int
@@ -79,6 +116,10 @@ type HedgingLoadBalancer struct {
 	// IsWinner decides whether a leg's result wins the race; nil means "a response
 	// with no transport error". Set it to, say, only accept non-5xx.
 	IsWinner func(resp *http.Response, err error) bool
+
+	// OnHedge observes hedge launches, hedge wins and budget denials; nil disables
+	// it. See prom.Hedge.
+	OnHedge HedgeFunc
 }
 
 // hedgeResult is one leg's outcome. idx identifies the leg's cancel in the
@@ -94,6 +135,66 @@ func (l *HedgingLoadBalancer) init() {
 	if l.MaxHedge <= 0 {
 		l.MaxHedge = defaultMaxHedge
 	}
+	if l.HedgePercentile > 0 {
+		if l.HedgeWindow <= 0 {
+			l.HedgeWindow = defaultHedgeWindow
+		}
+		if l.HedgeMinSamples <= 0 {
+			l.HedgeMinSamples = defaultHedgeMinSamples
+		}
+		if l.MinHedgeDelay <= 0 {
+			l.MinHedgeDelay = defaultMinHedgeDelay
+		}
+		l.hist = &latencyHistogram{
+			window:     int64(l.HedgeWindow),
+			minSamples: uint64(l.HedgeMinSamples),
+			percentile: min(l.HedgePercentile, 1),
+		}
+	}
+	if l.HedgeBudget > 0 {
+		l.budget = &hedgeBudget{deposit: max(1, int64(l.HedgeBudget*1000))}
+	}
+}
+
+// CurrentDelay returns the hedge delay a request would use now: HedgeDelay, or in
+// adaptive mode the clamped percentile (HedgeDelay while warming up). 0 means a
+// request is not hedged.
+func (l *HedgingLoadBalancer) CurrentDelay() time.Duration {
+	l.once.Do(l.init)
+	if l.hist == nil {
+		return l.HedgeDelay
+	}
+	d := time.Duration(l.hist.cached.Load())
+	if d <= 0 {
+		return l.HedgeDelay
+	}
+	d = max(d, l.MinHedgeDelay)
+	if l.MaxHedgeDelay > 0 {
+		d = min(d, l.MaxHedgeDelay)
+	}
+	return d
+}
+
+// observeLatency feeds one leg's time to headers into the adaptive histogram. A
+// leg that failed is not a latency sample, except a primary the race cancelled:
+// its elapsed time is a lower bound on the slow answer it would have given, and
+// dropping it would bias the percentile down (so hedge sooner, so cancel more
+// primaries). A cancelled hedge is dropped for the mirror-image reason.
+func (l *HedgingLoadBalancer) observeLatency(legCtx context.Context, r *http.Request, idx int, start time.Time, err error) {
+	if l.hist == nil {
+		return
+	}
+	if err != nil && (idx != 0 || legCtx.Err() == nil || r.Context().Err() != nil) {
+		return
+	}
+	now := time.Now()
+	l.hist.record(now.UnixNano(), now.Sub(start))
+}
+
+func (l *HedgingLoadBalancer) emit(ev HedgeEvent, delay time.Duration) {
+	if l.OnHedge != nil {
+		l.OnHedge(HedgeInfo{Event: ev, Delay: delay})
+	}
 }
 
 func (l *HedgingLoadBalancer) hedgeable(r *http.Request) bool {
@@ -130,9 +231,20 @@ func (l *HedgingLoadBalancer) RoundTrip(r *http.Request) (*http.Response, error)
 
 	// Fast path: hedging off or request not eligible -> one plain call, no
 	// clone/goroutine/timer.
-	if l.HedgeDelay <= 0 || l.MaxHedge <= 0 || !l.hedgeable(r) {
+	if (l.HedgeDelay <= 0 && l.hist == nil) || l.MaxHedge <= 0 || !l.hedgeable(r) {
 		return l.Next.RoundTrip(r)
 	}
+	if l.budget != nil {
+		l.budget.credit()
+	}
+	delay := l.CurrentDelay()
+	if delay <= 0 {
+		// Adaptive mode still warming up with no fallback delay: a plain, timed call.
+		start := time.Now()
+		resp, err := l.Next.RoundTrip(r)
+		l.observeLatency(r.Context(), r, 0, start, err)
+		return resp, err
+	}
 
 	maxAttempts := l.MaxHedge + 1
 	results := make(chan hedgeResult, maxAttempts) // buffered: a late loser never blocks on send
@@ -147,18 +259,34 @@ func (l *HedgingLoadBalancer) RoundTrip(r *http.Request) (*http.Response, error)
 		cancels = append(cancels, legCancel)
 		req := r.Clone(legCtx) // deep-copies Header+URL: legs never share a Host or header slice
 		go func() {
+			start := time.Now()
 			resp, err := safeRoundTrip(l.Next, req)
+			l.observeLatency(legCtx, r, idx, start, err)
 			results <- hedgeResult{resp: resp, err: err, host: req.URL.Host, idx: idx}
 		}()
 	}
 
 	launched := 1
 	launch() // primary, immediately
-	timer := time.NewTimer(l.HedgeDelay)
+	timer := time.NewTimer(delay)
 	defer timer.Stop()
 
 	var firstErr error
 	received := 0
+	denied := false // the budget refused a hedge: launch no more for this request
+
+	// hedge launches the next hedge if the budget allows.
+	hedge := func() bool {
+		if l.budget != nil && !l.budget.spend() {
+			denied = true
+			l.emit(HedgeBudgetDenied, delay)
+			return false
+		}
+		launch()
+		launched++
+		l.emit(HedgeLaunched, delay)
+		return true
+	}
 
 	for {
 		select {
@@ -175,6 +303,9 @@ func (l *HedgingLoadBalancer) RoundTrip(r *http.Request) (*http.Response, error)
 					}
 				}
 				go reap(results, launched-received)
+				if res.idx > 0 {
+					l.emit(HedgeWon, delay)
+				}
 				return wrapWinner(res.resp, cancels[res.idx]), nil
 			}
 			// Loser: a transport error, or IsWinner==false.
@@ -183,31 +314,17 @@ func (l *HedgingLoadBalancer) RoundTrip(r *http.Request) (*http.Response, error)
 			if firstErr == nil {
 				firstErr = res.err
 			}
-			if received == maxAttempts {
-				// Every attempt finished without a winner: surface the first error so the
-				// Upstream ErrorHandler maps it (ErrUnavailable->503, else ->502).
-				if firstErr == nil {
-					firstErr = ErrUnavailable
-				}
-				return nil, firstErr
-			}
 			// Fail-fast: an attempt errored and a hedge slot remains -> launch now.
-			if l.HedgeOnError && launched < maxAttempts {
+			if l.HedgeOnError && !denied && launched < maxAttempts {
 				stopDrain(timer)
-				launch()
-				launched++
-				if launched < maxAttempts {
-					timer.Reset(l.HedgeDelay)
+				if hedge() && launched < maxAttempts {
+					timer.Reset(delay)
 				}
 			}
 
 		case <-timer.C:
-			if launched < maxAttempts {
-				launch()
-				launched++
-				if launched < maxAttempts {
-					timer.Reset(l.HedgeDelay) // remaining hedges fire every HedgeDelay
-				}
+			if !denied && launched < maxAttempts && hedge() && launched < maxAttempts {
+				timer.Reset(delay) // remaining hedges fire every delay
 			}
 
 		case <-r.Context().Done():
@@ -218,6 +335,16 @@ func (l *HedgingLoadBalancer) RoundTrip(r *http.Request) (*http.Response, error)
 			go reap(results, launched-received)
 			return nil, r.Context().Err()
 		}
+
+		if received == launched && (launched == maxAttempts || denied) {
+			// Every attempt finished without a winner and no hedge can follow: surface
+			// the first error so the Upstream ErrorHandler maps it (ErrUnavailable->503,
+			// else ->502).
+			if firstErr == nil {
+				firstErr = ErrUnavailable
+			}
+			return nil, firstErr
+		}
 	}
 }
 
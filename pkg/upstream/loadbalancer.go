@@ -41,6 +41,11 @@ type Target struct {
 	// MaxConcurrent stalled requests the target sheds all traffic permanently — the
 	// cap becomes a latch, not a limiter.
 	MaxConcurrent int
+
+	// Probe overrides ActiveHealthCheck's probe settings for this target (probe
+	// type, address, path, assertions, interval, ...); nil probes it like the rest
+	// of the pool. Balancers ignore it.
+	Probe *Probe
 }
 
 // effectiveWeight normalizes a target's weight for the weighted balancers: a
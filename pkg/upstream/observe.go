@@ -30,15 +30,31 @@ type RoundTripInfo struct {
 	// regardless of that response's status code.
 	Err error
 
+	// ErrorKind classifies Err (see ClassifyError) — the bounded form of it to
+	// label metrics with. It is KindNone when Err is nil.
+	ErrorKind ErrorKind
+
 	// Attempt is the zero-based retry index: 0 on the first try, 1 on the first
 	// retry, and so on (read from the proxy's retry context). Existing observers
 	// simply see a new zero-valued field.
 	Attempt int
+
+	// GRPC is set for a native gRPC call (see IsGRPC); the fields below are only
+	// meaningful then. GRPCService and GRPCMethod are parsed from the request path,
+	// so they come from the CLIENT and are unbounded — see prom.Upstream for how they
+	// are labelled safely. GRPCStatus is the call's status: the origin's
+	// grpc-status, or the status the proxy answered with on a transport error.
+	GRPC        bool
+	GRPCService string
+	GRPCMethod  string
+	GRPCStatus  GRPCCode
 }
 
 // RoundTripFunc observes an upstream round-trip. Assign one to Upstream.OnRoundTrip
 // to make the origin observable — see prom.Upstream for Prometheus metrics. It is
 // invoked once per attempt (including each retry), synchronously on the request
 // goroutine, right after the transport returns and before the response unwinds back
-// through the proxy. The callee owns its own concurrency.
+// through the proxy. A gRPC call that streams a body is the exception: its status
+// arrives in the trailers, so it fires once the body ends. The callee owns its own
+// concurrency.
 type RoundTripFunc func(r *http.Request, info RoundTripInfo)
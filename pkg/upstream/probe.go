@@ -0,0 +1,367 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Probe limits.
+const (
+	// probeBodyLimit bounds how much of a probe response body is read for the
+	// ExpectBody / ExpectBodyRegexp assertions; the match runs on this prefix.
+	probeBodyLimit = 64 << 10 // 64 KiB
+
+	grpcHealthPath   = "/grpc.health.v1.Health/Check"
+	grpcServing      = 1 // grpc.health.v1.HealthCheckResponse.ServingStatus SERVING
+	grpcFrameHeader  = 5 // compressed flag + 4-byte big-endian length
+	grpcProbeMaxBody = 4 << 10
+)
+
+// ProbeType selects how ActiveHealthCheck probes a target. The zero value means
+// ProbeHTTP on ActiveHealthCheck, and "inherit" on a Target.Probe.
+type ProbeType uint8
+
+const (
+	// ProbeHTTP sends an HTTP request through the target's transport (or
+	// ProbeTransport) and judges the response. The default.
+	ProbeHTTP ProbeType = iota + 1
+
+	// ProbeTCP only opens (and closes) a TCP connection to the target: up if the
+	// connect succeeds. It needs no HTTP endpoint, but proves only that something
+	// is listening. A Host (or Probe.Addr) containing a slash is dialed as a unix
+	// socket.
+	ProbeTCP
+
+	// ProbeGRPC calls the standard grpc.health.v1.Health/Check RPC (service
+	// GRPCService) through the target's transport: up only on grpc-status OK and
+	// status SERVING. The transport must speak HTTP/2 to the target — H2CTransport,
+	// HTTPSTransport, or the dynamic Transport with Scheme "h2c"/"https".
+	ProbeGRPC
+)
+
+// Probe overrides ActiveHealthCheck's probe for one target (Target.Probe). Every
+// zero field inherits the ActiveHealthCheck's value, so an override names only
+// what differs — e.g. a separate health port, or a gRPC target in an HTTP pool.
+// Header and ExpectHeader replace (not merge with) the pool-wide maps when set.
+//
+//nolint:govet // fields grouped by probe type for readability
+type Probe struct {
+	Type ProbeType
+
+	// Addr is the address probed instead of Target.Host (e.g. "10.0.0.1:9090" for a
+	// dedicated health port). The data path is unaffected.
+	Addr string
+
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// HTTP and gRPC.
+	Scheme string
+	Host   string
+	Header http.Header
+
+	// HTTP only.
+	Path             string
+	Method           string
+	ExpectBody       string
+	ExpectBodyRegexp *regexp.Regexp
+	ExpectHeader     http.Header
+
+	// gRPC only.
+	GRPCService string
+}
+
+// resolveProbe merges a target's override onto the pool-wide probe.
+func (a *ActiveHealthCheck) resolveProbe(t *Target) *Probe {
+	p := &Probe{
+		Type:             a.Type,
+		Addr:             t.Host,
+		Interval:         a.Interval,
+		Timeout:          a.Timeout,
+		Scheme:           a.Scheme,
+		Host:             a.Host,
+		Header:           a.Header,
+		Path:             a.Path,
+		Method:           a.Method,
+		ExpectBody:       a.ExpectBody,
+		ExpectBodyRegexp: a.ExpectBodyRegexp,
+		ExpectHeader:     a.ExpectHeader,
+		GRPCService:      a.GRPCService,
+	}
+	o := t.Probe
+	if o == nil {
+		return p
+	}
+	if o.Type != 0 {
+		p.Type = o.Type
+	}
+	if o.Addr != "" {
+		p.Addr = o.Addr
+	}
+	if o.Interval > 0 {
+		p.Interval = o.Interval
+	}
+	if o.Timeout > 0 {
+		p.Timeout = o.Timeout
+	}
+	if o.Scheme != "" {
+		p.Scheme = o.Scheme
+	}
+	if o.Host != "" {
+		p.Host = o.Host
+	}
+	if o.Header != nil {
+		p.Header = o.Header
+	}
+	if o.Path != "" {
+		p.Path = o.Path
+		if p.Path[0] != '/' {
+			p.Path = "/" + p.Path
+		}
+	}
+	if o.Method != "" {
+		p.Method = o.Method
+	}
+	if o.ExpectBody != "" {
+		p.ExpectBody = o.ExpectBody
+	}
+	if o.ExpectBodyRegexp != nil {
+		p.ExpectBodyRegexp = o.ExpectBodyRegexp
+	}
+	if o.ExpectHeader != nil {
+		p.ExpectHeader = o.ExpectHeader
+	}
+	if o.GRPCService != "" {
+		p.GRPCService = o.GRPCService
+	}
+	return p
+}
+
+// nextInterval returns the wait before pt's next probe: Interval spread uniformly
+// over +/- Jitter/2 of itself, so probers started together drift apart instead of
+// hitting every target (and every proxy's targets) on the same tick.
+func (a *ActiveHealthCheck) nextInterval(pt *probeTarget) time.Duration {
+	d := pt.probe.Interval
+	if a.Jitter <= 0 {
+		return d
+	}
+	spread := float64(d) * a.Jitter
+	return time.Duration(float64(d) - spread/2 + rand.Float64()*spread)
+}
+
+// probeTransport is the RoundTripper an HTTP or gRPC probe goes through.
+func (a *ActiveHealthCheck) probeTransport(pt *probeTarget) http.RoundTripper {
+	if a.ProbeTransport != nil {
+		return a.ProbeTransport
+	}
+	return pt.target.Transport
+}
+
+// newProbeRequest builds a probe request for p. It builds with a placeholder
+// authority, then assigns the real address and scheme directly (as the balancers
+// do, r.URL.Host = t.Host) so a unix-socket path Host is never parsed from a URL
+// string, and the dynamic Transport dispatches on the right scheme.
+func newProbeRequest(ctx context.Context, p *Probe, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+probePlaceholderHost+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Scheme = p.Scheme
+	req.URL.Host = p.Addr
+	// With no Host override, derive the Host header from URL.Host (the probed
+	// address), not the placeholder. Note this differs from the data path (which
+	// forwards the client's Host): set Host for a backend that vhost-routes.
+	req.Host = p.Host
+	for k, vs := range p.Header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	return req, nil
+}
+
+// probeHTTP sends one HTTP probe and judges it: IsHealthy (or status < 400), then
+// ExpectHeader, then the body assertions.
+func (a *ActiveHealthCheck) probeHTTP(ctx context.Context, pt *probeTarget) (bool, ProbeCause) {
+	p := pt.probe
+	req, err := newProbeRequest(ctx, p, p.Method, p.Path, http.NoBody)
+	if err != nil {
+		return false, CauseError // a malformed request config is a real failure
+	}
+
+	resp, rerr := a.probeTransport(pt).RoundTrip(req)
+	if resp != nil && resp.Body != nil {
+		defer func() {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, probeDrainLimit))
+			_ = resp.Body.Close()
+		}()
+	}
+	if !a.healthy(resp, rerr) {
+		return false, classifyProbeCause(resp, rerr)
+	}
+	if resp == nil {
+		return true, CauseNone // a custom IsHealthy accepted a transport error
+	}
+	if !headerMatches(resp.Header, p.ExpectHeader) {
+		return false, CauseHeader
+	}
+	if p.ExpectBody == "" && p.ExpectBodyRegexp == nil {
+		return true, CauseNone
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, probeBodyLimit))
+	if err != nil {
+		return false, classifyProbeCause(nil, err)
+	}
+	if p.ExpectBody != "" && !bytes.Contains(body, []byte(p.ExpectBody)) {
+		return false, CauseBody
+	}
+	if p.ExpectBodyRegexp != nil && !p.ExpectBodyRegexp.Match(body) {
+		return false, CauseBody
+	}
+	return true, CauseNone
+}
+
+// headerMatches reports whether h carries every header in want. An empty value
+// list only requires the header be present; otherwise one of h's values must equal
+// one of want's.
+func headerMatches(h, want http.Header) bool {
+	for k, vs := range want {
+		got := h.Values(k)
+		if len(got) == 0 {
+			return false
+		}
+		if len(vs) > 0 && !slices.ContainsFunc(got, func(g string) bool { return slices.Contains(vs, g) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// probeTCP opens and closes one connection to the probed address.
+func (a *ActiveHealthCheck) probeTCP(ctx context.Context, pt *probeTarget) (bool, ProbeCause) {
+	network, addr := dialNetwork(pt.probe.Addr)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return false, classifyProbeCause(nil, err)
+	}
+	_ = conn.Close()
+	return true, CauseNone
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check and requires SERVING.
+func (a *ActiveHealthCheck) probeGRPC(ctx context.Context, pt *probeTarget) (bool, ProbeCause) {
+	p := pt.probe
+	req, err := newProbeRequest(ctx, p, http.MethodPost, grpcHealthPath, bytes.NewReader(grpcHealthRequest(p.GRPCService)))
+	if err != nil {
+		return false, CauseError
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := a.probeTransport(pt).RoundTrip(req)
+	if err != nil {
+		return false, classifyProbeCause(nil, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, CauseStatus
+	}
+	// Read to EOF (bounded) so the trailers are populated.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, grpcProbeMaxBody))
+	if err != nil {
+		return false, classifyProbeCause(nil, err)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status") // trailers-only response
+	}
+	if status != "0" {
+		return false, CauseStatus // the RPC itself failed (e.g. UNIMPLEMENTED: no health service)
+	}
+	if s, ok := grpcServingStatus(body); !ok || s != grpcServing {
+		return false, CauseNotServing
+	}
+	return true, CauseNone
+}
+
+// grpcHealthRequest encodes a length-prefixed grpc.health.v1.HealthCheckRequest
+// message: field 1 (service) as a length-delimited string.
+func grpcHealthRequest(service string) []byte {
+	msg := make([]byte, 0, len(service)+binary.MaxVarintLen64+1)
+	if service != "" {
+		msg = append(msg, 0x0a) // field 1, wire type 2
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	b := make([]byte, grpcFrameHeader, grpcFrameHeader+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+var errGRPCFrame = errors.New("upstream: malformed grpc health response")
+
+// grpcServingStatus decodes the status (field 1) of a length-prefixed
+// grpc.health.v1.HealthCheckResponse. An absent field is UNKNOWN (0).
+func grpcServingStatus(b []byte) (uint64, bool) {
+	if len(b) < grpcFrameHeader || b[0] != 0 {
+		return 0, false // short, or compressed (never requested)
+	}
+	n := binary.BigEndian.Uint32(b[1:grpcFrameHeader])
+	msg := b[grpcFrameHeader:]
+	if uint64(n) > uint64(len(msg)) {
+		return 0, false
+	}
+	msg = msg[:n]
+
+	var status uint64
+	for len(msg) > 0 {
+		tag, k := binary.Uvarint(msg)
+		if k <= 0 {
+			return 0, false
+		}
+		msg = msg[k:]
+		var err error
+		switch field, wire := tag>>3, tag&7; wire {
+		case 0:
+			v, k := binary.Uvarint(msg)
+			if k <= 0 {
+				return 0, false
+			}
+			msg = msg[k:]
+			if field == 1 {
+				status = v
+			}
+		case 1:
+			msg, err = skipBytes(msg, 8)
+		case 2:
+			l, k := binary.Uvarint(msg)
+			if k <= 0 {
+				return 0, false
+			}
+			msg, err = skipBytes(msg[k:], l)
+		case 5:
+			msg, err = skipBytes(msg, 4)
+		default:
+			return 0, false
+		}
+		if err != nil {
+			return 0, false
+		}
+	}
+	return status, true
+}
+
+func skipBytes(b []byte, n uint64) ([]byte, error) {
+	if n > uint64(len(b)) {
+		return nil, errGRPCFrame
+	}
+	return b[n:], nil
+}
@@ -0,0 +1,273 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type probeRT func(*http.Request) (*http.Response, error)
+
+func (f probeRT) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// probePeer builds a probe target whose config a (after init) resolves.
+func probePeer(a *ActiveHealthCheck, t *Target) *probeTarget {
+	a.init()
+	return &probeTarget{target: t, probe: a.resolveProbe(t), up: new(atomic.Bool)}
+}
+
+func TestProbeHTTP_Assertions(t *testing.T) {
+	t.Parallel()
+
+	var got *http.Request
+	rt := probeRT(func(r *http.Request) (*http.Response, error) {
+		got = r
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Role", "primary")
+		io.WriteString(w, `{"status":"ok","db":"up"}`)
+		return w.Result(), nil
+	})
+
+	cases := []struct {
+		name  string
+		setup func(*ActiveHealthCheck)
+		ok    bool
+		cause ProbeCause
+	}{
+		{"plain", func(*ActiveHealthCheck) {}, true, CauseNone},
+		{"body substring", func(a *ActiveHealthCheck) { a.ExpectBody = `"db":"up"` }, true, CauseNone},
+		{"body substring miss", func(a *ActiveHealthCheck) { a.ExpectBody = `"db":"down"` }, false, CauseBody},
+		{"body regexp", func(a *ActiveHealthCheck) { a.ExpectBodyRegexp = regexp.MustCompile(`"status":\s*"ok"`) }, true, CauseNone},
+		{"body regexp miss", func(a *ActiveHealthCheck) { a.ExpectBodyRegexp = regexp.MustCompile(`degraded`) }, false, CauseBody},
+		{"header present", func(a *ActiveHealthCheck) { a.ExpectHeader = http.Header{"X-Role": nil} }, true, CauseNone},
+		{"header value", func(a *ActiveHealthCheck) { a.ExpectHeader = http.Header{"X-Role": {"replica", "primary"}} }, true, CauseNone},
+		{"header value miss", func(a *ActiveHealthCheck) { a.ExpectHeader = http.Header{"X-Role": {"replica"}} }, false, CauseHeader},
+		{"header missing", func(a *ActiveHealthCheck) { a.ExpectHeader = http.Header{"X-Ready": nil} }, false, CauseHeader},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ActiveHealthCheck{}
+			tc.setup(a)
+			pt := probePeer(a, &Target{Host: "10.0.0.1:8080", Transport: rt})
+			ok, cause := a.probeHTTP(context.Background(), pt)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.cause, cause)
+		})
+	}
+
+	t.Run("request headers and Host", func(t *testing.T) {
+		a := &ActiveHealthCheck{
+			Path:   "/healthz",
+			Host:   "api.internal",
+			Header: http.Header{"Authorization": {"Bearer probe"}},
+		}
+		pt := probePeer(a, &Target{Host: "10.0.0.1:8080", Transport: rt})
+		ok, _ := a.probeHTTP(context.Background(), pt)
+		require.True(t, ok)
+		assert.Equal(t, "api.internal", got.Host)
+		assert.Equal(t, "10.0.0.1:8080", got.URL.Host, "the probe still dials the target")
+		assert.Equal(t, "/healthz", got.URL.Path)
+		assert.Equal(t, "Bearer probe", got.Header.Get("Authorization"))
+	})
+}
+
+func TestProbeTCP(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+
+	a := &ActiveHealthCheck{Type: ProbeTCP}
+	pt := probePeer(a, &Target{Host: addr})
+	ok, cause := a.probeTCP(context.Background(), pt)
+	assert.True(t, ok)
+	assert.Equal(t, CauseNone, cause)
+
+	ln.Close()
+	ok, cause = a.probeTCP(context.Background(), pt)
+	assert.False(t, ok)
+	assert.Equal(t, CauseRefused, cause)
+}
+
+// grpcHealthServer is an in-process grpc.health.v1 server over h2c: services maps
+// a service name to its ServingStatus; an unknown name answers NOT_FOUND (5).
+func grpcHealthServer(t *testing.T, services map[string]uint64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcHealthPath || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		var service string
+		if len(b) > grpcFrameHeader+2 {
+			service = string(b[grpcFrameHeader+2:]) // tag, 1-byte length, name
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		status, ok := services[service]
+		if !ok {
+			w.Header().Set("Grpc-Status", "5") // trailers-only: NOT_FOUND
+			return
+		}
+		msg := binary.AppendUvarint([]byte{0x08}, status)
+		frame := make([]byte, grpcFrameHeader)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProbeGRPC(t *testing.T) {
+	t.Parallel()
+
+	srv := grpcHealthServer(t, map[string]uint64{"": 1, "api.v1.Users": 1, "api.v1.Billing": 2})
+	target := &Target{Host: strings.TrimPrefix(srv.URL, "http://"), Transport: &H2CTransport{}}
+
+	for _, tc := range []struct {
+		service string
+		ok      bool
+		cause   ProbeCause
+	}{
+		{"", true, CauseNone},
+		{"api.v1.Users", true, CauseNone},
+		{"api.v1.Billing", false, CauseNotServing},
+		{"api.v1.Missing", false, CauseStatus},
+	} {
+		a := &ActiveHealthCheck{Type: ProbeGRPC, GRPCService: tc.service}
+		pt := probePeer(a, target)
+		ok, cause := a.probeGRPC(context.Background(), pt)
+		assert.Equal(t, tc.ok, ok, "service %q", tc.service)
+		assert.Equal(t, tc.cause, cause, "service %q", tc.service)
+	}
+}
+
+func TestGRPCServingStatus(t *testing.T) {
+	t.Parallel()
+
+	frame := func(msg ...byte) []byte {
+		b := make([]byte, grpcFrameHeader, grpcFrameHeader+len(msg))
+		binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+		return append(b, msg...)
+	}
+
+	s, ok := grpcServingStatus(frame(0x08, 0x01))
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, s)
+
+	s, ok = grpcServingStatus(frame(0x12, 0x02, 'h', 'i', 0x08, 0x02)) // unknown field 2 skipped
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, s)
+
+	s, ok = grpcServingStatus(frame())
+	assert.True(t, ok)
+	assert.EqualValues(t, 0, s, "an absent status is UNKNOWN")
+
+	_, ok = grpcServingStatus([]byte{0, 0, 0})
+	assert.False(t, ok, "short frame")
+	_, ok = grpcServingStatus(frame(0x12, 0x09, 'x'))
+	assert.False(t, ok, "truncated field")
+
+	req := grpcHealthRequest("svc")
+	assert.Equal(t, []byte{0, 0, 0, 0, 5, 0x0a, 3, 's', 'v', 'c'}, req)
+}
+
+func TestActiveHealthCheck_PerTargetProbe(t *testing.T) {
+	t.Parallel()
+
+	a := &ActiveHealthCheck{
+		Path:         "/hz",
+		Interval:     time.Second,
+		Header:       http.Header{"X-Pool": {"1"}},
+		ExpectBody:   "ok",
+		ExpectHeader: http.Header{"X-Ready": nil},
+	}
+	a.init()
+
+	p := a.resolveProbe(&Target{Host: "a:80"})
+	assert.Equal(t, ProbeHTTP, p.Type)
+	assert.Equal(t, "a:80", p.Addr)
+	assert.Equal(t, "/hz", p.Path)
+	assert.Equal(t, time.Second, p.Interval)
+
+	p = a.resolveProbe(&Target{Host: "b:80", Probe: &Probe{
+		Type:     ProbeGRPC,
+		Addr:     "b:9090",
+		Interval: 3 * time.Second,
+		Header:   http.Header{"X-Other": {"2"}},
+	}})
+	assert.Equal(t, ProbeGRPC, p.Type)
+	assert.Equal(t, "b:9090", p.Addr, "the override address replaces the target's")
+	assert.Equal(t, 3*time.Second, p.Interval)
+	assert.Equal(t, a.Timeout, p.Timeout, "an unset override field inherits")
+	assert.Equal(t, http.Header{"X-Other": {"2"}}, p.Header, "header maps replace, not merge")
+	assert.Equal(t, "ok", p.ExpectBody)
+}
+
+func TestActiveHealthCheck_PerTargetProbeRuns(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	httpHC := &healthFake{healthPath: "/hz"}
+	failing := &healthFake{healthPath: "/hz"}
+	failing.status.Store(500) // an HTTP probe would keep this target down
+	targets := []*Target{
+		{Host: "http-target", Transport: httpHC},
+		{Host: "tcp-target", Transport: failing, Probe: &Probe{Type: ProbeTCP, Addr: ln.Addr().String()}},
+	}
+	ahc := NewActiveHealthCheck(targets, NewRoundRobinLoadBalancer(targets))
+	ahc.Path = "/hz"
+	ahc.Interval = 5 * time.Millisecond
+	ahc.StartUnhealthy = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ahc.Start(ctx)
+	defer ahc.Close()
+
+	require.Eventually(t, func() bool { return ahc.up[0].Load() && ahc.up[1].Load() }, 2*time.Second, 5*time.Millisecond)
+	assert.Positive(t, httpHC.probes.Load())
+	assert.Zero(t, failing.probes.Load(), "the TCP-probed target's transport never sees a probe")
+}
+
+func TestActiveHealthCheck_Jitter(t *testing.T) {
+	t.Parallel()
+
+	a := &ActiveHealthCheck{Interval: time.Second, Jitter: 0.2}
+	pt := probePeer(a, &Target{Host: "a"})
+	seen := map[time.Duration]bool{}
+	for range 100 {
+		d := a.nextInterval(pt)
+		assert.GreaterOrEqual(t, d, 900*time.Millisecond)
+		assert.LessOrEqual(t, d, 1100*time.Millisecond)
+		seen[d] = true
+	}
+	assert.Greater(t, len(seen), 1, "jittered intervals vary")
+
+	a = &ActiveHealthCheck{Interval: time.Second}
+	pt = probePeer(a, &Target{Host: "a"})
+	assert.Equal(t, time.Second, a.nextInterval(pt), "no jitter by default")
+
+	a = &ActiveHealthCheck{Jitter: 5}
+	a.init()
+	assert.Equal(t, 1.0, a.Jitter, "clamped to 1")
+}
@@ -1,10 +1,10 @@
 package upstream
 
 // State is a reliability balancer's per-target health state, reported via
-// OnStateChange. The circuit breaker uses all three; EjectingLoadBalancer and
-// LatencyEjectingLoadBalancer use only StateClosed (in rotation) and StateOpen
-// (ejected). The numeric value doubles as the Prometheus gauge value exported by
-// prom.UpstreamState.
+// OnStateChange. The circuit breaker uses all three; EjectingLoadBalancer,
+// LatencyEjectingLoadBalancer and SuccessRateEjectingLoadBalancer use only
+// StateClosed (in rotation) and StateOpen (ejected). The numeric value doubles as
+// the Prometheus gauge value exported by prom.UpstreamState.
 type State uint8
 
 const (
@@ -73,14 +73,17 @@ func (r Reason) String() string {
 type ProbeCause uint8
 
 const (
-	CauseNone    ProbeCause = iota // not a probe-down event (the zero value)
-	CauseTimeout                   // per-probe Timeout deadline fired (context.DeadlineExceeded / net.Error.Timeout)
-	CauseRefused                   // connection refused (syscall.ECONNREFUSED): nothing listening
-	CauseReset                     // connection reset / closed mid-probe (syscall.ECONNRESET, io.EOF, io.ErrUnexpectedEOF)
-	CauseDNS                       // name resolution failed (*net.DNSError)
-	CauseTLS                       // TLS handshake / certificate failure (tls.RecordHeaderError, *tls.CertificateVerificationError)
-	CauseStatus                    // a response arrived but healthy() rejected it (e.g. status >= 400)
-	CauseError                     // any other transport error (catch-all, keeps the set closed)
+	CauseNone       ProbeCause = iota // not a probe-down event (the zero value)
+	CauseTimeout                      // per-probe Timeout deadline fired (context.DeadlineExceeded / net.Error.Timeout)
+	CauseRefused                      // connection refused (syscall.ECONNREFUSED): nothing listening
+	CauseReset                        // connection reset / closed mid-probe (syscall.ECONNRESET, io.EOF, io.ErrUnexpectedEOF)
+	CauseDNS                          // name resolution failed (*net.DNSError)
+	CauseTLS                          // TLS handshake / certificate failure (tls.RecordHeaderError, tls.AlertError, *tls.CertificateVerificationError)
+	CauseStatus                       // a response arrived but healthy() rejected it (e.g. status >= 400), or a gRPC probe's RPC failed
+	CauseError                        // any other transport error (catch-all, keeps the set closed)
+	CauseHeader                       // an HTTP probe response lacked a required header (ExpectHeader)
+	CauseBody                         // an HTTP probe response body did not match (ExpectBody / ExpectBodyRegexp)
+	CauseNotServing                   // a gRPC health probe answered, but not SERVING
 )
 
 func (c ProbeCause) String() string {
@@ -99,6 +102,12 @@ func (c ProbeCause) String() string {
 		return "status"
 	case CauseError:
 		return "error"
+	case CauseHeader:
+		return "header"
+	case CauseBody:
+		return "body"
+	case CauseNotServing:
+		return "not_serving"
 	default:
 		return "none"
 	}
@@ -38,14 +38,17 @@ func TestReasonString(t *testing.T) {
 func TestProbeCauseString(t *testing.T) {
 	t.Parallel()
 	for c, s := range map[ProbeCause]string{
-		CauseNone:    "none",
-		CauseTimeout: "timeout",
-		CauseRefused: "refused",
-		CauseReset:   "reset",
-		CauseDNS:     "dns",
-		CauseTLS:     "tls",
-		CauseStatus:  "status",
-		CauseError:   "error",
+		CauseNone:       "none",
+		CauseTimeout:    "timeout",
+		CauseRefused:    "refused",
+		CauseReset:      "reset",
+		CauseDNS:        "dns",
+		CauseTLS:        "tls",
+		CauseStatus:     "status",
+		CauseError:      "error",
+		CauseHeader:     "header",
+		CauseBody:       "body",
+		CauseNotServing: "not_serving",
 	} {
 		assert.Equal(t, s, c.String())
 	}
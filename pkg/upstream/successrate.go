@@ -0,0 +1,411 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Success-rate ejecting load balancer defaults.
+const (
+	defaultSRWindow      = 30 * time.Second
+	defaultSRMinRequests = 100
+	defaultSRMinHosts    = 5
+	defaultSRStdevFactor = 1.9
+	defaultSRMinDelta    = 0.05
+	// MaxEjectionPercent reuses latencyejecting.go's defaultMaxEjectionPercent (30);
+	// EjectTimeout / MaxEjectTimeout reuse ejecting.go's defaultEjectTimeout (30s)
+	// and defaultMaxEjectTimeout (5m).
+)
+
+// srBuckets is the number of buckets the sliding window is split into; the window
+// slides one bucket (Window/srBuckets) at a time.
+const srBuckets = 10
+
+// NewSuccessRateEjectingLoadBalancer creates a round-robin load balancer with
+// passive success-rate-based outlier ejection.
+func NewSuccessRateEjectingLoadBalancer(targets []*Target) *SuccessRateEjectingLoadBalancer {
+	return &SuccessRateEjectingLoadBalancer{Targets: targets}
+}
+
+// SuccessRateEjectingLoadBalancer is a round-robin load balancer that ejects a
+// target whose error ratio over a sliding Window stands out — the host that fails
+// one request in five interleaved with successes, which never strings together
+// EjectingLoadBalancer's consecutive failures.
+//
+// By default detection is relative-to-pool (Envoy's success-rate outlier
+// detection): a target whose success rate is below the pool mean minus
+// StdevFactor standard deviations, and at least MinEjectDelta below it, is
+// ejected. That needs a baseline, so only targets with at least MinRequests in
+// the window take part, and a pool with fewer than MinHosts such targets never
+// ejects. Setting FailureThreshold switches
+// to an absolute rule instead: a target whose error ratio reaches it is ejected
+// whatever its peers look like.
+//
+// An ejected target is skipped for a backed-off cooldown, reusing
+// EjectingLoadBalancer's eject mechanics; its window is cleared, so after the
+// cooldown it must re-accumulate MinRequests before it is judged again. It heals
+// (ReasonRecover) on a later success once it is judged back within tolerance. At
+// most MaxEjectionPercent of the pool is ejected at once, and if every target is
+// out the balancer fails open and routes anyway.
+//
+// Like the other error balancers, what counts as a failure is IsFailure's call;
+// by default a transport error other than a client cancel or an adaptive-limit
+// shed (ErrLimited). Weight is ignored. State is per-target atomics; the hot path
+// is lock-free. Configuration fields are read once; set them before serving.
+//
+//nolint:govet // fields grouped by role (state, then config) for readability
+type SuccessRateEjectingLoadBalancer struct {
+	once   sync.Once
+	i      atomic.Uint32 // round-robin cursor
+	bucket int64         // Window / srBuckets, ns; computed in init
+	peers  []srPeer      // per-target state, built in init
+	gate   []atomic.Bool // active-HC gate; nil = all up (installed before serving)
+
+	// Targets is the set of upstreams to balance across.
+	Targets []*Target
+
+	// Window is the span of the sliding window a target's error ratio is measured
+	// over. Defaults to 30s.
+	Window time.Duration
+
+	// MinRequests is the number of round-trips a target needs in the window before
+	// it is judged or counts toward the pool baseline. Defaults to 100.
+	MinRequests uint64
+
+	// MinHosts is the minimum number of targets with MinRequests for a valid pool
+	// baseline; a pool with fewer never ejects on the relative rule. Ignored when
+	// FailureThreshold is set. Defaults to 5.
+	MinHosts int
+
+	// StdevFactor ejects a target whose success rate is below the pool mean minus
+	// this many standard deviations. Lower is more aggressive. Defaults to 1.9.
+	StdevFactor float64
+
+	// MinEjectDelta is an absolute floor on the relative rule: a target must also be
+	// at least this far below the pool mean success rate (0.05 = five points) to be
+	// ejected. Without it a pool where every target is near-perfect ejects whichever
+	// is a hair worse — the spread is tiny, so any gap is many deviations wide.
+	// Defaults to 0.05.
+	MinEjectDelta float64
+
+	// FailureThreshold, if set (0 < t <= 1), replaces the relative rule with a fixed
+	// one: a target whose window error ratio is at least this is ejected. 0 keeps
+	// the relative rule.
+	FailureThreshold float64
+
+	// MaxEjectionPercent caps the fraction of the pool that may be ejected at once.
+	// Defaults to 30. Like LatencyEjectingLoadBalancer's it is a near-hard cap — a
+	// concurrent burst can transiently overshoot it by the in-flight concurrency.
+	MaxEjectionPercent int
+
+	// EjectTimeout is the base cooldown a target stays ejected, doubling on each
+	// repeat ejection up to MaxEjectTimeout. Defaults to 30s.
+	EjectTimeout time.Duration
+
+	// MaxEjectTimeout caps the ejection cooldown. Defaults to 5m.
+	MaxEjectTimeout time.Duration
+
+	// IsFailure decides whether a round-trip result counts as a failure. When nil,
+	// any transport error other than a client-canceled request or an adaptive-limit
+	// shed (ErrLimited) counts. Set it to also treat responses such as 5xx as
+	// failures — usually what you want here.
+	IsFailure func(resp *http.Response, err error) bool
+
+	// OnStateChange observes a target being ejected (ReasonEject) or healed back into
+	// rotation (ReasonRecover); nil disables it. Like EjectingLoadBalancer, it
+	// reflects committed eject/recover events, not cooldown-expiry rotation
+	// membership. See prom.UpstreamState. The callee owns its own concurrency.
+	OnStateChange StateChangeFunc
+}
+
+// srPeer holds one target's success-rate state.
+//
+//nolint:govet // fields grouped by role for readability
+type srPeer struct {
+	target       *Target
+	buckets      [srBuckets]srBucket
+	ejections    atomic.Int32 // consecutive ejection episodes -> backoff exponent
+	ejectedUntil atomic.Int64 // unix nanos; <= now means selectable
+}
+
+// srBucket counts one slice of the sliding window. epoch is the absolute bucket
+// number (unix nanos / bucket width) the counts belong to; a bucket whose epoch has
+// fallen out of the window is stale and reads as empty.
+type srBucket struct {
+	epoch atomic.Int64
+	ok    atomic.Uint64
+	fail  atomic.Uint64
+}
+
+func (l *SuccessRateEjectingLoadBalancer) init() {
+	if l.Window <= 0 {
+		l.Window = defaultSRWindow
+	}
+	if l.MinRequests == 0 {
+		l.MinRequests = defaultSRMinRequests
+	}
+	if l.MinHosts < 2 {
+		l.MinHosts = defaultSRMinHosts
+	}
+	if l.StdevFactor <= 0 {
+		l.StdevFactor = defaultSRStdevFactor
+	}
+	if l.MinEjectDelta <= 0 || l.MinEjectDelta > 1 {
+		l.MinEjectDelta = defaultSRMinDelta
+	}
+	if l.FailureThreshold < 0 || l.FailureThreshold > 1 {
+		l.FailureThreshold = 0
+	}
+	if l.MaxEjectionPercent <= 0 || l.MaxEjectionPercent > 100 {
+		l.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	if l.EjectTimeout <= 0 {
+		l.EjectTimeout = defaultEjectTimeout
+	}
+	if l.MaxEjectTimeout <= 0 {
+		l.MaxEjectTimeout = defaultMaxEjectTimeout
+	}
+	if l.MaxEjectTimeout < l.EjectTimeout {
+		l.MaxEjectTimeout = l.EjectTimeout
+	}
+	l.bucket = max(int64(l.Window)/srBuckets, 1)
+
+	l.peers = make([]srPeer, len(l.Targets))
+	for i, t := range l.Targets {
+		l.peers[i].target = t
+	}
+}
+
+// RoundTrip sends a request to a non-ejected upstream and records the outcome.
+func (l *SuccessRateEjectingLoadBalancer) RoundTrip(r *http.Request) (*http.Response, error) {
+	l.once.Do(l.init)
+
+	n := len(l.peers)
+	if n == 0 {
+		return nil, ErrUnavailable
+	}
+
+	p := l.pick(n)
+	r.URL.Host = p.target.Host
+	resp, err := p.target.Transport.RoundTrip(r)
+	l.record(p, resp, err)
+	return resp, err
+}
+
+// pick selects the next selectable target round-robin, skipping ejected ones AND
+// any the active-HC gate marks down. If all are out it falls open to the
+// round-robin slot.
+func (l *SuccessRateEjectingLoadBalancer) pick(n int) *srPeer {
+	start := l.i.Add(1) - 1
+	now := time.Now().UnixNano()
+	for k := uint32(0); k < uint32(n); k++ {
+		idx := (start + k) % uint32(n)
+		p := &l.peers[idx]
+		if p.ejectedUntil.Load() <= now && l.up(idx) { // passive AND active
+			return p
+		}
+	}
+	return &l.peers[start%uint32(n)]
+}
+
+// setHealthGate installs the active health-check gate (see ActiveHealthCheck).
+func (l *SuccessRateEjectingLoadBalancer) setHealthGate(gate []atomic.Bool) { l.gate = gate }
+
+// up reports the active-HC verdict for target index i. A nil gate means "always
+// up", so the hot path is unchanged for callers not using active health checks.
+func (l *SuccessRateEjectingLoadBalancer) up(i uint32) bool {
+	return l.gate == nil || int(i) >= len(l.gate) || l.gate[i].Load() // out-of-range => up (fail open, no panic)
+}
+
+func (l *SuccessRateEjectingLoadBalancer) failed(resp *http.Response, err error) bool {
+	if l.IsFailure != nil {
+		return l.IsFailure(resp, err)
+	}
+	return err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrLimited)
+}
+
+// record counts a round-trip into the target's window and runs the outlier test.
+// A target's ratio only worsens on a failure, so the (pool-scanning) ejection test
+// runs on failures only; a success runs it only for a target with ejection state
+// to heal, keeping the common healthy path to a couple of atomic adds.
+func (l *SuccessRateEjectingLoadBalancer) record(p *srPeer, resp *http.Response, err error) {
+	if err != nil && errors.Is(err, context.Canceled) {
+		return // a client cancel says nothing about the target
+	}
+	now := time.Now().UnixNano()
+	failed := l.failed(resp, err)
+	p.add(now/l.bucket, failed)
+
+	if !failed {
+		if p.ejections.Load() != 0 || p.ejectedUntil.Load() != 0 {
+			if outlier, valid := l.judge(p, now); valid && !outlier {
+				l.heal(p)
+			}
+		}
+		return
+	}
+
+	outlier, valid := l.judge(p, now)
+	if !valid || !outlier {
+		return
+	}
+	if (l.ejectedCount(now)+1)*100 > l.MaxEjectionPercent*len(l.peers) {
+		return // at the cap: keep it in rotation
+	}
+	l.eject(p)
+}
+
+// add counts one outcome into the bucket for epoch, first claiming the bucket if it
+// still holds a stale epoch. An add racing the claim of a fresh bucket can be lost;
+// the window is a statistical signal, so that is accepted over a lock.
+func (p *srPeer) add(epoch int64, failed bool) {
+	b := &p.buckets[epoch%srBuckets]
+	if cur := b.epoch.Load(); cur != epoch && b.epoch.CompareAndSwap(cur, epoch) {
+		b.ok.Store(0)
+		b.fail.Store(0)
+	}
+	if failed {
+		b.fail.Add(1)
+	} else {
+		b.ok.Add(1)
+	}
+}
+
+// counts sums the buckets still inside the window ending at epoch.
+func (p *srPeer) counts(epoch int64) (ok, fail uint64) {
+	for i := range p.buckets {
+		b := &p.buckets[i]
+		if e := b.epoch.Load(); e > epoch-srBuckets && e <= epoch {
+			ok += b.ok.Load()
+			fail += b.fail.Load()
+		}
+	}
+	return
+}
+
+// reset forgets the window, so a target coming back from ejection is judged only
+// on its post-cooldown traffic.
+func (p *srPeer) reset() {
+	for i := range p.buckets {
+		p.buckets[i].epoch.Store(0)
+		p.buckets[i].ok.Store(0)
+		p.buckets[i].fail.Store(0)
+	}
+}
+
+// successRate returns the target's window success rate and whether it has enough
+// requests to be judged.
+func (l *SuccessRateEjectingLoadBalancer) successRate(p *srPeer, epoch int64) (float64, bool) {
+	ok, fail := p.counts(epoch)
+	total := ok + fail
+	if total == 0 || total < l.MinRequests {
+		return 0, false
+	}
+	return float64(ok) / float64(total), true
+}
+
+// judge reports whether p is an outlier, and whether the verdict is valid (p has
+// MinRequests and, on the relative rule, the pool has a baseline). An invalid
+// verdict neither ejects nor heals.
+func (l *SuccessRateEjectingLoadBalancer) judge(p *srPeer, now int64) (outlier, valid bool) {
+	epoch := now / l.bucket
+	rate, ok := l.successRate(p, epoch)
+	if !ok {
+		return false, false
+	}
+	if l.FailureThreshold > 0 {
+		return 1-rate >= l.FailureThreshold, true
+	}
+
+	mean, stdev, eligible := l.poolStats(epoch)
+	if eligible < l.MinHosts {
+		return false, false // no valid baseline: cannot name an outlier; do not heal
+	}
+	return rate < mean-l.StdevFactor*stdev && mean-rate >= l.MinEjectDelta, true
+}
+
+// poolStats is the pool baseline: the mean and population standard deviation of
+// the success rates of the targets with MinRequests in the window.
+func (l *SuccessRateEjectingLoadBalancer) poolStats(epoch int64) (mean, stdev float64, eligible int) {
+	var sum, sumSq float64
+	for i := range l.peers {
+		rate, ok := l.successRate(&l.peers[i], epoch)
+		if !ok {
+			continue
+		}
+		sum += rate
+		sumSq += rate * rate
+		eligible++
+	}
+	if eligible == 0 {
+		return 0, 0, 0
+	}
+	mean = sum / float64(eligible)
+	return mean, math.Sqrt(max(sumSq/float64(eligible)-mean*mean, 0)), eligible
+}
+
+// ejectedCount counts targets currently ejected (a lock-free scan).
+func (l *SuccessRateEjectingLoadBalancer) ejectedCount(now int64) (c int) {
+	for i := range l.peers {
+		if l.peers[i].ejectedUntil.Load() > now {
+			c++
+		}
+	}
+	return
+}
+
+// heal clears a target's ejection state once it is judged back within tolerance,
+// forgetting the backoff exponent. Swap so exactly one concurrent healer emits
+// ReasonRecover.
+func (l *SuccessRateEjectingLoadBalancer) heal(p *srPeer) {
+	wasEjected := p.ejectedUntil.Swap(0) != 0
+	p.ejections.Store(0)
+	if wasEjected && l.OnStateChange != nil {
+		l.OnStateChange(StateChange{Host: p.target.Host, From: StateOpen, To: StateClosed, Reason: ReasonRecover})
+	}
+}
+
+// eject takes a target out of rotation for a backed-off cooldown (CAS-once per
+// down-window, like ejecting.go) and clears its window, so the stale failures that
+// ejected it cannot re-eject it on its first post-cooldown request.
+func (l *SuccessRateEjectingLoadBalancer) eject(p *srPeer) {
+	now := time.Now()
+	for {
+		prev := p.ejectedUntil.Load()
+		if prev > now.UnixNano() {
+			return // already ejected for this window
+		}
+		e := p.ejections.Load() + 1
+		until := now.Add(l.ejectionTimeout(e)).UnixNano()
+		if p.ejectedUntil.CompareAndSwap(prev, until) {
+			p.ejections.Store(e)
+			p.reset()
+			if l.OnStateChange != nil {
+				from := StateClosed
+				if prev != 0 {
+					from = StateOpen
+				}
+				l.OnStateChange(StateChange{Host: p.target.Host, From: from, To: StateOpen, Reason: ReasonEject})
+			}
+			return
+		}
+	}
+}
+
+// ejectionTimeout returns EjectTimeout doubled for each prior ejection, capped at
+// MaxEjectTimeout. e is the 1-based ejection count.
+func (l *SuccessRateEjectingLoadBalancer) ejectionTimeout(e int32) time.Duration {
+	d := l.EjectTimeout
+	for i := int32(1); i < e && d < l.MaxEjectTimeout; i++ {
+		d *= 2
+	}
+	if d <= 0 || d > l.MaxEjectTimeout {
+		return l.MaxEjectTimeout
+	}
+	return d
+}
@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// srTestLB builds a success-rate balancer with small, fast-to-exercise thresholds.
+func srTestLB(n int) *SuccessRateEjectingLoadBalancer {
+	trs := make([]*fakeUpstream, n)
+	for i := range trs {
+		trs[i] = &fakeUpstream{}
+	}
+	l := &SuccessRateEjectingLoadBalancer{
+		Targets:      newEjectTargets(trs...),
+		MinRequests:  20,
+		EjectTimeout: 30 * time.Millisecond,
+	}
+	l.once.Do(l.init)
+	return l
+}
+
+func srEjected(l *SuccessRateEjectingLoadBalancer, i int) bool {
+	return l.peers[i].ejectedUntil.Load() > time.Now().UnixNano()
+}
+
+var errSRDown = errors.New("dial tcp: connection refused")
+
+// srDrive feeds rounds synthetic outcomes to every selectable target (an ejected
+// one gets no traffic, as under pick): failEvery[i] > 0 makes every failEvery[i]-th
+// round of target i fail, interleaved with successes.
+func srDrive(l *SuccessRateEjectingLoadBalancer, rounds int, failEvery ...int) {
+	resp := httptest.NewRecorder().Result()
+	for r := 1; r <= rounds; r++ {
+		for i := range l.peers {
+			if srEjected(l, i) {
+				continue
+			}
+			if i < len(failEvery) && failEvery[i] > 0 && r%failEvery[i] == 0 {
+				l.record(&l.peers[i], nil, errSRDown)
+				continue
+			}
+			l.record(&l.peers[i], resp, nil)
+		}
+	}
+}
+
+func TestSuccessRateEjectingLoadBalancer(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+		l := NewSuccessRateEjectingLoadBalancer(nil)
+		resp, err := l.RoundTrip(httptest.NewRequest("GET", "/", nil))
+		assert.Nil(t, resp)
+		assert.Equal(t, ErrUnavailable, err)
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		t.Parallel()
+		l := NewSuccessRateEjectingLoadBalancer(newEjectTargets(&fakeUpstream{}))
+		driveLB(l, 1)
+		assert.Equal(t, 30*time.Second, l.Window)
+		assert.EqualValues(t, 100, l.MinRequests)
+		assert.Equal(t, 5, l.MinHosts)
+		assert.Equal(t, 1.9, l.StdevFactor)
+		assert.Equal(t, 0.05, l.MinEjectDelta)
+		assert.Zero(t, l.FailureThreshold)
+		assert.Equal(t, 30, l.MaxEjectionPercent)
+		assert.Equal(t, 30*time.Second, l.EjectTimeout)
+		assert.Equal(t, 5*time.Minute, l.MaxEjectTimeout)
+	})
+
+	t.Run("EjectsTheInterleavedFailer", func(t *testing.T) {
+		t.Parallel()
+		l := srTestLB(5)
+		// Target 0 fails every 3rd request — never three in a row, so consecutive-
+		// failure ejection would not see it.
+		srDrive(l, 60, 3)
+		assert.True(t, srEjected(l, 0), "a 33% error ratio stands out from a clean pool")
+		for i := 1; i < 5; i++ {
+			assert.False(t, srEjected(l, i))
+		}
+	})
+
+	t.Run("UniformErrorsEjectNoOne", func(t *testing.T) {
+		t.Parallel()
+		l := srTestLB(5)
+		srDrive(l, 60, 3, 3, 3, 3, 3)
+		for i := range 5 {
+			assert.False(t, srEjected(l, i), "a pool-wide error rate is not an outlier")
+		}
+	})
+
+	t.Run("TooFewHostsForABaseline", func(t *testing.T) {
+		t.Parallel()
+		l := srTestLB(3)
+		srDrive(l, 60, 2)
+		assert.False(t, srEjected(l, 0), "fewer than MinHosts never ejects on the relative rule")
+	})
+
+	t.Run("FixedThreshold", func(t *testing.T) {
+		t.Parallel()
+		l := srTestLB(2)
+		l.FailureThreshold = 0.3
+		l.MaxEjectionPercent = 50
+		srDrive(l, 60, 2, 5) // 50% and 20% error ratios
+		assert.True(t, srEjected(l, 0), "at or above the fixed threshold ejects without a pool baseline")
+		assert.False(t, srEjected(l, 1))
+	})
+
+	t.Run("MaxEjectionPercentCaps", func(t *testing.T) {
+		t.Parallel()
+		l := srTestLB(5)
+		l.FailureThreshold = 0.3
+		srDrive(l, 60, 1, 1, 1, 1, 1) // every target fails every request
+		c := 0
+		for i := range 5 {
+			if srEjected(l, i) {
+				c++
+			}
+		}
+		assert.Equal(t, 1, c, "30% of 5 allows one ejection")
+	})
+
+	t.Run("WindowSlides", func(t *testing.T) {
+		t.Parallel()
+		l := srTestLB(2)
+		l.FailureThreshold = 0.5
+		now := time.Now().UnixNano() / l.bucket
+		p := &l.peers[0]
+		for range 30 {
+			p.add(now-srBuckets-1, true) // older than the window
+			p.add(now, false)
+		}
+		ok, fail := p.counts(now)
+		assert.EqualValues(t, 30, ok)
+		assert.Zero(t, fail, "buckets that slid out of the window are not counted")
+	})
+
+	t.Run("HealsAfterCooldown", func(t *testing.T) {
+		t.Parallel()
+		var rec stateRecorder
+		l := srTestLB(5)
+		l.OnStateChange = rec.fn()
+		srDrive(l, 60, 3)
+		assert.Equal(t, 1, rec.count(ReasonEject))
+		assert.True(t, srEjected(l, 0))
+
+		time.Sleep(40 * time.Millisecond) // past the cooldown
+		assert.False(t, srEjected(l, 0), "selectable again after the cooldown")
+		srDrive(l, 60) // now clean: re-accumulates MinRequests and is judged healthy
+		assert.Equal(t, 1, rec.count(ReasonRecover))
+		assert.Zero(t, l.peers[0].ejections.Load(), "recovery forgets the backoff")
+	})
+
+	t.Run("RoutesAroundEjected", func(t *testing.T) {
+		t.Parallel()
+		trs := []*fakeUpstream{{}, {}, {}}
+		l := &SuccessRateEjectingLoadBalancer{Targets: newEjectTargets(trs...)}
+		l.once.Do(l.init)
+		l.eject(&l.peers[0])
+		driveLB(l, 30)
+		assert.Zero(t, trs[0].calls.Load())
+		assert.EqualValues(t, 30, trs[1].calls.Load()+trs[2].calls.Load())
+	})
+}
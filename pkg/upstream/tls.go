@@ -0,0 +1,233 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrPinMismatch is the cause of a *tls.CertificateVerificationError for an
+// origin whose certificate chain matches none of TLSConfig.PinSHA256.
+var ErrPinMismatch = errors.New("upstream: no certificate matches a pinned public key")
+
+// TLSConfig is the TLS client side of a connection to an origin. Set it as
+// HTTPSTransport.TLS or Transport.TLS (one per Target.Transport), or per host in
+// Transport.HostTLS. Unlike the transports' default, it verifies the origin.
+//
+// A verification failure, pin mismatch included, is a *tls.CertificateVerificationError:
+// it fails the request as ErrorKind "tls" (upstream_errors_total{kind="tls"}) and
+// an ActiveHealthCheck probe with ProbeCause "tls".
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the CAs that sign the origin's certificate; ""
+	// uses the system roots.
+	CAFile string
+
+	// ServerName is sent as SNI and verified against the origin's certificate;
+	// "" uses the target host. Set it when targets are addressed by IP.
+	ServerName string
+
+	// CertFile and KeyFile are a PEM client certificate and key presented for
+	// mutual TLS. They are re-read when either file's modification time changes,
+	// so a rotated certificate applies to the next new connection; a failed
+	// reload keeps the previous certificate.
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is the lowest TLS version accepted; default TLS 1.2.
+	MinVersion uint16
+
+	// PinSHA256 pins the origin's public keys: the base64 SHA-256 of a
+	// certificate's SubjectPublicKeyInfo (as in HPKP and curl's
+	// --pinnedpubkey sha256//...). When set, some certificate of the chain must
+	// match one of them, in addition to the usual verification.
+	PinSHA256 []string
+
+	// InsecureSkipVerify skips chain and name verification. Combined with
+	// PinSHA256, the pins alone establish trust, as for a self-signed origin.
+	InsecureSkipVerify bool
+
+	once sync.Once
+	cfg  *tls.Config
+	err  error
+}
+
+// ClientConfig returns the tls.Config the transports use. It is built once; call
+// it at startup to fail fast on an unreadable CA bundle or client certificate.
+func (c *TLSConfig) ClientConfig() (*tls.Config, error) {
+	c.once.Do(func() {
+		c.cfg, c.err = c.build()
+	})
+	return c.cfg, c.err
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		MinVersion:         c.MinVersion,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: tls: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream: tls: no certificate in %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cl := &certLoader{certFile: c.CertFile, keyFile: c.KeyFile}
+		if _, err := cl.get(); err != nil {
+			return nil, fmt.Errorf("upstream: tls: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cl.get()
+		}
+	}
+
+	if len(c.PinSHA256) > 0 {
+		pins := make([][]byte, 0, len(c.PinSHA256))
+		for _, p := range c.PinSHA256 {
+			b, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("upstream: tls: invalid pin %q", p)
+			}
+			pins = append(pins, b)
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// verifyPins accepts a connection when a presented certificate, or one of a
+// verified chain, matches one of pins.
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	pinned := func(certs []*x509.Certificate) bool {
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, p := range pins {
+				if bytes.Equal(sum[:], p) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if pinned(cs.PeerCertificates) {
+		return nil
+	}
+	for _, chain := range cs.VerifiedChains {
+		if pinned(chain) {
+			return nil // a pinned root the origin does not send
+		}
+	}
+	return &tls.CertificateVerificationError{
+		UnverifiedCertificates: cs.PeerCertificates,
+		Err:                    ErrPinMismatch,
+	}
+}
+
+// certLoader holds a client certificate, reloading it when its files change.
+type certLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func (l *certLoader) get() (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	certMod, cerr := modTime(l.certFile)
+	keyMod, kerr := modTime(l.keyFile)
+	if l.cert != nil && (cerr != nil || kerr != nil || (certMod.Equal(l.certMod) && keyMod.Equal(l.keyMod))) {
+		return l.cert, nil // unchanged, or mid-rotation: keep serving the last good pair
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil // e.g. the new cert written before its key
+		}
+		return nil, err
+	}
+	l.cert, l.certMod, l.keyMod = &cert, certMod, keyMod
+	return l.cert, nil
+}
+
+func modTime(name string) (time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// tlsConfigError is a TLSConfig that failed to build, returned by the requests
+// that need it so they fail as ErrorKind "tls".
+type tlsConfigError struct{ err error }
+
+func (e *tlsConfigError) Error() string { return e.err.Error() }
+func (e *tlsConfigError) Unwrap() error { return e.err }
+
+// isTLSError reports a TLS handshake or certificate failure, or an unusable TLS
+// config, shared by ClassifyError and the probe classifier so both name it "tls".
+func isTLSError(err error) bool {
+	var cfgErr *tlsConfigError
+	if errors.As(err, &cfgErr) {
+		return true
+	}
+	var certErr *tls.CertificateVerificationError
+	var recErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	if errors.As(err, &certErr) || errors.As(err, &recErr) || errors.As(err, &alertErr) {
+		return true
+	}
+	// crypto/tls reports an alert from the origin, such as a rejected client
+	// certificate, as this op
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// dialTLS dials addr and runs the TLS handshake with cfg, naming the server
+// after addr's host unless cfg sets ServerName.
+func dialTLS(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, defaultTLSHandshakeTimeout)
+	defer cancel()
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(hctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,315 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a leaf for name, a server name or a client common name.
+func (ca *testCA) issue(t *testing.T, name string, client bool) tls.Certificate {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{name},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	p := x509.NewCertPool()
+	p.AddCert(ca.cert)
+	return p
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// writeKeyPair writes cert as PEM files at certFile and keyFile.
+func writeKeyPair(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	t.Helper()
+
+	key, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600)
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsOrigin starts an origin serving cert that answers with the client
+// certificate's common name.
+func tlsOrigin(t *testing.T, cert tls.Certificate, clientCAs *x509.CertPool) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		ts.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		ts.TLS.ClientCAs = clientCAs
+	}
+	ts.Config.ErrorLog = discardLog
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "origin.test", false)
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", ca.cert.Raw)
+	ts := tlsOrigin(t, serverCert, nil)
+	host := strings.TrimPrefix(ts.URL, "https://")
+
+	get := func(tr http.RoundTripper) (string, error) {
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", "https://"+host+"/", nil))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), nil
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		_, err := get(&HTTPSTransport{TLS: &TLSConfig{CAFile: caFile, ServerName: "origin.test"}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("unknown authority", func(t *testing.T) {
+		_, err := get(&HTTPSTransport{TLS: &TLSConfig{ServerName: "origin.test"}})
+		assert.Error(t, err)
+		assert.Equal(t, KindTLS, ClassifyError(err), "%v", err)
+		assert.Equal(t, CauseTLS, classifyProbeCause(nil, err))
+	})
+
+	t.Run("name mismatch", func(t *testing.T) {
+		_, err := get(&HTTPSTransport{TLS: &TLSConfig{CAFile: caFile, ServerName: "other.test"}})
+		assert.Equal(t, KindTLS, ClassifyError(err), "%v", err)
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		_, err := get(&HTTPSTransport{TLS: &TLSConfig{InsecureSkipVerify: true, PinSHA256: []string{spkiPin(serverCert.Leaf)}}})
+		assert.NoError(t, err, "the pin alone establishes trust")
+
+		_, err = get(&HTTPSTransport{TLS: &TLSConfig{CAFile: caFile, ServerName: "origin.test", PinSHA256: []string{spkiPin(ca.cert)}}})
+		assert.NoError(t, err, "a pinned root of the verified chain")
+
+		other := ca.issue(t, "other.test", false)
+		_, err = get(&HTTPSTransport{TLS: &TLSConfig{CAFile: caFile, ServerName: "origin.test", PinSHA256: []string{spkiPin(other.Leaf)}}})
+		assert.ErrorIs(t, err, ErrPinMismatch)
+		assert.Equal(t, KindTLS, ClassifyError(err))
+	})
+
+	t.Run("min version", func(t *testing.T) {
+		old := httptest.NewUnstartedServer(http.NotFoundHandler())
+		old.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, MaxVersion: tls.VersionTLS12}
+		old.Config.ErrorLog = discardLog
+		old.StartTLS()
+		defer old.Close()
+
+		tr := &HTTPSTransport{TLS: &TLSConfig{CAFile: caFile, ServerName: "origin.test", MinVersion: tls.VersionTLS13}}
+		_, err := tr.RoundTrip(httptest.NewRequest("GET", old.URL, nil))
+		assert.Equal(t, KindTLS, ClassifyError(err), "%v", err)
+	})
+
+	t.Run("bad CA file", func(t *testing.T) {
+		_, err := get(&HTTPSTransport{TLS: &TLSConfig{CAFile: filepath.Join(t.TempDir(), "none.pem")}})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Equal(t, KindTLS, ClassifyError(err))
+
+		_, err = (&TLSConfig{PinSHA256: []string{"not-a-pin"}}).ClientConfig()
+		assert.Error(t, err)
+	})
+
+	t.Run("per host on Transport", func(t *testing.T) {
+		tr := &Transport{HostTLS: map[string]*TLSConfig{
+			host: {CAFile: caFile, ServerName: "origin.test"},
+		}}
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		r.URL.Scheme = "https"
+		resp, err := tr.RoundTrip(r)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+
+		tr = &Transport{HostTLS: map[string]*TLSConfig{
+			"127.0.0.1": {CAFile: caFile, ServerName: "other.test"},
+		}}
+		_, err = get(tr)
+		assert.Equal(t, KindTLS, ClassifyError(err), "a host-only key matches any port: %v", err)
+	})
+
+	t.Run("one bad host entry", func(t *testing.T) {
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer plain.Close()
+
+		tr := &Transport{HostTLS: map[string]*TLSConfig{
+			host:       {CAFile: caFile, ServerName: "origin.test"},
+			"bad.test": {CAFile: filepath.Join(t.TempDir(), "none.pem")},
+		}}
+		_, err := get(tr)
+		assert.NoError(t, err, "the good host is unaffected")
+
+		_, err = tr.RoundTrip(httptest.NewRequest("GET", "https://bad.test/", nil))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Equal(t, KindTLS, ClassifyError(err), "%v", err)
+
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", plain.URL, nil))
+		if assert.NoError(t, err, "plain http is unaffected") {
+			resp.Body.Close()
+		}
+		_, err = get(tr)
+		assert.NoError(t, err, "nor is the good host later")
+	})
+
+	t.Run("bad default TLS on Transport", func(t *testing.T) {
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer plain.Close()
+
+		tr := &Transport{TLS: &TLSConfig{CAFile: filepath.Join(t.TempDir(), "none.pem")}}
+		_, err := get(tr)
+		assert.Equal(t, KindTLS, ClassifyError(err), "never falls back to an unverified config: %v", err)
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", plain.URL, nil))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	})
+}
+
+func TestTLSConfig_ClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", ca.cert.Raw)
+	ts := tlsOrigin(t, ca.issue(t, "origin.test", false), ca.pool())
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeKeyPair(t, ca.issue(t, "client-1", true), certFile, keyFile)
+
+	tr := &HTTPSTransport{
+		DisableKeepAlives: true, // a new handshake per request
+		TLS:               &TLSConfig{CAFile: caFile, ServerName: "origin.test", CertFile: certFile, KeyFile: keyFile},
+	}
+	get := func() (string, error) {
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", ts.URL, nil))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), nil
+	}
+
+	cn, err := get()
+	assert.NoError(t, err)
+	assert.Equal(t, "client-1", cn)
+
+	// rotate the pair on disk
+	writeKeyPair(t, ca.issue(t, "client-2", true), certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	cn, err = get()
+	assert.NoError(t, err)
+	assert.Equal(t, "client-2", cn, "the rotated certificate is picked up")
+
+	// a half-written rotation keeps the last good pair
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	evenLater := later.Add(time.Minute)
+	os.Chtimes(keyFile, evenLater, evenLater)
+	cn, err = get()
+	assert.NoError(t, err)
+	assert.Equal(t, "client-2", cn)
+
+	t.Run("rejected without a client certificate", func(t *testing.T) {
+		tr := &HTTPSTransport{TLS: &TLSConfig{CAFile: caFile, ServerName: "origin.test"}}
+		resp, err := tr.RoundTrip(httptest.NewRequest("GET", ts.URL, nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.Error(t, err)
+		assert.Equal(t, KindTLS, ClassifyError(err), "%v", err)
+		assert.Equal(t, CauseTLS, classifyProbeCause(nil, err))
+	})
+
+	t.Run("missing files fail fast", func(t *testing.T) {
+		_, err := (&TLSConfig{CertFile: filepath.Join(dir, "none.pem"), KeyFile: keyFile}).ClientConfig()
+		assert.True(t, errors.Is(err, os.ErrNotExist), "%v", err)
+	})
+}
@@ -158,8 +158,9 @@ func (t *HTTPTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 //
 //nolint:govet
 type HTTPSTransport struct {
-	once sync.Once
-	h    *http.Transport
+	once   sync.Once
+	h      *http.Transport
+	tlsErr error
 
 	DialTimeout           time.Duration
 	TCPKeepAlive          time.Duration
@@ -169,7 +170,17 @@ type HTTPSTransport struct {
 	IdleConnTimeout       time.Duration
 	ExpectContinueTimeout time.Duration
 	ResponseHeaderTimeout time.Duration
-	TLSClientConfig       *tls.Config
+
+	// TLSClientConfig is used as is; nil skips verification of the origin
+	// (InsecureSkipVerify). Prefer TLS.
+	TLSClientConfig *tls.Config
+
+	// TLS, if set, replaces TLSClientConfig with verified settings: a CA bundle,
+	// SNI, a hot-reloaded client certificate for mTLS, pinning. It is built on
+	// the first request; when that fails (an unreadable CA bundle, say), every
+	// request fails with the error, as ErrorKind "tls", for the transport's
+	// lifetime. Call TLS.ClientConfig at startup to catch it early.
+	TLS *TLSConfig
 
 	// DialContext, if non-nil, replaces the default net.Dialer used to open
 	// TCP connections to the upstream (the TLS handshake is then performed on
@@ -196,6 +207,12 @@ func (t *HTTPSTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 		if t.ResponseHeaderTimeout == 0 {
 			t.ResponseHeaderTimeout = defaultResponseHeaderTimeout
 		}
+		if t.TLS != nil {
+			var err error
+			if t.TLSClientConfig, err = t.TLS.ClientConfig(); err != nil {
+				t.tlsErr = &tlsConfigError{err}
+			}
+		}
 		if t.TLSClientConfig == nil {
 			t.TLSClientConfig = &tls.Config{
 				InsecureSkipVerify: true,
@@ -225,6 +242,11 @@ func (t *HTTPSTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 		}
 	})
 
+	if t.tlsErr != nil {
+		closeBody(r)
+		return nil, t.tlsErr
+	}
+
 	r.URL.Scheme = "https"
 	return t.h.RoundTrip(r)
 }
@@ -294,7 +316,23 @@ type Transport struct {
 	ExpectContinueTimeout time.Duration
 	ResponseHeaderTimeout time.Duration
 	DisableCompression    bool
-	TLSClientConfig       *tls.Config
+
+	// TLSClientConfig is used as is for https; nil skips verification of the
+	// origin (InsecureSkipVerify). Prefer TLS or HostTLS.
+	TLSClientConfig *tls.Config
+
+	// TLS, if set, replaces TLSClientConfig with verified settings: a CA bundle,
+	// SNI, a hot-reloaded client certificate for mTLS, pinning.
+	TLS *TLSConfig
+
+	// HostTLS sets the TLS per target, keyed by Target.Host ("host:port", or
+	// "host" for any port); a host not in it uses TLS or TLSClientConfig.
+	//
+	// TLS and each HostTLS entry are built on the first request. One that fails
+	// to build (an unreadable CA bundle, say) fails only the https requests it
+	// applies to, as ErrorKind "tls", for the transport's lifetime; other hosts
+	// and schemes are unaffected. Call ClientConfig at startup to catch it early.
+	HostTLS map[string]*TLSConfig
 
 	// DialContext, if non-nil, replaces the default net.Dialer used to open
 	// TCP connections to the upstream for the http and h2c (plaintext) paths.
@@ -321,11 +359,27 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		if t.ResponseHeaderTimeout == 0 {
 			t.ResponseHeaderTimeout = defaultResponseHeaderTimeout
 		}
+		var tlsErr error
+		if t.TLS != nil {
+			var err error
+			if t.TLSClientConfig, err = t.TLS.ClientConfig(); err != nil {
+				tlsErr = &tlsConfigError{err}
+			}
+		}
 		if t.TLSClientConfig == nil {
 			t.TLSClientConfig = &tls.Config{
 				InsecureSkipVerify: true,
 			}
 		}
+		hostTLS := make(map[string]hostTLSConfig, len(t.HostTLS))
+		for host, c := range t.HostTLS {
+			cfg, err := c.ClientConfig()
+			if err != nil {
+				hostTLS[host] = hostTLSConfig{err: &tlsConfigError{err}}
+				continue
+			}
+			hostTLS[host] = hostTLSConfig{cfg: cfg}
+		}
 
 		t.dialer = &net.Dialer{
 			Timeout:   t.DialTimeout,
@@ -349,6 +403,22 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 			DisableCompression:    t.DisableCompression,
 			ResponseHeaderTimeout: t.ResponseHeaderTimeout,
 		}
+		if len(hostTLS) > 0 || tlsErr != nil {
+			t.httpTr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, ok := hostTLS[addr]
+				if !ok {
+					host, _, _ := net.SplitHostPort(addr)
+					c, ok = hostTLS[host]
+				}
+				if !ok {
+					c = hostTLSConfig{cfg: t.TLSClientConfig, err: tlsErr}
+				}
+				if c.err != nil {
+					return nil, c.err
+				}
+				return dialTLS(ctx, dial, network, addr, c.cfg)
+			}
+		}
 		t.h2cTr = &http2.Transport{
 			AllowHTTP:          true,
 			DisableCompression: t.DisableCompression,
@@ -388,3 +458,17 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	return tr.RoundTrip(r)
 }
+
+// hostTLSConfig is a built TLS config of Transport, or why it failed to build.
+type hostTLSConfig struct {
+	cfg *tls.Config
+	err error
+}
+
+// closeBody closes a request body a round-trip fails before sending, as
+// http.RoundTripper requires.
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
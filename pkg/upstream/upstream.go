@@ -3,6 +3,7 @@ package upstream
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -17,14 +18,28 @@ import (
 // Errors
 var (
 	ErrUnavailable = errors.New("upstream: unavailable")
+
+	// ErrLimited is returned when an adaptive concurrency limit sheds a round-trip
+	// (see AdaptiveTransport). It wraps ErrUnavailable, so errors.Is(err,
+	// ErrUnavailable) holds and it is answered with 503.
+	ErrLimited = fmt.Errorf("%w: concurrency limited", ErrUnavailable)
 )
 
+// limitedRetryAfter is the Retry-After hint sent with a 503 for ErrLimited.
+const limitedRetryAfter = "1"
+
 // Upstream controls request flow to upstream server via load balancer
 type Upstream struct {
 	Transport   http.RoundTripper
 	ErrorLog    *log.Logger
 	OnRoundTrip RoundTripFunc // observe each origin round-trip (nil disables); see prom.Upstream
 
+	// ErrorResponder writes the response when the proxy cannot complete a
+	// request: 504 for a timeout, 503 when shed, 502 otherwise (see ErrorKind).
+	// nil uses DefaultErrorResponder's plain text. gRPC calls always get a gRPC
+	// status instead.
+	ErrorResponder ErrorResponder
+
 	// RetryPolicy decides whether a request is eligible to be retried after a
 	// transport error. nil uses the default canRetry: an idempotent method
 	// (GET/HEAD/OPTIONS/TRACE) AND a body that is either absent or rewindable
@@ -106,12 +121,16 @@ func (m Upstream) ServeHandler(h http.Handler) http.Handler {
 				return
 			}
 
-			if m.retryable(r) {
+			grpc := IsGRPC(r)
+			if (!grpc && m.retryable(r)) || (grpc && m.grpcRetryable(r, err)) {
 				ctx := r.Context()
 				retry, _ := ctx.Value(retryContextKey{}).(int)
 				if retry < m.Retries {
 					select {
 					case <-ctx.Done():
+						if grpc && ctx.Err() == context.DeadlineExceeded {
+							writeGRPCError(w, r, ctx.Err()) // grpc-timeout ran out mid-backoff
+						}
 						// client canceled request
 						return
 					case <-time.After(m.BackoffFactor * time.Duration(1<<uint(retry))):
@@ -136,18 +155,23 @@ func (m Upstream) ServeHandler(h http.Handler) http.Handler {
 			}
 
 			m.logf("upstream: %v", err)
-			switch err {
-			case ErrUnavailable: // load balancer don't have next upstream
-				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-			// TODO: timeout is unexposed from http (transport) package
-			default:
-				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			if grpc {
+				// A gRPC client cannot decode a plain-text 502/503: answer with the
+				// call's status instead.
+				writeGRPCError(w, r, err)
+				return
 			}
+			m.writeProxyError(w, r, err)
 		},
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.RemoteAddr = "" // disable httputil.ReverseProxy to add X-Forwarded-For since we already added
+		if IsGRPC(r) {
+			var cancel context.CancelFunc
+			r, cancel = withGRPCTimeout(r) // grpc-timeout is the call's deadline
+			defer cancel()
+		}
 		p.ServeHTTP(w, r)
 	})
 }
@@ -162,14 +186,26 @@ func (m *Upstream) RoundTrip(r *http.Request) (*http.Response, error) {
 	start := time.Now()
 	resp, err := m.Transport.RoundTrip(r)
 	logger.Set(r.Context(), "upstream", r.URL.Host)
-	if m.OnRoundTrip != nil {
-		// r.URL.Host is the target just resolved; Duration is the time to response
-		// headers, before the body streams; Attempt is the retry index (0 first try).
-		attempt, _ := r.Context().Value(retryContextKey{}).(int)
-		info := RoundTripInfo{Host: r.URL.Host, Duration: time.Since(start), Err: err, Attempt: attempt}
-		if resp != nil {
-			info.Status = resp.StatusCode
-		}
+	if err != nil {
+		logger.Set(r.Context(), "upstreamError", ClassifyError(err).String())
+	}
+	grpc := IsGRPC(r)
+	if m.OnRoundTrip == nil && !grpc {
+		return resp, err
+	}
+
+	// r.URL.Host is the target just resolved; Duration is the time to response
+	// headers, before the body streams; Attempt is the retry index (0 first try).
+	attempt, _ := r.Context().Value(retryContextKey{}).(int)
+	info := RoundTripInfo{Host: r.URL.Host, Duration: time.Since(start), Err: err, Attempt: attempt, ErrorKind: ClassifyError(err)}
+	if resp != nil {
+		info.Status = resp.StatusCode
+	}
+	var deferred bool
+	if grpc {
+		resp, deferred, err = m.observeGRPC(r, resp, err, &info)
+	}
+	if m.OnRoundTrip != nil && !deferred {
 		m.OnRoundTrip(r, info)
 	}
 	return resp, err
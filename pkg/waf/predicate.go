@@ -142,3 +142,13 @@ func (p *Predicate) Eval(ctx context.Context, in Input) (bool, error) {
 	defer cancel()
 	return evalProgram(ctx, p.prg, in.m)
 }
+
+// Match adapts the predicate to the func(*http.Request) bool matcher shape used
+// across parapet (block.New, mirror.Mirror.Match, split.Route.Match), so a CEL
+// expression can gate any of them. The request is evaluated with no body and no
+// GeoIP resolution. An evaluation error fails CLOSED — the request does not match —
+// since a matcher has no way to surface it.
+func (p *Predicate) Match(r *http.Request) bool {
+	ok, err := p.Eval(r.Context(), NewInput(r, "", "", 0))
+	return err == nil && ok
+}
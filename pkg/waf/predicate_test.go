@@ -195,3 +195,21 @@ func TestPredicate_EvalTimeoutOptionAccepted(t *testing.T) {
 	require.NoError(t, err)
 	assert.True(t, got)
 }
+
+func TestPredicate_Match(t *testing.T) {
+	t.Parallel()
+
+	p, err := waf.NewPredicate(`request.headers["x-canary"] == "1"`)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.False(t, p.Match(r))
+
+	r.Header.Set("X-Canary", "1")
+	assert.True(t, p.Match(r))
+
+	// A runtime error (missing map key) fails closed.
+	p, err = waf.NewPredicate(`request.headers["x-missing"] == "1"`)
+	require.NoError(t, err)
+	assert.False(t, p.Match(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
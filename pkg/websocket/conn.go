@@ -0,0 +1,194 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// conn is the client side of an upgraded connection, as handed to the upstream
+// proxy by Hijack. Reads are frames from the client, writes are frames to it.
+type conn struct {
+	net.Conn
+	r    io.Reader // the client's bytes, buffered ones first
+	kill func()    // cuts the connection, unblocking any read or write
+	m    *WebSocket
+	t    *tracker
+
+	in, out   frameParser
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	reason    atomic.Uint32 // the first Reason to end the connection
+	isOpen    atomic.Bool
+	startTime time.Time
+
+	idle, lifetime, force *time.Timer
+
+	wmu       sync.Mutex // guards out and the fields below
+	closeCode uint16     // a close frame to send at the next frame boundary
+	closeSent bool
+	closed    bool
+
+	kmu  sync.Mutex
+	done bool // the handler returned; kill must not touch the connection
+}
+
+func newConn(t *tracker) *conn {
+	c := &conn{m: t.m, t: t}
+	c.in.onClose = func() { c.setReason(ReasonClient) }
+	c.out.onClose = func() { c.setReason(ReasonUpstream) }
+	return c
+}
+
+// start begins tracking the hijacked connection nc.
+func (c *conn) start(nc net.Conn, r io.Reader, kill func()) {
+	c.Conn, c.r, c.kill = nc, r, kill
+	c.startTime = time.Now()
+
+	c.force = time.AfterFunc(c.m.CloseTimeout, c.forceClose)
+	c.force.Stop() // armed by shut
+	if c.m.IdleTimeout > 0 {
+		c.idle = time.AfterFunc(c.m.IdleTimeout, func() { c.shut(ReasonIdle, closeNormal) })
+	}
+	if c.m.MaxLifetime > 0 {
+		c.lifetime = time.AfterFunc(c.m.MaxLifetime, func() { c.shut(ReasonLifetime, closeGoingAway) })
+	}
+	c.isOpen.Store(true)
+	c.t.opened(c)
+}
+
+func (c *conn) opened() bool {
+	return c.isOpen.Load()
+}
+
+func (c *conn) setReason(r Reason) bool {
+	return c.reason.CompareAndSwap(uint32(reasonNone), uint32(r))
+}
+
+func (c *conn) active() {
+	if c.idle != nil {
+		c.idle.Reset(c.m.IdleTimeout)
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.active()
+		c.bytesIn.Add(int64(n))
+		c.in.advance(p[:n], false)
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.closeSent {
+		return len(p), nil // nothing may follow a close frame; drop it
+	}
+	if c.closeCode == 0 {
+		c.out.advance(p, false)
+		n, err := c.Conn.Write(p)
+		c.count(n)
+		return n, err
+	}
+
+	// a close frame is due: finish the frame in flight, then send it
+	k, boundary := c.out.advance(p, true)
+	n, err := c.Conn.Write(p[:k])
+	c.count(n)
+	if err != nil {
+		return n, err
+	}
+	if boundary {
+		c.writeClose(c.closeCode)
+	}
+	return len(p), nil
+}
+
+func (c *conn) count(n int) {
+	if n > 0 {
+		c.active()
+		c.bytesOut.Add(int64(n))
+	}
+}
+
+// writeClose sends a close frame; wmu must be held.
+func (c *conn) writeClose(code uint16) {
+	c.closeSent = true
+	n, _ := c.Conn.Write(closeFrame(code))
+	c.bytesOut.Add(int64(n))
+}
+
+// shut closes the connection gracefully: it sends the client a close frame,
+// leaving the close handshake to the peers, and cuts the connection if it is
+// still open after CloseTimeout.
+func (c *conn) shut(reason Reason, code uint16) {
+	c.force.Reset(c.m.CloseTimeout) // first, so a blocked write cannot hold it up
+	if !c.setReason(reason) {
+		return // a close handshake is already under way
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed || c.closeSent {
+		return
+	}
+	if c.out.atBoundary() {
+		c.writeClose(code)
+		return
+	}
+	c.closeCode = code
+}
+
+func (c *conn) forceClose() {
+	c.kmu.Lock()
+	defer c.kmu.Unlock()
+	if !c.done {
+		c.kill()
+	}
+}
+
+// Close implements net.Conn; the proxy calls it when either direction ends.
+func (c *conn) Close() error {
+	c.forceClose() // unblocks a pending write, which holds wmu
+	c.wmu.Lock()
+	c.closed = true
+	c.wmu.Unlock()
+	return nil
+}
+
+// end stops tracking the connection once the handler returned, and returns
+// its closed Event.
+func (c *conn) end() Event {
+	c.kmu.Lock()
+	c.done = true
+	c.kmu.Unlock()
+
+	c.force.Stop()
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	if c.lifetime != nil {
+		c.lifetime.Stop()
+	}
+	c.setReason(ReasonAbnormal)
+
+	return Event{
+		Name:             c.m.Name,
+		Type:             EventClosed,
+		Reason:           Reason(c.reason.Load()),
+		Duration:         time.Since(c.startTime),
+		MessagesReceived: c.in.messages.Load(),
+		MessagesSent:     c.out.messages.Load(),
+		BytesReceived:    c.bytesIn.Load(),
+		BytesSent:        c.bytesOut.Load(),
+	}
+}
@@ -0,0 +1,32 @@
+package websocket_test
+
+import (
+	"time"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/location"
+	"github.com/moonrhythm/parapet/pkg/prom"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/moonrhythm/parapet/pkg/websocket"
+)
+
+// Bound the chat service's WebSocket connections, close idle ones, and close
+// every connection with 1001 "going away" on shutdown so clients reconnect to
+// another instance.
+func ExampleNew() {
+	ws := websocket.New()
+	ws.Name = "chat"
+	ws.MaxConns = 10000
+	ws.MaxConnsPerClient = 20
+	ws.IdleTimeout = 5 * time.Minute
+	ws.MaxLifetime = 24 * time.Hour
+	ws.Observe = prom.WebSocket()
+
+	chat := location.Prefix("/chat/")
+	chat.Use(ws)
+	chat.Use(upstream.SingleHost("chat.internal:8080", &upstream.HTTPTransport{}))
+
+	s := parapet.New()
+	s.GraceTimeout = 10 * time.Second // above ws.CloseTimeout
+	s.Use(chat)
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// WebSocket opcodes (RFC 6455, section 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+)
+
+// Close codes (RFC 6455, section 7.4.1)
+const (
+	closeNormal    = 1000
+	closeGoingAway = 1001
+)
+
+// frameParser follows the frames of one direction of a connection without
+// buffering them: it only keeps the header being read and the payload bytes
+// left, to count messages and know where the next frame starts.
+type frameParser struct {
+	hdr       [14]byte
+	hn        int // header bytes read
+	op        byte
+	remaining uint64 // payload bytes left of the current frame
+	inPayload bool
+
+	messages atomic.Int64
+	onClose  func() // called on a close frame
+}
+
+// atBoundary reports whether the next byte starts a new frame.
+func (f *frameParser) atBoundary() bool {
+	return f.hn == 0 && !f.inPayload
+}
+
+// advance consumes p. With stop, it returns as soon as a frame ends, reporting
+// the bytes consumed up to there and true.
+func (f *frameParser) advance(p []byte, stop bool) (int, bool) {
+	n := 0
+	for n < len(p) {
+		if f.inPayload {
+			k := uint64(len(p) - n)
+			if k > f.remaining {
+				k = f.remaining
+			}
+			n += int(k)
+			f.remaining -= k
+			if f.remaining > 0 {
+				break
+			}
+			f.inPayload = false
+			f.end()
+			if stop {
+				return n, true
+			}
+			continue
+		}
+
+		f.hdr[f.hn] = p[n]
+		f.hn++
+		n++
+		need := headerLen(f.hdr[:f.hn])
+		if need == 0 || f.hn < need {
+			continue
+		}
+		f.op = f.hdr[0]
+		f.remaining = payloadLen(f.hdr[:f.hn])
+		f.hn = 0
+		if f.remaining > 0 {
+			f.inPayload = true
+			continue
+		}
+		f.end()
+		if stop {
+			return n, true
+		}
+	}
+	return n, false
+}
+
+func (f *frameParser) end() {
+	fin := f.op&0x80 != 0
+	switch op := f.op & 0x0f; {
+	case op == opClose:
+		if f.onClose != nil {
+			f.onClose()
+		}
+	case fin && (op == opContinuation || op == opText || op == opBinary):
+		f.messages.Add(1) // the last frame of a data message
+	}
+}
+
+// headerLen returns a frame header's length from its first bytes, or 0 when
+// they are not enough to tell.
+func headerLen(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4 // masking key
+	}
+	return n
+}
+
+func payloadLen(h []byte) uint64 {
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10]) &^ (1 << 63)
+	default:
+		return uint64(l)
+	}
+}
+
+// closeFrame is an unmasked server close frame carrying code.
+func closeFrame(code uint16) []byte {
+	return []byte{0x80 | opClose, 2, byte(code >> 8), byte(code)}
+}
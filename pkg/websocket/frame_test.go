@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameParser(t *testing.T) {
+	t.Parallel()
+
+	var stream []byte
+	stream = append(stream, 0x01, 0x03, 'a', 'b', 'c') // text, not final
+	stream = append(stream, 0x89, 0x80, 1, 2, 3, 4)    // masked ping
+	stream = append(stream, 0x80, 0x7e, 0x01, 0x00)    // final continuation, 256 bytes
+	stream = append(stream, make([]byte, 256)...)
+	stream = append(stream, 0x82, 0x00)                                     // empty binary
+	stream = append(stream, 0x88, 0x02, 0x03, 0xe8)                         // close
+	stream = append(stream, 0x82, 0xff, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 3, 4) // masked, 64-bit length
+	stream = append(stream, 'x')
+
+	t.Run("byte by byte", func(t *testing.T) {
+		var closed int
+		f := frameParser{onClose: func() { closed++ }}
+		for i := range stream {
+			f.advance(stream[i:i+1], false)
+		}
+		assert.EqualValues(t, 3, f.messages.Load())
+		assert.Equal(t, 1, closed)
+		assert.True(t, f.atBoundary())
+	})
+
+	t.Run("stop at boundaries", func(t *testing.T) {
+		var f frameParser
+		var ends []int
+		for off := 0; off < len(stream); {
+			n, boundary := f.advance(stream[off:], true)
+			off += n
+			if boundary {
+				ends = append(ends, off)
+			}
+		}
+		assert.Equal(t, []int{5, 11, 271, 273, 277, 292}, ends)
+	})
+}
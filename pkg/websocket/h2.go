@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isExtendedConnect reports an RFC 8441 WebSocket bootstrap: an HTTP/2
+// CONNECT carrying the :protocol pseudo-header.
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.ProtoMajor >= 2 && strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// upgradeRequest rewrites an extended CONNECT into the HTTP/1.1 upgrade the
+// upstream expects (RFC 8441, section 5). The stream itself is kept for the
+// connection.
+func upgradeRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.Method = http.MethodGet
+	out.Proto, out.ProtoMajor, out.ProtoMinor = "HTTP/1.1", 1, 1
+	out.Body = http.NoBody
+	out.ContentLength = 0
+	out.Header.Del(":protocol")
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", "websocket")
+	if out.Header.Get("Sec-Websocket-Version") == "" {
+		out.Header.Set("Sec-Websocket-Version", "13")
+	}
+	var key [16]byte
+	rand.Read(key[:])
+	out.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+	return out
+}
+
+// streamWriter lets the upstream proxy hijack an HTTP/2 stream: it answers the
+// upstream's 101 with the 200 of RFC 8441 and carries the connection over the
+// stream.
+type streamWriter struct {
+	http.ResponseWriter
+	body io.ReadCloser
+	c    *conn
+}
+
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *streamWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker
+func (w *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rc := http.NewResponseController(w.ResponseWriter)
+	sc := &streamConn{body: w.body, w: w.ResponseWriter, rc: rc}
+	w.c.start(sc, w.body, sc.kill)
+
+	// the proxy writes the upstream's response head to brw
+	head := &headWriter{w: w.ResponseWriter, rc: rc}
+	return w.c, bufio.NewReadWriter(bufio.NewReader(w.c), bufio.NewWriter(head)), nil
+}
+
+// headWriter takes the HTTP/1.1 101 response head and sends 200 on the stream,
+// with the upstream's headers but the upgrade ones.
+type headWriter struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	buf  []byte
+	sent bool
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if h.sent {
+		n, err := h.w.Write(p)
+		if err == nil {
+			err = h.rc.Flush()
+		}
+		return n, err
+	}
+
+	h.buf = append(h.buf, p...)
+	i := bytes.Index(h.buf, []byte("\r\n\r\n"))
+	if i < 0 {
+		return len(p), nil
+	}
+	rest := h.buf[i+4:]
+	h.buf = nil
+	h.sent = true
+
+	hdr := h.w.Header()
+	hdr.Del("Connection")
+	hdr.Del("Upgrade")
+	hdr.Del("Sec-Websocket-Accept")
+	h.w.WriteHeader(http.StatusOK)
+	if len(rest) > 0 {
+		if _, err := h.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), h.rc.Flush()
+}
+
+// streamConn is an HTTP/2 stream as a net.Conn: the request body and the
+// response.
+type streamConn struct {
+	body io.ReadCloser
+	w    io.Writer
+	rc   *http.ResponseController
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// kill unblocks the stream's reads and writes; the stream ends when the
+// handler returns.
+func (c *streamConn) kill() {
+	c.rc.SetReadDeadline(time.Now())
+	c.rc.SetWriteDeadline(time.Now())
+	c.body.Close()
+}
+
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr { return streamAddr{} }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.rc.SetReadDeadline(t)
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "http2" }
+func (streamAddr) String() string  { return "http2-stream" }
@@ -0,0 +1,107 @@
+package websocket
+
+import "time"
+
+// EventType is what happened to a WebSocket connection, reported via
+// WebSocket.Observe.
+type EventType uint8
+
+const (
+	// EventOpened: the upgrade succeeded and the connection is open.
+	EventOpened EventType = iota
+	// EventClosed: an open connection ended; the Event carries its Reason, its
+	// Duration and its counters.
+	EventClosed
+	// EventRejected: an upgrade was refused before reaching the upstream, for the
+	// Reason given.
+	EventRejected
+)
+
+// String renders an EventType as a stable, bounded metric-label value.
+func (t EventType) String() string {
+	switch t {
+	case EventOpened:
+		return "opened"
+	case EventClosed:
+		return "closed"
+	case EventRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// Reason is why a connection was closed or an upgrade rejected.
+type Reason uint8
+
+const (
+	reasonNone Reason = iota
+
+	// ReasonClient: the client sent the first close frame.
+	ReasonClient
+	// ReasonUpstream: the upstream sent the first close frame.
+	ReasonUpstream
+	// ReasonAbnormal: the connection ended without a close frame, e.g. a peer
+	// dropped it.
+	ReasonAbnormal
+	// ReasonIdle: no frame crossed the connection for IdleTimeout.
+	ReasonIdle
+	// ReasonLifetime: the connection reached MaxLifetime.
+	ReasonLifetime
+	// ReasonShutdown: the server began graceful shutdown. It also rejects an
+	// upgrade arriving during shutdown.
+	ReasonShutdown
+	// ReasonRouteLimit: the upgrade was rejected at MaxConns.
+	ReasonRouteLimit
+	// ReasonClientLimit: the upgrade was rejected at MaxConnsPerClient.
+	ReasonClientLimit
+)
+
+// String renders a Reason as a stable, bounded metric-label value.
+func (r Reason) String() string {
+	switch r {
+	case ReasonClient:
+		return "client"
+	case ReasonUpstream:
+		return "upstream"
+	case ReasonAbnormal:
+		return "abnormal"
+	case ReasonIdle:
+		return "idle"
+	case ReasonLifetime:
+		return "lifetime"
+	case ReasonShutdown:
+		return "shutdown"
+	case ReasonRouteLimit:
+		return "route_limit"
+	case ReasonClientLimit:
+		return "client_limit"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports a connection opening, closing or being rejected to
+// WebSocket.Observe. Like the logger record, it never carries the client key,
+// so every field is safe as a metric label or value.
+type Event struct {
+	// Name is the operator-set WebSocket.Name (may be "").
+	Name string
+	Type EventType
+
+	// Reason is set for EventClosed and EventRejected.
+	Reason Reason
+
+	// The rest is set for EventClosed. Received is from the client, Sent is to
+	// the client; bytes are counted on the wire, framing included.
+	Duration         time.Duration
+	MessagesReceived int64
+	MessagesSent     int64
+	BytesReceived    int64
+	BytesSent        int64
+}
+
+// ObserveFunc is the WebSocket observation-hook shape, returned by prom.WebSocket
+// for wiring into WebSocket.Observe. It runs synchronously on the request or
+// timer goroutine; keep it cheap.
+type ObserveFunc func(Event)
@@ -0,0 +1,272 @@
+package websocket
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/header"
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/moonrhythm/parapet/pkg/ratelimit"
+)
+
+const defaultCloseTimeout = 5 * time.Second
+
+// New creates new websocket middleware
+func New() *WebSocket {
+	return &WebSocket{}
+}
+
+// WebSocket bounds and observes the WebSocket connections proxied through it,
+// typically by upstream. Mount it in front of the upstream on the WebSocket
+// route; other requests pass through untouched.
+//
+// It follows the connection's frames without buffering them: when the
+// connection ends, the logger record gets websocketMessagesReceived,
+// websocketMessagesSent, websocketBytesReceived, websocketBytesSent (received
+// is from the client), websocketDuration and websocketCloseReason.
+//
+// A connection closed by IdleTimeout, MaxLifetime or the server's graceful
+// shutdown is sent a close frame (1000, or 1001 "going away"), so the client
+// and the upstream complete the close handshake; it is cut if that takes
+// longer than CloseTimeout. http.Server.Shutdown does not wait for upgraded
+// connections, so keep GraceTimeout above CloseTimeout.
+//
+// An RFC 8441 WebSocket over HTTP/2 (extended CONNECT) is bridged to an
+// HTTP/1.1 upgrade to the upstream. Go's HTTP/2 server only accepts it when
+// the process runs with GODEBUG=http2xconnect=1.
+type WebSocket struct {
+	// Name is a bounded label carried on every Event; never derive it from the
+	// request.
+	Name string
+
+	// MaxConns bounds the connections through this middleware, upgrades in
+	// progress included; beyond it an upgrade gets 503. 0 is unlimited.
+	MaxConns int
+
+	// MaxConnsPerClient bounds the connections per Key; beyond it an upgrade
+	// gets 429. 0 is unlimited.
+	MaxConnsPerClient int
+	Key               func(r *http.Request) string // default ratelimit.ClientIP
+
+	IdleTimeout  time.Duration // closes a connection no frame crossed for this long; 0 never
+	MaxLifetime  time.Duration // closes a connection this long after the upgrade; 0 never
+	CloseTimeout time.Duration // default 5s
+
+	// Observe, if set, is called when a connection opens or closes and when an
+	// upgrade is rejected. See prom.WebSocket.
+	Observe ObserveFunc
+}
+
+// ServeHandler implements middleware interface
+func (m WebSocket) ServeHandler(h http.Handler) http.Handler {
+	if m.Key == nil {
+		m.Key = ratelimit.ClientIP
+	}
+	if m.CloseTimeout <= 0 {
+		m.CloseTimeout = defaultCloseTimeout
+	}
+
+	t := &tracker{
+		m:         &m,
+		perClient: make(map[string]int),
+		conns:     make(map[*conn]struct{}),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extended := isExtendedConnect(r)
+		if !extended && !isUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		t.once.Do(func() {
+			if srv, ok := r.Context().Value(parapet.ServerContextKey).(*parapet.Server); ok {
+				srv.RegisterOnShutdown(t.shutdown)
+			}
+		})
+
+		var key string
+		if m.MaxConnsPerClient > 0 {
+			key = m.Key(r)
+		}
+		if reason := t.acquire(key); reason != reasonNone {
+			m.observe(Event{Name: m.Name, Type: EventRejected, Reason: reason})
+			if reason == ReasonClientLimit {
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer t.release(key)
+
+		c := newConn(t)
+		var ww http.ResponseWriter
+		if extended {
+			ww = &streamWriter{ResponseWriter: w, body: r.Body, c: c}
+			r = upgradeRequest(r)
+		} else {
+			ww = &hijackWriter{ResponseWriter: w, r: r, c: c}
+		}
+
+		t.pending(c)
+		h.ServeHTTP(ww, r)
+		t.remove(c)
+		if !c.opened() {
+			return // the upstream refused the upgrade
+		}
+
+		e := c.end()
+		ctx := r.Context()
+		logger.Set(ctx, "websocketMessagesReceived", e.MessagesReceived)
+		logger.Set(ctx, "websocketMessagesSent", e.MessagesSent)
+		logger.Set(ctx, "websocketBytesReceived", e.BytesReceived)
+		logger.Set(ctx, "websocketBytesSent", e.BytesSent)
+		logger.Set(ctx, "websocketDuration", e.Duration.Nanoseconds())
+		logger.Set(ctx, "websocketCloseReason", e.Reason.String())
+		m.observe(e)
+	})
+}
+
+func (m *WebSocket) observe(e Event) {
+	if m.Observe != nil {
+		m.Observe(e)
+	}
+}
+
+// isUpgrade reports an HTTP/1.1 WebSocket upgrade.
+func isUpgrade(r *http.Request) bool {
+	return hasToken(r.Header.Values("Connection"), "upgrade") && hasToken(r.Header.Values(header.Upgrade), "websocket")
+}
+
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tracker holds a middleware's connections, for its limits and for closing
+// them on shutdown.
+type tracker struct {
+	m    *WebSocket
+	once sync.Once
+
+	mu           sync.Mutex
+	total        int
+	perClient    map[string]int
+	conns        map[*conn]struct{}
+	shuttingDown bool
+}
+
+// acquire takes a connection slot, or returns why it cannot.
+func (t *tracker) acquire(key string) Reason {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.shuttingDown:
+		return ReasonShutdown
+	case t.m.MaxConns > 0 && t.total >= t.m.MaxConns:
+		return ReasonRouteLimit
+	case t.m.MaxConnsPerClient > 0 && t.perClient[key] >= t.m.MaxConnsPerClient:
+		return ReasonClientLimit
+	}
+	t.total++
+	if t.m.MaxConnsPerClient > 0 {
+		t.perClient[key]++
+	}
+	return reasonNone
+}
+
+func (t *tracker) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.total--
+	if t.m.MaxConnsPerClient > 0 {
+		if t.perClient[key]--; t.perClient[key] <= 0 {
+			delete(t.perClient, key)
+		}
+	}
+}
+
+// pending tracks c before its upgrade.
+func (t *tracker) pending(c *conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[c] = struct{}{}
+}
+
+// opened reports c upgraded, closing it at once when shutdown began in the
+// meantime.
+func (t *tracker) opened(c *conn) {
+	t.m.observe(Event{Name: t.m.Name, Type: EventOpened})
+
+	t.mu.Lock()
+	shuttingDown := t.shuttingDown
+	t.mu.Unlock()
+	if shuttingDown {
+		c.shut(ReasonShutdown, closeGoingAway)
+	}
+}
+
+func (t *tracker) remove(c *conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// shutdown closes every open connection gracefully; it runs on the server's
+// graceful shutdown.
+func (t *tracker) shutdown() {
+	t.mu.Lock()
+	t.shuttingDown = true
+	conns := make([]*conn, 0, len(t.conns))
+	for c := range t.conns {
+		if c.opened() {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		go c.shut(ReasonShutdown, closeGoingAway)
+	}
+}
+
+// hijackWriter hands the upstream proxy the counted conn of an HTTP/1.1
+// upgrade.
+type hijackWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	c *conn
+}
+
+func (w *hijackWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *hijackWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	nc, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.c.start(nc, brw.Reader, func() { nc.Close() })
+	logger.Set(w.r.Context(), "status", http.StatusSwitchingProtocols) // written past the logger
+	return w.c, brw, nil
+}
@@ -0,0 +1,506 @@
+package websocket_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	. "github.com/moonrhythm/parapet/pkg/websocket"
+)
+
+type frame struct {
+	fin     bool
+	op      byte
+	payload []byte
+}
+
+func writeFrame(w io.Writer, f frame, mask bool) error {
+	b := []byte{f.op, 0}
+	if f.fin {
+		b[0] |= 0x80
+	}
+	switch n := len(f.payload); {
+	case n < 126:
+		b[1] = byte(n)
+	case n <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	payload := f.payload
+	if mask {
+		b[1] |= 0x80
+		key := []byte{1, 2, 3, 4}
+		b = append(b, key...)
+		payload = make([]byte, len(f.payload))
+		for i := range payload {
+			payload[i] = f.payload[i] ^ key[i%4]
+		}
+	}
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, err
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(r, b[:])
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	var key [4]byte
+	masked := h[1]&0x80 != 0
+	if masked {
+		io.ReadFull(r, key[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return frame{fin: h[0]&0x80 != 0, op: h[0] & 0x0f, payload: payload}, nil
+}
+
+// echoServer upgrades any request and echoes each frame back, answering a
+// close frame with one.
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-Websocket-Key") == "" {
+			http.Error(w, "not a websocket", http.StatusBadRequest)
+			return
+		}
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: x\r\n\r\n")
+		for {
+			f, err := readFrame(brw)
+			if err != nil {
+				return
+			}
+			writeFrame(c, f, false)
+			if f.op == 0x8 {
+				return
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// events collects the Observe calls.
+type events struct {
+	mu sync.Mutex
+	l  []Event
+}
+
+func (e *events) observe(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.l = append(e.l, ev)
+}
+
+func (e *events) get() []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Event(nil), e.l...)
+}
+
+func proxyHandler(t *testing.T, m *WebSocket, logs io.Writer) http.Handler {
+	t.Helper()
+
+	origin := echoServer(t)
+	u := upstream.SingleHost(strings.TrimPrefix(origin.URL, "http://"), &upstream.HTTPTransport{})
+	return logger.Logger{Writer: logs}.ServeHandler(m.ServeHandler(u.ServeHandler(http.NotFoundHandler())))
+}
+
+func dial(t *testing.T, addr, hdr string) (int, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	io.WriteString(c, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+hdr+"\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, c, br
+}
+
+func lastRecord(t *testing.T, logs *syncBuffer) map[string]any {
+	t.Helper()
+
+	var rec map[string]any
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	json.Unmarshal([]byte(lines[len(lines)-1]), &rec)
+	return rec
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	var logs syncBuffer
+	var ev events
+	m := &WebSocket{Name: "chat", Observe: ev.observe}
+	ts := httptest.NewServer(proxyHandler(t, m, &logs))
+	defer ts.Close()
+
+	code, c, br := dial(t, ts.Listener.Addr().String(), "")
+	if !assert.Equal(t, http.StatusSwitchingProtocols, code) {
+		return
+	}
+
+	writeFrame(c, frame{fin: true, op: 0x1, payload: []byte("hello")}, true)
+	writeFrame(c, frame{op: 0x2, payload: make([]byte, 300)}, true)
+	writeFrame(c, frame{op: 0x9, fin: true}, true) // a ping between fragments
+	writeFrame(c, frame{fin: true, op: 0x0, payload: make([]byte, 70000)}, true)
+	for _, want := range []byte{0x1, 0x2, 0x9, 0x0} {
+		f, err := readFrame(br)
+		assert.NoError(t, err)
+		assert.Equal(t, want, f.op)
+	}
+
+	writeFrame(c, frame{fin: true, op: 0x8, payload: []byte{0x03, 0xe8}}, true)
+	f, err := readFrame(br)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0x8, f.op)
+
+	assert.Eventually(t, func() bool { return strings.Contains(logs.String(), "websocketCloseReason") }, 2*time.Second, 10*time.Millisecond)
+	rec := lastRecord(t, &logs)
+	assert.EqualValues(t, 101, rec["status"])
+	assert.EqualValues(t, 2, rec["websocketMessagesReceived"])
+	assert.EqualValues(t, 2, rec["websocketMessagesSent"])
+	assert.Greater(t, rec["websocketBytesReceived"], float64(70300))
+	assert.Greater(t, rec["websocketBytesSent"], float64(70300))
+	assert.Equal(t, "client", rec["websocketCloseReason"])
+
+	evs := ev.get()
+	if assert.Len(t, evs, 2) {
+		assert.Equal(t, EventOpened, evs[0].Type)
+		assert.Equal(t, EventClosed, evs[1].Type)
+		assert.Equal(t, "chat", evs[1].Name)
+		assert.Equal(t, ReasonClient, evs[1].Reason)
+		assert.EqualValues(t, 2, evs[1].MessagesSent)
+	}
+
+	// other requests pass through
+	resp, err := http.Get(ts.URL + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "the origin's answer to a plain request")
+	}
+}
+
+func TestWebSocket_Limits(t *testing.T) {
+	t.Parallel()
+
+	var ev events
+	m := &WebSocket{
+		MaxConns:          2,
+		MaxConnsPerClient: 1,
+		Key:               func(r *http.Request) string { return r.Header.Get("X-Client") },
+		Observe:           ev.observe,
+	}
+	ts := httptest.NewServer(proxyHandler(t, m, io.Discard))
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	code, a, _ := dial(t, addr, "X-Client: a\r\n")
+	assert.Equal(t, http.StatusSwitchingProtocols, code)
+	code, _, _ = dial(t, addr, "X-Client: a\r\n")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	code, _, _ = dial(t, addr, "X-Client: b\r\n")
+	assert.Equal(t, http.StatusSwitchingProtocols, code)
+	code, _, _ = dial(t, addr, "X-Client: c\r\n")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// a closed connection frees its slot
+	a.Close()
+	assert.Eventually(t, func() bool {
+		code, c, _ := dial(t, addr, "X-Client: a\r\n")
+		c.Close()
+		return code == http.StatusSwitchingProtocols
+	}, 2*time.Second, 20*time.Millisecond)
+
+	var reasons []Reason
+	for _, e := range ev.get() {
+		if e.Type == EventRejected {
+			reasons = append(reasons, e.Reason)
+		}
+	}
+	assert.Equal(t, []Reason{ReasonClientLimit, ReasonRouteLimit}, reasons[:2])
+}
+
+func TestWebSocket_IdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	var logs syncBuffer
+	m := &WebSocket{IdleTimeout: 200 * time.Millisecond}
+	ts := httptest.NewServer(proxyHandler(t, m, &logs))
+	defer ts.Close()
+
+	code, c, br := dial(t, ts.Listener.Addr().String(), "")
+	if !assert.Equal(t, http.StatusSwitchingProtocols, code) {
+		return
+	}
+
+	// traffic keeps it open
+	for range 3 {
+		writeFrame(c, frame{fin: true, op: 0x1, payload: []byte("ping")}, true)
+		readFrame(br)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := readFrame(br)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 0x8, f.op)
+	assert.Equal(t, []byte{0x03, 0xe8}, f.payload, "1000 normal closure")
+
+	writeFrame(c, f, true) // complete the handshake
+	assert.Eventually(t, func() bool { return strings.Contains(logs.String(), "websocketCloseReason") }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "idle", lastRecord(t, &logs)["websocketCloseReason"])
+}
+
+func TestWebSocket_MaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	var logs syncBuffer
+	m := &WebSocket{MaxLifetime: 100 * time.Millisecond, CloseTimeout: 100 * time.Millisecond}
+	ts := httptest.NewServer(proxyHandler(t, m, &logs))
+	defer ts.Close()
+
+	code, c, br := dial(t, ts.Listener.Addr().String(), "")
+	if !assert.Equal(t, http.StatusSwitchingProtocols, code) {
+		return
+	}
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := readFrame(br)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0x8, f.op)
+		assert.Equal(t, []byte{0x03, 0xe9}, f.payload, "1001 going away")
+	}
+
+	// a client that never answers is cut after CloseTimeout
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return strings.Contains(logs.String(), "websocketCloseReason") }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "lifetime", lastRecord(t, &logs)["websocketCloseReason"])
+}
+
+func TestWebSocket_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+	s := parapet.New()
+	s.Handler = proxyHandler(t, m, io.Discard)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go s.Serve(ln)
+
+	code, c, br := dial(t, ln.Addr().String(), "")
+	if !assert.Equal(t, http.StatusSwitchingProtocols, code) {
+		return
+	}
+
+	go s.Shutdown()
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := readFrame(br)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0x8, f.op)
+		assert.Equal(t, []byte{0x03, 0xe9}, f.payload, "1001 going away")
+	}
+}
+
+// h2Stream is a single HTTP/2 stream over prior-knowledge h2c, enough for an
+// extended CONNECT, which net/http's client refuses to send.
+type h2Stream struct {
+	mu     sync.Mutex
+	fr     *http2.Framer
+	status chan int
+	body   *io.PipeReader
+}
+
+func dialH2(t *testing.T, addr string, fields ...hpack.HeaderField) *h2Stream {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	io.WriteString(c, http2.ClientPreface)
+	fr := http2.NewFramer(c, c)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.WriteSettings()
+
+	pr, pw := io.Pipe()
+	s := &h2Stream{fr: fr, status: make(chan int, 1), body: pr}
+	settings := make(chan bool, 1)
+	go func() {
+		defer pw.Close()
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					v, _ := f.Value(http2.SettingEnableConnectProtocol)
+					settings <- v == 1
+					s.mu.Lock()
+					fr.WriteSettingsAck()
+					s.mu.Unlock()
+				}
+			case *http2.MetaHeadersFrame:
+				code, _ := strconv.Atoi(f.PseudoValue("status"))
+				s.status <- code
+			case *http2.DataFrame:
+				pw.Write(f.Data())
+				s.mu.Lock()
+				if n := uint32(len(f.Data())); n > 0 {
+					fr.WriteWindowUpdate(0, n)
+					fr.WriteWindowUpdate(1, n)
+				}
+				s.mu.Unlock()
+				if f.StreamEnded() {
+					return
+				}
+			case *http2.RSTStreamFrame, *http2.GoAwayFrame:
+				return
+			}
+		}
+	}()
+	if !<-settings {
+		t.Fatal("the server does not accept extended CONNECT")
+	}
+
+	var hb bytes.Buffer
+	enc := hpack.NewEncoder(&hb)
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	s.mu.Lock()
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: hb.Bytes(), EndHeaders: true})
+	s.mu.Unlock()
+	return s
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(p), s.fr.WriteData(1, false, p)
+}
+
+// TestWebSocket_HTTP2 runs itself with GODEBUG=http2xconnect=1, which Go's
+// HTTP/2 server needs at startup to accept extended CONNECT.
+func TestWebSocket_HTTP2(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.Parallel()
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWebSocket_HTTP2$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, "%s", out)
+		return
+	}
+
+	var logs syncBuffer
+	ts := httptest.NewUnstartedServer(proxyHandler(t, New(), &logs))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	s := dialH2(t, ts.Listener.Addr().String(),
+		hpack.HeaderField{Name: ":method", Value: "CONNECT"},
+		hpack.HeaderField{Name: ":protocol", Value: "websocket"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+		hpack.HeaderField{Name: ":path", Value: "/ws"},
+		hpack.HeaderField{Name: ":authority", Value: "example.com"},
+		hpack.HeaderField{Name: "sec-websocket-version", Value: "13"},
+	)
+	assert.Equal(t, http.StatusOK, <-s.status)
+
+	writeFrame(s, frame{fin: true, op: 0x1, payload: []byte("over h2")}, true)
+	f, err := readFrame(s.body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "over h2", string(f.payload))
+	}
+
+	writeFrame(s, frame{fin: true, op: 0x8}, true)
+	f, err = readFrame(s.body)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0x8, f.op)
+	}
+
+	assert.Eventually(t, func() bool { return strings.Contains(logs.String(), "websocketCloseReason") }, 2*time.Second, 10*time.Millisecond)
+	rec := lastRecord(t, &logs)
+	assert.EqualValues(t, 200, rec["status"])
+	assert.Equal(t, "CONNECT", rec["requestMethod"])
+	assert.EqualValues(t, 1, rec["websocketMessagesReceived"])
+	assert.Equal(t, "client", rec["websocketCloseReason"])
+}